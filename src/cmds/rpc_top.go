@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+//
+// 查看rpc_proxy/rpc_lb最近几分钟的热点方法(通过profile_address上的admin api)
+//   rpc_top -address=127.0.0.1:7030 -by=latency -minutes=5
+//
+var (
+	address = flag.String("address", "127.0.0.1:7030", "profile address of rpc_proxy or rpc_lb")
+	by      = flag.String("by", "calls", "calls, latency or errors")
+	minutes = flag.Int("minutes", 1, "window in minutes, 1 ~ 15")
+	n       = flag.Int("n", 20, "number of methods")
+	version = flag.Bool("V", false, "version")
+)
+
+var (
+	buildDate  string
+	gitVersion string
+)
+
+type opStats struct {
+	Service     string  `json:"service"`
+	Method      string  `json:"method"`
+	Calls       int64   `json:"calls"`
+	Exceptions  int64   `json:"exceptions"`
+	Errors      int64   `json:"errors"`
+	Timeouts    int64   `json:"timeouts"`
+	NoWorker    int64   `json:"no_worker"`
+	RateLimited int64   `json:"rate_limited"`
+	Overloaded  int64   `json:"overloaded"`
+	Avg         float64 `json:"usecs_percall"`
+	P50         float64 `json:"usecs_p50"`
+	P99         float64 `json:"usecs_p99"`
+	P999        float64 `json:"usecs_p999"`
+}
+
+func main() {
+	flag.Parse()
+	if *version {
+		fmt.Printf("Version: %s\nBuildDate: %s\n", gitVersion, buildDate)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("by", *by)
+	params.Set("minutes", fmt.Sprintf("%d", *minutes))
+	params.Set("n", fmt.Sprintf("%d", *n))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/api/top?%s", *address, params.Encode()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Request Failed: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "Request Failed: %s %s\n", resp.Status, string(data))
+		os.Exit(1)
+	}
+
+	var top []opStats
+	if err := json.Unmarshal(data, &top); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid Response: %v\n", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tMETHOD\tCALLS\tEXCEPTIONS\tERRORS\tTIMEOUTS\tNO_WORKER\tRATE_LIMITED\tOVERLOADED\tAVG(ms)\tP50(ms)\tP99(ms)\tP999(ms)")
+	for _, s := range top {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.3f\t%.3f\t%.3f\t%.3f\n", s.Service, s.Method, s.Calls,
+			s.Exceptions, s.Errors, s.Timeouts, s.NoWorker, s.RateLimited, s.Overloaded,
+			s.Avg*0.001, s.P50*0.001, s.P99*0.001, s.P999*0.001)
+	}
+	w.Flush()
+}
@@ -0,0 +1,190 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	ACCESS_LOG_DEFAULT_KEEP_DAYS = 3
+	ACCESS_LOG_QUEUE_SIZE        = 8192 // 等待写入的日志, 超过时直接丢弃
+	ACCESS_LOG_FLUSH_INTERVAL    = time.Second
+	ACCESS_LOG_TIME_FORMAT       = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+type AccessLogConfig struct {
+	File       string  // 没有配置时不记录
+	SampleRate float64 // 成功的请求的采样比例, 失败的请求总是记录
+	KeepDays   int
+}
+
+//
+// 每个请求一行JSON(心跳除外), 由Session在返回结果之前记录
+//
+type accessLogEntry struct {
+	Ts           string `json:"ts"` // 请求开始的时间
+	Client       string `json:"client"`
+	Service      string `json:"service"`
+	Method       string `json:"method"`
+	SeqId        int32  `json:"seq_id"`         // Client的SeqId
+	BackendSeqId int32  `json:"backend_seq_id"` // 转发给后端时替换之后的SeqId, 0表示没有发送
+	Backend      string `json:"backend"`
+	Attempts     int    `json:"attempts,omitempty"`
+	ReqSize      int    `json:"req_size"`
+	RespSize     int    `json:"resp_size"`
+	LatencyUs    int64  `json:"latency_us"`
+	Outcome      string `json:"outcome"`
+	TraceId      string `json:"trace_id,omitempty"`
+}
+
+//
+// 日志的写入是异步的: Session只负责生成accessLogEntry, 由单独的goroutine编码和写入(带缓存)
+//
+type accessLogger struct {
+	sampleRate float64
+	entries    chan *accessLogEntry
+	writer     *bufio.Writer
+
+	written atomic2.Int64
+	dropped atomic2.Int64
+}
+
+var accessLogState struct {
+	lock   sync.RWMutex
+	logger *accessLogger
+}
+
+func getAccessLogger() *accessLogger {
+	accessLogState.lock.RLock()
+	defer accessLogState.lock.RUnlock()
+	return accessLogState.logger
+}
+
+func setAccessLogger(l *accessLogger) {
+	accessLogState.lock.Lock()
+	accessLogState.logger = l
+	accessLogState.lock.Unlock()
+}
+
+func newAccessLogger(w io.Writer, sampleRate float64) *accessLogger {
+	return &accessLogger{
+		sampleRate: sampleRate,
+		entries:    make(chan *accessLogEntry, ACCESS_LOG_QUEUE_SIZE),
+		writer:     bufio.NewWriterSize(w, 64*1024),
+	}
+}
+
+//
+// 配置了access_log时才记录; 一个进程只启动一次
+// 日志文件按天滚动, 保留KeepDays天
+//
+func StartAccessLog(config *AccessLogConfig) {
+	if len(config.File) == 0 {
+		return
+	}
+	if getAccessLogger() != nil {
+		log.Warnf("Access log already started")
+		return
+	}
+
+	if err := os.MkdirAll(path.Dir(config.File), 0755); err != nil {
+		log.ErrorErrorf(err, "Create access log dir failed: %s", config.File)
+		return
+	}
+	f, err := log.NewRollingFile(config.File, config.KeepDays)
+	if err != nil {
+		log.ErrorErrorf(err, "Open access log failed: %s", config.File)
+		return
+	}
+
+	l := newAccessLogger(f, config.SampleRate)
+	setAccessLogger(l)
+
+	log.Printf(Green("Access log: %s, sample rate: %.4f"), config.File, config.SampleRate)
+	go l.run()
+}
+
+//
+// 记录一个请求(在Session返回结果时调用, 心跳不计入)
+// client: Session.RemoteAddress
+//
+func logAccess(r *Request, client string, usecs int64) {
+	l := getAccessLogger()
+	if l == nil || r.Request.TypeId == MESSAGE_TYPE_HEART_BEAT {
+		return
+	}
+
+	outcome := r.Outcome()
+	if outcome == OUTCOME_SUCCESS && l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return
+	}
+
+	entry := &accessLogEntry{
+		Ts:           time.Unix(0, r.Start*int64(time.Microsecond)).Format(ACCESS_LOG_TIME_FORMAT),
+		Client:       client,
+		Service:      r.Service,
+		Method:       r.Request.Name,
+		SeqId:        r.Request.SeqId,
+		BackendSeqId: r.Response.SeqId,
+		Backend:      r.BackendAddr,
+		Attempts:     r.Attempts,
+		ReqSize:      len(r.Request.Data),
+		RespSize:     len(r.Response.Data),
+		LatencyUs:    usecs,
+		Outcome:      outcome.String(),
+	}
+	// Request.Data中的service已经被剥离
+	if r.Request.DataOrig != nil {
+		entry.ReqSize = len(r.Request.DataOrig)
+	}
+	if r.Trace != nil {
+		entry.TraceId = r.Trace.TraceId()
+	}
+
+	select {
+	case l.entries <- entry:
+	default:
+		l.dropped.Incr()
+	}
+}
+
+func (l *accessLogger) run() {
+	ticker := time.NewTicker(ACCESS_LOG_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry := <-l.entries:
+			l.write(entry)
+		case <-ticker.C:
+			if err := l.writer.Flush(); err != nil {
+				log.ErrorErrorf(err, "Flush access log failed: %v", err)
+			}
+		}
+	}
+}
+
+func (l *accessLogger) write(entry *accessLogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		l.dropped.Incr()
+		return
+	}
+	data = append(data, '\n')
+	if _, err := l.writer.Write(data); err != nil {
+		l.dropped.Incr()
+		return
+	}
+	l.written.Incr()
+}
@@ -0,0 +1,92 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+func drainAccessLog(t *testing.T, l *accessLogger, buf *bytes.Buffer) []map[string]interface{} {
+	for len(l.entries) > 0 {
+		l.write(<-l.entries)
+	}
+	assert.NoError(t, l.writer.Flush())
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+//
+// go test proxy -v -run "TestAccessLog"
+//
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := newAccessLogger(&buf, 1)
+	setAccessLogger(l)
+	defer setAccessLogger(nil)
+
+	// 1. 转发给后端的请求: SeqId被替换, service被剥离
+	r := newRetryTestRequest("typo:get_user", 5)
+	reqSize := len(r.Request.Data)
+	r.Attempts = 1
+	r.BackendAddr = "10.0.0.1:5555"
+	r.ReplaceSeqId(1234)
+	r.Response.TypeId = thrift.REPLY
+	r.Response.Data = make([]byte, 30)
+	logAccess(r, "127.0.0.1:50000", 1500)
+
+	// 2. 心跳不记录
+	logAccess(NewPingRequest(), "127.0.0.1:50000", 10)
+
+	entries := drainAccessLog(t, l, &buf)
+	assert.Equal(t, 1, len(entries))
+	entry := entries[0]
+	assert.Equal(t, "127.0.0.1:50000", entry["client"])
+	assert.Equal(t, "typo", entry["service"])
+	assert.Equal(t, "get_user", entry["method"])
+	assert.Equal(t, float64(5), entry["seq_id"])
+	assert.Equal(t, float64(1234), entry["backend_seq_id"])
+	assert.Equal(t, "10.0.0.1:5555", entry["backend"])
+	assert.Equal(t, float64(reqSize), entry["req_size"])
+	assert.Equal(t, float64(30), entry["resp_size"])
+	assert.Equal(t, float64(1500), entry["latency_us"])
+	assert.Equal(t, "success", entry["outcome"])
+	assert.Nil(t, entry["trace_id"])
+
+	ts, err := time.Parse(ACCESS_LOG_TIME_FORMAT, entry["ts"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, r.Start, ts.UnixNano()/int64(time.Microsecond))
+
+	// 3. 采样只针对成功的请求, 失败的请求总是记录
+	l.sampleRate = 0
+	logAccess(newRetryTestRequest("typo:get_user", 6), "127.0.0.1:50000", 1000)
+	failed := newRetryTestRequest("typo:get_user", 7)
+	failed.Response.Err = failed.NewTimeoutError()
+	logAccess(failed, "127.0.0.1:50000", 5000000)
+
+	entries = drainAccessLog(t, l, &buf)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, float64(7), entries[0]["seq_id"])
+	assert.Equal(t, "timeout", entries[0]["outcome"])
+	assert.Equal(t, float64(0), entries[0]["backend_seq_id"])
+	assert.Equal(t, int64(2), l.written.Get())
+
+	// 4. 队列满了之后丢弃, 不阻塞Session
+	for i := 0; i < ACCESS_LOG_QUEUE_SIZE+10; i++ {
+		logAccess(failed, "127.0.0.1:50000", 1000)
+	}
+	assert.Equal(t, int64(10), l.dropped.Get())
+}
@@ -0,0 +1,183 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+//
+// Admin API: 和pprof共用profile_address对应的http server(http.DefaultServeMux), 以JSON的格式返回运行时的状态
+//   /api/services[?service=xxx]  rpc_proxy: Router中的服务, 以及每个服务的BackendConn
+//   /api/lb                      rpc_lb: BackServiceLB的Worker
+//   /api/sessions                当前所有的Session
+//   /api/stats[?minutes=5]       最近几分钟(默认为1, 最多15)各个方法的调用统计
+//   /api/top?by=calls&minutes=5&n=10
+//                                最近几分钟调用次数(calls)/p99(latency)/错误数(errors)最多的方法
+//   /api/breakers                所有的CircuitBreaker
+//   /api/rate_limits             rpc_proxy: 当前生效的限流规则
+// Prometheus的/metrics参考: metrics_prometheus.go
+//
+func init() {
+	http.HandleFunc("/api/services", handleAdminServices)
+	http.HandleFunc("/api/lb", handleAdminLB)
+	http.HandleFunc("/api/sessions", handleAdminSessions)
+	http.HandleFunc("/api/stats", handleAdminStats)
+	http.HandleFunc("/api/top", handleAdminTop)
+	http.HandleFunc("/api/breakers", handleAdminBreakers)
+	http.HandleFunc("/api/rate_limits", handleAdminRateLimits)
+}
+
+//
+// 当前进程中需要暴露给admin api的对象
+//
+var admin struct {
+	lock     sync.RWMutex
+	routers  []*Router
+	lbs      []*BackServiceLB
+	sessions map[json.Marshaler]bool
+}
+
+func init() {
+	admin.sessions = make(map[json.Marshaler]bool)
+}
+
+func registerAdminRouter(r *Router) {
+	admin.lock.Lock()
+	admin.routers = append(admin.routers, r)
+	admin.lock.Unlock()
+}
+
+func registerAdminLB(s *BackServiceLB) {
+	admin.lock.Lock()
+	admin.lbs = append(admin.lbs, s)
+	admin.lock.Unlock()
+}
+
+// Session在Serve期间注册
+func registerSession(s json.Marshaler) {
+	admin.lock.Lock()
+	admin.sessions[s] = true
+	admin.lock.Unlock()
+}
+
+func unregisterSession(s json.Marshaler) {
+	admin.lock.Lock()
+	delete(admin.sessions, s)
+	admin.lock.Unlock()
+}
+
+func adminRouters() []*Router {
+	admin.lock.RLock()
+	defer admin.lock.RUnlock()
+
+	routers := make([]*Router, len(admin.routers))
+	copy(routers, admin.routers)
+	return routers
+}
+
+func adminLBs() []*BackServiceLB {
+	admin.lock.RLock()
+	defer admin.lock.RUnlock()
+
+	lbs := make([]*BackServiceLB, len(admin.lbs))
+	copy(lbs, admin.lbs)
+	return lbs
+}
+
+func adminSessions() []json.Marshaler {
+	admin.lock.RLock()
+	defer admin.lock.RUnlock()
+
+	sessions := make([]json.Marshaler, 0, len(admin.sessions))
+	for s := range admin.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func handleAdminServices(w http.ResponseWriter, req *http.Request) {
+	routers := adminRouters()
+
+	// 只查看一个服务, 例如: 排查Worker Not Found
+	if service := req.FormValue("service"); len(service) > 0 {
+		for _, r := range routers {
+			if backService := r.GetBackService(service); backService != nil {
+				writeAdminJSON(w, backService)
+				return
+			}
+		}
+		http.Error(w, "Service Not Found: "+service, http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, routers)
+}
+
+func handleAdminLB(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, adminLBs())
+}
+
+func handleAdminSessions(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, adminSessions())
+}
+
+func handleAdminStats(w http.ResponseWriter, req *http.Request) {
+	minutes := adminIntParam(req, "minutes", 1)
+
+	var m = make(map[string]interface{})
+	m["requests"] = OpCounts()
+	m["minutes"] = minutes
+	m["ops"] = GetWindowOpStats(minutes)
+	writeAdminJSON(w, m)
+}
+
+func handleAdminTop(w http.ResponseWriter, req *http.Request) {
+	by := req.FormValue("by")
+	if len(by) == 0 {
+		by = OP_STATS_TOP_BY_CALLS
+	}
+	top, err := TopOpStats(adminIntParam(req, "minutes", 1), by, adminIntParam(req, "n", 10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAdminJSON(w, top)
+}
+
+func adminIntParam(req *http.Request, name string, def int) int {
+	value, err := strconv.Atoi(req.FormValue(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+func handleAdminBreakers(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, GetAllCircuitBreakers())
+}
+
+func handleAdminRateLimits(w http.ResponseWriter, req *http.Request) {
+	limiters := make([]*RateLimiter, 0)
+	for _, r := range adminRouters() {
+		if r.limiter != nil {
+			limiters = append(limiters, r.limiter)
+		}
+	}
+	writeAdminJSON(w, limiters)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.ErrorErrorf(err, "Admin API Marshal Error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(data)
+}
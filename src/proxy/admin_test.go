@@ -0,0 +1,169 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getAdminJSON(t *testing.T, url string, v interface{}) int {
+	req, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+//
+// go test proxy -v -run "TestAdminServices"
+//
+func TestAdminServices(t *testing.T) {
+	s := &BackService{
+		serviceName: "admin_typo",
+		activeConns: make([]*BackendConn, 0, 10),
+		balancer:    newRoundRobinBalancer(),
+		addr2Conn:   make(map[string]*BackendConn),
+	}
+	for _, addr := range []string{"10.0.0.2:5555", "10.0.0.1:5555"} {
+		requestMap, _ := NewRequestMap(16)
+		conn := &BackendConn{
+			addr:             addr,
+			service:          "admin_typo",
+			input:            make(chan *Request, 16),
+			seqNumRequestMap: requestMap,
+			minSeqId:         100,
+			maxSeqId:         199,
+			currentSeqId:     120,
+			Index:            INVALID_ARRAY_INDEX,
+			delegate:         s,
+		}
+		conn.weight.Set(DEFAULT_ENDPOINT_WEIGHT)
+		conn.breaker = NewCircuitBreaker(addr, &CircuitBreakerConfig{}, nil)
+		defer unregisterBreaker(conn.breaker)
+		s.addr2Conn[addr] = conn
+	}
+	s.addr2Conn["10.0.0.1:5555"].IsConnActive.Set(true)
+	s.StateChanged(s.addr2Conn["10.0.0.1:5555"])
+	s.addr2Conn["10.0.0.2:5555"].IsMarkOffline.Set(true)
+	s.addr2Conn["10.0.0.2:5555"].seqNumRequestMap.Add(121, &Request{})
+
+	registerAdminRouter(&Router{
+		productName: "admin_test",
+		services:    map[string]*BackService{"admin_typo": s},
+	})
+
+	// 1. 所有的服务
+	var routers []struct {
+		Product  string `json:"product"`
+		Services []struct {
+			Service string `json:"service"`
+		} `json:"services"`
+	}
+	assert.Equal(t, http.StatusOK, getAdminJSON(t, "/api/services", &routers))
+	found := false
+	for _, r := range routers {
+		if r.Product == "admin_test" {
+			found = true
+			assert.Equal(t, "admin_typo", r.Services[0].Service)
+		}
+	}
+	assert.True(t, found)
+
+	// 2. 单个服务: BackendConn按照addr排序
+	var service struct {
+		Active int `json:"active"`
+		Conns  []struct {
+			Addr         string `json:"addr"`
+			ConnActive   bool   `json:"conn_active"`
+			MarkOffline  bool   `json:"mark_offline"`
+			InFlight     int    `json:"in_flight"`
+			MinSeqId     int32  `json:"min_seq_id"`
+			MaxSeqId     int32  `json:"max_seq_id"`
+			CurrentSeqId int32  `json:"current_seq_id"`
+			Breaker      string `json:"breaker"`
+		} `json:"conns"`
+	}
+	assert.Equal(t, http.StatusOK, getAdminJSON(t, "/api/services?service=admin_typo", &service))
+	assert.Equal(t, 1, service.Active)
+	assert.Equal(t, 2, len(service.Conns))
+	assert.Equal(t, "10.0.0.1:5555", service.Conns[0].Addr)
+	assert.True(t, service.Conns[0].ConnActive)
+	assert.False(t, service.Conns[0].MarkOffline)
+	assert.Equal(t, "closed", service.Conns[0].Breaker)
+	assert.Equal(t, "10.0.0.2:5555", service.Conns[1].Addr)
+	assert.True(t, service.Conns[1].MarkOffline)
+	assert.Equal(t, 1, service.Conns[1].InFlight)
+	assert.Equal(t, int32(100), service.Conns[1].MinSeqId)
+	assert.Equal(t, int32(199), service.Conns[1].MaxSeqId)
+	assert.Equal(t, int32(120), service.Conns[1].CurrentSeqId)
+
+	assert.Equal(t, http.StatusNotFound, getAdminJSON(t, "/api/services?service=not_found", nil))
+}
+
+//
+// go test proxy -v -run "TestAdminSessionsAndStats"
+//
+func TestAdminSessionsAndStats(t *testing.T) {
+	s := &NonBlockSession{RemoteAddress: "10.0.0.3:6666"}
+	s.Ops.Set(10)
+	registerSession(s)
+
+	var sessions []struct {
+		Remote string `json:"remote"`
+		Ops    int64  `json:"ops"`
+	}
+	assert.Equal(t, http.StatusOK, getAdminJSON(t, "/api/sessions", &sessions))
+	found := false
+	for _, session := range sessions {
+		if session.Remote == "10.0.0.3:6666" {
+			found = true
+			assert.Equal(t, int64(10), session.Ops)
+		}
+	}
+	assert.True(t, found)
+
+	unregisterSession(s)
+	assert.Equal(t, http.StatusOK, getAdminJSON(t, "/api/sessions", &sessions))
+	for _, session := range sessions {
+		assert.NotEqual(t, "10.0.0.3:6666", session.Remote)
+	}
+
+	r := newRetryTestRequest("admin_typo:get_user", 1)
+	incrOpStats(r, 1000)
+	r.Response.Err = r.NewTimeoutError()
+	incrOpStats(r, 1000)
+	rotateOpStats(time.Now())
+
+	var stats struct {
+		Requests int64 `json:"requests"`
+		Ops      []struct {
+			Cmd      string `json:"cmd"`
+			Service  string `json:"service"`
+			Method   string `json:"method"`
+			Calls    int64  `json:"calls"`
+			Success  int64  `json:"success"`
+			Timeouts int64  `json:"timeouts"`
+		} `json:"ops"`
+	}
+	assert.Equal(t, http.StatusOK, getAdminJSON(t, "/api/stats", &stats))
+	assert.True(t, stats.Requests >= 2)
+	found = false
+	for _, op := range stats.Ops {
+		if op.Cmd == "admin_typo.get_user" {
+			found = true
+			assert.Equal(t, "admin_typo", op.Service)
+			assert.Equal(t, "get_user", op.Method)
+			assert.Equal(t, int64(2), op.Calls)
+			assert.Equal(t, int64(1), op.Success)
+			assert.Equal(t, int64(1), op.Timeouts)
+		}
+	}
+	assert.True(t, found)
+}
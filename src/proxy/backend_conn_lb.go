@@ -3,7 +3,9 @@
 package proxy
 
 import (
+	"encoding/json"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/wfxiang08/cyutils/utils/atomic2"
@@ -20,17 +22,22 @@ type BackendConnLB struct {
 	transport   thrift.TTransport
 	address     string
 	serviceName string
-	input       chan *Request // 输入的请求, 有: 1024个Buffer
+	input       chan *Request // 输入的请求, 大小由queue决定(默认: 1024)
+	queue       *BackendQueueConfig
+	overflows   atomic2.Int64 // input满了, 请求没有被接受的次数
 
 	seqNumRequestMap *RequestMap
 	currentSeqId     int32 // 范围: 1 ~ 100000
 	Index            int
 	delegate         BackendConnLBStateChanged
+	theader          bool // rpc server支持THeader transport, 请求带上Client的headers
 	verbose          bool
 	IsConnActive     atomic2.Bool // 是否处于Active状态呢
 
 	hbLastTime atomic2.Int64
 	hbTicker   *time.Ticker
+
+	latency PeakEwma // 请求的latency, 用于负载均衡
 }
 
 //
@@ -45,14 +52,16 @@ type BackendConnLB struct {
 //      就是建立在transport之上的控制逻辑
 //
 func NewBackendConnLB(transport thrift.TTransport, serviceName string,
-	address string, delegate BackendConnLBStateChanged,
-	verbose bool) *BackendConnLB {
-	requestMap, _ := NewRequestMap(4096)
+	address string, delegate BackendConnLBStateChanged, queue *BackendQueueConfig,
+	theader bool, verbose bool) *BackendConnLB {
+	// 请求的超时由TimingWheel负责, 不再依赖心跳的定时扫描
+	requestMap, _ := NewExpiringRequestMap(4096, getRequestTimingWheel())
 	bc := &BackendConnLB{
 		transport:   transport,
 		address:     address,
 		serviceName: serviceName,
-		input:       make(chan *Request, 1024),
+		input:       make(chan *Request, queue.GetSize()),
+		queue:       queue,
 
 		seqNumRequestMap: requestMap,
 		currentSeqId:     BACKEND_CONN_MIN_SEQ_ID,
@@ -60,6 +69,7 @@ func NewBackendConnLB(transport thrift.TTransport, serviceName string,
 		Index: INVALID_ARRAY_INDEX, // 用于记录: BackendConnLB在数组中的位置
 
 		delegate: delegate,
+		theader:  theader,
 		verbose:  verbose,
 	}
 	bc.IsConnActive.Set(true)
@@ -106,22 +116,71 @@ func (bc *BackendConnLB) Address() string {
 	return bc.address
 }
 
+// 等待发送的请求 + 已经发送, 但是还没有返回的请求
+func (bc *BackendConnLB) Outstanding() int {
+	return len(bc.input) + bc.seqNumRequestMap.Len()
+}
+
+func (bc *BackendConnLB) Latency() *PeakEwma {
+	return &bc.latency
+}
+
+func (bc *BackendConnLB) Addr() string {
+	return bc.address
+}
+
+// Worker之间没有权重的区别
+func (bc *BackendConnLB) Weight() int {
+	return DEFAULT_ENDPOINT_WEIGHT
+}
+
+//
+// 用于admin api: 查看Worker的运行时状态
+//
+func (bc *BackendConnLB) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["addr"] = bc.address
+	m["conn_active"] = bc.IsConnActive.Get()
+	m["pending"] = len(bc.input)
+	m["overflows"] = bc.overflows.Get()
+	m["in_flight"] = bc.seqNumRequestMap.Len()
+	m["current_seq_id"] = atomic.LoadInt32(&bc.currentSeqId)
+	m["latency_ms"] = bc.latency.Get() * 0.001
+	return json.Marshal(m)
+}
+
 //
 // Request为将要发送到后端进程请求，包括lb层的心跳，或来自前端的正常请求
 //
-func (bc *BackendConnLB) PushBack(r *Request) {
+func (bc *BackendConnLB) PushBack(r *Request) error {
 	// 关键路径必须有Log, 高频路径的Log需要受verbose状态的控制
 	if bc.IsConnActive.Get() {
 		// log.Printf("Push Request to backend: %s", r.Request.Name)
 		r.Service = bc.serviceName
+		// BackendAddr和trace必须在进入input之前记录(之后loopWriter随时可能处理请求), 没有进入input时恢复
+		addr := r.BackendAddr
 		r.Wait.Add(1)
-		bc.input <- r
-
+		r.BackendAddr = bc.address
+		r.AttemptStart = microseconds()
+		r.Trace.enqueue(bc.address)
+		if !enqueueRequest(bc.input, r, bc.queue) {
+			// 队列满了: 不阻塞, 由BackServiceLB按照overflow的策略处理
+			r.Wait.Done()
+			r.BackendAddr = addr
+			r.Trace.dequeue()
+			bc.overflows.Incr()
+			r.Response.Err = &OverloadedError{Service: bc.serviceName, Addr: bc.address, Queue: cap(bc.input)}
+			if bc.verbose {
+				log.Warnf("%v", r.Response.Err)
+			}
+			return r.Response.Err
+		}
+		return nil
 	} else {
 		r.Response.Err = errors.New(fmt.Sprintf("[%s] Request Assigned to inactive BackendConnLB", bc.serviceName))
 		log.Warn(Magenta("Push Request To Inactive Backend"))
+		return r.Response.Err
 	}
-
 }
 
 //
@@ -165,17 +224,9 @@ func (bc *BackendConnLB) loopWriter() error {
 				// 强制关闭c
 				c.Close()
 				return errors.New("Worker HB timeout")
-			} else {
-				if bc.IsConnActive.Get() {
-					// 定时添加Ping的任务
-					r := NewPingRequest()
-					bc.PushBack(r)
-
-					// 同时检测当前的异常请求
-					expired := microseconds() - REQUEST_EXPIRED_TIME_MICRO // 以microsecond为单位
-					bc.seqNumRequestMap.RemoveExpired(expired)
-				}
 			}
+			// 心跳由Worker主动发送(参考: setResponse), loopWriter不会写出input中的心跳;
+			// 因此不再往input中添加Ping的任务, 避免在队列满的时候占用队列, 或者被计入overflows
 
 		case r, ok = <-bc.input:
 			if !ok {
@@ -191,8 +242,10 @@ func (bc *BackendConnLB) loopWriter() error {
 					}
 				} else if r.Request.TypeId == MESSAGE_TYPE_STOP_CONFIRM {
 					// 强制写一个新的Response到Worker，不关心是否写成功；也不关心反馈结果
-					c.Write(r.Request.Data)
-					err := c.FlushBuffer(true)
+					err := bc.write(c, r)
+					if err == nil {
+						err = c.FlushBuffer(true)
+					}
 
 					if err != nil {
 						log.ErrorErrorf(err, "Stop confirm Error")
@@ -204,12 +257,21 @@ func (bc *BackendConnLB) loopWriter() error {
 					// 1. 替换新的SeqId(currentSeqId只在当前线程中使用, 不需要同步)
 					r.ReplaceSeqId(bc.currentSeqId)
 					bc.IncreaseCurrentSeqId()
+					r.Trace.sent(r.Request.Data)
 
 					// 2. 主动控制Buffer的flush
 					// 先记录SeqId <--> Request, 再发送请求
 					// 否则: 请求从后端返回，记录还没有完成，就容易导致Request丢失
 					bc.seqNumRequestMap.Add(r.Response.SeqId, r)
-					c.Write(r.Request.Data)
+					if err := bc.write(c, r); err != nil {
+						// 请求本身的问题(例如: headers太大), 没有写出; 直接返回错误
+						log.ErrorErrorf(err, "Encode Request Error: %v", err)
+						if bc.seqNumRequestMap.Pop(r.Response.SeqId) != nil {
+							r.Response.Err = err
+							r.Wait.Done()
+						}
+						continue
+					}
 					err := c.FlushBuffer(flush)
 
 					if err != nil {
@@ -227,6 +289,23 @@ func (bc *BackendConnLB) loopWriter() error {
 	return nil
 }
 
+//
+// 将请求写入Buffer; rpc server支持THeader时, 带上Client的headers
+//
+func (bc *BackendConnLB) write(c *TBufferedFramedTransport, r *Request) error {
+	if !bc.theader {
+		c.Write(r.Request.Data)
+		return nil
+	}
+	frame, err := encodeTHeaderFrame(PROTOCOL_BINARY, r.Response.SeqId, r.Headers, r.Request.Data)
+	if err != nil {
+		return err
+	}
+	c.Write(frame)
+	returnSlice(frame)
+	return nil
+}
+
 //
 // 从"RPC Backend" RPC Worker 中读取结果, ReadFrame读取的是一个thrift message
 // 存在两种情况:
@@ -294,6 +373,22 @@ func (bc *BackendConnLB) setResponse(r *Request, data []byte, err error) error {
 		log.Printf("No Data From Server, error: %v\n", err)
 		r.Response.Err = err
 	} else {
+		// 支持THeader的rpc server返回的数据带有headers
+		var headers map[string]string
+		if IsTHeaderFrame(data) {
+			frame := data
+			if headers, data, err = unwrapTHeaderFrame(frame); err != nil {
+				log.ErrorErrorf(err, "Decode THeader Error: %v", err)
+				// 通过THeader中的seqId找到对应的请求, 直接返回错误(不用等到超时)
+				if req := bc.seqNumRequestMap.Pop(getTHeaderSeqId(frame)); req != nil &&
+					req.Request.TypeId != MESSAGE_TYPE_HEART_BEAT {
+					req.Response.Err = err
+					req.Wait.Done()
+				}
+				return err
+			}
+		}
+
 		// 从resp中读取基本的信息
 		typeId, method, seqId, err := DecodeThriftTypIdSeqId(data)
 
@@ -318,6 +413,14 @@ func (bc *BackendConnLB) setResponse(r *Request, data []byte, err error) error {
 			return nil
 		}
 
+		if typeId == MESSAGE_TYPE_REGISTER {
+			// 只服务一个service的rpc_lb不需要Worker声明服务
+			if method != bc.serviceName {
+				log.Warnf("[%s]Worker %s registered for service: %s", bc.serviceName, bc.address, method)
+			}
+			return nil
+		}
+
 		// 找到对应的Request
 
 		req := bc.seqNumRequestMap.Pop(seqId)
@@ -338,9 +441,12 @@ func (bc *BackendConnLB) setResponse(r *Request, data []byte, err error) error {
 			}
 			r = req
 			r.Response.TypeId = typeId
+			r.Response.Headers = headers
 			if req.Request.Name != method {
 				data = nil
 				err = req.NewInvalidResponseError(method, "conn_lb")
+			} else {
+				bc.latency.Observe(microseconds() - req.AttemptStart)
 			}
 		}
 	}
@@ -357,9 +463,10 @@ func (bc *BackendConnLB) setResponse(r *Request, data []byte, err error) error {
 }
 
 func (bc *BackendConnLB) IncreaseCurrentSeqId() {
-	// 备案(只有loopWriter操作，不加锁)
-	bc.currentSeqId++
-	if bc.currentSeqId > BACKEND_CONN_MAX_SEQ_ID {
-		bc.currentSeqId = BACKEND_CONN_MIN_SEQ_ID
+	// 备案(只有loopWriter修改，不加锁; 其他的goroutine通过atomic读取)
+	seqId := bc.currentSeqId + 1
+	if seqId > BACKEND_CONN_MAX_SEQ_ID {
+		seqId = BACKEND_CONN_MIN_SEQ_ID
 	}
+	atomic.StoreInt32(&bc.currentSeqId, seqId)
 }
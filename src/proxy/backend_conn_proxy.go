@@ -3,9 +3,11 @@
 package proxy
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/wfxiang08/cyutils/utils/atomic2"
@@ -27,7 +29,10 @@ var (
 type BackendConn struct {
 	addr    string
 	service string
-	input   chan *Request // 输入的请求, 有: 1024个Buffer
+	input   chan *Request // 输入的请求, 大小由queue决定(默认: 1024)
+	queue   *BackendQueueConfig
+	// input满了, 请求没有被接受的次数
+	overflows atomic2.Int64
 
 	// seqNum2Request 读写基本上差不多
 	seqNumRequestMap *RequestMap
@@ -44,10 +49,25 @@ type BackendConn struct {
 
 	hbLastTime atomic2.Int64
 	hbTicker   *time.Ticker
+
+	latency PeakEwma      // 请求的latency, 用于负载均衡
+	weight  atomic2.Int64 // 来自ServiceEndpoint的权重, 可以动态调整
+	breaker *CircuitBreaker
+	theader bool // 后端支持THeader transport, 请求带上Client的headers
+	// 后端为服务多个service的rpc_lb, 请求中保留service前缀
+	multiplexed atomic2.Bool
+
+	// 异常节点检测: 统计数据, 以及被摘除的状态(ejectedUntil, ejections只由BackService#detectOutliers访问)
+	outlier      OutlierStats
+	ejected      atomic2.Bool
+	ejectedUntil int64
+	ejections    int
 }
 
-func NewBackendConn(addr string, delegate *BackService, service string, verbose bool) *BackendConn {
-	requestMap, _ := NewRequestMap(4096)
+func NewBackendConn(addr string, weight int, delegate *BackService, service string,
+	breakerConfig *CircuitBreakerConfig, queue *BackendQueueConfig, theader bool, verbose bool) *BackendConn {
+	// 请求的超时由TimingWheel负责, 不再依赖心跳的定时扫描
+	requestMap, _ := NewExpiringRequestMap(4096, getRequestTimingWheel())
 
 	var minSeqId int32
 	backendConnIndexMutex.Lock()
@@ -68,7 +88,8 @@ func NewBackendConn(addr string, delegate *BackService, service string, verbose
 	bc := &BackendConn{
 		addr:             addr,
 		service:          service,
-		input:            make(chan *Request, 1024),
+		input:            make(chan *Request, queue.GetSize()),
+		queue:            queue,
 		seqNumRequestMap: requestMap,
 
 		currentSeqId: minSeqId,
@@ -77,8 +98,17 @@ func NewBackendConn(addr string, delegate *BackService, service string, verbose
 		Index:        INVALID_ARRAY_INDEX,
 
 		delegate: delegate,
+		theader:  theader,
 		verbose:  verbose,
 	}
+	bc.weight.Set(int64(weight))
+
+	if breakerConfig == nil {
+		breakerConfig = &CircuitBreakerConfig{}
+	}
+	bc.breaker = NewCircuitBreaker(fmt.Sprintf("%s@%s", service, addr), breakerConfig, bc.breakerStateChanged)
+	requestMap.SetExpiredHandler(bc.requestExpired)
+
 	go bc.Run()
 	return bc
 }
@@ -98,6 +128,7 @@ func (bc *BackendConn) MarkOffline() {
 
 		// 不再接受(来自backend_service_proxy的)新的输入
 		bc.MarkConnActiveFalse()
+		unregisterBreaker(bc.breaker)
 
 		close(bc.input)
 	}
@@ -132,23 +163,151 @@ func (bc *BackendConn) MarkConnActiveOK() {
 
 }
 
+//
+// 是否可以分配请求: 连接正常, 没有熔断, 并且没有被当作异常节点摘除
+//
+func (bc *BackendConn) IsAvailable() bool {
+	return bc.IsConnActive.Get() && bc.breaker.State() != BREAKER_OPEN && !bc.ejected.Get()
+}
+
+func (bc *BackendConn) Breaker() *CircuitBreaker {
+	return bc.breaker
+}
+
+// 熔断/恢复之后, 通知BackService调整activeConns
+func (bc *BackendConn) breakerStateChanged(from, to BreakerState) {
+	if bc.delegate != nil {
+		bc.delegate.StateChanged(bc)
+	}
+}
+
+func (bc *BackendConn) requestExpired(r *Request) {
+	bc.recordResult(r, false)
+}
+
+//
+// 记录请求的结果, 用于熔断和异常节点检测(心跳不计入)
+//
+func (bc *BackendConn) recordResult(r *Request, success bool) {
+	if r.Request.TypeId == MESSAGE_TYPE_HEART_BEAT {
+		return
+	}
+	bc.breaker.Record(success)
+	bc.outlier.Record(success, microseconds()-r.AttemptStart)
+}
+
 func (bc *BackendConn) Addr() string {
 	return bc.addr
 }
 
+// 等待发送的请求 + 已经发送, 但是还没有返回的请求
+func (bc *BackendConn) Outstanding() int {
+	return len(bc.input) + bc.seqNumRequestMap.Len()
+}
+
+func (bc *BackendConn) Latency() *PeakEwma {
+	return &bc.latency
+}
+
+func (bc *BackendConn) Weight() int {
+	return int(bc.weight.Get())
+}
+
+func (bc *BackendConn) SetWeight(weight int) {
+	if old := bc.weight.Get(); old != int64(weight) {
+		log.Printf(Cyan("[%s]BackendConn: %s weight %d --> %d"), bc.service, bc.addr, old, weight)
+		bc.weight.Set(int64(weight))
+	}
+}
+
+func (bc *BackendConn) SetMultiplexed(multiplexed bool) {
+	if bc.multiplexed.Get() != multiplexed {
+		log.Printf(Cyan("[%s]BackendConn: %s multiplexed: %v"), bc.service, bc.addr, multiplexed)
+		bc.multiplexed.Set(multiplexed)
+	}
+}
+
+//
+// 发送给后端的数据: 服务多个service的rpc_lb需要service前缀; 支持THeader的后端带上Client的headers
+// allocated: 数据是否为新分配的(写入之后需要归还)
+//
+func (bc *BackendConn) encodeRequest(r *Request) (data []byte, allocated bool, err error) {
+	data = r.Request.Data
+	// 重试之前service前缀已经被剥离时, 才需要重新加上
+	if bc.multiplexed.Get() && len(r.Service) > 0 && !r.hasServicePrefix() && r.Request.TypeId != MESSAGE_TYPE_HEART_BEAT {
+		if data, err = multiplexThriftMessage(r.Service, data); err != nil {
+			return nil, false, err
+		}
+		allocated = true
+	}
+	if bc.theader {
+		frame, err := encodeTHeaderFrame(PROTOCOL_BINARY, r.Response.SeqId, r.Headers, data)
+		if allocated {
+			returnSlice(data)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		data, allocated = frame, true
+	}
+	return data, allocated, nil
+}
+
+//
+// 用于admin api: 查看BackendConn的运行时状态
+//
+func (bc *BackendConn) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["addr"] = bc.addr
+	m["weight"] = bc.Weight()
+	m["multiplexed"] = bc.multiplexed.Get()
+	m["conn_active"] = bc.IsConnActive.Get()
+	m["mark_offline"] = bc.IsMarkOffline.Get()
+	m["available"] = bc.IsAvailable()
+	m["ejected"] = bc.ejected.Get()
+	m["breaker"] = bc.breaker.State().String()
+	m["pending"] = len(bc.input)
+	m["overflows"] = bc.overflows.Get()
+	m["in_flight"] = bc.seqNumRequestMap.Len()
+	m["min_seq_id"] = bc.minSeqId
+	m["max_seq_id"] = bc.maxSeqId
+	m["current_seq_id"] = atomic.LoadInt32(&bc.currentSeqId)
+	m["latency_ms"] = bc.latency.Get() * 0.001
+	return json.Marshal(m)
+}
+
 //
 // 目前有两类请求:
 // 1. ping request
 // 2. 正常的请求
-func (bc *BackendConn) PushBack(r *Request) {
+// 返回error时请求没有被接受(也没有r.Wait.Add), 可以直接分配给其他的BackendConn
+func (bc *BackendConn) PushBack(r *Request) error {
 	if bc.IsConnActive.Get() && !bc.IsMarkOffline.Get() {
 		// 1. 处于Active状态，并且没有标记下线, 则将 Request 添加到 input 中
+		// BackendAddr和trace必须在进入input之前记录(之后loopWriter随时可能处理请求), 没有进入input时恢复
+		addr := r.BackendAddr
 		r.Wait.Add(1)
-		bc.input <- r
+		r.BackendAddr = bc.addr
+		r.AttemptStart = microseconds()
+		r.Trace.enqueue(bc.addr)
+		if !enqueueRequest(bc.input, r, bc.queue) {
+			// 3. 队列满了: 不阻塞, 由BackService按照overflow的策略处理
+			r.Wait.Done()
+			r.BackendAddr = addr
+			r.Trace.dequeue()
+			bc.overflows.Incr()
+			r.Response.Err = &OverloadedError{Service: bc.service, Addr: bc.addr, Queue: cap(bc.input)}
+			if bc.verbose {
+				log.Warnf("%v", r.Response.Err)
+			}
+			return r.Response.Err
+		}
+		return nil
 	} else {
 		// 2. 直接报错（返回)
 		r.Response.Err = errors.New(fmt.Sprintf("[%s] Request Assigned to inactive BackendConn", bc.service))
 		log.Warn(Magenta("Push Request To Inactive Backend"))
+		return r.Response.Err
 	}
 }
 
@@ -222,10 +381,10 @@ func (bc *BackendConn) Run() {
 			log.Printf(Red("[%s]BackendConn#loopWriter normal Exit..."), bc.service)
 			break
 		} else {
-			// 对于尚未处理的Request, 直接报错
+			// 对于尚未处理的Request, 直接报错(还没有发送到后端, 可以重试)
 			for i := len(bc.input); i != 0; i-- {
 				r := <-bc.input
-				bc.setResponse(r, nil, err)
+				bc.failRequest(r, err, false)
 			}
 		}
 	}
@@ -256,18 +415,19 @@ func (bc *BackendConn) loopWriter(c *TBufferedFramedTransport) error {
 			if time.Now().Unix()-bc.hbLastTime.Get() > HB_TIMEOUT {
 				return errors.New(fmt.Sprintf("[%s]HB timeout", bc.service))
 			} else {
-				// 定时添加Ping的任务; 如果标记下线，则不在心跳
+				// 定时发送心跳; 如果标记下线，则不在心跳
 				if !bc.IsMarkOffline.Get() {
-					// 发送心跳信息
-					r := NewPingRequest()
-					bc.PushBack(r)
-
-					// 同时检测当前的异常请求
-					expired := microseconds() - REQUEST_EXPIRED_TIME_MICRO // 以microsecond为单位
-					// microseconds() - request.Start > REQUEST_EXPIRED_TIME_MICRO
-					// 超时: microseconds() - REQUEST_EXPIRED_TIME_MICRO > request.Start
-					bc.seqNumRequestMap.RemoveExpired(expired)
+					// 心跳直接写出, 不经过bc.input: 队列满的时候(最需要心跳的时候)也不会被丢弃
+					if bc.IsConnActive.Get() {
+						r := NewPingRequest()
+						r.Wait.Add(1)
+						if err := bc.writeRequest(c, r, true); err != nil {
+							return err
+						}
+					}
 
+					// 熔断一段时间之后, 开始试探
+					bc.breaker.TryHalfOpen()
 				}
 			}
 
@@ -279,42 +439,58 @@ func (bc *BackendConn) loopWriter(c *TBufferedFramedTransport) error {
 				// 如果暂时没有数据输入，则p策略可能就有问题了
 				// 只有写入数据，才有可能产生flush; 如果是最后一个数据必须自己flush, 否则就可能无限期等待
 				//
-				if r.Request.TypeId == MESSAGE_TYPE_HEART_BEAT {
-					// 过期的HB信号，直接放弃
-					if time.Now().Unix()-r.Start > 4 {
-						log.Printf(Magenta("Expired HB Signal"))
-					}
+				if err := bc.writeRequest(c, r, len(bc.input) == 0); err != nil {
+					return err
 				}
+			}
+		}
+	}
 
-				// 请求正常转发给后端的Rpc Server
-				var flush = len(bc.input) == 0
-
-				// 1. 替换新的SeqId
-				r.ReplaceSeqId(bc.currentSeqId)
-				bc.IncreaseCurrentSeqId()
-
-				// 2. 主动控制Buffer的flush
-				// 先记录SeqId <--> Request, 再发送请求
-				// 否则: 请求从后端返回，记录还没有完成，就容易导致Request丢失
-				bc.seqNumRequestMap.Add(r.Response.SeqId, r)
+	return nil
+}
 
-				// 2. 主动控制Buffer的flush
-				c.Write(r.Request.Data)
-				err := c.FlushBuffer(flush)
+//
+// 将请求(包括心跳)转发给后端的Rpc Server, 返回error时连接不再可用
+//
+func (bc *BackendConn) writeRequest(c *TBufferedFramedTransport, r *Request, flush bool) error {
+	// 1. 替换新的SeqId(rpc_lb需要service前缀, 直接保留)
+	r.replaceSeqId(bc.currentSeqId, bc.multiplexed.Get())
+	bc.IncreaseCurrentSeqId()
+	r.Trace.sent(r.Request.Data)
+
+	// 2. 主动控制Buffer的flush
+	// 先记录SeqId <--> Request, 再发送请求
+	// 否则: 请求从后端返回，记录还没有完成，就容易导致Request丢失
+	// 记录之后r可能随时被返回(或者重试), 不能再访问r.Response
+	seqId, reqSeqId := r.Response.SeqId, r.Request.SeqId
+	data, allocated, err := bc.encodeRequest(r)
+	if err != nil {
+		// 请求本身的问题(例如: headers太大), 不需要重试
+		log.ErrorErrorf(err, "[%s]Encode Request Error: %v", bc.service, err)
+		r.Response.Err = err
+		r.Wait.Done()
+		return nil
+	}
+	bc.seqNumRequestMap.Add(seqId, r)
 
-				if err == nil {
-					log.Debugf("--> SeqId: %d vs. %d To Backend", r.Request.SeqId, r.Response.SeqId)
+	c.Write(data)
+	if allocated {
+		returnSlice(data)
+	}
+	err = c.FlushBuffer(flush)
 
-				} else {
-					bc.seqNumRequestMap.Pop(r.Response.SeqId) // 如果写错了，在删除
-					// 进入不可用状态(不可用状态下，通过自我心跳进入可用状态)
-					return bc.setResponse(r, nil, err)
-				}
-			}
-		}
+	if err == nil {
+		log.Debugf("--> SeqId: %d vs. %d To Backend", reqSeqId, seqId)
+		return nil
 	}
 
-	return nil
+	// 如果写错了，在删除(如果已经被flushRequests处理, 则不再处理)
+	// 进入不可用状态(不可用状态下，通过自我心跳进入可用状态)
+	// 请求可能已经部分发送到后端
+	if req := bc.seqNumRequestMap.Pop(seqId); req != nil {
+		bc.failRequest(req, err, true)
+	}
+	return err
 }
 
 //
@@ -367,13 +543,27 @@ func (bc *BackendConn) flushRequests(err error) {
 
 	seqRequest := bc.seqNumRequestMap.Purge()
 	for _, request := range seqRequest {
-		request.Response.Err = err
-		request.Wait.Done()
 		log.Debugf("FlushRequests, SeqId: %d", request.Response.SeqId)
+		bc.failRequest(request, err, true)
 	}
 
 }
 
+//
+// 请求因为连接的问题失败: 优先交给BackService重试, 否则直接报错
+// written: 请求是否已经(或者可能已经)发送到后端
+//
+func (bc *BackendConn) failRequest(r *Request, err error, written bool) {
+	if written {
+		bc.recordResult(r, false)
+	}
+	if bc.delegate != nil && bc.delegate.Retry(bc, r, err, written) {
+		return
+	}
+	r.Response.Err = err
+	r.Wait.Done()
+}
+
 // 配对 Request, resp, err
 // PARAM: resp []byte 为一帧完整的thrift数据包
 func (bc *BackendConn) setResponse(r *Request, data []byte, err error) error {
@@ -382,6 +572,23 @@ func (bc *BackendConn) setResponse(r *Request, data []byte, err error) error {
 		log.Debugf("[%s] SeqId: %d, No Data From Server, error: %v", r.Service, r.Response.SeqId, err)
 		r.Response.Err = err
 	} else {
+		// 支持THeader的后端返回的数据带有headers
+		var headers map[string]string
+		if IsTHeaderFrame(data) {
+			frame := data
+			if headers, data, err = unwrapTHeaderFrame(frame); err != nil {
+				log.ErrorErrorf(err, "[%s]Decode THeader Error: %v", bc.service, err)
+				// 通过THeader中的seqId找到对应的请求, 直接返回错误(不用等到超时)
+				if req := bc.seqNumRequestMap.Pop(getTHeaderSeqId(frame)); req != nil &&
+					req.Request.TypeId != MESSAGE_TYPE_HEART_BEAT {
+					bc.recordResult(req, false)
+					req.Response.Err = err
+					req.Wait.Done()
+				}
+				return err
+			}
+		}
+
 		// 从resp中读取基本的信息
 		typeId, method, seqId, err := DecodeThriftTypIdSeqId(data)
 		//		if err != nil {
@@ -419,9 +626,15 @@ func (bc *BackendConn) setResponse(r *Request, data []byte, err error) error {
 			}
 			r = req
 			r.Response.TypeId = typeId
+			r.Response.Headers = headers
 			if req.Request.Name != method {
 				data = nil
 				err = req.NewInvalidResponseError(method, "conn_proxy")
+				bc.recordResult(req, false)
+			} else {
+				bc.latency.Observe(microseconds() - req.AttemptStart)
+				// 后端返回的异常也计入错误
+				bc.recordResult(req, typeId != thrift.EXCEPTION)
 			}
 		}
 	}
@@ -441,9 +654,10 @@ func (bc *BackendConn) setResponse(r *Request, data []byte, err error) error {
 }
 
 func (bc *BackendConn) IncreaseCurrentSeqId() {
-	// 备案(只有loopWriter操作，不加锁)
-	bc.currentSeqId++
-	if bc.currentSeqId > bc.maxSeqId {
-		bc.currentSeqId = bc.minSeqId
+	// 备案(只有loopWriter修改，不加锁; 其他的goroutine通过atomic读取)
+	seqId := bc.currentSeqId + 1
+	if seqId > bc.maxSeqId {
+		seqId = bc.minSeqId
 	}
+	atomic.StoreInt32(&bc.currentSeqId, seqId)
 }
@@ -52,7 +52,7 @@ func TestBackend(t *testing.T) {
 
 	go func() {
 		// 客户端代码
-		bc := NewBackendConn(addr, nil, "test", true)
+		bc := NewBackendConn(addr, DEFAULT_ENDPOINT_WEIGHT, nil, "test", nil, nil, false, true)
 		bc.currentSeqId = 10
 
 		// 准备发送数据
@@ -0,0 +1,110 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	BACKEND_QUEUE_DEFAULT_SIZE = 1024
+	BACKEND_QUEUE_DEFAULT_WAIT = 50 * time.Millisecond
+
+	// BackendConn(BackendConnLB)的input满了之后的处理
+	BACKEND_QUEUE_OVERFLOW_REJECT = "reject" // 直接返回Overloaded Exception
+	BACKEND_QUEUE_OVERFLOW_RETRY  = "retry"  // 分配给另外一个BackendConn, 仍然满的话返回Overloaded Exception
+	BACKEND_QUEUE_OVERFLOW_WAIT   = "wait"   // 最多等待一段时间(不超过请求的deadline)
+)
+
+//
+// BackendConn(BackendConnLB)的请求队列
+//
+type BackendQueueConfig struct {
+	Size     int
+	Overflow string
+	Wait     time.Duration
+}
+
+func (c *BackendQueueConfig) GetSize() int {
+	if c == nil || c.Size <= 0 {
+		return BACKEND_QUEUE_DEFAULT_SIZE
+	}
+	return c.Size
+}
+
+func (c *BackendQueueConfig) GetOverflow() string {
+	if c == nil || len(c.Overflow) == 0 {
+		return BACKEND_QUEUE_OVERFLOW_REJECT
+	}
+	return c.Overflow
+}
+
+func (c *BackendQueueConfig) GetWait() time.Duration {
+	if c == nil || c.Wait <= 0 {
+		return BACKEND_QUEUE_DEFAULT_WAIT
+	}
+	return c.Wait
+}
+
+func IsValidBackendQueueOverflow(overflow string) bool {
+	switch overflow {
+	case BACKEND_QUEUE_OVERFLOW_REJECT, BACKEND_QUEUE_OVERFLOW_RETRY, BACKEND_QUEUE_OVERFLOW_WAIT:
+		return true
+	default:
+		return false
+	}
+}
+
+//
+// 将请求放入input, 队列满时不阻塞(overflow为wait时最多等待一段时间); 返回false表示没有放入
+// 心跳不经过input: BackendConn的loopWriter直接写出心跳, 不受队列的限制
+//
+func enqueueRequest(input chan *Request, r *Request, config *BackendQueueConfig) bool {
+	select {
+	case input <- r:
+		return true
+	default:
+	}
+
+	if config.GetOverflow() != BACKEND_QUEUE_OVERFLOW_WAIT {
+		return false
+	}
+
+	wait := config.GetWait()
+	if r.Deadline > 0 {
+		if remain := time.Duration(r.Deadline-microseconds()) * time.Microsecond; remain < wait {
+			wait = remain
+		}
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case input <- r:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+//
+// BackendConn(BackendConnLB)的队列满了, 请求没有被接受; 最终返回给Client的是专门的Overloaded Exception
+//
+type OverloadedError struct {
+	Service string
+	Addr    string
+	Queue   int
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("Overloaded, %s@%s, queue size: %d", e.Service, e.Addr, e.Queue)
+}
+
+func IsOverloadedError(err error) bool {
+	_, ok := err.(*OverloadedError)
+	return ok
+}
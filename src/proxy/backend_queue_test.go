@@ -0,0 +1,173 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// go test proxy -v -run "TestEnqueueRequest"
+//
+func TestEnqueueRequest(t *testing.T) {
+	input := make(chan *Request, 1)
+	r := newRetryTestRequest("typo:get_user", 1)
+	assert.True(t, enqueueRequest(input, r, nil))
+
+	// 1. reject(默认): 不等待
+	start := time.Now()
+	assert.False(t, enqueueRequest(input, r, nil))
+	assert.True(t, time.Since(start) < 10*time.Millisecond)
+
+	// 2. wait: 最多等待backend_queue_wait
+	config := &BackendQueueConfig{Size: 1, Overflow: BACKEND_QUEUE_OVERFLOW_WAIT, Wait: 20 * time.Millisecond}
+	start = time.Now()
+	assert.False(t, enqueueRequest(input, r, config))
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+
+	// 等待期间队列有了空位
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		<-input
+	}()
+	assert.True(t, enqueueRequest(input, r, config))
+
+	// 不超过请求的deadline
+	config.Wait = time.Second
+	r.SetTimeout(20 * time.Millisecond)
+	start = time.Now()
+	assert.False(t, enqueueRequest(input, r, config))
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func newQueueTestConn(addr string, queue *BackendQueueConfig) *BackendConn {
+	requestMap, _ := NewRequestMap(16)
+	conn := &BackendConn{
+		addr:             addr,
+		service:          "typo",
+		input:            make(chan *Request, queue.GetSize()),
+		queue:            queue,
+		seqNumRequestMap: requestMap,
+		Index:            INVALID_ARRAY_INDEX,
+	}
+	conn.weight.Set(DEFAULT_ENDPOINT_WEIGHT)
+	conn.breaker = NewCircuitBreaker(addr, &CircuitBreakerConfig{}, nil)
+	conn.IsConnActive.Set(true)
+	return conn
+}
+
+//
+// go test proxy -v -run "TestBackendConnOverloaded"
+//
+func TestBackendConnOverloaded(t *testing.T) {
+	conn := newQueueTestConn("10.0.0.1:5555", &BackendQueueConfig{Size: 1})
+	defer unregisterBreaker(conn.breaker)
+
+	assert.NoError(t, conn.PushBack(newRetryTestRequest("typo:get_user", 1)))
+
+	// 队列满了: 不阻塞, 直接返回OverloadedError
+	r := newRetryTestRequest("typo:get_user", 2)
+	err := conn.PushBack(r)
+	assert.True(t, IsOverloadedError(err))
+	assert.Equal(t, int64(1), conn.overflows.Get())
+	// 没有进入队列: 不记录BackendConn
+	assert.Equal(t, "", r.BackendAddr)
+	r.Wait.Wait()
+
+	assert.Equal(t, OUTCOME_OVERLOADED, r.Outcome())
+	assert.Equal(t, "overloaded", r.Outcome().String())
+
+	data := GetThriftException(r, "proxy")
+	protocol := thrift.NewTBinaryProtocolTransport(NewTMemoryBufferWithBuf(data))
+	_, _, _, err = protocol.ReadMessageBegin()
+	assert.NoError(t, err)
+	exc, err := thrift.NewTApplicationException(thrift.UNKNOWN_APPLICATION_EXCEPTION, "").Read(protocol)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(OVERLOADED_APPLICATION_EXCEPTION), exc.TypeId())
+}
+
+//
+// go test proxy -v -run "TestBackServiceOverflow"
+//
+func TestBackServiceOverflow(t *testing.T) {
+	for _, overflow := range []string{BACKEND_QUEUE_OVERFLOW_REJECT, BACKEND_QUEUE_OVERFLOW_RETRY} {
+		queue := &BackendQueueConfig{Size: 1, Overflow: overflow}
+		s := &BackService{
+			serviceName: "typo",
+			activeConns: make([]*BackendConn, 0, 10),
+			balancer:    newRoundRobinBalancer(),
+			retry:       &RetryPolicy{},
+			retryBudget: NewRetryBudget(RETRY_DEFAULT_BUDGET_RATIO),
+			queue:       queue,
+			addr2Conn:   make(map[string]*BackendConn),
+		}
+		full := newQueueTestConn("10.0.0.1:5555", queue)
+		idle := newQueueTestConn("10.0.0.2:5555", queue)
+		defer unregisterBreaker(full.breaker)
+		defer unregisterBreaker(idle.breaker)
+		s.StateChanged(full)
+		s.StateChanged(idle)
+		full.input <- newRetryTestRequest("typo:get_user", 1)
+
+		// 分配给full的请求
+		for i := 0; i < 2; i++ {
+			r := newRetryTestRequest("typo:get_user", 2)
+			s.dispatch(r, idle)
+			if overflow == BACKEND_QUEUE_OVERFLOW_RETRY {
+				// 分配给另外一个BackendConn
+				assert.NoError(t, r.Response.Err)
+				assert.Equal(t, idle.addr, r.BackendAddr)
+				assert.Equal(t, 2, r.Attempts)
+				<-idle.input
+			} else {
+				assert.True(t, IsOverloadedError(r.Response.Err))
+				assert.Equal(t, 1, r.Attempts)
+			}
+		}
+
+		// 所有的BackendConn都满了
+		idle.input <- newRetryTestRequest("typo:get_user", 1)
+		r := newRetryTestRequest("typo:get_user", 3)
+		s.dispatch(r, idle)
+		assert.True(t, IsOverloadedError(r.Response.Err))
+		r.Wait.Wait()
+	}
+}
+
+//
+// go test proxy -v -run "TestBackServiceLBOverflow"
+//
+func TestBackServiceLBOverflow(t *testing.T) {
+	queue := &BackendQueueConfig{Size: 1, Overflow: BACKEND_QUEUE_OVERFLOW_RETRY}
+	s := newBackServiceLB("typo", "lb.sock", NewRequestTimeouts(time.Second, nil), newRoundRobinBalancer(),
+		queue, false, false, make(chan bool))
+
+	var conns []*BackendConnLB
+	for i, addr := range []string{"lb.sock#1", "lb.sock#2"} {
+		conn := &BackendConnLB{address: addr, serviceName: "typo", input: make(chan *Request, 1), queue: queue, Index: i}
+		conn.IsConnActive.Set(true)
+		conns = append(conns, conn)
+	}
+	s.activeConns = conns
+	conns[0].input <- newRetryTestRequest("typo:get_user", 1)
+
+	// Worker的队列满了, 分配给另外一个Worker
+	r := newRetryTestRequest("typo:get_user", 2)
+	assert.True(t, IsOverloadedError(conns[0].PushBack(r)))
+	s.overflow(r, conns[0])
+	assert.NoError(t, r.Response.Err)
+	assert.Equal(t, "lb.sock#2", r.BackendAddr)
+	assert.Equal(t, 1, len(conns[1].input))
+
+	// 所有的Worker都满了
+	r = newRetryTestRequest("typo:get_user", 3)
+	assert.True(t, IsOverloadedError(conns[0].PushBack(r)))
+	s.overflow(r, conns[0])
+	assert.True(t, IsOverloadedError(r.Response.Err))
+	assert.Equal(t, int64(2), conns[0].overflows.Get())
+	assert.Equal(t, int64(1), conns[1].overflows.Get())
+}
@@ -3,6 +3,7 @@
 package proxy
 
 import (
+	"encoding/json"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"github.com/wfxiang08/go_thrift/thrift"
 	"os"
@@ -24,43 +25,59 @@ type BackServiceLB struct {
 	// Mutex的使用：
 	// 	避免使用匿名的Mutex, 需要指定一个语义明确的变量，限定它的使用范围(另可多定义几个Mutex, 不能滥用)
 	//
-	// 同时保护: activeConns 和 currentConnIndex
-	activeConnsLock  sync.Mutex
-	activeConns      []*BackendConnLB // 每一个BackendConn应该有一定的高可用保障
-	currentConnIndex int
-
-	verbose bool
-	exitEvt chan bool
-	ch      chan thrift.TTransport
+	// 同时保护: activeConns 和 balancer
+	activeConnsLock sync.Mutex
+	activeConns     []*BackendConnLB // 每一个BackendConn应该有一定的高可用保障
+	balancer        Balancer
+
+	timeouts *RequestTimeouts
+	queue    *BackendQueueConfig // BackendConnLB的请求队列
+	theader  bool                // 后端的rpc server支持THeader transport
+	verbose  bool
+	exitEvt  chan bool
+	ch       chan thrift.TTransport
 }
 
 // 创建一个BackService
-func NewBackServiceLB(serviceName string, backendAddr string, verbose bool,
-	falconClient string, exitEvt chan bool) *BackServiceLB {
-
-	service := &BackServiceLB{
-		serviceName:      serviceName,
-		backendAddr:      backendAddr,
-		activeConns:      make([]*BackendConnLB, 0, 10),
-		verbose:          verbose,
-		exitEvt:          exitEvt,
-		currentConnIndex: 0,
-		ch:               make(chan thrift.TTransport, 4096),
-	}
+func NewBackServiceLB(serviceName string, backendAddr string, timeouts *RequestTimeouts,
+	balancer Balancer, queue *BackendQueueConfig, theader bool, verbose bool, metrics *MetricsConfig,
+	exitEvt chan bool) *BackServiceLB {
+
+	service := newBackServiceLB(serviceName, backendAddr, timeouts, balancer, queue, theader, verbose, exitEvt)
 
 	service.run()
 
-	StartTicker(falconClient, serviceName)
+	StartTicker(metrics, serviceName)
 	return service
 
 }
 
+//
+// 创建一个BackService, 但是不监听backendAddr; Worker的连接由BackServiceLBMux通过addConn交给它
+//
+func newBackServiceLB(serviceName string, backendAddr string, timeouts *RequestTimeouts,
+	balancer Balancer, queue *BackendQueueConfig, theader bool, verbose bool, exitEvt chan bool) *BackServiceLB {
+
+	return &BackServiceLB{
+		serviceName: serviceName,
+		backendAddr: backendAddr,
+		activeConns: make([]*BackendConnLB, 0, 10),
+		balancer:    balancer,
+		timeouts:    timeouts,
+		queue:       queue,
+		theader:     theader,
+		verbose:     verbose,
+		exitEvt:     exitEvt,
+		ch:          make(chan thrift.TTransport, 4096),
+	}
+}
+
 //
 // 后端如何处理一个Request, 处理完毕之后直接返回，因为Caller已经做好异步处理了
 // Dispatch完毕之后，Request中带有完整的结果
 //
 func (s *BackServiceLB) Dispatch(r *Request) error {
-	backendConn := s.nextBackendConn()
+	backendConn := s.nextBackendConn(r, nil)
 
 	r.Service = s.serviceName
 
@@ -80,13 +97,36 @@ func (s *BackServiceLB) Dispatch(r *Request) error {
 		//		if s.verbose {
 		//			log.Println("SendMessage With: ", backendConn.Addr4Log(), "For Service: ", s.serviceName)
 		//		}
-		backendConn.PushBack(r)
+		r.SetTimeout(s.timeouts.Get(s.serviceName, r.Request.Name))
+		if err := backendConn.PushBack(r); IsOverloadedError(err) {
+			s.overflow(r, backendConn)
+		}
 		r.Wait.Wait() // 等待处理完毕
 
 		return nil
 	}
 }
 
+//
+// backendConn的队列满了: overflow为retry时分配给另外一个Worker, 否则直接返回Overloaded Exception
+//
+func (s *BackServiceLB) overflow(r *Request, backendConn *BackendConnLB) {
+	if s.queue.GetOverflow() != BACKEND_QUEUE_OVERFLOW_RETRY {
+		return
+	}
+	other := s.nextBackendConn(r, backendConn)
+	if other == nil || other == backendConn {
+		return
+	}
+
+	err := r.Response.Err
+	r.Response.Err = nil
+	if other.PushBack(r) != nil {
+		// 两个Worker都没有接受, 返回第一个错误
+		r.Response.Err = err
+	}
+}
+
 func (s *BackServiceLB) run() {
 	go func() {
 		// 定时汇报当前的状态
@@ -150,19 +190,7 @@ func (s *BackServiceLB) run() {
 					backendAddr = socket.Addr().String()
 				}
 
-				// 有可能连接刚刚创建，就立马挂了
-				conn := NewBackendConnLB(trans, s.serviceName, backendAddr, s, s.verbose)
-
-				// 因为连接刚刚建立，可靠性还是挺高的，因此直接加入到列表中
-				s.activeConnsLock.Lock()
-				// 可能在这里就出现 IsConnActive 为False的情况，如果出现了，就不再加入activeConns
-				if conn.IsConnActive.Get() {
-					conn.Index = len(s.activeConns)
-					s.activeConns = append(s.activeConns, conn)
-				}
-				s.activeConnsLock.Unlock()
-
-				log.Printf(Green("%s --> %d workers"), s.serviceName, conn.Index)
+				s.addConn(trans, backendAddr)
 			} else {
 				panic("Invalid Socket Type")
 			}
@@ -183,34 +211,77 @@ func (s *BackServiceLB) run() {
 	}()
 }
 
+//
+// 新的Worker连接
+//
+func (s *BackServiceLB) addConn(trans thrift.TTransport, backendAddr string) {
+	// 有可能连接刚刚创建，就立马挂了
+	conn := NewBackendConnLB(trans, s.serviceName, backendAddr, s, s.queue, s.theader, s.verbose)
+
+	// 因为连接刚刚建立，可靠性还是挺高的，因此直接加入到列表中
+	s.activeConnsLock.Lock()
+	// 可能在这里就出现 IsConnActive 为False的情况，如果出现了，就不再加入activeConns
+	if conn.IsConnActive.Get() {
+		conn.Index = len(s.activeConns)
+		s.activeConns = append(s.activeConns, conn)
+	}
+	s.activeConnsLock.Unlock()
+
+	log.Printf(Green("%s --> %d workers"), s.serviceName, conn.Index)
+}
+
 func (s *BackServiceLB) Active() int {
 	s.activeConnsLock.Lock()
 	defer s.activeConnsLock.Unlock()
 	return len(s.activeConns)
 }
 
-// 获取下一个active状态的BackendConn
-func (s *BackServiceLB) nextBackendConn() *BackendConnLB {
+//
+// 当前所有的Worker
+//
+func (s *BackServiceLB) Workers() []*BackendConnLB {
 	s.activeConnsLock.Lock()
 	defer s.activeConnsLock.Unlock()
 
-	// TODO: 暂时采用RoundRobin的方法，可以采用其他具有优先级排列的方法
+	workers := make([]*BackendConnLB, len(s.activeConns))
+	copy(workers, s.activeConns)
+	return workers
+}
+
+// 用于admin api
+func (s *BackServiceLB) MarshalJSON() ([]byte, error) {
+	workers := s.Workers()
+
+	var m = make(map[string]interface{})
+	m["service"] = s.serviceName
+	m["backend_addr"] = s.backendAddr
+	m["active"] = len(workers)
+	m["workers"] = workers
+	return json.Marshal(m)
+}
+
+// 获取下一个active状态的BackendConn, 尽量避开except(例如: 队列已经满了的Worker)
+func (s *BackServiceLB) nextBackendConn(r *Request, except *BackendConnLB) *BackendConnLB {
+	s.activeConnsLock.Lock()
+	defer s.activeConnsLock.Unlock()
+
+	// 具体的策略由balancer决定(round robin, random, least outstanding, p2c ewma, 一致性hash)
 	var backSocket *BackendConnLB
 
-	if len(s.activeConns) == 0 {
+	index := nextBalancerIndex(s.balancer, backendConnLBs(s.activeConns), r)
+	if index == INVALID_ARRAY_INDEX {
 		if s.verbose {
 			log.Debugf(Cyan("[%s]ActiveConns Len 0"), s.serviceName)
 		}
 		backSocket = nil
 	} else {
-		if s.currentConnIndex >= len(s.activeConns) {
-			s.currentConnIndex = 0
+		if s.activeConns[index] == except && len(s.activeConns) > 1 {
+			index = (index + 1) % len(s.activeConns)
 		}
-		backSocket = s.activeConns[s.currentConnIndex]
-		s.currentConnIndex++
+		backSocket = s.activeConns[index]
 		if s.verbose {
 			log.Debugf(Cyan("[%s]ActiveConns Len %d, CurrentIndex: %d"), s.serviceName,
-				len(s.activeConns), s.currentConnIndex)
+				len(s.activeConns), index)
 		}
 	}
 	return backSocket
@@ -256,3 +327,14 @@ func (s *BackServiceLB) StateChanged(conn *BackendConnLB) {
 		}
 	}
 }
+
+// 将activeConns包装成为BalancerConns
+type backendConnLBs []*BackendConnLB
+
+func (c backendConnLBs) Len() int {
+	return len(c)
+}
+
+func (c backendConnLBs) Get(i int) BalancerConn {
+	return c[i]
+}
@@ -0,0 +1,234 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/go_thrift/thrift"
+	"github.com/wfxiang08/thrift_rpc_base/rpc_utils"
+)
+
+const (
+	// Worker连接之后需要在多长时间内声明自己的服务
+	LB_REGISTER_TIMEOUT = 5 * time.Second
+	// MESSAGE_TYPE_REGISTER的frame中只有Message Header
+	LB_REGISTER_MAX_FRAME_SIZE = 1024
+)
+
+//
+// 一个rpc_lb进程同时服务多个service(配置: services=typo,user,analytics):
+//   1. 所有的Worker连接同一个backendAddr, 连接之后首先发送MESSAGE_TYPE_REGISTER(name为service), 然后交给对应的BackServiceLB
+//   2. 每一个service都以frontendAddr注册到Registry, ServiceEndpoint.Multiplexed为true
+//   3. rpc_proxy转发请求时保留service前缀(service:method, 同TMultiplexedProtocol), rpc_lb按照前缀分发, 转发给Worker时再剥离
+//
+type BackServiceLBMux struct {
+	backendAddr string
+	services    map[string]*BackServiceLB // 创建之后只读
+	verbose     bool
+	exitEvt     chan bool
+}
+
+func NewBackServiceLBMux(serviceNames []string, backendAddr string, timeouts *RequestTimeouts,
+	balancers *BalancerPolicies, queue *BackendQueueConfig, theader THeaderBackends, verbose bool,
+	metrics *MetricsConfig, exitEvt chan bool) *BackServiceLBMux {
+
+	m := newBackServiceLBMux(serviceNames, backendAddr, timeouts, balancers, queue, theader, verbose, exitEvt)
+	m.run()
+
+	// 多个service共享一个进程, 以rpc_lb为前缀
+	StartTicker(metrics, "rpc_lb")
+	return m
+}
+
+func newBackServiceLBMux(serviceNames []string, backendAddr string, timeouts *RequestTimeouts,
+	balancers *BalancerPolicies, queue *BackendQueueConfig, theader THeaderBackends, verbose bool,
+	exitEvt chan bool) *BackServiceLBMux {
+
+	m := &BackServiceLBMux{
+		backendAddr: backendAddr,
+		services:    make(map[string]*BackServiceLB, len(serviceNames)),
+		verbose:     verbose,
+		exitEvt:     exitEvt,
+	}
+	for _, name := range serviceNames {
+		m.services[name] = newBackServiceLB(name, backendAddr, timeouts, balancers.NewBalancer(name), queue,
+			theader.Enabled(name), verbose, exitEvt)
+	}
+	return m
+}
+
+func (m *BackServiceLBMux) Service(name string) *BackServiceLB {
+	return m.services[name]
+}
+
+//
+// 按照请求中的service前缀分发
+//
+func (m *BackServiceLBMux) Dispatch(r *Request) error {
+	s := m.services[r.Service]
+	if s == nil {
+		if m.verbose {
+			log.Printf(Red("Service Not Found for: %s.%s"), r.Service, r.Request.Name)
+		}
+		r.Response.Data = GetServiceNotFoundData(r)
+		return nil
+	}
+
+	// 转发给Worker时剥离service前缀(参考: ReplaceSeqId)
+	r.ProxyRequest = true
+	return s.Dispatch(r)
+}
+
+func (m *BackServiceLBMux) run() {
+	go func() {
+		// 定时汇报当前的状态
+		for true {
+			for name, s := range m.services {
+				log.Printf(Green("[Report]: %s --> %d workers"), name, s.Active())
+			}
+			log.Printf(Green("[Report]: coroutine: %d"), runtime.NumGoroutine())
+			time.Sleep(time.Second * 10)
+		}
+	}()
+
+	var transport thrift.TServerTransport
+	var err error
+
+	isUnixDomain := false
+	// 127.0.0.1:9999(以:区分不同的类型)
+	if !strings.Contains(m.backendAddr, ":") {
+		if rpc_utils.FileExist(m.backendAddr) {
+			os.Remove(m.backendAddr)
+		}
+		transport, err = rpc_utils.NewTServerUnixDomain(m.backendAddr)
+		isUnixDomain = true
+	} else {
+		transport, err = thrift.NewTServerSocket(m.backendAddr)
+	}
+
+	if err != nil {
+		log.ErrorErrorf(err, "Server Socket Create Failed: %v", err)
+		panic("BackendAddr Invalid")
+	}
+
+	err = transport.Listen()
+	if err != nil {
+		log.ErrorErrorf(err, "Server Socket Open Failed: %v", err)
+		panic("Server Socket Open Failed")
+	}
+	log.Printf(Green("LB Backend Services listens at: %s"), m.backendAddr)
+
+	go func() {
+		<-m.exitEvt
+		log.Info(Red("Receive Exit Signals...."))
+		transport.Interrupt()
+		transport.Close()
+	}()
+
+	go func() {
+		for {
+			trans, err := transport.Accept()
+			if err != nil {
+				return
+			}
+
+			socket, ok := trans.(rpc_utils.SocketAddr)
+			if !ok {
+				panic("Invalid Socket Type")
+			}
+			backendAddr := m.backendAddr
+			if !isUnixDomain {
+				backendAddr = socket.Addr().String()
+			}
+			// 等待Worker声明服务, 不阻塞Accept
+			go m.register(trans, backendAddr)
+		}
+	}()
+}
+
+//
+// 读取Worker声明的服务, 然后交给对应的BackServiceLB
+//
+func (m *BackServiceLBMux) register(trans thrift.TTransport, backendAddr string) {
+	timer := time.AfterFunc(LB_REGISTER_TIMEOUT, func() {
+		trans.Close()
+	})
+	service, err := readWorkerRegister(trans)
+	if !timer.Stop() && err == nil {
+		err = errors.New("register timeout")
+	}
+	if err != nil {
+		log.ErrorErrorf(err, "Worker %s register failed: %v", backendAddr, err)
+		trans.Close()
+		return
+	}
+
+	s := m.services[service]
+	if s == nil {
+		log.Errorf("Worker %s registered for unknown service: %s", backendAddr, service)
+		trans.Close()
+		return
+	}
+	s.addConn(trans, backendAddr)
+}
+
+//
+// 直接从transport中读取一个frame(不能使用带缓存的transport, 之后的数据由BackendConnLB读取)
+//
+func readWorkerRegister(trans io.Reader) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(trans, header[:]); err != nil {
+		return "", err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > LB_REGISTER_MAX_FRAME_SIZE {
+		return "", fmt.Errorf("register frame too large: %d", size)
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(trans, frame); err != nil {
+		return "", err
+	}
+	typeId, service, _, err := DecodeThriftTypIdSeqId(frame)
+	if err != nil {
+		return "", err
+	}
+	if typeId != MESSAGE_TYPE_REGISTER || len(service) == 0 {
+		return "", fmt.Errorf("expect register message, got type: %d", typeId)
+	}
+	return service, nil
+}
+
+//
+// 给TBinaryProtocol的message的name加上service前缀: method --> service:method
+// 返回的数据通过getSlice分配
+//
+func multiplexThriftMessage(service string, data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("invalid thrift message: %d bytes", len(data))
+	}
+	nameLen := int(binary.BigEndian.Uint32(data[4:8]))
+	if nameLen < 0 || nameLen > len(data)-8 {
+		return nil, fmt.Errorf("invalid thrift message name length: %d", nameLen)
+	}
+	prefixLen := len(service) + len(thrift.MULTIPLEXED_SEPARATOR)
+
+	size := len(data) + prefixLen
+	result := getSlice(size, size)
+	copy(result[0:4], data[0:4])
+	binary.BigEndian.PutUint32(result[4:8], uint32(nameLen+prefixLen))
+	idx := 8
+	idx += copy(result[idx:], service)
+	idx += copy(result[idx:], thrift.MULTIPLEXED_SEPARATOR)
+	copy(result[idx:], data[8:])
+	return result, nil
+}
@@ -0,0 +1,190 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+func newFrame(data []byte) []byte {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return frame
+}
+
+//
+// go test proxy -v -run "TestMultiplexThriftMessage"
+//
+func TestMultiplexThriftMessage(t *testing.T) {
+	data := fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.CALL, 7, protocolTestArgs...)
+	multiplexed, err := multiplexThriftMessage("typo", data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data)+len("typo:"), len(multiplexed))
+
+	// 数据不完整
+	_, err = multiplexThriftMessage("typo", data[:6])
+	assert.True(t, err != nil)
+	_, err = multiplexThriftMessage("typo", data[:10])
+	assert.True(t, err != nil)
+
+	r, err := NewRequest(append([]byte(nil), multiplexed...), false)
+	assert.NoError(t, err)
+	assert.Equal(t, "typo", r.Service)
+	assert.Equal(t, "get_user", r.Request.Name)
+	assert.Equal(t, int32(7), r.Request.SeqId)
+
+	// 转发给rpc_lb: 保留service前缀, 只替换SeqId
+	r.ProxyRequest = true
+	r.replaceSeqId(8, true)
+	assert.Equal(t, len(multiplexed), len(r.Request.Data))
+	_, name, seqId, _ := DecodeThriftTypIdSeqId(r.Request.Data)
+	assert.Equal(t, "typo:get_user", name)
+	assert.Equal(t, int32(8), seqId)
+
+	// 重试时转发给普通的后端: 剥离service之后和原来的数据一致
+	r.ResetForRetry()
+	r.ReplaceSeqId(7)
+	assert.Equal(t, data, r.Request.Data)
+}
+
+//
+// go test proxy -v -run "TestWorkerRegister"
+//
+func TestWorkerRegister(t *testing.T) {
+	service, err := readWorkerRegister(bytes.NewReader(newFrame(fakeArgsData(PROTOCOL_BINARY, "user", MESSAGE_TYPE_REGISTER, 0, protocolTestArgs...))))
+	assert.NoError(t, err)
+	assert.Equal(t, "user", service)
+
+	// 不是register message, frame太大, 数据不完整
+	_, err = readWorkerRegister(bytes.NewReader(newFrame(fakeArgsData(PROTOCOL_BINARY, "user", thrift.CALL, 0, protocolTestArgs...))))
+	assert.True(t, err != nil)
+	_, err = readWorkerRegister(bytes.NewReader(newFrame(make([]byte, LB_REGISTER_MAX_FRAME_SIZE+1))))
+	assert.True(t, err != nil)
+	_, err = readWorkerRegister(bytes.NewReader([]byte{0, 0, 0, 10, 0x80}))
+	assert.True(t, err != nil)
+}
+
+//
+// go test proxy -v -run "TestBackServiceLBMux"
+//
+func TestBackServiceLBMux(t *testing.T) {
+	mux := newBackServiceLBMux([]string{"typo", "user"}, "lb.sock", NewRequestTimeouts(time.Second, nil),
+		&BalancerPolicies{}, nil, nil, false, make(chan bool))
+
+	// Worker: 声明服务, 然后原样返回请求的数据
+	lbConn, workerConn := net.Pipe()
+	defer workerConn.Close()
+	received := make(chan string, 1)
+	go func() {
+		c := NewTBufferedFramedTransport(thrift.NewTSocketFromConnTimeout(workerConn, 0), 100*time.Microsecond, 20)
+		c.Write(fakeArgsData(PROTOCOL_BINARY, "user", MESSAGE_TYPE_REGISTER, 0, protocolTestArgs...))
+		c.FlushBuffer(true)
+		for {
+			frame, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			typeId, method, _, _ := DecodeThriftTypIdSeqId(frame)
+			if typeId != MESSAGE_TYPE_HEART_BEAT {
+				received <- method
+			}
+			c.Write(frame)
+			c.FlushBuffer(true)
+		}
+	}()
+	mux.register(thrift.NewTSocketFromConnTimeout(lbConn, 0), "lb.sock")
+	assert.Equal(t, 1, mux.Service("user").Active())
+	assert.Equal(t, 0, mux.Service("typo").Active())
+
+	// 1. 按照service前缀分发, Worker收到的请求不带前缀
+	r, err := NewRequest(fakeArgsData(PROTOCOL_BINARY, "user:get_user", thrift.CALL, 7, protocolTestArgs...), false)
+	assert.NoError(t, err)
+	assert.NoError(t, mux.Dispatch(r))
+	assert.Equal(t, "get_user", <-received)
+	assert.NoError(t, r.Response.Err)
+	_, method, seqId, err := DecodeThriftTypIdSeqId(r.Response.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "get_user", method)
+	assert.Equal(t, int32(7), seqId)
+
+	// 2. 没有Worker的service, 不存在的service
+	r, _ = NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 8, protocolTestArgs...), false)
+	mux.Dispatch(r)
+	assert.True(t, r.Response.NotFound)
+
+	r, _ = NewRequest(fakeArgsData(PROTOCOL_BINARY, "analytics:get_user", thrift.CALL, 9, protocolTestArgs...), false)
+	mux.Dispatch(r)
+	assert.True(t, r.Response.NotFound)
+
+	// 3. 没有声明服务的Worker
+	lbConn, workerConn = net.Pipe()
+	go func() {
+		workerConn.Write(newFrame(fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.CALL, 1, protocolTestArgs...)))
+	}()
+	mux.register(thrift.NewTSocketFromConnTimeout(lbConn, 0), "lb.sock")
+	assert.Equal(t, 0, mux.Service("typo").Active())
+	assert.Equal(t, 1, mux.Service("user").Active())
+}
+
+//
+// go test proxy -v -run "TestBackendConnMultiplexed"
+//
+func TestBackendConnMultiplexed(t *testing.T) {
+	transport, _ := thrift.NewTServerSocket("127.0.0.1:0")
+	assert.NoError(t, transport.Open())
+	defer transport.Close()
+	assert.NoError(t, transport.Listen())
+
+	// 服务多个service的rpc_lb: 收到的请求带有service前缀, 返回的结果不带前缀
+	received := make(chan string, 1)
+	go func() {
+		trans, err := transport.Accept()
+		if err != nil {
+			return
+		}
+		defer trans.Close()
+		c := NewTBufferedFramedTransport(trans, 100*time.Microsecond, 20)
+		for {
+			frame, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			typeId, method, seqId, _ := DecodeThriftTypIdSeqId(frame)
+			if typeId == MESSAGE_TYPE_HEART_BEAT {
+				c.Write(frame)
+			} else {
+				received <- method
+				c.Write(fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.REPLY, seqId, protocolTestArgs...))
+			}
+			c.FlushBuffer(true)
+		}
+	}()
+
+	bc := NewBackendConn(transport.Addr().String(), DEFAULT_ENDPOINT_WEIGHT, nil, "typo", nil, nil, false, false)
+	bc.SetMultiplexed(true)
+	defer bc.MarkOffline()
+	for i := 0; i < 100 && !bc.IsConnActive.Get(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, bc.IsConnActive.Get())
+
+	r, _ := NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, protocolTestArgs...), true)
+	assert.NoError(t, bc.PushBack(r))
+	r.Wait.Wait()
+
+	assert.Equal(t, "typo:get_user", <-received)
+	assert.NoError(t, r.Response.Err)
+	typeId, method, seqId, err := DecodeThriftTypIdSeqId(r.Response.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.REPLY, typeId)
+	assert.Equal(t, "get_user", method)
+	assert.Equal(t, int32(7), seqId)
+}
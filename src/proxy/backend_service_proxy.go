@@ -3,9 +3,11 @@
 package proxy
 
 import (
+	"encoding/json"
 	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,14 +19,32 @@ import (
 type BackService struct {
 	productName string
 	serviceName string
-	topo        *Topology
+	topo        Registry
 
-	// 同时保护: activeConns 和 currentConnIndex
-	activeConnsLock  sync.Mutex
-	activeConns      []*BackendConn // 每一个BackendConn应该有一定的高可用保障
-	currentConnIndex int
+	// 同时保护: activeConns 和 balancer
+	activeConnsLock sync.Mutex
+	activeConns     []*BackendConn // 每一个BackendConn应该有一定的高可用保障
+	balancer        Balancer
 
-	// 用于zk的状态管理(记录当前有效的Conn)
+	// 请求失败之后的重试
+	retry       *RetryPolicy
+	retryBudget *RetryBudget
+
+	// BackendConn的熔断配置
+	breakerConfig *CircuitBreakerConfig
+
+	// BackendConn的请求队列, 以及队列满了之后的处理
+	queue *BackendQueueConfig
+
+	// 异常节点检测, ejectedConns只由detectOutliers访问
+	outlierConfig *OutlierConfig
+	ejectedConns  []*BackendConn
+
+	// 后端是否支持THeader transport
+	theader bool
+
+	// 用于zk的状态管理(记录当前有效的Conn), 只由WatchBackServiceNodes修改
+	addr2ConnLock   sync.RWMutex
 	addr2Conn       map[string]*BackendConn
 	verbose         bool
 	stop            atomic2.Bool
@@ -33,19 +53,32 @@ type BackService struct {
 }
 
 // 创建一个BackService
-func NewBackService(productName string, serviceName string, topo *Topology, verbose bool) *BackService {
+func NewBackService(productName string, serviceName string, topo Registry,
+	balancer Balancer, retry *RetryPolicy, breakerConfig *CircuitBreakerConfig,
+	outlierConfig *OutlierConfig, queue *BackendQueueConfig, theader bool, verbose bool) *BackService {
 
 	service := &BackService{
-		productName: productName,
-		serviceName: serviceName,
-		activeConns: make([]*BackendConn, 0, 10),
-		addr2Conn:   make(map[string]*BackendConn),
-		topo:        topo,
-		verbose:     verbose,
+		productName:   productName,
+		serviceName:   serviceName,
+		activeConns:   make([]*BackendConn, 0, 10),
+		balancer:      balancer,
+		retry:         retry,
+		retryBudget:   NewRetryBudget(retry.BudgetRatio),
+		breakerConfig: breakerConfig,
+		outlierConfig: outlierConfig,
+		queue:         queue,
+		theader:       theader,
+		addr2Conn:     make(map[string]*BackendConn),
+		topo:          topo,
+		verbose:       verbose,
 	}
 
 	service.WatchBackServiceNodes()
 
+	if outlierConfig.Enabled {
+		go service.runOutlierDetector()
+	}
+
 	go func() {
 		for !service.stop.Get() {
 			log.Printf(Blue("[Report]: %s --> %d backservice, coroutine: %d"),
@@ -62,7 +95,10 @@ func (s *BackService) Stop() {
 	// 标志停止
 	s.stop.Set(true)
 	// 触发一个事件（之后ServiceNodes也不再监控)
-	s.evtbus <- true
+	select {
+	case s.evtbus <- true:
+	default:
+	}
 	go func() {
 		// TODO:
 		for true {
@@ -83,51 +119,113 @@ func (s *BackService) Stop() {
 }
 
 func (s *BackService) Active() int {
+	s.activeConnsLock.Lock()
+	defer s.activeConnsLock.Unlock()
 	return len(s.activeConns)
 }
 
+//
+// 当前所有的BackendConn(按照addr排序), 包括不可用的
+//
+func (s *BackService) Conns() []*BackendConn {
+	s.addr2ConnLock.RLock()
+	defer s.addr2ConnLock.RUnlock()
+
+	addrs := make([]string, 0, len(s.addr2Conn))
+	for addr := range s.addr2Conn {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	conns := make([]*BackendConn, 0, len(addrs))
+	for _, addr := range addrs {
+		conns = append(conns, s.addr2Conn[addr])
+	}
+	return conns
+}
+
+// 用于admin api
+func (s *BackService) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["service"] = s.serviceName
+	m["active"] = s.Active()
+	m["stopped"] = s.stop.Get()
+	m["last_request_time"] = s.lastRequestTime.Get()
+	m["conns"] = s.Conns()
+	return json.Marshal(m)
+}
+
 //
 // 如何处理后端服务的变化呢?
+// 1. 监听Endpoints列表: 上线/下线BackendConn
+// 2. 监听每一个Endpoint的数据: 动态调整BackendConn的权重(不需要重连)
+// Watch都是一次性的，只有在对应的事件触发之后才重新Watch, 避免重复注册
+// 任何一个Watch触发之后, 重新读取所有的Endpoints(多个事件合并成为一次读取)
 //
 func (s *BackService) WatchBackServiceNodes() {
-	s.evtbus = make(chan interface{}, 2)
-	servicePath := s.topo.ProductServicePath(s.serviceName)
+	watches := newRegistryWatches()
+	s.evtbus = watches.notify
 
 	go func() {
 		for !s.stop.Get() {
-			serviceIds, err := s.topo.WatchChildren(servicePath, s.evtbus)
+			var serviceIds []string
+			var err error
+			if evtbus, cancel := watches.arm(productServicePath(s.productName, s.serviceName)); evtbus != nil {
+				if serviceIds, err = s.topo.WatchServiceEndpoints(s.serviceName, evtbus); err != nil {
+					cancel()
+				}
+			} else {
+				serviceIds, err = s.topo.ListServiceEndpoints(s.serviceName)
+			}
 
 			if err == nil {
-				// 如何监听endpoints的变化呢?
-				addressMap := make(map[string]bool, len(serviceIds))
+				// addr --> weight
+				addressMap := make(map[string]int, len(serviceIds))
+				multiplexed := make(map[string]bool, len(serviceIds))
 
 				for _, serviceId := range serviceIds {
 					log.Printf(Green("---->Find Endpoint: %s for Service: %s"), serviceId, s.serviceName)
-					endpointInfo, err := GetServiceEndpoint(s.topo, s.serviceName, serviceId)
+
+					var endpointInfo *ServiceEndpoint
+					path := productServiceEndPointPath(s.productName, s.serviceName, serviceId)
+					if evtbus, cancel := watches.arm(path); evtbus != nil {
+						if endpointInfo, err = s.topo.WatchServiceEndpoint(s.serviceName, serviceId, evtbus); err != nil {
+							cancel()
+						}
+					} else {
+						endpointInfo, err = GetServiceEndpoint(s.topo, s.serviceName, serviceId)
+					}
 
 					if err != nil {
 						log.ErrorErrorf(err, "Service Endpoint Read Error: %v\n", err)
 					} else {
 
-						log.Printf(Green("---->Add endpoint %s To Service %s"),
-							endpointInfo.Frontend, s.serviceName)
+						weight := endpointInfo.GetWeight()
+						log.Printf(Green("---->Add endpoint %s To Service %s, weight: %d"),
+							endpointInfo.Frontend, s.serviceName, weight)
 
 						if strings.Contains(endpointInfo.Frontend, ":") {
-							addressMap[endpointInfo.Frontend] = true
+							addressMap[endpointInfo.Frontend] = weight
 						} else if s.productName == TEST_PRODUCT_NAME {
 							// unix domain socket只在测试的时候可以使用(因为不能实现跨机器访问）
-							addressMap[endpointInfo.Frontend] = true
+							addressMap[endpointInfo.Frontend] = weight
 						}
+						multiplexed[endpointInfo.Frontend] = endpointInfo.Multiplexed
 					}
 				}
 
-				for addr, _ := range addressMap {
+				s.addr2ConnLock.Lock()
+				for addr, weight := range addressMap {
 					conn, ok := s.addr2Conn[addr]
 					if ok && !conn.IsMarkOffline.Get() {
+						// 权重的调整直接生效
+						conn.SetWeight(weight)
+						conn.SetMultiplexed(multiplexed[addr])
 						continue
 					} else {
 						// 创建新的连接（心跳成功之后就自动加入到 s.activeConns 中
-						s.addr2Conn[addr] = NewBackendConn(addr, s, s.serviceName, s.verbose)
+						conn = NewBackendConn(addr, weight, s, s.serviceName, s.breakerConfig, s.queue, s.theader, s.verbose)
+						conn.SetMultiplexed(multiplexed[addr])
+						s.addr2Conn[addr] = conn
 					}
 				}
 
@@ -140,11 +238,12 @@ func (s *BackService) WatchBackServiceNodes() {
 						delete(s.addr2Conn, addr)
 					}
 				}
+				s.addr2ConnLock.Unlock()
 
 				// 等待事件
 				<-s.evtbus
 			} else {
-				log.WarnErrorf(err, "zk read failed: %s", servicePath)
+				log.WarnErrorf(err, "registry read failed: %s", s.serviceName)
 				// 如果读取失败则，则继续等待5s
 				time.Sleep(time.Duration(5) * time.Second)
 			}
@@ -153,21 +252,28 @@ func (s *BackService) WatchBackServiceNodes() {
 	}()
 }
 
-// 获取下一个active状态的BackendConn
-func (s *BackService) NextBackendConn() *BackendConn {
+// 获取下一个active状态的BackendConn, 尽量避开except(重试时为上一次失败的BackendConn)
+func (s *BackService) NextBackendConn(req *Request, except *BackendConn) *BackendConn {
 	var backSocket *BackendConn
 
 	s.activeConnsLock.Lock()
 	defer s.activeConnsLock.Unlock()
 
-	if len(s.activeConns) == 0 {
-		backSocket = nil
-	} else {
-		if s.currentConnIndex >= len(s.activeConns) {
-			s.currentConnIndex = 0
+	index := nextBalancerIndex(s.balancer, backendConns(s.activeConns), req)
+	if index == INVALID_ARRAY_INDEX {
+		return nil
+	}
+	if s.activeConns[index] == except && len(s.activeConns) > 1 {
+		index = (index + 1) % len(s.activeConns)
+	}
+
+	// half open状态的BackendConn只接受有限的试探请求, 超出之后分配给其他的BackendConn
+	for i := 0; i < len(s.activeConns); i++ {
+		conn := s.activeConns[(index+i)%len(s.activeConns)]
+		if conn.breaker.Allow() {
+			backSocket = conn
+			break
 		}
-		backSocket = s.activeConns[s.currentConnIndex]
-		s.currentConnIndex++
 	}
 
 	return backSocket
@@ -177,10 +283,15 @@ func (s *BackService) NextBackendConn() *BackendConn {
 // 将消息发送到Backend上去
 //
 func (s *BackService) HandleRequest(req *Request) (err error) {
-	// 并发度可能很高
-	backendConn := s.NextBackendConn()
-
 	s.lastRequestTime.Set(time.Now().Unix())
+	s.retryBudget.Deposit()
+	s.dispatch(req, nil)
+	return nil
+}
+
+func (s *BackService) dispatch(req *Request, except *BackendConn) {
+	// 并发度可能很高
+	backendConn := s.NextBackendConn(req, except)
 
 	if backendConn == nil {
 		// 没有后端服务
@@ -191,17 +302,82 @@ func (s *BackService) HandleRequest(req *Request) (err error) {
 		errMsg := GetWorkerNotFoundData(req, "BackService")
 		req.Response.Data = errMsg
 		// XXX: 没有等待，req.Wait.Wait() 直接返回
-
-		return nil
 	} else {
 		if s.verbose {
 			log.Println("SendMessage With: ", backendConn.Addr(), "For Service: ", s.serviceName)
 		}
-		backendConn.PushBack(req)
-		return nil
+		req.Attempts++
+		if err := backendConn.PushBack(req); IsOverloadedError(err) {
+			s.overflow(req, backendConn)
+		} else if err != nil {
+			// 请求没有被接受, 由Retry负责Done
+			req.Wait.Add(1)
+			if !s.Retry(backendConn, req, err, false) {
+				req.Wait.Done()
+			}
+		}
 	}
 }
 
+//
+// backendConn的队列满了: overflow为retry时立即分配给另外一个BackendConn(不经过backoff和retry budget),
+// 否则直接返回Overloaded Exception(wait已经在PushBack中等待过了)
+//
+func (s *BackService) overflow(req *Request, backendConn *BackendConn) {
+	if s.queue.GetOverflow() != BACKEND_QUEUE_OVERFLOW_RETRY {
+		return
+	}
+	other := s.NextBackendConn(req, backendConn)
+	if other == nil || other == backendConn {
+		return
+	}
+
+	err := req.Response.Err
+	req.Response.Err = nil
+	req.Attempts++
+	if other.PushBack(req) != nil {
+		// 两个BackendConn都没有接受, 返回第一个错误
+		req.Response.Err = err
+	}
+}
+
+//
+// 请求在backendConn上失败之后, 是否重新分配给其他的BackendConn
+// 返回true时, 请求在backoff之后重新分配, 并且由Retry负责调用: req.Wait.Done()
+//
+func (s *BackService) Retry(backendConn *BackendConn, req *Request, err error, written bool) bool {
+	if req.Request.TypeId == MESSAGE_TYPE_HEART_BEAT || s.stop.Get() {
+		return false
+	}
+	if req.Attempts >= s.retry.GetMaxAttempts(req.Service, req.Request.Name) {
+		return false
+	}
+	if written && !s.retry.IsIdempotent(req.Service, req.Request.Name) {
+		return false
+	}
+
+	backoff := s.retry.GetBackoff(req.Attempts)
+	if req.IsExpired(microseconds() + int64(backoff/time.Microsecond)) {
+		return false
+	}
+	if !s.retryBudget.TryWithdraw() {
+		log.Warnf("[%s]Retry budget exhausted, %s.%s", s.serviceName, req.Service, req.Request.Name)
+		return false
+	}
+
+	if s.verbose {
+		log.Printf(Magenta("[%s]Retry %s.%s after %v, attempts: %d, error: %v"), s.serviceName,
+			req.Service, req.Request.Name, backoff, req.Attempts, err)
+	}
+
+	time.AfterFunc(backoff, func() {
+		req.ResetForRetry()
+		s.dispatch(req, backendConn)
+		req.Wait.Done()
+	})
+	return true
+}
+
 func (s *BackService) StateChanged(conn *BackendConn) {
 	//	log.Printf(Cyan("[%s]StateChanged: %s, Index: %d, Count: %d, IsConnActive: %t"),
 	//		s.serviceName, conn.addr, conn.Index, len(s.activeConns),
@@ -210,7 +386,7 @@ func (s *BackService) StateChanged(conn *BackendConn) {
 	s.activeConnsLock.Lock()
 	defer s.activeConnsLock.Unlock()
 
-	if conn.IsConnActive.Get() {
+	if conn.IsAvailable() {
 		// 上线: BackendConn
 		log.Printf(Cyan("[%s]MarkConnActiveOK: %s, Index: %d, Count: %d"),
 			s.serviceName, conn.addr, conn.Index, len(s.activeConns))
@@ -248,3 +424,14 @@ func (s *BackService) StateChanged(conn *BackendConn) {
 			s.serviceName, conn.Addr(), connIndex)
 	}
 }
+
+// 将activeConns包装成为BalancerConns
+type backendConns []*BackendConn
+
+func (c backendConns) Len() int {
+	return len(c)
+}
+
+func (c backendConns) Get(i int) BalancerConn {
+	return c[i]
+}
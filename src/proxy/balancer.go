@@ -0,0 +1,267 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+const (
+	BALANCER_ROUND_ROBIN       = "round_robin"
+	BALANCER_RANDOM            = "random"
+	BALANCER_LEAST_OUTSTANDING = "least_outstanding"
+	BALANCER_P2C_PEAK_EWMA     = "p2c_ewma"
+
+	PEAK_EWMA_DECAY_MICRO   = 10 * 1000000 // 10s, 历史的latency的影响按照指数衰减
+	PEAK_EWMA_PENALTY_MICRO = 1000000      // 新的连接还没有latency数据, 但是有请求在处理中时，按照1s来估计
+)
+
+//
+// 负载均衡中的一个节点: BackendConn, BackendConnLB
+//
+type BalancerConn interface {
+	// 已经分配给当前连接，但是还没有返回的请求数
+	Outstanding() int
+	// 请求的latency(peak ewma)
+	Latency() *PeakEwma
+	// 权重(用于round robin, 一致性hash)
+	Weight() int
+	// 地址(用于一致性hash)
+	Addr() string
+}
+
+type BalancerConns interface {
+	Len() int
+	Get(i int) BalancerConn
+}
+
+//
+// 负载均衡策略: 从conns中选择一个，返回它的下标
+// Balancer的状态由调用方来保护(例如: BackService.activeConnsLock), Balancer自身不加锁
+//
+type Balancer interface {
+	Next(conns BalancerConns) int
+}
+
+func NewBalancer(policy string) (Balancer, error) {
+	return NewBalancerWithHashKey(policy, HASH_KEY_ARG)
+}
+
+//
+// hashKey只用于一致性hash(ring_hash, maglev), 参考: NewHashKeySource
+//
+func NewBalancerWithHashKey(policy string, hashKey string) (Balancer, error) {
+	switch policy {
+	case "", BALANCER_ROUND_ROBIN:
+		return newRoundRobinBalancer(), nil
+	case BALANCER_RANDOM:
+		return &randomBalancer{}, nil
+	case BALANCER_LEAST_OUTSTANDING:
+		return &leastOutstandingBalancer{}, nil
+	case BALANCER_P2C_PEAK_EWMA:
+		return &p2cPeakEwmaBalancer{}, nil
+	case BALANCER_RING_HASH, BALANCER_MAGLEV:
+		keySource, err := NewHashKeySource(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return newConsistentHashBalancer(policy, keySource), nil
+	default:
+		return nil, fmt.Errorf("unknown balancer: %s", policy)
+	}
+}
+
+//
+// 负载均衡策略的配置: 默认的策略 + 按照服务覆盖
+//
+type BalancerPolicies struct {
+	Default  string
+	Services map[string]string
+
+	// 一致性hash的Key: 默认的Key + 按照服务覆盖
+	HashKey  string
+	HashKeys map[string]string
+}
+
+func (p *BalancerPolicies) Get(service string) string {
+	if policy, ok := p.Services[service]; ok {
+		return policy
+	}
+	return p.Default
+}
+
+func (p *BalancerPolicies) GetHashKey(service string) string {
+	if hashKey, ok := p.HashKeys[service]; ok {
+		return hashKey
+	}
+	return p.HashKey
+}
+
+//
+// 服务对应的Balancer(配置在加载时已经检查过, 这里不会出错)
+//
+func (p *BalancerPolicies) NewBalancer(service string) Balancer {
+	balancer, err := NewBalancerWithHashKey(p.Get(service), p.GetHashKey(service))
+	if err != nil {
+		balancer = newRoundRobinBalancer()
+	}
+	return balancer
+}
+
+//
+// 平滑的加权轮询(参考: nginx smooth weighted round robin)
+// 例如: 权重为{5, 1, 1}时, 选择的顺序为: a, a, b, a, c, a, a; 权重相同时退化为普通的轮询
+//
+type roundRobinBalancer struct {
+	currentWeights map[BalancerConn]int
+}
+
+func newRoundRobinBalancer() *roundRobinBalancer {
+	return &roundRobinBalancer{
+		currentWeights: make(map[BalancerConn]int),
+	}
+}
+
+func (b *roundRobinBalancer) Next(conns BalancerConns) int {
+	n := conns.Len()
+	if n == 0 {
+		return INVALID_ARRAY_INDEX
+	}
+
+	best, bestWeight, totalWeight := INVALID_ARRAY_INDEX, 0, 0
+	for i := 0; i < n; i++ {
+		conn := conns.Get(i)
+		weight := conn.Weight()
+		if weight <= 0 {
+			weight = DEFAULT_ENDPOINT_WEIGHT
+		}
+		totalWeight += weight
+
+		currentWeight := b.currentWeights[conn] + weight
+		b.currentWeights[conn] = currentWeight
+		if best == INVALID_ARRAY_INDEX || currentWeight > bestWeight {
+			best, bestWeight = i, currentWeight
+		}
+	}
+	b.currentWeights[conns.Get(best)] = bestWeight - totalWeight
+
+	// 清理已经下线的连接
+	if len(b.currentWeights) > n {
+		currentWeights := make(map[BalancerConn]int, n)
+		for i := 0; i < n; i++ {
+			conn := conns.Get(i)
+			currentWeights[conn] = b.currentWeights[conn]
+		}
+		b.currentWeights = currentWeights
+	}
+	return best
+}
+
+//
+// 随机
+//
+type randomBalancer struct {
+}
+
+func (b *randomBalancer) Next(conns BalancerConns) int {
+	n := conns.Len()
+	if n == 0 {
+		return INVALID_ARRAY_INDEX
+	}
+	return rand.Intn(n)
+}
+
+//
+// 选择未返回的请求最少的连接; 从随机的位置开始扫描, 避免请求都集中到前面的连接上
+//
+type leastOutstandingBalancer struct {
+}
+
+func (b *leastOutstandingBalancer) Next(conns BalancerConns) int {
+	n := conns.Len()
+	if n == 0 {
+		return INVALID_ARRAY_INDEX
+	}
+
+	start := rand.Intn(n)
+	best, bestOutstanding := INVALID_ARRAY_INDEX, math.MaxInt32
+	for i := 0; i < n; i++ {
+		index := (start + i) % n
+		if outstanding := conns.Get(index).Outstanding(); outstanding < bestOutstanding {
+			best, bestOutstanding = index, outstanding
+		}
+	}
+	return best
+}
+
+//
+// Power of two choices + peak ewma(参考: finagle, linkerd)
+// 随机选择两个连接，选择: latency * (outstanding + 1) 较小的那个
+//
+type p2cPeakEwmaBalancer struct {
+}
+
+func (b *p2cPeakEwmaBalancer) Next(conns BalancerConns) int {
+	n := conns.Len()
+	if n == 0 {
+		return INVALID_ARRAY_INDEX
+	} else if n == 1 {
+		return 0
+	}
+
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	if peakEwmaCost(conns.Get(j)) < peakEwmaCost(conns.Get(i)) {
+		return j
+	}
+	return i
+}
+
+func peakEwmaCost(conn BalancerConn) float64 {
+	outstanding := conn.Outstanding()
+	latency := conn.Latency().Get()
+	if latency == 0 && outstanding > 0 {
+		latency = PEAK_EWMA_PENALTY_MICRO
+	}
+	return latency * float64(outstanding+1)
+}
+
+//
+// Peak EWMA: 出现更大的latency时立即生效, 之后按照时间指数衰减
+//
+type PeakEwma struct {
+	lock  sync.Mutex
+	stamp int64   // 上次更新的时间, 单位: microseconds
+	value float64 // 单位: microseconds
+}
+
+func (e *PeakEwma) Observe(latency int64) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := microseconds()
+	rtt := float64(latency)
+	if rtt > e.value {
+		e.value = rtt
+	} else {
+		w := math.Exp(-float64(now-e.stamp) / PEAK_EWMA_DECAY_MICRO)
+		e.value = e.value*w + rtt*(1-w)
+	}
+	e.stamp = now
+}
+
+func (e *PeakEwma) Get() float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// 长时间没有请求时，latency逐渐衰减到0
+	now := microseconds()
+	w := math.Exp(-float64(now-e.stamp) / PEAK_EWMA_DECAY_MICRO)
+	return e.value * w
+}
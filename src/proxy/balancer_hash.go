@@ -0,0 +1,346 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"github.com/wfxiang08/go_thrift/thrift"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	BALANCER_RING_HASH = "ring_hash"
+	BALANCER_MAGLEV    = "maglev"
+
+	HASH_KEY_ARG           = "arg"     // 参数中第一个string/i64类型的field
+	HASH_KEY_FIELD_PREFIX  = "field:"  // 参数中指定id的field, 例如: field:2
+	HASH_KEY_HEADER_PREFIX = "header:" // THeader中指定的header, 例如: header:caller
+
+	RING_HASH_REPLICAS = 160   // 每个权重对应的虚拟节点数
+	MAGLEV_TABLE_SIZE  = 65537 // 必须为质数
+)
+
+//
+// 可以根据请求的内容来选择连接的Balancer(例如: 一致性hash)
+//
+type RequestBalancer interface {
+	Balancer
+	NextForRequest(conns BalancerConns, r *Request) int
+}
+
+//
+// BackService, BackServiceLB选择连接的统一入口
+//
+func nextBalancerIndex(balancer Balancer, conns BalancerConns, r *Request) int {
+	if rb, ok := balancer.(RequestBalancer); ok {
+		return rb.NextForRequest(conns, r)
+	}
+	return balancer.Next(conns)
+}
+
+//
+// Hash Key的来源: 从Request.Request.Data中解析出参数中的某一个field, 或者THeader中的header
+//
+type HashKeySource struct {
+	fieldId int16  // 0表示第一个string/i64类型的field
+	header  string // 不为空时使用Request.Headers中的header
+}
+
+func NewHashKeySource(source string) (*HashKeySource, error) {
+	source = strings.TrimSpace(source)
+	if source == "" || source == HASH_KEY_ARG {
+		return &HashKeySource{}, nil
+	}
+	if strings.HasPrefix(source, HASH_KEY_FIELD_PREFIX) {
+		fieldId, err := strconv.ParseInt(source[len(HASH_KEY_FIELD_PREFIX):], 10, 16)
+		if err == nil && fieldId > 0 {
+			return &HashKeySource{fieldId: int16(fieldId)}, nil
+		}
+	}
+	if strings.HasPrefix(source, HASH_KEY_HEADER_PREFIX) {
+		header := strings.TrimSpace(source[len(HASH_KEY_HEADER_PREFIX):])
+		if len(header) > 0 {
+			return &HashKeySource{header: header}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hash key: %s", source)
+}
+
+//
+// 读取Request的Hash Key
+//
+func (s *HashKeySource) ExtractRequest(r *Request) ([]byte, error) {
+	if len(s.header) == 0 {
+		return s.Extract(r.Request.Data)
+	}
+	if value, ok := r.Headers[s.header]; ok {
+		return []byte(value), nil
+	}
+	return nil, fmt.Errorf("header %s not found", s.header)
+}
+
+//
+// 从thrift message(TBinaryProtocol)中读取Hash Key, i64会转换成为十进制的字符串
+// 只读取数据，不修改data
+//
+func (s *HashKeySource) Extract(data []byte) ([]byte, error) {
+	transport := NewTMemoryBufferWithBuf(data)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+
+	if _, _, _, err := protocol.ReadMessageBegin(); err != nil {
+		return nil, err
+	}
+	if _, err := protocol.ReadStructBegin(); err != nil {
+		return nil, err
+	}
+
+	for {
+		_, fieldType, fieldId, err := protocol.ReadFieldBegin()
+		if err != nil {
+			return nil, err
+		}
+		if fieldType == thrift.STOP {
+			break
+		}
+
+		// trace的field由proxy插入, 不作为Hash Key
+		if fieldId != TRACE_FIELD_ID && (s.fieldId == 0 || s.fieldId == fieldId) {
+			switch fieldType {
+			case thrift.STRING:
+				return protocol.ReadBinary()
+			case thrift.I64:
+				v, err := protocol.ReadI64()
+				if err != nil {
+					return nil, err
+				}
+				return []byte(strconv.FormatInt(v, 10)), nil
+			}
+		}
+
+		if err := protocol.Skip(fieldType); err != nil {
+			return nil, err
+		}
+		if err := protocol.ReadFieldEnd(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.fieldId == 0 {
+		return nil, fmt.Errorf("no string/i64 field found")
+	}
+	return nil, fmt.Errorf("field %d not found", s.fieldId)
+}
+
+//
+// 一致性hash: 相同的Key总是路由到相同的连接; 连接增减时只有少部分的Key被重新分配
+// 解析不到Key的请求(例如: 心跳, 没有参数的方法)按照轮询处理
+//
+type consistentHashBalancer struct {
+	keySource *HashKeySource
+	newTable  func(nodes []hashNode) hashTable
+	fallback  Balancer
+
+	// 生成table时的连接, 连接或者权重变化时重新生成
+	conns   []BalancerConn
+	weights []int
+	table   hashTable
+}
+
+type hashNode struct {
+	addr   string
+	weight int
+	index  int // 在conns中的下标
+}
+
+type hashTable interface {
+	// 返回hash对应的节点在conns中的下标
+	Lookup(hash uint64) int
+}
+
+func newConsistentHashBalancer(policy string, keySource *HashKeySource) *consistentHashBalancer {
+	b := &consistentHashBalancer{
+		keySource: keySource,
+		fallback:  newRoundRobinBalancer(),
+	}
+	if policy == BALANCER_MAGLEV {
+		b.newTable = newMaglevTable
+	} else {
+		b.newTable = newHashRing
+	}
+	return b
+}
+
+func (b *consistentHashBalancer) Next(conns BalancerConns) int {
+	return b.fallback.Next(conns)
+}
+
+func (b *consistentHashBalancer) NextForRequest(conns BalancerConns, r *Request) int {
+	if conns.Len() == 0 || r == nil {
+		return b.Next(conns)
+	}
+
+	key, err := b.keySource.ExtractRequest(r)
+	if err != nil {
+		return b.Next(conns)
+	}
+
+	b.update(conns)
+	return b.table.Lookup(hash64(key))
+}
+
+func (b *consistentHashBalancer) update(conns BalancerConns) {
+	n := conns.Len()
+	changed := b.table == nil || len(b.conns) != n
+	for i := 0; !changed && i < n; i++ {
+		conn := conns.Get(i)
+		changed = b.conns[i] != conn || b.weights[i] != conn.Weight()
+	}
+	if !changed {
+		return
+	}
+
+	b.conns = make([]BalancerConn, n)
+	b.weights = make([]int, n)
+	nodes := make([]hashNode, n)
+	addrs := make(map[string]int, n)
+	for i := 0; i < n; i++ {
+		conn := conns.Get(i)
+		b.conns[i], b.weights[i] = conn, conn.Weight()
+
+		weight := conn.Weight()
+		if weight <= 0 {
+			weight = DEFAULT_ENDPOINT_WEIGHT
+		}
+
+		// 通过unix domain socket连接到rpc_lb的worker的addr都相同, 需要区分开
+		addr := conn.Addr()
+		if count := addrs[addr]; count > 0 {
+			addrs[addr] = count + 1
+			addr = fmt.Sprintf("%s#%d", addr, count)
+		} else {
+			addrs[addr] = 1
+		}
+		nodes[i] = hashNode{addr: addr, weight: weight, index: i}
+	}
+	// 节点的分布只和addr相关, 和activeConns中的顺序无关
+	sort.Sort(hashNodesByAddr(nodes))
+	b.table = b.newTable(nodes)
+}
+
+type hashNodesByAddr []hashNode
+
+func (s hashNodesByAddr) Len() int           { return len(s) }
+func (s hashNodesByAddr) Less(i, j int) bool { return s[i].addr < s[j].addr }
+func (s hashNodesByAddr) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//
+// Hash环(参考: ketama), 每个节点按照权重对应多个虚拟节点
+//
+type hashRing struct {
+	hashes  []uint64
+	indexes []int
+}
+
+func newHashRing(nodes []hashNode) hashTable {
+	points := make(ringPoints, 0, len(nodes)*RING_HASH_REPLICAS)
+	for _, node := range nodes {
+		for i := 0; i < node.weight*RING_HASH_REPLICAS; i++ {
+			hash := hash64([]byte(fmt.Sprintf("%s#%d", node.addr, i)))
+			points = append(points, ringPoint{hash: hash, index: node.index})
+		}
+	}
+	sort.Stable(points)
+
+	ring := &hashRing{
+		hashes:  make([]uint64, len(points)),
+		indexes: make([]int, len(points)),
+	}
+	for i, point := range points {
+		ring.hashes[i], ring.indexes[i] = point.hash, point.index
+	}
+	return ring
+}
+
+func (ring *hashRing) Lookup(hash uint64) int {
+	i := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= hash
+	})
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.indexes[i]
+}
+
+type ringPoint struct {
+	hash  uint64
+	index int
+}
+
+type ringPoints []ringPoint
+
+func (s ringPoints) Len() int           { return len(s) }
+func (s ringPoints) Less(i, j int) bool { return s[i].hash < s[j].hash }
+func (s ringPoints) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+//
+// Maglev(参考: Maglev: A Fast and Reliable Software Network Load Balancer)
+// 查找为O(1), 各节点分到的Key更加均匀; 每一轮中节点按照权重占用多个位置
+//
+type maglevTable struct {
+	entries []int
+}
+
+func newMaglevTable(nodes []hashNode) hashTable {
+	m := uint64(MAGLEV_TABLE_SIZE)
+	offsets := make([]uint64, len(nodes))
+	skips := make([]uint64, len(nodes))
+	nexts := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		offsets[i] = hash64([]byte(node.addr+"#offset")) % m
+		skips[i] = hash64([]byte(node.addr+"#skip"))%(m-1) + 1
+	}
+
+	entries := make([]int, m)
+	for i := range entries {
+		entries[i] = INVALID_ARRAY_INDEX
+	}
+
+	filled := uint64(0)
+	for filled < m {
+		for i, node := range nodes {
+			for w := 0; w < node.weight && filled < m; w++ {
+				c := (offsets[i] + nexts[i]*skips[i]) % m
+				for entries[c] != INVALID_ARRAY_INDEX {
+					nexts[i]++
+					c = (offsets[i] + nexts[i]*skips[i]) % m
+				}
+				entries[c] = node.index
+				nexts[i]++
+				filled++
+			}
+		}
+	}
+	return &maglevTable{entries: entries}
+}
+
+func (t *maglevTable) Lookup(hash uint64) int {
+	return t.entries[hash%uint64(len(t.entries))]
+}
+
+//
+// fnv64a + mix(splitmix64), 保证相似的字符串(例如: addr#1, addr#2)也能均匀分布
+//
+func hash64(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,128 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+	"testing"
+)
+
+func hashTestArgs(userName string, userId int64) []fakeField {
+	return []fakeField{
+		{"flag", thrift.I32, 1, int32(1)},
+		{"user_name", thrift.STRING, 2, userName},
+		{"user_id", thrift.I64, 3, userId},
+	}
+}
+
+//
+// go test proxy -v -run "TestHashKeySource"
+//
+func TestHashKeySource(t *testing.T) {
+	r, _ := NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 0, hashTestArgs("u1", 42)...), true)
+
+	source, err := NewHashKeySource(HASH_KEY_ARG)
+	assert.NoError(t, err)
+	key, err := source.Extract(r.Request.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "u1", string(key))
+
+	source, _ = NewHashKeySource("field:3")
+	key, err = source.Extract(r.Request.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, "42", string(key))
+
+	// field的类型不对, 或者不存在
+	for _, s := range []string{"field:1", "field:9"} {
+		source, _ = NewHashKeySource(s)
+		_, err = source.Extract(r.Request.Data)
+		assert.True(t, err != nil)
+	}
+
+	// 心跳中没有参数
+	source, _ = NewHashKeySource(HASH_KEY_ARG)
+	_, err = source.Extract(NewPingRequest().Request.Data)
+	assert.True(t, err != nil)
+
+	// 读取Key不影响Request
+	assert.Equal(t, "get_user", r.Request.Name)
+	assert.Equal(t, "typo", r.Service)
+
+	for _, s := range []string{"header", "field:", "field:0", "field:abc"} {
+		_, err = NewHashKeySource(s)
+		assert.True(t, err != nil)
+	}
+}
+
+//
+// go test proxy -v -run "TestConsistentHashBalancer"
+//
+func TestConsistentHashBalancer(t *testing.T) {
+	for _, policy := range []string{BALANCER_RING_HASH, BALANCER_MAGLEV} {
+		conns := make(fakeBalancerConns, 10)
+		for i := range conns {
+			conns[i] = &fakeBalancerConn{addr: fmt.Sprintf("10.0.0.%d:5555", i), weight: 1}
+		}
+
+		balancer, err := NewBalancer(policy)
+		assert.NoError(t, err)
+
+		requests := make([]*Request, 1000)
+		for i := range requests {
+			data := fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 0, hashTestArgs(fmt.Sprintf("user_%d", i), int64(i))...)
+			requests[i], _ = NewRequest(data, true)
+		}
+
+		// 1. 相同的Key总是路由到相同的连接, 而且分布比较均匀
+		assigned := make([]string, len(requests))
+		counts := make(map[string]int)
+		for i, r := range requests {
+			assigned[i] = conns[nextBalancerIndex(balancer, conns, r)].addr
+			assert.Equal(t, assigned[i], conns[nextBalancerIndex(balancer, conns, r)].addr)
+			counts[assigned[i]]++
+		}
+		assert.Equal(t, 10, len(counts))
+		for _, count := range counts {
+			assert.True(t, count > 30 && count < 200, "%s: %d", policy, count)
+		}
+
+		// 2. 连接的顺序变化不影响路由的结果
+		conns[0], conns[9] = conns[9], conns[0]
+		for i, r := range requests {
+			assert.Equal(t, assigned[i], conns[nextBalancerIndex(balancer, conns, r)].addr)
+		}
+
+		// 3. 删除一个连接, 只有该连接上的Key被重新分配(maglev允许少量的额外变化)
+		removed := conns[9].addr
+		conns = conns[0:9]
+		moved := 0
+		for i, r := range requests {
+			addr := conns[nextBalancerIndex(balancer, conns, r)].addr
+			assert.NotEqual(t, removed, addr)
+			if assigned[i] != removed && addr != assigned[i] {
+				moved++
+			}
+		}
+		assert.True(t, moved <= len(requests)/50, "%s: %d moved", policy, moved)
+
+		// 4. 没有Key的请求按照轮询处理
+		assert.Equal(t, 0, nextBalancerIndex(balancer, conns, NewPingRequest()))
+		assert.Equal(t, 1, nextBalancerIndex(balancer, conns, NewPingRequest()))
+	}
+
+	// 不支持的Key
+	_, err := NewBalancerWithHashKey(BALANCER_MAGLEV, "unknown")
+	assert.True(t, err != nil)
+
+	policies := &BalancerPolicies{
+		Default:  BALANCER_ROUND_ROBIN,
+		Services: map[string]string{"typo": BALANCER_MAGLEV},
+		HashKey:  HASH_KEY_ARG,
+		HashKeys: map[string]string{"typo": "field:3"},
+	}
+	balancer, ok := policies.NewBalancer("typo").(*consistentHashBalancer)
+	assert.True(t, ok)
+	assert.Equal(t, int16(3), balancer.keySource.fieldId)
+}
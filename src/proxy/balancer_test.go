@@ -0,0 +1,136 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type fakeBalancerConn struct {
+	outstanding int
+	latency     PeakEwma
+	weight      int
+	addr        string
+}
+
+func (c *fakeBalancerConn) Outstanding() int {
+	return c.outstanding
+}
+
+func (c *fakeBalancerConn) Latency() *PeakEwma {
+	return &c.latency
+}
+
+func (c *fakeBalancerConn) Weight() int {
+	return c.weight
+}
+
+func (c *fakeBalancerConn) Addr() string {
+	return c.addr
+}
+
+type fakeBalancerConns []*fakeBalancerConn
+
+func (c fakeBalancerConns) Len() int {
+	return len(c)
+}
+
+func (c fakeBalancerConns) Get(i int) BalancerConn {
+	return c[i]
+}
+
+//
+// go test proxy -v -run "TestBalancer"
+//
+func TestBalancer(t *testing.T) {
+	conns := fakeBalancerConns{{outstanding: 5}, {outstanding: 1}, {outstanding: 3}}
+
+	for _, policy := range []string{BALANCER_ROUND_ROBIN, BALANCER_RANDOM,
+		BALANCER_LEAST_OUTSTANDING, BALANCER_P2C_PEAK_EWMA} {
+		balancer, err := NewBalancer(policy)
+		assert.NoError(t, err)
+		assert.Equal(t, INVALID_ARRAY_INDEX, balancer.Next(fakeBalancerConns{}))
+		assert.Equal(t, 0, balancer.Next(conns[0:1]))
+
+		index := balancer.Next(conns)
+		assert.True(t, index >= 0 && index < len(conns))
+	}
+
+	_, err := NewBalancer("unknown")
+	assert.True(t, err != nil)
+
+	// 1. round robin
+	balancer, _ := NewBalancer(BALANCER_ROUND_ROBIN)
+	assert.Equal(t, 0, balancer.Next(conns))
+	assert.Equal(t, 1, balancer.Next(conns))
+	assert.Equal(t, 2, balancer.Next(conns))
+	assert.Equal(t, 0, balancer.Next(conns))
+
+	// 平滑的加权轮询
+	weighted := fakeBalancerConns{{weight: 5}, {weight: 1}, {weight: 1}}
+	balancer, _ = NewBalancer(BALANCER_ROUND_ROBIN)
+	picks := make([]int, 0, 7)
+	for i := 0; i < 7; i++ {
+		picks = append(picks, balancer.Next(weighted))
+	}
+	assert.Equal(t, []int{0, 0, 1, 0, 2, 0, 0}, picks)
+
+	// 动态调整权重
+	weighted[1].weight = 5
+	counts := make(map[int]int)
+	for i := 0; i < 110; i++ {
+		counts[balancer.Next(weighted)]++
+	}
+	assert.True(t, counts[1] >= 49 && counts[1] <= 51)
+	assert.True(t, counts[2] >= 9 && counts[2] <= 11)
+
+	// 2. least outstanding
+	balancer, _ = NewBalancer(BALANCER_LEAST_OUTSTANDING)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, balancer.Next(conns))
+	}
+
+	// 3. p2c: 只有两个连接时，总是选择cost较小的那个
+	slow := &fakeBalancerConn{outstanding: 1}
+	slow.latency.Observe(100000)
+	fast := &fakeBalancerConn{outstanding: 1}
+	fast.latency.Observe(1000)
+
+	balancer, _ = NewBalancer(BALANCER_P2C_PEAK_EWMA)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 1, balancer.Next(fakeBalancerConns{slow, fast}))
+	}
+}
+
+//
+// go test proxy -v -run "TestBalancerPolicies"
+//
+func TestBalancerPolicies(t *testing.T) {
+	policies := &BalancerPolicies{
+		Default:  BALANCER_ROUND_ROBIN,
+		Services: map[string]string{"typo": BALANCER_P2C_PEAK_EWMA},
+	}
+	assert.Equal(t, BALANCER_P2C_PEAK_EWMA, policies.Get("typo"))
+	assert.Equal(t, BALANCER_ROUND_ROBIN, policies.Get("account"))
+
+	_, ok := policies.NewBalancer("typo").(*p2cPeakEwmaBalancer)
+	assert.True(t, ok)
+}
+
+//
+// go test proxy -v -run "TestPeakEwma"
+//
+func TestPeakEwma(t *testing.T) {
+	var ewma PeakEwma
+	ewma.Observe(1000)
+	assert.True(t, ewma.Get() > 990)
+
+	// 更大的latency立即生效
+	ewma.Observe(50000)
+	assert.True(t, ewma.Get() > 49000)
+
+	// 较小的latency按照时间衰减, 短时间内变化不大
+	ewma.Observe(1000)
+	assert.True(t, ewma.Get() > 40000)
+}
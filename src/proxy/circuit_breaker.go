@@ -0,0 +1,255 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+type BreakerState int32
+
+const (
+	BREAKER_CLOSED    BreakerState = iota // 正常
+	BREAKER_OPEN                          // 熔断: 不再分配请求
+	BREAKER_HALF_OPEN                     // 试探: 只允许少量的请求, 根据结果决定关闭还是重新熔断
+)
+
+const (
+	BREAKER_WINDOW_BUCKETS          = 10
+	BREAKER_DEFAULT_WINDOW          = 10 * time.Second
+	BREAKER_DEFAULT_MIN_REQUESTS    = 20
+	BREAKER_DEFAULT_ERROR_RATE      = 0.5
+	BREAKER_DEFAULT_OPEN_TIMEOUT    = 5 * time.Second
+	BREAKER_DEFAULT_HALF_OPEN_PROBE = 3
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BREAKER_CLOSED:
+		return "closed"
+	case BREAKER_OPEN:
+		return "open"
+	case BREAKER_HALF_OPEN:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+//
+// 熔断的配置(只用于rpc_proxy)
+//
+type CircuitBreakerConfig struct {
+	Enabled     bool
+	Window      time.Duration // 统计错误率的时间窗口
+	MinRequests int           // 时间窗口内的请求数少于MinRequests时不熔断
+	ErrorRate   float64       // 错误(包括: 超时, 异常)的比例达到ErrorRate时熔断
+	OpenTimeout time.Duration // 熔断之后, 经过OpenTimeout进入half open状态
+	Probes      int           // half open状态下的试探请求数, 全部成功之后关闭
+}
+
+//
+// 每一个BackendConn对应一个CircuitBreaker
+// 状态的变化通过onStateChange通知BackendConn(不持有锁), 再由BackService#StateChanged调整activeConns
+//
+type CircuitBreaker struct {
+	name   string
+	config *CircuitBreakerConfig
+
+	// 用于快速判断, 和metrics
+	state  atomic2.Int64
+	opened atomic2.Int64 // 熔断的次数
+
+	lock     sync.Mutex
+	buckets  [BREAKER_WINDOW_BUCKETS]breakerBucket
+	openedAt int64 // microseconds
+	probes   int   // half open状态下已经分配的试探请求
+	passed   int   // half open状态下成功的试探请求
+
+	onStateChange func(from, to BreakerState)
+}
+
+type breakerBucket struct {
+	index    int64 // 时间窗口中的第几个bucket(按照绝对时间计算)
+	total    int
+	failures int
+}
+
+func NewCircuitBreaker(name string, config *CircuitBreakerConfig, onStateChange func(from, to BreakerState)) *CircuitBreaker {
+	b := &CircuitBreaker{
+		name:          name,
+		config:        config,
+		onStateChange: onStateChange,
+	}
+	registerBreaker(b)
+	return b
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	return BreakerState(b.state.Get())
+}
+
+//
+// 是否可以分配新的请求给当前的连接
+//
+func (b *CircuitBreaker) Allow() bool {
+	if !b.config.Enabled || b.State() == BREAKER_CLOSED {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.State() == BREAKER_HALF_OPEN && b.probes < b.config.Probes {
+		b.probes++
+		return true
+	}
+	return false
+}
+
+//
+// 熔断的时间超过OpenTimeout之后进入half open状态(由心跳定时调用)
+//
+func (b *CircuitBreaker) TryHalfOpen() {
+	if !b.config.Enabled || b.State() != BREAKER_OPEN {
+		return
+	}
+
+	b.lock.Lock()
+	if b.State() != BREAKER_OPEN ||
+		microseconds()-b.openedAt < int64(b.config.OpenTimeout/time.Microsecond) {
+		b.lock.Unlock()
+		return
+	}
+	b.setState(BREAKER_HALF_OPEN)
+	b.lock.Unlock()
+
+	b.notify(BREAKER_OPEN, BREAKER_HALF_OPEN)
+}
+
+//
+// 记录请求的结果: 正常返回, 或者出错(超时, 异常, 连接断开)
+//
+func (b *CircuitBreaker) Record(success bool) {
+	if !b.config.Enabled {
+		return
+	}
+
+	b.lock.Lock()
+	from := b.State()
+	switch from {
+	case BREAKER_CLOSED:
+		total, failures := b.observe(success)
+		if total >= b.config.MinRequests && float64(failures) >= float64(total)*b.config.ErrorRate {
+			b.open()
+		}
+	case BREAKER_HALF_OPEN:
+		if !success {
+			b.open()
+		} else if b.passed++; b.passed >= b.config.Probes {
+			b.reset()
+			b.setState(BREAKER_CLOSED)
+		}
+	}
+	to := b.State()
+	b.lock.Unlock()
+
+	if from != to {
+		b.notify(from, to)
+	}
+}
+
+// 将结果计入当前的bucket, 返回时间窗口内的总数和错误数
+func (b *CircuitBreaker) observe(success bool) (total int, failures int) {
+	width := int64(b.config.Window/time.Microsecond) / BREAKER_WINDOW_BUCKETS
+	if width <= 0 {
+		width = 1
+	}
+	index := microseconds() / width
+
+	bucket := &b.buckets[index%BREAKER_WINDOW_BUCKETS]
+	if bucket.index != index {
+		*bucket = breakerBucket{index: index}
+	}
+	bucket.total++
+	if !success {
+		bucket.failures++
+	}
+
+	for i := range b.buckets {
+		if index-b.buckets[i].index < BREAKER_WINDOW_BUCKETS {
+			total += b.buckets[i].total
+			failures += b.buckets[i].failures
+		}
+	}
+	return total, failures
+}
+
+func (b *CircuitBreaker) open() {
+	b.openedAt = microseconds()
+	b.opened.Incr()
+	b.setState(BREAKER_OPEN)
+}
+
+func (b *CircuitBreaker) reset() {
+	b.buckets = [BREAKER_WINDOW_BUCKETS]breakerBucket{}
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.probes, b.passed = 0, 0
+	b.state.Set(int64(state))
+}
+
+func (b *CircuitBreaker) notify(from, to BreakerState) {
+	log.Printf(Magenta("[%s]CircuitBreaker: %s --> %s"), b.name, from, to)
+	if b.onStateChange != nil {
+		b.onStateChange(from, to)
+	}
+}
+
+func (b *CircuitBreaker) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["name"] = b.name
+	m["state"] = b.State().String()
+	m["opened"] = b.opened.Get()
+	return json.Marshal(m)
+}
+
+//
+// 所有的CircuitBreaker, 用于metrics
+//
+var breakers struct {
+	lock sync.RWMutex
+	all  map[*CircuitBreaker]bool
+}
+
+func init() {
+	breakers.all = make(map[*CircuitBreaker]bool)
+}
+
+func registerBreaker(b *CircuitBreaker) {
+	breakers.lock.Lock()
+	breakers.all[b] = true
+	breakers.lock.Unlock()
+}
+
+func unregisterBreaker(b *CircuitBreaker) {
+	breakers.lock.Lock()
+	delete(breakers.all, b)
+	breakers.lock.Unlock()
+}
+
+func GetAllCircuitBreakers() []*CircuitBreaker {
+	breakers.lock.RLock()
+	all := make([]*CircuitBreaker, 0, len(breakers.all))
+	for b := range breakers.all {
+		all = append(all, b)
+	}
+	breakers.lock.RUnlock()
+	return all
+}
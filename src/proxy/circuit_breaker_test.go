@@ -0,0 +1,126 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestBreakerConfig() *CircuitBreakerConfig {
+	return &CircuitBreakerConfig{
+		Enabled:     true,
+		Window:      10 * time.Second,
+		MinRequests: 4,
+		ErrorRate:   0.5,
+		OpenTimeout: 20 * time.Millisecond,
+		Probes:      2,
+	}
+}
+
+//
+// go test proxy -v -run "TestCircuitBreaker"
+//
+func TestCircuitBreaker(t *testing.T) {
+	transitions := make([]BreakerState, 0)
+	b := NewCircuitBreaker("test", newTestBreakerConfig(), func(from, to BreakerState) {
+		transitions = append(transitions, to)
+	})
+	defer unregisterBreaker(b)
+
+	// 1. 请求数太少时不熔断
+	b.Record(false)
+	b.Record(false)
+	b.Record(true)
+	assert.Equal(t, BREAKER_CLOSED, b.State())
+	assert.True(t, b.Allow())
+
+	// 2. 错误率达到50%, 熔断
+	b.Record(false)
+	assert.Equal(t, BREAKER_OPEN, b.State())
+	assert.False(t, b.Allow())
+
+	// 3. 经过OpenTimeout之后进入half open
+	b.TryHalfOpen()
+	assert.Equal(t, BREAKER_OPEN, b.State())
+	time.Sleep(30 * time.Millisecond)
+	b.TryHalfOpen()
+	assert.Equal(t, BREAKER_HALF_OPEN, b.State())
+
+	// 只允许有限的试探请求
+	assert.True(t, b.Allow())
+	assert.True(t, b.Allow())
+	assert.False(t, b.Allow())
+
+	// 4. 试探失败, 重新熔断
+	b.Record(false)
+	assert.Equal(t, BREAKER_OPEN, b.State())
+
+	// 5. 试探全部成功, 恢复正常; 之前的统计数据被清除
+	time.Sleep(30 * time.Millisecond)
+	b.TryHalfOpen()
+	b.Record(true)
+	assert.Equal(t, BREAKER_HALF_OPEN, b.State())
+	b.Record(true)
+	assert.Equal(t, BREAKER_CLOSED, b.State())
+	b.Record(false)
+	assert.Equal(t, BREAKER_CLOSED, b.State())
+
+	assert.Equal(t, []BreakerState{BREAKER_OPEN, BREAKER_HALF_OPEN, BREAKER_OPEN, BREAKER_HALF_OPEN, BREAKER_CLOSED}, transitions)
+	assert.Equal(t, int64(2), b.opened.Get())
+
+	// 没有打开熔断
+	disabled := NewCircuitBreaker("disabled", &CircuitBreakerConfig{}, nil)
+	defer unregisterBreaker(disabled)
+	for i := 0; i < 100; i++ {
+		disabled.Record(false)
+	}
+	assert.True(t, disabled.Allow())
+	assert.Equal(t, BREAKER_CLOSED, disabled.State())
+}
+
+//
+// go test proxy -v -run "TestBackServiceBreaker"
+//
+func TestBackServiceBreaker(t *testing.T) {
+	s := &BackService{
+		serviceName: "typo",
+		activeConns: make([]*BackendConn, 0, 10),
+		balancer:    newRoundRobinBalancer(),
+	}
+
+	bc := &BackendConn{addr: "127.0.0.1:5555", service: "typo", Index: INVALID_ARRAY_INDEX, delegate: s}
+	bc.breaker = NewCircuitBreaker("typo@127.0.0.1:5555", newTestBreakerConfig(), bc.breakerStateChanged)
+	defer unregisterBreaker(bc.breaker)
+
+	bc.IsConnActive.Set(true)
+	s.StateChanged(bc)
+	assert.Equal(t, 1, s.Active())
+
+	// 熔断之后从activeConns中删除
+	for i := 0; i < 4; i++ {
+		bc.breaker.Record(false)
+	}
+	assert.Equal(t, 0, s.Active())
+	assert.Nil(t, s.NextBackendConn(nil, nil))
+
+	// half open: 重新加入activeConns, 但是只接受试探请求
+	time.Sleep(30 * time.Millisecond)
+	bc.breaker.TryHalfOpen()
+	assert.Equal(t, 1, s.Active())
+	assert.Equal(t, bc, s.NextBackendConn(nil, nil))
+	assert.Equal(t, bc, s.NextBackendConn(nil, nil))
+	assert.Nil(t, s.NextBackendConn(nil, nil))
+
+	// 熔断的状态可以通过metrics查看
+	found := false
+	for _, b := range GetAllCircuitBreakers() {
+		if b == bc.breaker {
+			found = true
+			data, _ := b.MarshalJSON()
+			assert.Contains(t, string(data), `"state":"half_open"`)
+		}
+	}
+	assert.True(t, found)
+}
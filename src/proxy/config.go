@@ -9,18 +9,47 @@ import (
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ProductConfig struct {
 	ProductName      string
+	Registry         string // 服务注册方式: zk(默认), etcd, memory, file
 	ZkAddr           string
 	ZkSessionTimeout int
+	EtcdAddr         string
+	ServicesFile     string // registry=file时, 服务列表对应的文件
+
+	// 请求的超时时间
+	RpcTimeout      time.Duration
+	RpcTimeouts     map[string]time.Duration // service/service.method --> timeout
+	RpcTimeoutsInZk bool                     // 是否从zk读取超时配置
+
+	// 负载均衡策略
+	Balancers BalancerPolicies
+
+	// 监控数据的输出
+	Metrics MetricsConfig
+
+	// 分布式追踪
+	Trace TraceConfig
+
+	// 每个请求一行的access log
+	AccessLog AccessLogConfig
+
+	// 支持THeader transport的后端
+	THeaderBackends THeaderBackends
+
+	// BackendConn(BackendConnLB)的请求队列
+	BackendQueue BackendQueueConfig
 }
 type ServiceConfig struct {
 	ProductConfig
 	StandAlone     bool
 	Service        string
+	Services       []string // 服务多个service的rpc_lb(参考: BackServiceLBMux), 此时忽略Service
 	FrontHost      string
 	FrontPort      string
 	FrontSock      string
@@ -36,8 +65,12 @@ type ServiceConfig struct {
 	WorkDir        string
 	CodeUrlVersion string
 
-	// 用于监控
-	FalconClient   string
+	// 注册到Registry中的权重, rpc_proxy按照权重来分配请求
+	Weight         int
+
+	// NonBlockSession正在处理的请求数的上限, 到达上限之后暂停读取socket
+	MaxInflightPerSession int
+	MaxInflight           int // 所有Session共享, 0表示不限制
 }
 
 type ProxyConfig struct {
@@ -46,6 +79,17 @@ type ProxyConfig struct {
 	ProxyAddr string
 	Profile   bool
 	Verbose   bool
+
+	// 请求失败之后的重试策略
+	Retry RetryPolicy
+	// BackendConn的熔断
+	Breaker CircuitBreakerConfig
+	// 异常节点检测
+	Outlier OutlierConfig
+	// HTTP/JSON gateway
+	HttpGateway HttpGatewayConfig
+	// 按照service/method限流
+	RateLimit RateLimitConfig
 }
 
 //
@@ -71,6 +115,456 @@ func (conf *ServiceConfig) getFrontendAddr(frontHost, ipPrefix, frontPort string
 	return frontendAddr
 }
 
+//
+// 读取服务注册相关的配置:
+//     registry=zk|etcd|memory|file, 默认为zk
+//     zk=rd1:2181,rd2:2181
+//     etcd=rd1:2379,rd2:2379
+//     services_file=services.json
+//
+func (conf *ProductConfig) loadRegistryConf(c *cfg.Cfg, configFile string) {
+	conf.Registry, _ = c.ReadString("registry", REGISTRY_ZK)
+	conf.Registry = strings.TrimSpace(conf.Registry)
+
+	conf.ZkAddr, _ = c.ReadString("zk", "")
+	conf.ZkAddr = strings.TrimSpace(conf.ZkAddr)
+
+	conf.EtcdAddr, _ = c.ReadString("etcd", "")
+	conf.EtcdAddr = strings.TrimSpace(conf.EtcdAddr)
+
+	conf.ServicesFile, _ = c.ReadString("services_file", "")
+	conf.ServicesFile = strings.TrimSpace(conf.ServicesFile)
+	conf.ServicesFile = resolveConfPath(configFile, conf.ServicesFile)
+
+	switch conf.Registry {
+	case REGISTRY_ZK:
+		if len(conf.ZkAddr) == 0 {
+			log.Panicf("invalid config: need zk entry is missing in %s", configFile)
+		}
+	case REGISTRY_ETCD:
+		if len(conf.EtcdAddr) == 0 {
+			log.Panicf("invalid config: need etcd entry is missing in %s", configFile)
+		}
+	case REGISTRY_FILE:
+		if len(conf.ServicesFile) == 0 {
+			log.Panicf("invalid config: need services_file entry is missing in %s", configFile)
+		}
+	case REGISTRY_MEMORY:
+	default:
+		log.Panicf("invalid config: unknown registry %s in %s", conf.Registry, configFile)
+	}
+}
+
+//
+// 读取超时相关的配置:
+//     rpc_timeout=15 不带单位时以秒为单位, 也可以是: 500ms
+//     rpc_timeouts=analytics:30s,typo.get_user_info:500ms
+//     rpc_timeouts_zk=1 从zk读取超时配置(只在registry=zk时有效)
+//
+func (conf *ProductConfig) loadTimeoutConf(c *cfg.Cfg, configFile string) {
+	var err error
+
+	rpcTimeout, _ := c.ReadString("rpc_timeout", "")
+	rpcTimeout = strings.TrimSpace(rpcTimeout)
+	if len(rpcTimeout) == 0 {
+		conf.RpcTimeout = time.Second * REQUEST_EXPIRED_TIME_SECONDS
+	} else if conf.RpcTimeout, err = ParseTimeout(rpcTimeout); err != nil {
+		log.PanicErrorf(err, "invalid config: rpc_timeout = %s in %s", rpcTimeout, configFile)
+	}
+
+	rpcTimeouts, _ := c.ReadString("rpc_timeouts", "")
+	if conf.RpcTimeouts, err = ParseTimeoutRules(rpcTimeouts); err != nil {
+		log.PanicErrorf(err, "invalid config: rpc_timeouts = %s in %s", rpcTimeouts, configFile)
+	}
+
+	timeoutsInZk, _ := c.ReadInt("rpc_timeouts_zk", 0)
+	conf.RpcTimeoutsInZk = timeoutsInZk == 1
+}
+
+//
+// 读取负载均衡相关的配置:
+//     balancer=round_robin|random|least_outstanding|p2c_ewma, 默认为round_robin
+//     balancers=typo:p2c_ewma,analytics:least_outstanding 按照服务覆盖
+//     hash_key=arg|field:<id>|header:<name>, 一致性hash(ring_hash, maglev)的Key, 默认为arg
+//     hash_keys=typo:field:2 按照服务覆盖
+//
+func (conf *ProductConfig) loadBalancerConf(c *cfg.Cfg, configFile string) {
+	conf.Balancers.Default, _ = c.ReadString("balancer", BALANCER_ROUND_ROBIN)
+	conf.Balancers.Default = strings.TrimSpace(conf.Balancers.Default)
+	conf.Balancers.HashKey, _ = c.ReadString("hash_key", HASH_KEY_ARG)
+	conf.Balancers.HashKey = strings.TrimSpace(conf.Balancers.HashKey)
+
+	balancers, _ := c.ReadString("balancers", "")
+	services, err := parseServiceRules(balancers)
+	if err != nil {
+		log.PanicErrorf(err, "invalid config: balancers = %s in %s", balancers, configFile)
+	}
+	conf.Balancers.Services = services
+
+	hashKeys, _ := c.ReadString("hash_keys", "")
+	conf.Balancers.HashKeys, err = parseServiceRules(hashKeys)
+	if err != nil {
+		log.PanicErrorf(err, "invalid config: hash_keys = %s in %s", hashKeys, configFile)
+	}
+
+	// 检查所有的服务的配置
+	if _, err := NewBalancerWithHashKey(conf.Balancers.Default, conf.Balancers.HashKey); err != nil {
+		log.PanicErrorf(err, "invalid config: balancer = %s, hash_key = %s in %s",
+			conf.Balancers.Default, conf.Balancers.HashKey, configFile)
+	}
+	for _, rules := range []map[string]string{conf.Balancers.Services, conf.Balancers.HashKeys} {
+		for service := range rules {
+			policy, hashKey := conf.Balancers.Get(service), conf.Balancers.GetHashKey(service)
+			if _, err := NewBalancerWithHashKey(policy, hashKey); err != nil {
+				log.PanicErrorf(err, "invalid config: %s balancer = %s, hash_key = %s in %s",
+					service, policy, hashKey, configFile)
+			}
+		}
+	}
+}
+
+//
+// 解析按照服务覆盖的配置: service1:value1,service2:value2, value中可以包含":"
+//
+func parseServiceRules(value string) (map[string]string, error) {
+	rules := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rule: %s", item)
+		}
+		rules[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return rules, nil
+}
+
+//
+// 读取重试相关的配置(只用于rpc_proxy):
+//     retry_max_attempts=2 包括第一次请求, 1表示不重试
+//     retry_attempts=typo:3,typo.get_user_info:1 按照service, service.method覆盖
+//     retry_idempotent=typo.get_user_info,analytics 幂等的方法(或服务), 已经发送到后端的请求只有幂等时才重试
+//     retry_budget=0.2 重试的请求最多占正常请求的比例
+//     retry_backoff=10ms 第一次重试之前等待的时间, 之后按照指数增长
+//
+func (conf *ProxyConfig) loadRetryConf(c *cfg.Cfg, configFile string) {
+	var err error
+
+	conf.Retry.MaxAttempts, _ = c.ReadInt("retry_max_attempts", RETRY_DEFAULT_MAX_ATTEMPTS)
+	if conf.Retry.MaxAttempts <= 0 {
+		log.Panicf("invalid config: retry_max_attempts = %d in %s", conf.Retry.MaxAttempts, configFile)
+	}
+
+	attempts, _ := c.ReadString("retry_attempts", "")
+	if conf.Retry.Attempts, err = ParseRetryAttempts(attempts); err != nil {
+		log.PanicErrorf(err, "invalid config: retry_attempts = %s in %s", attempts, configFile)
+	}
+
+	idempotent, _ := c.ReadString("retry_idempotent", "")
+	conf.Retry.Idempotent = ParseIdempotentMethods(idempotent)
+
+	budget, _ := c.ReadString("retry_budget", "")
+	budget = strings.TrimSpace(budget)
+	if len(budget) == 0 {
+		conf.Retry.BudgetRatio = RETRY_DEFAULT_BUDGET_RATIO
+	} else if conf.Retry.BudgetRatio, err = strconv.ParseFloat(budget, 64); err != nil || conf.Retry.BudgetRatio < 0 {
+		log.Panicf("invalid config: retry_budget = %s in %s", budget, configFile)
+	}
+
+	backoff, _ := c.ReadString("retry_backoff", "")
+	backoff = strings.TrimSpace(backoff)
+	if len(backoff) == 0 {
+		conf.Retry.Backoff = RETRY_DEFAULT_BACKOFF
+	} else if conf.Retry.Backoff, err = ParseTimeout(backoff); err != nil {
+		log.PanicErrorf(err, "invalid config: retry_backoff = %s in %s", backoff, configFile)
+	}
+}
+
+//
+// 读取熔断相关的配置(只用于rpc_proxy):
+//     breaker=1 是否打开熔断, 默认不打开
+//     breaker_window=10s 统计错误率的时间窗口
+//     breaker_min_requests=20 时间窗口内请求数太少时不熔断
+//     breaker_error_rate=0.5 错误(超时, 异常, 连接断开)的比例
+//     breaker_open_timeout=5s 熔断之后, 经过多长时间开始试探
+//     breaker_probes=3 试探的请求数, 全部成功之后恢复
+//
+func (conf *ProxyConfig) loadBreakerConf(c *cfg.Cfg, configFile string) {
+	enabled, _ := c.ReadInt("breaker", 0)
+	conf.Breaker.Enabled = enabled == 1
+
+	conf.Breaker.Window = readConfDuration(c, configFile, "breaker_window", BREAKER_DEFAULT_WINDOW)
+	conf.Breaker.OpenTimeout = readConfDuration(c, configFile, "breaker_open_timeout", BREAKER_DEFAULT_OPEN_TIMEOUT)
+
+	conf.Breaker.MinRequests, _ = c.ReadInt("breaker_min_requests", BREAKER_DEFAULT_MIN_REQUESTS)
+	conf.Breaker.Probes, _ = c.ReadInt("breaker_probes", BREAKER_DEFAULT_HALF_OPEN_PROBE)
+	if conf.Breaker.MinRequests < 0 || conf.Breaker.Probes <= 0 {
+		log.Panicf("invalid config: breaker_min_requests = %d, breaker_probes = %d in %s",
+			conf.Breaker.MinRequests, conf.Breaker.Probes, configFile)
+	}
+
+	conf.Breaker.ErrorRate = readConfFloat(c, configFile, "breaker_error_rate", BREAKER_DEFAULT_ERROR_RATE)
+	if conf.Breaker.ErrorRate <= 0 || conf.Breaker.ErrorRate > 1 {
+		log.Panicf("invalid config: breaker_error_rate = %.2f in %s", conf.Breaker.ErrorRate, configFile)
+	}
+}
+
+//
+// 读取异常节点检测相关的配置(只用于rpc_proxy):
+//     outlier=1 是否打开异常节点检测, 默认不打开
+//     outlier_interval=10s 检测的时间间隔
+//     outlier_min_requests=20 一个时间间隔内请求数太少的节点不参与检测
+//     outlier_min_hosts=3 参与检测的节点数太少时不检测
+//     outlier_latency_factor=3 p99 latency超过中位数的多少倍时摘除
+//     outlier_error_rate=0.2 错误率超过中位数多少时摘除
+//     outlier_base_ejection=30s 摘除的时间, 按照摘除的次数增加
+//     outlier_max_ejection=0.3 同时被摘除的节点的最大比例
+//
+func (conf *ProxyConfig) loadOutlierConf(c *cfg.Cfg, configFile string) {
+	enabled, _ := c.ReadInt("outlier", 0)
+	conf.Outlier.Enabled = enabled == 1
+
+	conf.Outlier.Interval = readConfDuration(c, configFile, "outlier_interval", OUTLIER_DEFAULT_INTERVAL)
+	conf.Outlier.BaseEjection = readConfDuration(c, configFile, "outlier_base_ejection", OUTLIER_DEFAULT_BASE_EJECTION)
+
+	conf.Outlier.MinRequests, _ = c.ReadInt("outlier_min_requests", OUTLIER_DEFAULT_MIN_REQUESTS)
+	conf.Outlier.MinHosts, _ = c.ReadInt("outlier_min_hosts", OUTLIER_DEFAULT_MIN_HOSTS)
+	if conf.Outlier.MinRequests <= 0 || conf.Outlier.MinHosts <= 0 {
+		log.Panicf("invalid config: outlier_min_requests = %d, outlier_min_hosts = %d in %s",
+			conf.Outlier.MinRequests, conf.Outlier.MinHosts, configFile)
+	}
+
+	conf.Outlier.LatencyFactor = readConfFloat(c, configFile, "outlier_latency_factor", OUTLIER_DEFAULT_LATENCY_FACTOR)
+	conf.Outlier.ErrorRate = readConfFloat(c, configFile, "outlier_error_rate", OUTLIER_DEFAULT_ERROR_RATE)
+	conf.Outlier.MaxEjection = readConfFloat(c, configFile, "outlier_max_ejection", OUTLIER_DEFAULT_MAX_EJECTION)
+	if conf.Outlier.LatencyFactor <= 1 || conf.Outlier.ErrorRate <= 0 || conf.Outlier.MaxEjection > 1 {
+		log.Panicf("invalid config: outlier_latency_factor = %.2f, outlier_error_rate = %.2f, outlier_max_ejection = %.2f in %s",
+			conf.Outlier.LatencyFactor, conf.Outlier.ErrorRate, conf.Outlier.MaxEjection, configFile)
+	}
+}
+
+//
+// 读取限流相关的配置(只用于rpc_proxy), 规则为: rate[/burst], rate为每秒的请求数
+//     rate_limits=typo:1000,typo.get_user_info:200/50,*:5000 所有Client共享, *为每一个service默认的规则
+//     rate_limits_per_session=typo.get_user_info:20 每一个Client Session单独计数
+//     rate_limits_zk=1 从zk读取规则(/zk/product/ProductName/config/rate_limits)
+//
+func (conf *ProxyConfig) loadRateLimitConf(c *cfg.Cfg, configFile string) {
+	var err error
+	limits, _ := c.ReadString("rate_limits", "")
+	if conf.RateLimit.Limits, err = ParseRateLimitRules(limits); err != nil {
+		log.PanicErrorf(err, "invalid config: rate_limits = %s in %s", limits, configFile)
+	}
+
+	sessionLimits, _ := c.ReadString("rate_limits_per_session", "")
+	if conf.RateLimit.SessionLimits, err = ParseRateLimitRules(sessionLimits); err != nil {
+		log.PanicErrorf(err, "invalid config: rate_limits_per_session = %s in %s", sessionLimits, configFile)
+	}
+
+	inZk, _ := c.ReadInt("rate_limits_zk", 0)
+	conf.RateLimit.InZk = inZk == 1
+}
+
+//
+// 读取BackendConn(rpc_proxy), BackendConnLB(rpc_lb)的请求队列的配置:
+//     backend_queue_size=1024 每一个连接最多排队的请求数
+//     backend_queue_overflow=reject|retry|wait 队列满了之后: 直接拒绝, 换一个连接, 或者等待(默认: reject)
+//     backend_queue_wait=50ms overflow为wait时最多等待的时间(不超过请求的deadline)
+//
+func (conf *ProductConfig) loadBackendQueueConf(c *cfg.Cfg, configFile string) {
+	conf.BackendQueue.Size, _ = c.ReadInt("backend_queue_size", BACKEND_QUEUE_DEFAULT_SIZE)
+	if conf.BackendQueue.Size <= 0 {
+		log.Panicf("invalid config: backend_queue_size = %d in %s", conf.BackendQueue.Size, configFile)
+	}
+
+	conf.BackendQueue.Overflow, _ = c.ReadString("backend_queue_overflow", BACKEND_QUEUE_OVERFLOW_REJECT)
+	conf.BackendQueue.Overflow = strings.TrimSpace(conf.BackendQueue.Overflow)
+	if !IsValidBackendQueueOverflow(conf.BackendQueue.Overflow) {
+		log.Panicf("invalid config: backend_queue_overflow = %s in %s", conf.BackendQueue.Overflow, configFile)
+	}
+
+	conf.BackendQueue.Wait = readConfDuration(c, configFile, "backend_queue_wait", BACKEND_QUEUE_DEFAULT_WAIT)
+}
+
+//
+// 读取监控数据输出相关的配置:
+//     metrics_sink=falcon|statsd|file|none 默认: 配置了falcon_client时为falcon, 否则为none
+//     falcon_client=http://127.0.0.1:1988/v1/push
+//     statsd_addr=127.0.0.1:8125
+//     statsd_prefix=rpc.
+//     metrics_file=log/metrics.log 每行一个JSON
+//     metrics_batch_size=200 每次发送的最多的数据点
+//     metrics_buffer_size=20000 发送失败时最多缓存的数据点, 超过之后丢弃最老的数据
+//     metrics_retry_interval=10s 发送失败之后重试的间隔
+//
+func (conf *ProductConfig) loadMetricsConf(c *cfg.Cfg, configFile string) {
+	conf.Metrics.FalconClient, _ = c.ReadString("falcon_client", "")
+	conf.Metrics.FalconClient = strings.TrimSpace(conf.Metrics.FalconClient)
+
+	conf.Metrics.Sink, _ = c.ReadString("metrics_sink", "")
+	conf.Metrics.Sink = strings.TrimSpace(conf.Metrics.Sink)
+	if len(conf.Metrics.Sink) == 0 {
+		if len(conf.Metrics.FalconClient) > 0 {
+			conf.Metrics.Sink = METRICS_SINK_FALCON
+		} else {
+			conf.Metrics.Sink = METRICS_SINK_NONE
+		}
+	}
+
+	conf.Metrics.StatsdAddr, _ = c.ReadString("statsd_addr", "")
+	conf.Metrics.StatsdAddr = strings.TrimSpace(conf.Metrics.StatsdAddr)
+	conf.Metrics.StatsdPrefix, _ = c.ReadString("statsd_prefix", "")
+	conf.Metrics.StatsdPrefix = strings.TrimSpace(conf.Metrics.StatsdPrefix)
+
+	conf.Metrics.File, _ = c.ReadString("metrics_file", "")
+	conf.Metrics.File = strings.TrimSpace(conf.Metrics.File)
+	conf.Metrics.File = resolveConfPath(configFile, conf.Metrics.File)
+
+	conf.Metrics.BatchSize, _ = c.ReadInt("metrics_batch_size", METRICS_DEFAULT_BATCH_SIZE)
+	conf.Metrics.BufferSize, _ = c.ReadInt("metrics_buffer_size", METRICS_DEFAULT_BUFFER_SIZE)
+	if conf.Metrics.BatchSize <= 0 || conf.Metrics.BufferSize < conf.Metrics.BatchSize {
+		log.Panicf("invalid config: metrics_batch_size = %d, metrics_buffer_size = %d in %s",
+			conf.Metrics.BatchSize, conf.Metrics.BufferSize, configFile)
+	}
+	conf.Metrics.RetryInterval = readConfDuration(c, configFile, "metrics_retry_interval", METRICS_DEFAULT_RETRY_INTERVAL)
+
+	switch conf.Metrics.Sink {
+	case METRICS_SINK_FALCON, METRICS_SINK_STATSD, METRICS_SINK_FILE, METRICS_SINK_NONE:
+	default:
+		log.Panicf("invalid config: metrics_sink = %s in %s", conf.Metrics.Sink, configFile)
+	}
+}
+
+//
+// 读取分布式追踪相关的配置(rpc_proxy, rpc_lb, rpc service):
+//     trace_collector=http://127.0.0.1:9411/api/v2/spans 或者本地文件(例如: log/spans.log), 没有配置时不追踪
+//     trace_exporter=zipkin|otlp 默认为zipkin
+//     trace_sample_rate=0.01 没有带trace context的请求开始新trace的比例, 默认为0(只追踪Client采样的请求)
+//
+func (conf *ProductConfig) loadTraceConf(c *cfg.Cfg, configFile string) {
+	conf.Trace.Collector, _ = c.ReadString("trace_collector", "")
+	conf.Trace.Collector = strings.TrimSpace(conf.Trace.Collector)
+	if !strings.Contains(conf.Trace.Collector, "://") {
+		conf.Trace.Collector = resolveConfPath(configFile, conf.Trace.Collector)
+	}
+
+	conf.Trace.Exporter, _ = c.ReadString("trace_exporter", TRACE_EXPORTER_ZIPKIN)
+	conf.Trace.Exporter = strings.TrimSpace(conf.Trace.Exporter)
+	if conf.Trace.Exporter != TRACE_EXPORTER_ZIPKIN && conf.Trace.Exporter != TRACE_EXPORTER_OTLP {
+		log.Panicf("invalid config: trace_exporter = %s in %s", conf.Trace.Exporter, configFile)
+	}
+
+	conf.Trace.SampleRate = readConfFloat(c, configFile, "trace_sample_rate", 0)
+	if conf.Trace.SampleRate > 1 {
+		log.Panicf("invalid config: trace_sample_rate = %.4f in %s", conf.Trace.SampleRate, configFile)
+	}
+}
+
+//
+// 读取access log相关的配置(rpc_proxy, rpc_lb, rpc service):
+//     access_log=log/access.log 每个请求一行JSON, 按天滚动; 没有配置时不记录
+//     access_log_sample_rate=0.1 成功的请求的采样比例, 默认为1; 失败的请求总是记录
+//     access_log_keep_days=3 保留的天数
+//
+func (conf *ProductConfig) loadAccessLogConf(c *cfg.Cfg, configFile string) {
+	conf.AccessLog.File, _ = c.ReadString("access_log", "")
+	conf.AccessLog.File = strings.TrimSpace(conf.AccessLog.File)
+	conf.AccessLog.File = resolveConfPath(configFile, conf.AccessLog.File)
+
+	conf.AccessLog.SampleRate = readConfFloat(c, configFile, "access_log_sample_rate", 1)
+	if conf.AccessLog.SampleRate > 1 {
+		log.Panicf("invalid config: access_log_sample_rate = %.4f in %s", conf.AccessLog.SampleRate, configFile)
+	}
+
+	conf.AccessLog.KeepDays, _ = c.ReadInt("access_log_keep_days", ACCESS_LOG_DEFAULT_KEEP_DAYS)
+	if conf.AccessLog.KeepDays <= 0 {
+		log.Panicf("invalid config: access_log_keep_days = %d in %s", conf.AccessLog.KeepDays, configFile)
+	}
+}
+
+//
+// 读取THeader相关的配置(rpc_proxy, rpc_lb):
+//     theader_backends=typo,user 支持THeader transport的服务(*表示所有的服务), 转发请求时带上Client的headers
+// Client是否使用THeader不需要配置, 按照每一个frame自动识别
+//
+func (conf *ProductConfig) loadTHeaderConf(c *cfg.Cfg, configFile string) {
+	backends, _ := c.ReadString("theader_backends", "")
+	conf.THeaderBackends = ParseTHeaderBackends(backends)
+}
+
+//
+// 读取HTTP/JSON gateway相关的配置(只用于rpc_proxy):
+//     http_gateway_address=0.0.0.0:5580 为空时不启动gateway
+//     http_gateway_idl=typo:idl/typo.thrift,user:idl/user.thrift 每个服务对应的IDL文件
+//
+func (conf *ProxyConfig) loadHttpGatewayConf(c *cfg.Cfg, configFile string) {
+	conf.HttpGateway.Addr, _ = c.ReadString("http_gateway_address", "")
+	conf.HttpGateway.Addr = strings.TrimSpace(conf.HttpGateway.Addr)
+
+	idls, _ := c.ReadString("http_gateway_idl", "")
+	rules, err := parseServiceRules(idls)
+	if err != nil {
+		log.PanicErrorf(err, "invalid config: http_gateway_idl = %s in %s", idls, configFile)
+	}
+	for service, file := range rules {
+		rules[service] = resolveConfPath(configFile, file)
+	}
+	conf.HttpGateway.Idls = rules
+
+	if len(conf.HttpGateway.Addr) > 0 && len(rules) == 0 {
+		log.Panicf("invalid config: http_gateway_idl is missing in %s", configFile)
+	}
+}
+
+//
+// 配置文件中的相对路径(services_file, front_sock, metrics_file, access_log等)以配置文件所在的目录为准,
+// 不依赖启动时的工作目录; 返回绝对路径
+//
+func resolveConfPath(configFile string, file string) string {
+	if len(file) == 0 || strings.HasPrefix(file, "/") {
+		return file
+	}
+	dir := path.Dir(configFile)
+	if !strings.HasPrefix(dir, "/") {
+		wd, _ := os.Getwd()
+		dir = path.Join(wd, dir)
+	}
+	return path.Clean(path.Join(dir, file))
+}
+
+//
+// 读取时间: 不带单位时以秒为单位, 也可以是: 500ms
+//
+func readConfDuration(c *cfg.Cfg, configFile string, entry string, defDuration time.Duration) time.Duration {
+	value, _ := c.ReadString(entry, "")
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return defDuration
+	}
+	d, err := ParseTimeout(value)
+	if err != nil {
+		log.PanicErrorf(err, "invalid config: %s = %s in %s", entry, value, configFile)
+	}
+	return d
+}
+
+func readConfFloat(c *cfg.Cfg, configFile string, entry string, defFloat float64) float64 {
+	value, _ := c.ReadString(entry, "")
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return defFloat
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Panicf("invalid config: %s = %s in %s", entry, value, configFile)
+	}
+	return f
+}
+
 func LoadConf(configFile string) (*ServiceConfig, error) {
 	c := cfg.NewCfg(configFile)
 	if err := c.Load(); err != nil {
@@ -85,12 +579,14 @@ func LoadConf(configFile string) (*ServiceConfig, error) {
 		log.Panicf("invalid config: product entry is missing in %s", configFile)
 	}
 
-	// 读取zk
-	conf.ZkAddr, _ = c.ReadString("zk", "")
-	if len(conf.ZkAddr) == 0 {
-		log.Panicf("invalid config: need zk entry is missing in %s", configFile)
-	}
-	conf.ZkAddr = strings.TrimSpace(conf.ZkAddr)
+	conf.loadRegistryConf(c, configFile)
+	conf.loadTimeoutConf(c, configFile)
+	conf.loadBalancerConf(c, configFile)
+	conf.loadMetricsConf(c, configFile)
+	conf.loadTraceConf(c, configFile)
+	conf.loadAccessLogConf(c, configFile)
+	conf.loadTHeaderConf(c, configFile)
+	conf.loadBackendQueueConf(c, configFile)
 
 	loadConfInt := func(entry string, defInt int) int {
 		v, _ := c.ReadInt(entry, defInt)
@@ -109,6 +605,14 @@ func LoadConf(configFile string) (*ServiceConfig, error) {
 	conf.Service, _ = c.ReadString("service", "")
 	conf.Service = strings.TrimSpace(conf.Service)
 
+	// rpc_lb: services=typo,user,analytics
+	services, _ := c.ReadString("services", "")
+	for _, service := range strings.Split(services, ",") {
+		if service = strings.TrimSpace(service); len(service) > 0 {
+			conf.Services = append(conf.Services, service)
+		}
+	}
+
 	conf.FrontHost, _ = c.ReadString("front_host", "")
 	conf.FrontHost = strings.TrimSpace(conf.FrontHost)
 
@@ -118,10 +622,7 @@ func LoadConf(configFile string) (*ServiceConfig, error) {
 	conf.FrontSock, _ = c.ReadString("front_sock", "")
 	conf.FrontSock = strings.TrimSpace(conf.FrontSock)
 	// 配置文件中使用的是相对路径，在注册到zk时，需要还原成为绝对路径
-	if len(conf.FrontSock) > 0 && !strings.HasPrefix(conf.FrontSock, "/") {
-		dir, _ := os.Getwd()
-		conf.FrontSock = path.Clean(path.Join(dir, conf.FrontSock))
-	}
+	conf.FrontSock = resolveConfPath(configFile, conf.FrontSock)
 
 	conf.IpPrefix, _ = c.ReadString("ip_prefix", "")
 	conf.IpPrefix = strings.TrimSpace(conf.IpPrefix)
@@ -133,7 +634,19 @@ func LoadConf(configFile string) (*ServiceConfig, error) {
 	conf.BackAddr, _ = c.ReadString("back_address", "")
 	conf.BackAddr = strings.TrimSpace(conf.BackAddr)
 
-	conf.FalconClient, _ = c.ReadString("falcon_client", "")
+	conf.Weight = loadConfInt("weight", DEFAULT_ENDPOINT_WEIGHT)
+	// 权重为0并不表示摘除流量(balancer按照默认权重处理), 直接拒绝
+	if conf.Weight == 0 {
+		log.Panicf("invalid config: weight = 0 in %s", configFile)
+	}
+
+	// rpc_lb, rpc service: 正在处理的请求数的上限
+	conf.MaxInflightPerSession = loadConfInt("max_inflight_per_session", DEFAULT_MAX_INFLIGHT_PER_SESSION)
+	// 负数已经在loadConfInt中检查
+	if conf.MaxInflightPerSession == 0 {
+		log.Panicf("invalid config: max_inflight_per_session = 0 in %s", configFile)
+	}
+	conf.MaxInflight = loadConfInt("max_inflight", 0)
 
 	profile, _ := c.ReadInt("profile", 0)
 	conf.Profile = profile == 1
@@ -154,12 +667,14 @@ func LoadProxyConf(configFile string) (*ProxyConfig, error) {
 		log.Panicf("invalid config: product entry is missing in %s", configFile)
 	}
 
-	// 读取zk
-	conf.ZkAddr, _ = c.ReadString("zk", "")
-	if len(conf.ZkAddr) == 0 {
-		log.Panicf("invalid config: need zk entry is missing in %s", configFile)
-	}
-	conf.ZkAddr = strings.TrimSpace(conf.ZkAddr)
+	conf.loadRegistryConf(c, configFile)
+	conf.loadTimeoutConf(c, configFile)
+	conf.loadBalancerConf(c, configFile)
+	conf.loadMetricsConf(c, configFile)
+	conf.loadTraceConf(c, configFile)
+	conf.loadAccessLogConf(c, configFile)
+	conf.loadTHeaderConf(c, configFile)
+	conf.loadBackendQueueConf(c, configFile)
 
 	loadConfInt := func(entry string, defInt int) int {
 		v, _ := c.ReadInt(entry, defInt)
@@ -172,6 +687,12 @@ func LoadProxyConf(configFile string) (*ProxyConfig, error) {
 	conf.ZkSessionTimeout = loadConfInt("zk_session_timeout", 30)
 	conf.Verbose = loadConfInt("verbose", 0) == 1
 
+	conf.loadRetryConf(c, configFile)
+	conf.loadBreakerConf(c, configFile)
+	conf.loadOutlierConf(c, configFile)
+	conf.loadHttpGatewayConf(c, configFile)
+	conf.loadRateLimitConf(c, configFile)
+
 	conf.ProxyAddr, _ = c.ReadString("proxy_address", "")
 	conf.ProxyAddr = strings.TrimSpace(conf.ProxyAddr)
 
@@ -0,0 +1,25 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path"
+	"testing"
+)
+
+//
+// go test proxy -v -run "TestResolveConfPath"
+//
+func TestResolveConfPath(t *testing.T) {
+	assert.Equal(t, "/data/run/typo.sock", resolveConfPath("/etc/rpc/config.ini", "/data/run/typo.sock"))
+	assert.Equal(t, "/etc/rpc/run/typo.sock", resolveConfPath("/etc/rpc/config.ini", "run/typo.sock"))
+	assert.Equal(t, "/etc/log/access.log", resolveConfPath("/etc/rpc/config.ini", "../log/access.log"))
+	assert.Equal(t, "", resolveConfPath("/etc/rpc/config.ini", ""))
+
+	// 配置文件本身是相对路径时, 相对于当前的工作目录
+	wd, _ := os.Getwd()
+	assert.Equal(t, path.Join(wd, "conf/services.json"), resolveConfPath("conf/config.ini", "services.json"))
+	assert.Equal(t, path.Join(wd, "services.json"), resolveConfPath("config.ini", "services.json"))
+}
@@ -3,13 +3,13 @@
 package proxy
 
 import (
-	"encoding/json"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
-	zookeeper "github.com/wfxiang08/go-zookeeper/zk"
 	"os"
-	os_path "path"
 	"time"
-	"github.com/wfxiang08/thrift_rpc_base/zkhelper"
+)
+
+const (
+	DEFAULT_ENDPOINT_WEIGHT = 1
 )
 
 type ServiceEndpoint struct {
@@ -20,6 +20,10 @@ type ServiceEndpoint struct {
 	CodeUrlVerion string `json:"code_url_version"`
 	Hostname      string `json:"hostname"`
 	StartTime     string `json:"start_time"`
+	Weight        int    `json:"weight"` // 负载均衡的权重, 例如: 按照机器的核数来设置
+
+	// 服务多个service的rpc_lb, 请求中需要保留service前缀(参考: BackServiceLBMux)
+	Multiplexed bool `json:"multiplexed,omitempty"`
 }
 
 func NewServiceEndpoint(service string, serviceId string, frontend string,
@@ -40,58 +44,37 @@ func NewServiceEndpoint(service string, serviceId string, frontend string,
 		CodeUrlVerion: codeUrlVerion,
 		Hostname:      hostname,
 		StartTime:     startTime,
+		Weight:        DEFAULT_ENDPOINT_WEIGHT,
 	}
 }
 
 //
-// 删除Service Endpoint
+// 之前注册的Endpoint中没有weight, 按照默认的权重处理
+// 权重不大于0(没有weight, 或者Registry中的数据被修改)时打印Warning, 避免被误认为已经摘除流量
 //
-func (s *ServiceEndpoint) DeleteServiceEndpoint(top *Topology) {
-	path := top.ProductServiceEndPointPath(s.Service, s.ServiceId)
-	if ok, _ := top.Exist(path); ok {
-		zkhelper.DeleteRecursive(top.ZkConn, path, -1)
-		log.Println(Red("DeleteServiceEndpoint"), "Path: ", path)
+func (s *ServiceEndpoint) GetWeight() int {
+	if s.Weight <= 0 {
+		log.Warnf("[%s]Endpoint %s weight = %d, use default weight: %d",
+			s.Service, s.Frontend, s.Weight, DEFAULT_ENDPOINT_WEIGHT)
+		return DEFAULT_ENDPOINT_WEIGHT
 	}
+	return s.Weight
 }
 
 //
-// 注册一个服务的Endpoints
+// 删除Service Endpoint
 //
-func (s *ServiceEndpoint) AddServiceEndpoint(topo *Topology) error {
-	path := topo.ProductServiceEndPointPath(s.Service, s.ServiceId)
-	data, err := json.Marshal(s)
-	if err != nil {
-		return err
-	}
-
-	// 创建Service(XXX: Service本身不包含数据)
-	CreateRecursive(topo.ZkConn, os_path.Dir(path), "", 0, zkhelper.DefaultDirACLs())
-
-	// 当前的Session挂了，服务就下线
-	// topo.FlagEphemeral
-
-	// 参考： https://www.box.com/blog/a-gotcha-when-using-zookeeper-ephemeral-nodes/
-	// 如果之前的Session信息还存在，则先删除；然后再添加
-	topo.ZkConn.Delete(path, -1)
-	var pathCreated string
-	pathCreated, err = topo.ZkConn.Create(path, []byte(data), int32(zookeeper.FlagEphemeral), zkhelper.DefaultFileACLs())
-
-	log.Println(Green("AddServiceEndpoint"), "Path: ", pathCreated, ", Error: ", err)
-	return err
+func (s *ServiceEndpoint) DeleteServiceEndpoint(topo Registry) {
+	topo.DeleteServiceEndpoint(s.Service, s.ServiceId)
 }
 
-func GetServiceEndpoint(top *Topology, service string, serviceId string) (endpoint *ServiceEndpoint, err error) {
+//
+// 注册一个服务的Endpoints
+//
+func (s *ServiceEndpoint) AddServiceEndpoint(topo Registry) error {
+	return topo.AddServiceEndpoint(s)
+}
 
-	path := top.ProductServiceEndPointPath(service, serviceId)
-	data, _, err := top.ZkConn.Get(path)
-	if err != nil {
-		return nil, err
-	}
-	endpoint = &ServiceEndpoint{}
-	err = json.Unmarshal(data, endpoint)
-	if err != nil {
-		return nil, err
-	} else {
-		return endpoint, nil
-	}
+func GetServiceEndpoint(topo Registry, service string, serviceId string) (endpoint *ServiceEndpoint, err error) {
+	return topo.GetServiceEndpoint(service, serviceId)
 }
@@ -39,6 +39,7 @@ func NewPingRequest() *Request {
 	// 告诉Request, Data中不包含service，在ReplaceSeqId时不需要特别处理
 	r.ProxyRequest = false
 	r.Start = microseconds()
+	r.AttemptStart = r.Start
 	r.Request.Data = transport.Bytes()
 	r.Request.Name = "ping"
 	r.Request.SeqId = 0 // SeqId在这里无效，因此设置为0
@@ -59,6 +60,7 @@ func NewStopConfirmRequest() *Request {
 	// 告诉Request, Data中不包含service，在ReplaceSeqId时不需要特别处理
 	r.ProxyRequest = false
 	r.Start = microseconds()
+	r.AttemptStart = r.Start
 	r.Request.Data = transport.Bytes()
 	r.Request.Name = "stop_confirm"
 	r.Request.SeqId = 0 // SeqId在这里无效，因此设置为0
@@ -0,0 +1,142 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"math"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+)
+
+const (
+	HISTOGRAM_SUB_BUCKET_BITS = 4
+	HISTOGRAM_SUB_BUCKETS     = 1 << HISTOGRAM_SUB_BUCKET_BITS
+	HISTOGRAM_MAX_EXP         = 40 // 2^40us(约12天), 更大的值计入最后一个bucket
+	HISTOGRAM_BUCKETS         = (HISTOGRAM_MAX_EXP - HISTOGRAM_SUB_BUCKET_BITS + 2) << HISTOGRAM_SUB_BUCKET_BITS
+)
+
+//
+// Log-linear的latency直方图(单位: microseconds)
+// [0, 16)每个值一个bucket; 之后每个[2^e, 2^(e+1))区间等分成16个bucket, 相对误差不超过1/16
+//
+// Record只有一次atomic的加法, 不加锁; 相同结构的直方图可以直接合并(Merge)
+//
+type LatencyHistogram struct {
+	counts [HISTOGRAM_BUCKETS]atomic2.Int64
+}
+
+func (h *LatencyHistogram) Record(usecs int64) {
+	h.counts[histogramIndex(usecs)].Incr()
+}
+
+func (h *LatencyHistogram) Merge(other *LatencyHistogram) {
+	for i := range other.counts {
+		if n := other.counts[i].Get(); n != 0 {
+			h.counts[i].Add(n)
+		}
+	}
+}
+
+func (h *LatencyHistogram) Count() int64 {
+	var total int64
+	for i := range h.counts {
+		total += h.counts[i].Get()
+	}
+	return total
+}
+
+//
+// 一次遍历计算多个分位数(ps需要从小到大排列, 例如: 0.5, 0.9, 0.99), 返回对应bucket的上界
+//
+func (h *LatencyHistogram) Percentiles(ps ...float64) []int64 {
+	var counts [HISTOGRAM_BUCKETS]int64
+	var total int64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Get()
+		total += counts[i]
+	}
+
+	results := make([]int64, len(ps))
+	if total == 0 {
+		return results
+	}
+
+	var seen int64
+	j := 0
+	for i := 0; i < HISTOGRAM_BUCKETS && j < len(ps); i++ {
+		seen += counts[i]
+		for j < len(ps) && seen >= histogramRank(ps[j], total) {
+			results[j] = histogramUpperBound(i)
+			j++
+		}
+	}
+	return results
+}
+
+// 第rank个值(从1开始)对应分位数p
+func histogramRank(p float64, total int64) int64 {
+	rank := int64(math.Ceil(p * float64(total)))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > total {
+		rank = total
+	}
+	return rank
+}
+
+func histogramIndex(v int64) int {
+	if v < HISTOGRAM_SUB_BUCKETS {
+		if v < 0 {
+			return 0
+		}
+		return int(v)
+	}
+	e := log2(uint64(v))
+	if e > HISTOGRAM_MAX_EXP {
+		return HISTOGRAM_BUCKETS - 1
+	}
+	shift := e - HISTOGRAM_SUB_BUCKET_BITS
+	sub := int(v>>shift) & (HISTOGRAM_SUB_BUCKETS - 1)
+	return int(shift+1)<<HISTOGRAM_SUB_BUCKET_BITS + sub
+}
+
+// bucket i中的最大值
+func histogramUpperBound(i int) int64 {
+	if i < HISTOGRAM_SUB_BUCKETS {
+		return int64(i)
+	}
+	shift := uint(i>>HISTOGRAM_SUB_BUCKET_BITS) - 1
+	sub := int64(i & (HISTOGRAM_SUB_BUCKETS - 1))
+	lower := (HISTOGRAM_SUB_BUCKETS + sub) << shift
+	return lower + (1 << shift) - 1
+}
+
+// 最高位的位置(v > 0)
+func log2(v uint64) uint {
+	var n uint
+	if v >= 1<<32 {
+		v >>= 32
+		n += 32
+	}
+	if v >= 1<<16 {
+		v >>= 16
+		n += 16
+	}
+	if v >= 1<<8 {
+		v >>= 8
+		n += 8
+	}
+	if v >= 1<<4 {
+		v >>= 4
+		n += 4
+	}
+	if v >= 1<<2 {
+		v >>= 2
+		n += 2
+	}
+	if v >= 1<<1 {
+		n += 1
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+//
+// go test proxy -v -run "TestHistogramBuckets"
+//
+func TestHistogramBuckets(t *testing.T) {
+	// 小于16的值是精确的
+	for v := int64(0); v < HISTOGRAM_SUB_BUCKETS; v++ {
+		assert.Equal(t, v, histogramUpperBound(histogramIndex(v)))
+	}
+	assert.Equal(t, 0, histogramIndex(-5))
+
+	// bucket连续并且单调, 相对误差不超过1/16
+	last := -1
+	for _, v := range []int64{16, 17, 31, 32, 34, 100, 1000, 12345, 999999, 1 << 30, 1<<40 + 12345} {
+		i := histogramIndex(v)
+		assert.True(t, i > last)
+		last = i
+		upper := histogramUpperBound(i)
+		assert.True(t, upper >= v)
+		assert.True(t, float64(upper-v) <= float64(v)/HISTOGRAM_SUB_BUCKETS)
+	}
+	for i := 1; i < HISTOGRAM_BUCKETS; i++ {
+		assert.Equal(t, i, histogramIndex(histogramUpperBound(i-1)+1))
+	}
+
+	// 超出范围的值计入最后一个bucket
+	assert.Equal(t, HISTOGRAM_BUCKETS-1, histogramIndex(1<<62))
+}
+
+//
+// go test proxy -v -run "TestHistogramPercentiles"
+//
+func TestHistogramPercentiles(t *testing.T) {
+	var h LatencyHistogram
+	assert.Equal(t, []int64{0, 0}, h.Percentiles(0.5, 0.99))
+
+	for v := int64(1); v <= 10000; v++ {
+		h.Record(v)
+	}
+	assert.Equal(t, int64(10000), h.Count())
+
+	expected := []int64{5000, 9000, 9900, 9990}
+	for i, p := range h.Percentiles(0.5, 0.9, 0.99, 0.999) {
+		assert.True(t, p >= expected[i] && float64(p) <= float64(expected[i])*(1+1.0/HISTOGRAM_SUB_BUCKETS))
+	}
+
+	// 合并: 长尾出现在p99之后
+	var other LatencyHistogram
+	for i := 0; i < 200; i++ {
+		other.Record(1000000)
+	}
+	h.Merge(&other)
+	assert.Equal(t, int64(10200), h.Count())
+	ps := h.Percentiles(0.5, 0.99)
+	assert.True(t, ps[0] < 6000)
+	assert.True(t, ps[1] >= 1000000)
+
+	// OpStats
+	s := &OpStats{opstr: "get_user"}
+	for i := 0; i < 100; i++ {
+		s.calls.Incr()
+		s.usecs.Add(1000)
+		s.hist.Record(1000)
+	}
+	data, err := json.Marshal(s)
+	assert.NoError(t, err)
+	var m struct {
+		P50  int64 `json:"usecs_p50"`
+		P99  int64 `json:"usecs_p99"`
+		P999 int64 `json:"usecs_p999"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &m))
+	assert.True(t, m.P99 >= 1000 && m.P99 < 1100)
+	assert.Equal(t, m.P50, m.P999)
+}
+
+func BenchmarkHistogramRecord(b *testing.B) {
+	var h LatencyHistogram
+	b.RunParallel(func(pb *testing.PB) {
+		v := int64(1)
+		for pb.Next() {
+			h.Record(v)
+			v = (v*31 + 7) % 1000000
+		}
+	})
+}
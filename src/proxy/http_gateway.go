@@ -0,0 +1,599 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// HTTP/JSON gateway(只用于rpc_proxy):
+//   POST /{service}/{method}, body为参数组成的JSON object, 例如: {"user_id": 1, "fields": ["name"]}
+//
+// 按照启动时读取的Thrift IDL将JSON转换成为TBinaryProtocol的CALL, 和普通的Client一样交给Router.Dispatch;
+// 返回的结果再按照IDL转换成为JSON:
+//   200 {"result": ...}                                          正常返回(void时为null)
+//   200 {"exception": {"name": "e", "type": "UserNotFound", "value": {...}}}  IDL中声明的exception
+//   4xx/5xx {"error": {"type": 100, "message": "..."}}            TApplicationException, 或者请求不合法
+//
+// JSON和thrift类型的对应:
+//   bool, 整数, double: JSON的bool, number(i64也可以使用string)
+//   string: string; binary: base64的string
+//   enum: 名字(也可以使用number)
+//   list, set: array; map: object(key转换成为string)
+//   struct, union, exception: object, key为field的名字
+//
+type HttpGatewayConfig struct {
+	Addr string
+	Idls map[string]string // service --> IDL文件
+}
+
+const (
+	HTTP_GATEWAY_MAX_BODY_SIZE = 16 * 1024 * 1024
+	HTTP_GATEWAY_MAX_DEPTH     = 64
+	// list/map的长度来自后端的数据, 预先分配的空间不能超过这个值(数据异常时不会一次分配大量的内存)
+	HTTP_GATEWAY_MAX_PREALLOC = 64
+
+	// 读取请求, 写回结果(包括等待后端处理, 需要大于请求的超时时间), 以及keep-alive连接空闲的最长时间
+	HTTP_GATEWAY_READ_TIMEOUT  = 30 * time.Second
+	HTTP_GATEWAY_WRITE_TIMEOUT = 2 * REQUEST_EXPIRED_TIME_SECONDS * time.Second
+	HTTP_GATEWAY_IDLE_TIMEOUT  = 120 * time.Second
+)
+
+type HttpGateway struct {
+	dispatcher Dispatcher
+	idls       map[string]*ThriftIdl
+	seqId      int32
+	verbose    bool
+}
+
+func NewHttpGateway(config *HttpGatewayConfig, dispatcher Dispatcher, verbose bool) (*HttpGateway, error) {
+	g := &HttpGateway{
+		dispatcher: dispatcher,
+		idls:       make(map[string]*ThriftIdl, len(config.Idls)),
+		verbose:    verbose,
+	}
+	for service, file := range config.Idls {
+		idl, err := LoadThriftIdl(file)
+		if err != nil {
+			return nil, fmt.Errorf("load idl for %s failed: %v", service, err)
+		}
+		g.idls[service] = idl
+	}
+	return g, nil
+}
+
+func (g *HttpGateway) Run(addr string) {
+	log.Printf(Magenta("Start HTTP Gateway at Address: %s"), addr)
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      g,
+		ReadTimeout:  HTTP_GATEWAY_READ_TIMEOUT,
+		WriteTimeout: HTTP_GATEWAY_WRITE_TIMEOUT,
+		IdleTimeout:  HTTP_GATEWAY_IDLE_TIMEOUT,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.ErrorErrorf(err, "HTTP Gateway Error: %v", err)
+	}
+}
+
+type httpGatewayError struct {
+	Type    int32  `json:"type"`
+	Message string `json:"message"`
+}
+
+func writeGatewayError(w http.ResponseWriter, status int, excType int32, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": &httpGatewayError{Type: excType, Message: message}})
+}
+
+func (g *HttpGateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeGatewayError(w, http.StatusMethodNotAllowed, thrift.UNKNOWN_APPLICATION_EXCEPTION, "POST /{service}/{method} only")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		writeGatewayError(w, http.StatusNotFound, thrift.UNKNOWN_METHOD, "POST /{service}/{method} only")
+		return
+	}
+	service, method := parts[0], parts[1]
+
+	idl, ok := g.idls[service]
+	if !ok {
+		writeGatewayError(w, http.StatusNotFound, thrift.UNKNOWN_METHOD, fmt.Sprintf("Service: %s Not Found", service))
+		return
+	}
+	f := idl.Function(service, method)
+	if f == nil {
+		writeGatewayError(w, http.StatusNotFound, thrift.UNKNOWN_METHOD, fmt.Sprintf("Method: %s.%s Not Found", service, method))
+		return
+	}
+	if f.Oneway {
+		writeGatewayError(w, http.StatusBadRequest, thrift.UNKNOWN_METHOD, fmt.Sprintf("Oneway method: %s.%s not supported", service, method))
+		return
+	}
+
+	var args map[string]interface{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, HTTP_GATEWAY_MAX_BODY_SIZE))
+	decoder.UseNumber()
+	if err := decoder.Decode(&args); err != nil && err != io.EOF {
+		writeGatewayError(w, http.StatusBadRequest, thrift.PROTOCOL_ERROR, fmt.Sprintf("Invalid JSON body: %v", err))
+		return
+	}
+
+	seqId := atomic.AddInt32(&g.seqId, 1)
+	data, err := encodeGatewayCall(service+":"+method, seqId, f, args, req.Header.Get("traceparent"))
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, thrift.PROTOCOL_ERROR, err.Error())
+		return
+	}
+
+	r, err := NewRequest(data, true)
+	if err != nil {
+		writeGatewayError(w, http.StatusBadRequest, thrift.PROTOCOL_ERROR, err.Error())
+		return
+	}
+	if g.verbose {
+		log.Printf("HTTP Gateway Request: %s.%s, SeqId: %d", service, method, seqId)
+	}
+
+	// 和Session一样: Dispatch, 等待结果, 统计
+	startRequestTrace(r)
+	if err := g.dispatcher.Dispatch(r); err != nil {
+		r.Response.Err = err
+	}
+	r.Wait.Wait()
+	if r.Response.Err != nil {
+		r.Response.Data = GetThriftException(r, "http_gateway")
+	}
+
+	usecs := microseconds() - r.Start
+	incrOpStats(r, usecs)
+	observeRequestMetrics(r, usecs)
+	logAccess(r, req.RemoteAddr, usecs)
+	finishRequestTrace(r, TRACE_SPAN_WIRE)
+
+	status, body := decodeGatewayReply(r, f)
+	r.Recycle()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+//
+// 将JSON参数转换成为thrift message(TBinaryProtocol)
+// traceparent: HTTP header中的trace context, 作为trace field(参考: tracing.go)传递
+//
+func encodeGatewayCall(name string, seqId int32, f *IdlFunction, args map[string]interface{}, traceParent string) ([]byte, error) {
+	transport := thrift.NewTMemoryBufferLen(1024)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+
+	protocol.WriteMessageBegin(name, thrift.CALL, seqId)
+	protocol.WriteStructBegin(f.Args.Name)
+	if _, ok := parseTraceParent([]byte(traceParent)); ok {
+		protocol.WriteFieldBegin("", thrift.STRING, TRACE_FIELD_ID)
+		protocol.WriteString(traceParent)
+		protocol.WriteFieldEnd()
+	}
+	if err := writeJSONFields(protocol, f.Args, args, HTTP_GATEWAY_MAX_DEPTH); err != nil {
+		return nil, err
+	}
+	protocol.WriteFieldStop()
+	protocol.WriteStructEnd()
+	protocol.WriteMessageEnd()
+	protocol.Flush()
+
+	data := getSlice(transport.Len(), transport.Len())
+	copy(data, transport.Bytes())
+	return data, nil
+}
+
+//
+// 解析返回的thrift message, 转换成为HTTP的status和JSON
+//
+func decodeGatewayReply(r *Request, f *IdlFunction) (int, interface{}) {
+	transport := NewTMemoryBufferWithBuf(r.Response.Data)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+
+	_, typeId, _, err := protocol.ReadMessageBegin()
+	if err != nil {
+		return http.StatusBadGateway, map[string]interface{}{"error": &httpGatewayError{thrift.PROTOCOL_ERROR, err.Error()}}
+	}
+
+	if typeId == thrift.EXCEPTION {
+		exc, err := thrift.NewTApplicationException(thrift.UNKNOWN_APPLICATION_EXCEPTION, "").Read(protocol)
+		if err != nil {
+			return http.StatusBadGateway, map[string]interface{}{"error": &httpGatewayError{thrift.PROTOCOL_ERROR, err.Error()}}
+		}
+		status := http.StatusBadGateway
+		if exc.TypeId() == TIMEOUT_APPLICATION_EXCEPTION {
+			status = http.StatusGatewayTimeout
+		} else if exc.TypeId() == RATE_LIMITED_APPLICATION_EXCEPTION {
+			status = http.StatusTooManyRequests
+		} else if exc.TypeId() == OVERLOADED_APPLICATION_EXCEPTION || r.Response.NotFound {
+			status = http.StatusServiceUnavailable
+		}
+		return status, map[string]interface{}{"error": &httpGatewayError{exc.TypeId(), exc.Error()}}
+	}
+
+	// result struct: 0为返回值, 其他为声明的exceptions
+	result := &IdlStruct{Name: f.Name + "_result", Fields: f.Throws}
+	if f.Returns != nil {
+		result.Fields = append([]*IdlField{{Id: 0, Name: "success", Type: f.Returns}}, f.Throws...)
+	}
+	value, err := readJSONValue(protocol, &IdlType{TType: thrift.STRUCT, Struct: result}, HTTP_GATEWAY_MAX_DEPTH)
+	if err != nil {
+		return http.StatusBadGateway, map[string]interface{}{"error": &httpGatewayError{thrift.PROTOCOL_ERROR, err.Error()}}
+	}
+
+	fields := value.(map[string]interface{})
+	for _, field := range f.Throws {
+		if v, ok := fields[field.Name]; ok {
+			return http.StatusOK, map[string]interface{}{
+				"exception": map[string]interface{}{"name": field.Name, "type": field.Type.Name, "value": v},
+			}
+		}
+	}
+	if v, ok := fields["success"]; ok {
+		return http.StatusOK, map[string]interface{}{"result": v}
+	}
+	if f.Returns != nil {
+		return http.StatusBadGateway, map[string]interface{}{
+			"error": &httpGatewayError{thrift.MISSING_RESULT, fmt.Sprintf("%s failed: unknown result", f.Name)},
+		}
+	}
+	return http.StatusOK, map[string]interface{}{"result": nil}
+}
+
+func writeJSONStruct(protocol thrift.TProtocol, s *IdlStruct, v map[string]interface{}, depth int) error {
+	protocol.WriteStructBegin(s.Name)
+	if err := writeJSONFields(protocol, s, v, depth); err != nil {
+		return err
+	}
+	protocol.WriteFieldStop()
+	return protocol.WriteStructEnd()
+}
+
+func writeJSONFields(protocol thrift.TProtocol, s *IdlStruct, v map[string]interface{}, depth int) error {
+	for key := range v {
+		found := false
+		for _, field := range s.Fields {
+			found = found || field.Name == key
+		}
+		if !found {
+			return fmt.Errorf("%s: unknown field %s", s.Name, key)
+		}
+	}
+
+	for _, field := range s.Fields {
+		value, ok := v[field.Name]
+		if !ok || value == nil {
+			if field.Required {
+				return fmt.Errorf("%s: required field %s is missing", s.Name, field.Name)
+			}
+			continue
+		}
+		protocol.WriteFieldBegin(field.Name, field.Type.TType, field.Id)
+		if err := writeJSONValue(protocol, field.Type, value, depth-1); err != nil {
+			return fmt.Errorf("%s.%s: %v", s.Name, field.Name, err)
+		}
+		protocol.WriteFieldEnd()
+	}
+	return nil
+}
+
+func writeJSONValue(protocol thrift.TProtocol, t *IdlType, v interface{}, depth int) error {
+	if depth <= 0 {
+		return errors.New("depth limit exceeded")
+	}
+
+	switch t.TType {
+	case thrift.BOOL:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("expect bool, got %v", v)
+		}
+		return protocol.WriteBool(b)
+	case thrift.BYTE, thrift.I16, thrift.I32, thrift.I64:
+		i, err := jsonToInt(t, v)
+		if err != nil {
+			return err
+		}
+		switch t.TType {
+		case thrift.BYTE:
+			return protocol.WriteByte(int8(i))
+		case thrift.I16:
+			return protocol.WriteI16(int16(i))
+		case thrift.I32:
+			return protocol.WriteI32(int32(i))
+		default:
+			return protocol.WriteI64(i)
+		}
+	case thrift.DOUBLE:
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("expect number, got %v", v)
+		}
+		d, err := n.Float64()
+		if err != nil {
+			return err
+		}
+		return protocol.WriteDouble(d)
+	case thrift.STRING:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expect string, got %v", v)
+		}
+		if t.Binary {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return err
+			}
+			return protocol.WriteBinary(b)
+		}
+		return protocol.WriteString(s)
+	case thrift.STRUCT:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expect object, got %v", v)
+		}
+		return writeJSONStruct(protocol, t.Struct, m, depth)
+	case thrift.LIST, thrift.SET:
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("expect array, got %v", v)
+		}
+		if t.TType == thrift.LIST {
+			protocol.WriteListBegin(t.Elem.TType, len(items))
+		} else {
+			protocol.WriteSetBegin(t.Elem.TType, len(items))
+		}
+		for _, item := range items {
+			if err := writeJSONValue(protocol, t.Elem, item, depth-1); err != nil {
+				return err
+			}
+		}
+		if t.TType == thrift.LIST {
+			return protocol.WriteListEnd()
+		}
+		return protocol.WriteSetEnd()
+	case thrift.MAP:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expect object, got %v", v)
+		}
+		// key按照顺序写入, 保证相同的请求得到相同的数据(例如: hash_key)
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		protocol.WriteMapBegin(t.Key.TType, t.Elem.TType, len(keys))
+		for _, key := range keys {
+			k, err := jsonMapKey(t.Key, key)
+			if err != nil {
+				return err
+			}
+			if err = writeJSONValue(protocol, t.Key, k, depth-1); err != nil {
+				return err
+			}
+			if err = writeJSONValue(protocol, t.Elem, m[key], depth-1); err != nil {
+				return err
+			}
+		}
+		return protocol.WriteMapEnd()
+	}
+	return fmt.Errorf("unsupported type: %s", t.Name)
+}
+
+func jsonToInt(t *IdlType, v interface{}) (int64, error) {
+	var i int64
+	var err error
+	switch n := v.(type) {
+	case json.Number:
+		i, err = strconv.ParseInt(string(n), 10, 64)
+	case string:
+		if value, ok := t.Enum.lookup(n); ok {
+			return int64(value), nil
+		}
+		i, err = strconv.ParseInt(n, 10, 64)
+	default:
+		err = fmt.Errorf("expect integer, got %v", v)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var min, max int64 = math.MinInt64, math.MaxInt64
+	switch t.TType {
+	case thrift.BYTE:
+		min, max = math.MinInt8, math.MaxInt8
+	case thrift.I16:
+		min, max = math.MinInt16, math.MaxInt16
+	case thrift.I32:
+		min, max = math.MinInt32, math.MaxInt32
+	}
+	if i < min || i > max {
+		return 0, fmt.Errorf("%d out of range for %s", i, t.Name)
+	}
+	return i, nil
+}
+
+func (e *IdlEnum) lookup(name string) (int32, bool) {
+	if e == nil {
+		return 0, false
+	}
+	v, ok := e.Values[name]
+	return v, ok
+}
+
+// JSON object的key都是string, 按照map的key类型转换
+func jsonMapKey(t *IdlType, key string) (interface{}, error) {
+	switch t.TType {
+	case thrift.STRING:
+		return key, nil
+	case thrift.BOOL:
+		return strconv.ParseBool(key)
+	case thrift.BYTE, thrift.I16, thrift.I32, thrift.I64:
+		if _, ok := t.Enum.lookup(key); ok {
+			return key, nil
+		}
+		return json.Number(key), nil
+	case thrift.DOUBLE:
+		return json.Number(key), nil
+	}
+	return nil, fmt.Errorf("unsupported map key type: %s", t.Name)
+}
+
+//
+// 按照IDL读取thrift的数据, 转换成为JSON; IDL中没有的field(或者类型不一致)被忽略
+//
+func readJSONValue(protocol thrift.TProtocol, t *IdlType, depth int) (interface{}, error) {
+	if depth <= 0 {
+		return nil, errors.New("depth limit exceeded")
+	}
+
+	switch t.TType {
+	case thrift.BOOL:
+		return protocol.ReadBool()
+	case thrift.BYTE:
+		v, err := protocol.ReadByte()
+		return int64(v), err
+	case thrift.I16:
+		v, err := protocol.ReadI16()
+		return int64(v), err
+	case thrift.I32:
+		v, err := protocol.ReadI32()
+		if err == nil && t.Enum != nil {
+			if name, ok := t.Enum.Names[v]; ok {
+				return name, nil
+			}
+		}
+		return int64(v), err
+	case thrift.I64:
+		return protocol.ReadI64()
+	case thrift.DOUBLE:
+		return protocol.ReadDouble()
+	case thrift.STRING:
+		if t.Binary {
+			v, err := protocol.ReadBinary()
+			return base64.StdEncoding.EncodeToString(v), err
+		}
+		return protocol.ReadString()
+	case thrift.STRUCT:
+		if _, err := protocol.ReadStructBegin(); err != nil {
+			return nil, err
+		}
+		result := make(map[string]interface{})
+		for {
+			_, fieldType, fieldId, err := protocol.ReadFieldBegin()
+			if err != nil {
+				return nil, err
+			}
+			if fieldType == thrift.STOP {
+				break
+			}
+
+			var field *IdlField
+			for _, f := range t.Struct.Fields {
+				if f.Id == fieldId && f.Type.TType == fieldType {
+					field = f
+				}
+			}
+			if field == nil {
+				err = protocol.Skip(fieldType)
+			} else {
+				result[field.Name], err = readJSONValue(protocol, field.Type, depth-1)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err = protocol.ReadFieldEnd(); err != nil {
+				return nil, err
+			}
+		}
+		return result, protocol.ReadStructEnd()
+	case thrift.LIST, thrift.SET:
+		var elemType thrift.TType
+		var size int
+		var err error
+		if t.TType == thrift.LIST {
+			elemType, size, err = protocol.ReadListBegin()
+		} else {
+			elemType, size, err = protocol.ReadSetBegin()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if elemType != t.Elem.TType && size > 0 {
+			return nil, fmt.Errorf("%s: unexpected element type %d", t.Name, elemType)
+		}
+		result := make([]interface{}, 0, gatewayPreallocSize(size))
+		for i := 0; i < size; i++ {
+			v, err := readJSONValue(protocol, t.Elem, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, v)
+		}
+		if t.TType == thrift.LIST {
+			return result, protocol.ReadListEnd()
+		}
+		return result, protocol.ReadSetEnd()
+	case thrift.MAP:
+		keyType, valueType, size, err := protocol.ReadMapBegin()
+		if err != nil {
+			return nil, err
+		}
+		if (keyType != t.Key.TType || valueType != t.Elem.TType) && size > 0 {
+			return nil, fmt.Errorf("%s: unexpected key/value type %d/%d", t.Name, keyType, valueType)
+		}
+		result := make(map[string]interface{}, gatewayPreallocSize(size))
+		for i := 0; i < size; i++ {
+			k, err := readJSONValue(protocol, t.Key, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := readJSONValue(protocol, t.Elem, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			result[fmt.Sprint(k)] = v
+		}
+		return result, protocol.ReadMapEnd()
+	}
+	return nil, fmt.Errorf("unsupported type: %s", t.Name)
+}
+
+//
+// list/map预先分配的大小: 不直接使用后端返回的长度
+//
+func gatewayPreallocSize(size int) int {
+	if size < 0 {
+		return 0
+	}
+	if size > HTTP_GATEWAY_MAX_PREALLOC {
+		return HTTP_GATEWAY_MAX_PREALLOC
+	}
+	return size
+}
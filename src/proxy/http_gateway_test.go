@@ -0,0 +1,307 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+const testSharedIdl = `
+namespace py shared
+/* 公共的类型 */
+enum Gender {
+  UNKNOWN = 0,
+  MALE = 1;
+  FEMALE
+}
+
+typedef i64 UserId
+
+exception UserNotFound {
+  1: UserId user_id
+  2: string message
+}
+`
+
+const testTypoIdl = `
+include "shared.thrift"
+namespace go typo
+
+const i32 MAX_USERS = 100
+const list<string> DEFAULT_FIELDS = ["name", "gender"]
+
+struct User {
+  1: required shared.UserId id,
+  2: optional string name = "",
+  3: shared.Gender gender (go.tag = "json"),
+  4: list<string> tags,
+  5: map<i32, double> scores,
+  6: binary avatar,
+}
+
+service BaseService {
+  string ping()
+}
+
+service Typo extends BaseService {
+  # 获取用户信息
+  User get_user(1: shared.UserId user_id, 2: set<string> fields) throws (1: shared.UserNotFound e),
+  void touch(1: i64 user_id);
+  oneway void log(1: string msg)
+}
+`
+
+func loadTestIdl(t *testing.T) (*ThriftIdl, string) {
+	dir, err := ioutil.TempDir("", "thrift_idl")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "shared.thrift"), []byte(testSharedIdl), 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "typo.thrift"), []byte(testTypoIdl), 0644))
+
+	idl, err := LoadThriftIdl(path.Join(dir, "typo.thrift"))
+	assert.NoError(t, err)
+	return idl, dir
+}
+
+//
+// go test proxy -v -run "TestThriftIdl"
+//
+func TestThriftIdl(t *testing.T) {
+	idl, dir := loadTestIdl(t)
+	defer os.RemoveAll(dir)
+
+	f := idl.Function("typo", "get_user")
+	assert.NotNil(t, f)
+	assert.Equal(t, thrift.STRUCT, f.Returns.TType)
+	assert.Equal(t, "User", f.Returns.Struct.Name)
+	assert.Equal(t, 2, len(f.Args.Fields))
+	assert.Equal(t, thrift.I64, f.Args.Fields[0].Type.TType)
+	assert.Equal(t, thrift.SET, f.Args.Fields[1].Type.TType)
+	assert.Equal(t, 1, len(f.Throws))
+	assert.True(t, f.Throws[0].Type.Struct.IsException)
+
+	user := f.Returns.Struct
+	assert.Equal(t, 6, len(user.Fields))
+	assert.True(t, user.Fields[0].Required)
+	assert.Equal(t, thrift.I32, user.Fields[2].Type.TType)
+	assert.Equal(t, int32(2), user.Fields[2].Type.Enum.Values["FEMALE"])
+	assert.Equal(t, thrift.MAP, user.Fields[4].Type.TType)
+	assert.Equal(t, thrift.DOUBLE, user.Fields[4].Type.Elem.TType)
+	assert.True(t, user.Fields[5].Type.Binary)
+
+	// extends的service中的函数
+	assert.Nil(t, idl.Function("typo", "ping").Returns.Struct)
+	assert.Nil(t, idl.Function("typo", "touch").Returns)
+	assert.True(t, idl.Function("typo", "log").Oneway)
+	assert.Nil(t, idl.Function("typo", "unknown"))
+
+	// 按照service查找: 多个service中有同名的函数
+	idl, err := ParseThriftIdl("user", `
+service UserService { i32 get(1: i32 id) }
+service Account { string get(1: string name) }`)
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.I32, idl.Function("UserService", "get").Returns.TType)
+	assert.Equal(t, thrift.STRING, idl.Function("account", "get").Returns.TType)
+	assert.Equal(t, thrift.STRING, idl.Function("user.Account", "get").Returns.TType)
+	// 不能确定是哪一个service
+	assert.Nil(t, idl.Function("user", "get"))
+
+	// extends的循环
+	_, err = ParseThriftIdl("typo", "service A extends B {}\nservice B extends A {}")
+	assert.True(t, err != nil)
+	_, err = ParseThriftIdl("typo", "service A extends A {}")
+	assert.True(t, err != nil)
+
+	// 没有定义的类型
+	_, err = ParseThriftIdl("typo", "struct A { 1: B b }")
+	assert.True(t, err != nil)
+	_, err = ParseThriftIdl("typo", "struct A { 1: i32 a ")
+	assert.True(t, err != nil)
+}
+
+//
+// 按照IDL解析参数, 返回固定的结果
+//
+type fakeGatewayServer struct {
+	idl  *ThriftIdl
+	args map[string]interface{}
+}
+
+func (s *fakeGatewayServer) Dispatch(r *Request) error {
+	f := s.idl.Function(r.Service, r.Request.Name)
+
+	transport := NewTMemoryBufferWithBuf(r.Request.Data)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+	protocol.ReadMessageBegin()
+	args, _ := readJSONValue(protocol, &IdlType{TType: thrift.STRUCT, Struct: f.Args}, HTTP_GATEWAY_MAX_DEPTH)
+	s.args = args.(map[string]interface{})
+
+	output := thrift.NewTMemoryBufferLen(1024)
+	protocol = thrift.NewTBinaryProtocolTransport(output)
+	protocol.WriteMessageBegin(r.Request.Name, thrift.REPLY, r.Request.SeqId)
+	protocol.WriteStructBegin("result")
+	if s.args["user_id"] == int64(404) {
+		protocol.WriteFieldBegin("e", thrift.STRUCT, 1)
+		protocol.WriteStructBegin("UserNotFound")
+		protocol.WriteFieldBegin("user_id", thrift.I64, 1)
+		protocol.WriteI64(404)
+		protocol.WriteFieldEnd()
+		protocol.WriteFieldStop()
+		protocol.WriteStructEnd()
+		protocol.WriteFieldEnd()
+	} else if f.Returns != nil {
+		protocol.WriteFieldBegin("success", thrift.STRUCT, 0)
+		writeJSONValue(protocol, f.Returns, map[string]interface{}{
+			"id":     json.Number("1"),
+			"name":   "Alice",
+			"gender": "FEMALE",
+			"tags":   []interface{}{"a", "b"},
+			"scores": map[string]interface{}{"1": json.Number("0.5")},
+			"avatar": "AQI=",
+		}, HTTP_GATEWAY_MAX_DEPTH)
+		protocol.WriteFieldEnd()
+	}
+	protocol.WriteFieldStop()
+	protocol.WriteStructEnd()
+	protocol.WriteMessageEnd()
+	r.Response.Data = output.Bytes()
+	return nil
+}
+
+type fakeErrorServer struct {
+	notFound bool
+}
+
+func (s *fakeErrorServer) Dispatch(r *Request) error {
+	if s.notFound {
+		r.Response.Data = GetServiceNotFoundData(r)
+	} else {
+		r.Response.Err = r.NewTimeoutError()
+	}
+	return nil
+}
+
+func postGateway(g *HttpGateway, url string, body string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("POST", url, strings.NewReader(body)))
+
+	var result map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return w.Code, result
+}
+
+//
+// go test proxy -v -run "TestHttpGateway"
+//
+func TestHttpGateway(t *testing.T) {
+	idl, dir := loadTestIdl(t)
+	defer os.RemoveAll(dir)
+
+	server := &fakeGatewayServer{idl: idl}
+	config := &HttpGatewayConfig{Idls: map[string]string{"typo": path.Join(dir, "typo.thrift")}}
+	g, err := NewHttpGateway(config, server, false)
+	assert.NoError(t, err)
+
+	// 1. 正常返回
+	code, result := postGateway(g, "/typo/get_user", `{"user_id": 1, "fields": ["name", "tags"]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, int64(1), server.args["user_id"])
+	assert.Equal(t, []interface{}{"name", "tags"}, server.args["fields"])
+	assert.Equal(t, map[string]interface{}{
+		"id":     float64(1),
+		"name":   "Alice",
+		"gender": "FEMALE",
+		"tags":   []interface{}{"a", "b"},
+		"scores": map[string]interface{}{"1": 0.5},
+		"avatar": "AQI=",
+	}, result["result"])
+
+	// void
+	code, result = postGateway(g, "/typo/touch", `{"user_id": "2"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, result["result"])
+	assert.Equal(t, int64(2), server.args["user_id"])
+
+	// 2. IDL中声明的exception
+	code, result = postGateway(g, "/typo/get_user", `{"user_id": 404}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"name":  "e",
+		"type":  "shared.UserNotFound",
+		"value": map[string]interface{}{"user_id": float64(404)},
+	}, result["exception"])
+
+	// 3. 不合法的请求
+	code, _ = postGateway(g, "/typo/get_user", `{"user_id": "abc"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postGateway(g, "/typo/get_user", `{"user": 1}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postGateway(g, "/typo/get_user", `{"user_id": 1`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postGateway(g, "/typo/log", `{"msg": "hello"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = postGateway(g, "/typo/unknown", `{}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = postGateway(g, "/user/get_user", `{}`)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest("GET", "/typo/get_user", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+//
+// go test proxy -v -run "TestHttpGatewayException"
+//
+func TestHttpGatewayException(t *testing.T) {
+	_, dir := loadTestIdl(t)
+	defer os.RemoveAll(dir)
+
+	config := &HttpGatewayConfig{Idls: map[string]string{"typo": path.Join(dir, "typo.thrift")}}
+
+	// 和Router一样: 没有对应的服务
+	server := &fakeErrorServer{notFound: true}
+	g, err := NewHttpGateway(config, server, false)
+	assert.NoError(t, err)
+	code, result := postGateway(g, "/typo/get_user", `{"user_id": 1}`)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, result["error"].(map[string]interface{})["message"], "Not Found")
+
+	// 超时
+	server.notFound = false
+	code, result = postGateway(g, "/typo/get_user", `{"user_id": 1}`)
+	assert.Equal(t, http.StatusGatewayTimeout, code)
+	assert.Equal(t, float64(TIMEOUT_APPLICATION_EXCEPTION), result["error"].(map[string]interface{})["type"])
+}
+
+//
+// go test proxy -v -run "TestReadJSONValueCorruptSize"
+//
+func TestReadJSONValueCorruptSize(t *testing.T) {
+	listType := &IdlType{Name: "list<i64>", TType: thrift.LIST, Elem: &IdlType{Name: "i64", TType: thrift.I64}}
+	mapType := &IdlType{Name: "map<string,i64>", TType: thrift.MAP,
+		Key: &IdlType{Name: "string", TType: thrift.STRING}, Elem: &IdlType{Name: "i64", TType: thrift.I64}}
+
+	// 长度异常(远大于实际的数据)时直接返回错误, 不按照长度预先分配内存
+	buf := thrift.NewTMemoryBufferLen(64)
+	protocol := thrift.NewTBinaryProtocolTransport(buf)
+	protocol.WriteListBegin(thrift.I64, 1<<30)
+	protocol.WriteI64(1)
+	_, err := readJSONValue(protocol, listType, HTTP_GATEWAY_MAX_DEPTH)
+	assert.Error(t, err)
+
+	buf = thrift.NewTMemoryBufferLen(64)
+	protocol = thrift.NewTBinaryProtocolTransport(buf)
+	protocol.WriteMapBegin(thrift.STRING, thrift.I64, 1<<30)
+	_, err = readJSONValue(protocol, mapType, HTTP_GATEWAY_MAX_DEPTH)
+	assert.Error(t, err)
+}
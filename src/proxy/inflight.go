@@ -0,0 +1,111 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"sync"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	DEFAULT_MAX_INFLIGHT_PER_SESSION = 1000
+)
+
+//
+// 正在处理的请求数的上限: 到达上限之后Acquire阻塞, 直到有请求处理完毕
+// NonBlockSession在读取下一个frame之前Acquire, 因此到达上限之后不再读取socket, 由TCP的流控反馈给Client
+//
+type InflightLimiter struct {
+	limit   int
+	slots   chan struct{} // limit <= 0时为nil, 只计数不限制
+	current atomic2.Int64
+	blocked *atomic2.Int64 // 因为到达上限而等待的次数
+}
+
+func NewInflightLimiter(limit int) *InflightLimiter {
+	return newInflightLimiter(limit, new(atomic2.Int64))
+}
+
+//
+// 所有Session的limiter共享同一个blocked计数
+//
+func newSessionInflightLimiter(limit int) *InflightLimiter {
+	return newInflightLimiter(limit, &inflightState.sessionBlocked)
+}
+
+func newInflightLimiter(limit int, blocked *atomic2.Int64) *InflightLimiter {
+	l := &InflightLimiter{limit: limit, blocked: blocked}
+	if limit > 0 {
+		l.slots = make(chan struct{}, limit)
+	}
+	return l
+}
+
+func (l *InflightLimiter) Acquire() {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			l.blocked.Incr()
+			l.slots <- struct{}{}
+		}
+	}
+	l.current.Incr()
+}
+
+func (l *InflightLimiter) Release() {
+	l.current.Decr()
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *InflightLimiter) Limit() int {
+	return l.limit
+}
+
+func (l *InflightLimiter) Inflight() int64 {
+	return l.current.Get()
+}
+
+// 对于Session的limiter, 为所有Session的总数
+func (l *InflightLimiter) Blocked() int64 {
+	return l.blocked.Get()
+}
+
+//
+// 所有NonBlockSession共享的上限(max_inflight), 默认不限制
+// Session在Serve开始时获取, 因此修改只对之后的Session生效
+//
+var inflightState struct {
+	lock    sync.RWMutex
+	limiter *InflightLimiter
+
+	// 所有Session因为到达各自的上限(max_inflight_per_session)而等待的次数
+	sessionBlocked atomic2.Int64
+}
+
+func init() {
+	inflightState.limiter = NewInflightLimiter(0)
+}
+
+func getGlobalInflight() *InflightLimiter {
+	inflightState.lock.RLock()
+	defer inflightState.lock.RUnlock()
+	return inflightState.limiter
+}
+
+//
+// 设置所有NonBlockSession正在处理的请求数的上限, limit <= 0表示不限制; 在开始Serve之前调用
+//
+func SetMaxInflight(limit int) {
+	inflightState.lock.Lock()
+	inflightState.limiter = NewInflightLimiter(limit)
+	inflightState.lock.Unlock()
+
+	if limit > 0 {
+		log.Printf(Green("Max inflight requests: %d"), limit)
+	}
+}
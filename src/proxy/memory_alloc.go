@@ -6,6 +6,8 @@ package proxy
 import (
 	"reflect"
 	"unsafe"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
 )
 
 const (
@@ -15,6 +17,14 @@ const (
 var memoryBuffer1024 chan []byte = make(chan []byte, 1000) // 1M
 var memoryBuffer2048 chan []byte = make(chan []byte, 1000) // 2M
 
+// 内存池的命中情况, 用于metrics
+type memoryPoolStats struct {
+	hits   atomic2.Int64
+	misses atomic2.Int64
+}
+
+var memoryPool1024Stats, memoryPool2048Stats memoryPoolStats
+
 func debugBuffer1024Size() int {
 	return len(memoryBuffer1024)
 }
@@ -37,13 +47,17 @@ func getSlice(initSize int, capacity int) []byte {
 	if capacity < DEFAULT_SLICE_LEN {
 		select {
 		case result = <-memoryBuffer1024:
+			memoryPool1024Stats.hits.Incr()
 		default:
+			memoryPool1024Stats.misses.Incr()
 			return make([]byte, initSize, DEFAULT_SLICE_LEN)
 		}
 	} else if capacity < 2048 {
 		select {
 		case result = <-memoryBuffer2048:
+			memoryPool2048Stats.hits.Incr()
 		default:
+			memoryPool2048Stats.misses.Incr()
 			return make([]byte, initSize, 2048)
 		}
 	} else {
@@ -0,0 +1,385 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+)
+
+//
+// Prometheus的exporter: 和admin api共用profile_address对应的http server, 采用text format(0.0.4)
+// 请求的统计独立于OpStats: 按照(service, method, outcome)区分, 并且不会被StartTicker重置
+//
+func init() {
+	http.HandleFunc("/metrics", handlePrometheusMetrics)
+}
+
+// 请求latency的buckets(单位: 秒), 和Prometheus的默认值保持一致
+var prometheusLatencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestSeriesKey struct {
+	service string
+	method  string
+	outcome RequestOutcome
+}
+
+type requestSeries struct {
+	buckets [len(prometheusLatencyBuckets) + 1]atomic2.Int64 // 非累计的计数, 最后一个为+Inf
+	usecs   atomic2.Int64
+}
+
+const (
+	// service, method来自Client, 不能无限制地创建新的series
+	PROMETHEUS_MAX_METHODS = 1000
+	PROMETHEUS_OTHER_LABEL = "other"
+)
+
+var requestMetrics struct {
+	lock   sync.RWMutex
+	series map[requestSeriesKey]*requestSeries
+
+	// 已经分配了series的(service, method), 最多PROMETHEUS_MAX_METHODS个
+	methods  map[opStatsKey]bool
+	services map[string]bool
+}
+
+func init() {
+	requestMetrics.series = make(map[requestSeriesKey]*requestSeries)
+	requestMetrics.methods = make(map[opStatsKey]bool)
+	requestMetrics.services = make(map[string]bool)
+}
+
+//
+// 记录一个请求的结果(在Session返回结果时调用, 心跳不计入)
+//
+func observeRequestMetrics(r *Request, usecs int64) {
+	if r.Request.TypeId == MESSAGE_TYPE_HEART_BEAT {
+		return
+	}
+	key := requestSeriesKey{service: r.Service, method: r.Request.Name, outcome: r.Outcome()}
+	// 没有找到Service/Worker: proxy/lb无法确认method是否存在
+	if r.Response.NotFound {
+		key.method = PROMETHEUS_OTHER_LABEL
+	}
+
+	// 已经登记的method, 或者超过上限之后合并到other中的method, 只需要读锁
+	var series *requestSeries
+	requestMetrics.lock.RLock()
+	if len(requestMetrics.methods) >= PROMETHEUS_MAX_METHODS ||
+		requestMetrics.methods[opStatsKey{service: key.service, method: key.method}] {
+		folded := key
+		folded.service, folded.method = requestMetricsLabels(key.service, key.method, false)
+		series = requestMetrics.series[folded]
+	}
+	requestMetrics.lock.RUnlock()
+
+	if series == nil {
+		requestMetrics.lock.Lock()
+		key.service, key.method = requestMetricsLabels(key.service, key.method, true)
+		series = requestMetrics.series[key]
+		if series == nil {
+			series = &requestSeries{}
+			requestMetrics.series[key] = series
+		}
+		requestMetrics.lock.Unlock()
+	}
+
+	seconds := float64(usecs) * 1e-6
+	i := sort.SearchFloat64s(prometheusLatencyBuckets[:], seconds)
+	series.buckets[i].Incr()
+	series.usecs.Add(usecs)
+}
+
+//
+// Prometheus中使用的(service, method)标签: 超过PROMETHEUS_MAX_METHODS之后, 新的method统一为other,
+// 新的service也统一为other; add为true时登记新的(service, method)
+// 需要在 requestMetrics.lock 的保护下调用
+//
+func requestMetricsLabels(service string, method string, add bool) (string, string) {
+	key := opStatsKey{service: service, method: method}
+	if requestMetrics.methods[key] {
+		return service, method
+	}
+	if len(requestMetrics.methods) >= PROMETHEUS_MAX_METHODS || !add {
+		if !requestMetrics.services[service] {
+			service = PROMETHEUS_OTHER_LABEL
+		}
+		return service, PROMETHEUS_OTHER_LABEL
+	}
+	requestMetrics.methods[key] = true
+	requestMetrics.services[service] = true
+	return service, method
+}
+
+func handlePrometheusMetrics(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	writePrometheusMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func writePrometheusMetrics(buf *bytes.Buffer) {
+	writeRequestMetrics(buf)
+	writeOpStatsMetrics(buf)
+
+	// 1. rpc_proxy: 每个服务的BackendConn
+	writePrometheusHeader(buf, "rpc_backend_active_conns", "gauge", "Active backend connections per service.")
+	for _, router := range adminRouters() {
+		for _, s := range router.BackServices() {
+			writePrometheusSample(buf, "rpc_backend_active_conns", s.Active(), "service", s.serviceName)
+		}
+	}
+	writePrometheusHeader(buf, "rpc_backend_in_flight", "gauge", "Requests sent to a backend connection and waiting for the response (RequestMap size).")
+	for _, router := range adminRouters() {
+		for _, s := range router.BackServices() {
+			for _, conn := range s.Conns() {
+				writePrometheusSample(buf, "rpc_backend_in_flight", conn.seqNumRequestMap.Len(),
+					"service", s.serviceName, "addr", conn.Addr())
+			}
+		}
+	}
+
+	writePrometheusHeader(buf, "rpc_backend_queue_overflows_total", "counter", "Requests not accepted because the backend connection queue was full.")
+	for _, router := range adminRouters() {
+		for _, s := range router.BackServices() {
+			for _, conn := range s.Conns() {
+				writePrometheusSample(buf, "rpc_backend_queue_overflows_total", conn.overflows.Get(),
+					"service", s.serviceName, "addr", conn.Addr())
+			}
+		}
+	}
+
+	// 2. rpc_lb: Worker
+	writePrometheusHeader(buf, "rpc_lb_workers", "gauge", "Workers connected to the load balancer.")
+	for _, s := range adminLBs() {
+		writePrometheusSample(buf, "rpc_lb_workers", s.Active(), "service", s.serviceName)
+	}
+	writePrometheusHeader(buf, "rpc_lb_worker_in_flight", "gauge", "Requests sent to a worker and waiting for the response (RequestMap size).")
+	for _, s := range adminLBs() {
+		for _, conn := range s.Workers() {
+			writePrometheusSample(buf, "rpc_lb_worker_in_flight", conn.seqNumRequestMap.Len(),
+				"service", s.serviceName, "addr", conn.Addr())
+		}
+	}
+
+	writePrometheusHeader(buf, "rpc_lb_worker_queue_overflows_total", "counter", "Requests not accepted because the worker connection queue was full.")
+	for _, s := range adminLBs() {
+		for _, conn := range s.Workers() {
+			writePrometheusSample(buf, "rpc_lb_worker_queue_overflows_total", conn.overflows.Get(),
+				"service", s.serviceName, "addr", conn.Addr())
+		}
+	}
+
+	// 3. Session
+	var proxySessions, nonBlockSessions int
+	for _, s := range adminSessions() {
+		switch s.(type) {
+		case *Session:
+			proxySessions++
+		case *NonBlockSession:
+			nonBlockSessions++
+		}
+	}
+	writePrometheusHeader(buf, "rpc_sessions", "gauge", "Client sessions being served.")
+	writePrometheusSample(buf, "rpc_sessions", proxySessions, "type", "proxy")
+	writePrometheusSample(buf, "rpc_sessions", nonBlockSessions, "type", "nonblock")
+
+	// NonBlockSession(rpc_lb, rpc service)正在处理的请求
+	global := getGlobalInflight()
+	writePrometheusHeader(buf, "rpc_nonblock_in_flight", "gauge", "Requests read from nonblock sessions and not yet written back.")
+	writePrometheusSample(buf, "rpc_nonblock_in_flight", global.Inflight())
+	writePrometheusHeader(buf, "rpc_nonblock_max_in_flight", "gauge", "Limit of in-flight requests across nonblock sessions (0 means unlimited).")
+	writePrometheusSample(buf, "rpc_nonblock_max_in_flight", global.Limit())
+	writePrometheusHeader(buf, "rpc_nonblock_in_flight_blocked_total", "counter", "Times a nonblock session stopped reading because an in-flight limit was reached.")
+	writePrometheusSample(buf, "rpc_nonblock_in_flight_blocked_total", inflightState.sessionBlocked.Get(), "limit", "session")
+	writePrometheusSample(buf, "rpc_nonblock_in_flight_blocked_total", global.Blocked(), "limit", "global")
+
+	// 4. 内存池
+	writePrometheusHeader(buf, "rpc_memory_pool_gets_total", "counter", "Slices requested from the memory pools, by hit or miss.")
+	for _, pool := range []struct {
+		name  string
+		stats *memoryPoolStats
+	}{{"1024", &memoryPool1024Stats}, {"2048", &memoryPool2048Stats}} {
+		writePrometheusSample(buf, "rpc_memory_pool_gets_total", pool.stats.hits.Get(), "pool", pool.name, "result", "hit")
+		writePrometheusSample(buf, "rpc_memory_pool_gets_total", pool.stats.misses.Get(), "pool", pool.name, "result", "miss")
+	}
+	writePrometheusHeader(buf, "rpc_memory_pool_free", "gauge", "Slices available in the memory pools.")
+	writePrometheusSample(buf, "rpc_memory_pool_free", debugBuffer1024Size(), "pool", "1024")
+	writePrometheusSample(buf, "rpc_memory_pool_free", debugBuffer2048Size(), "pool", "2048")
+
+	// 5. Registry(zk等)的事件
+	writePrometheusHeader(buf, "rpc_registry_watch_events_total", "counter", "Watch events received from the registry.")
+	for i := range registryEventCounts {
+		writePrometheusSample(buf, "rpc_registry_watch_events_total", registryEventCounts[i].Get(),
+			"type", RegistryEventType(i).String())
+	}
+
+	// 6. 监控数据的输出(StartTicker)
+	if pusher := metricsSinkPusher(); pusher != nil {
+		sink := pusher.sink.Name()
+		writePrometheusHeader(buf, "rpc_metrics_sink_points_total", "counter", "Metric points pushed to the metrics sink, by sent or dropped.")
+		writePrometheusSample(buf, "rpc_metrics_sink_points_total", pusher.sent.Get(), "sink", sink, "result", "sent")
+		writePrometheusSample(buf, "rpc_metrics_sink_points_total", pusher.dropped.Get(), "sink", sink, "result", "dropped")
+		writePrometheusHeader(buf, "rpc_metrics_sink_failures_total", "counter", "Failed sends to the metrics sink.")
+		writePrometheusSample(buf, "rpc_metrics_sink_failures_total", pusher.failures.Get(), "sink", sink)
+		writePrometheusHeader(buf, "rpc_metrics_sink_pending", "gauge", "Metric points buffered for retry.")
+		writePrometheusSample(buf, "rpc_metrics_sink_pending", pusher.Pending(), "sink", sink)
+	}
+
+	// 7. 分布式追踪
+	if tracer := getTracer(); tracer != nil {
+		writePrometheusHeader(buf, "rpc_trace_spans_total", "counter", "Spans exported to the trace collector, by exported or dropped.")
+		writePrometheusSample(buf, "rpc_trace_spans_total", tracer.exported.Get(), "result", "exported")
+		writePrometheusSample(buf, "rpc_trace_spans_total", tracer.dropped.Get(), "result", "dropped")
+	}
+
+	// 8. access log
+	if l := getAccessLogger(); l != nil {
+		writePrometheusHeader(buf, "rpc_access_log_entries_total", "counter", "Access log entries, by written or dropped.")
+		writePrometheusSample(buf, "rpc_access_log_entries_total", l.written.Get(), "result", "written")
+		writePrometheusSample(buf, "rpc_access_log_entries_total", l.dropped.Get(), "result", "dropped")
+	}
+
+	writePrometheusHeader(buf, "rpc_circuit_breakers_open", "gauge", "Circuit breakers not in the closed state.")
+	open := 0
+	for _, b := range GetAllCircuitBreakers() {
+		if b.State() != BREAKER_CLOSED {
+			open++
+		}
+	}
+	writePrometheusSample(buf, "rpc_circuit_breakers_open", open)
+
+	writePrometheusHeader(buf, "rpc_goroutines", "gauge", "Number of goroutines.")
+	writePrometheusSample(buf, "rpc_goroutines", runtime.NumGoroutine())
+}
+
+//
+// rpc_requests_total和rpc_request_duration_seconds(按照service, method排序, 保证输出稳定)
+//
+func writeRequestMetrics(buf *bytes.Buffer) {
+	requestMetrics.lock.RLock()
+	keys := make([]requestSeriesKey, 0, len(requestMetrics.series))
+	for key := range requestMetrics.series {
+		keys = append(keys, key)
+	}
+	all := make(map[requestSeriesKey]*requestSeries, len(keys))
+	for _, key := range keys {
+		all[key] = requestMetrics.series[key]
+	}
+	requestMetrics.lock.RUnlock()
+
+	sort.Sort(requestSeriesKeys(keys))
+
+	writePrometheusHeader(buf, "rpc_requests_total", "counter", "Requests handled by service, method and outcome.")
+	for _, key := range keys {
+		var count int64
+		for i := range all[key].buckets {
+			count += all[key].buckets[i].Get()
+		}
+		writePrometheusSample(buf, "rpc_requests_total", count,
+			"service", key.service, "method", key.method, "outcome", key.outcome.String())
+	}
+
+	writePrometheusHeader(buf, "rpc_request_duration_seconds", "histogram", "Request latency by service, method and outcome.")
+	for _, key := range keys {
+		series := all[key]
+		labels := []string{"service", key.service, "method", key.method, "outcome", key.outcome.String()}
+
+		var cumulative int64
+		for i, le := range prometheusLatencyBuckets {
+			cumulative += series.buckets[i].Get()
+			writePrometheusSample(buf, "rpc_request_duration_seconds_bucket", cumulative,
+				append(labels, "le", strconv.FormatFloat(le, 'g', -1, 64))...)
+		}
+		count := cumulative + series.buckets[len(prometheusLatencyBuckets)].Get()
+		writePrometheusSample(buf, "rpc_request_duration_seconds_bucket", count, append(labels, "le", "+Inf")...)
+		writePrometheusSample(buf, "rpc_request_duration_seconds_sum", float64(series.usecs.Get())*1e-6, labels...)
+		writePrometheusSample(buf, "rpc_request_duration_seconds_count", count, labels...)
+	}
+}
+
+//
+// 最近一分钟的分位数(来自OpStats的LatencyHistogram, 比rpc_request_duration_seconds的buckets更精确)
+//
+func writeOpStatsMetrics(buf *bytes.Buffer) {
+	// 和rpc_requests_total使用相同的标签, 没有登记的method合并到other中
+	merged := make(map[opStatsKey]*OpStats)
+	requestMetrics.lock.RLock()
+	for _, stats := range GetWindowOpStats(1) {
+		service, method := requestMetricsLabels(stats.Service(), stats.Method(), false)
+		key := opStatsKey{service: service, method: method}
+		m := merged[key]
+		if m == nil {
+			m = newOpStats(service, method)
+			merged[key] = m
+		}
+		m.merge(stats)
+	}
+	requestMetrics.lock.RUnlock()
+
+	all := make([]*OpStats, 0, len(merged))
+	for _, stats := range merged {
+		all = append(all, stats)
+	}
+	sort.Sort(opStatsByName(all))
+
+	writePrometheusHeader(buf, "rpc_op_latency_1m_seconds", "gauge", "Request latency quantiles over the last minute by service and method.")
+	for _, stats := range all {
+		for i, value := range stats.Percentiles() {
+			writePrometheusSample(buf, "rpc_op_latency_1m_seconds", float64(value)*1e-6,
+				"service", stats.Service(), "method", stats.Method(),
+				"quantile", strconv.FormatFloat(opStatsPercentiles[i], 'g', -1, 64))
+		}
+	}
+}
+
+type opStatsByName []*OpStats
+
+func (s opStatsByName) Len() int           { return len(s) }
+func (s opStatsByName) Less(i, j int) bool { return s[i].opstr < s[j].opstr }
+func (s opStatsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type requestSeriesKeys []requestSeriesKey
+
+func (s requestSeriesKeys) Len() int      { return len(s) }
+func (s requestSeriesKeys) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s requestSeriesKeys) Less(i, j int) bool {
+	if s[i].service != s[j].service {
+		return s[i].service < s[j].service
+	}
+	if s[i].method != s[j].method {
+		return s[i].method < s[j].method
+	}
+	return s[i].outcome < s[j].outcome
+}
+
+func writePrometheusHeader(buf *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// labels: name1, value1, name2, value2, ...
+func writePrometheusSample(buf *bytes.Buffer, name string, value interface{}, labels ...string) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", labels[i], prometheusLabelEscaper.Replace(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	fmt.Fprintf(buf, " %v\n", value)
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
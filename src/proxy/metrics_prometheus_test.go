@@ -0,0 +1,126 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//
+// go test proxy -v -run "TestRequestOutcome"
+//
+func TestRequestOutcome(t *testing.T) {
+	r := newRetryTestRequest("typo:get_user", 1)
+	assert.Equal(t, OUTCOME_SUCCESS, r.Outcome())
+
+	r.Response.TypeId = thrift.EXCEPTION
+	assert.Equal(t, OUTCOME_EXCEPTION, r.Outcome())
+
+	r.Response.Data = GetWorkerNotFoundData(r, "test")
+	assert.Equal(t, OUTCOME_NO_WORKER, r.Outcome())
+
+	// Err转换成为Exception之后依然可以区分
+	r.ResetForRetry()
+	r.Response.Err = r.NewTimeoutError()
+	r.Response.Data = GetThriftException(r, "test")
+	assert.Equal(t, OUTCOME_TIMEOUT, r.Outcome())
+
+	r.Response.Err = errors.New("connection reset")
+	assert.Equal(t, OUTCOME_TRANSPORT_ERROR, r.Outcome())
+}
+
+//
+// go test proxy -v -run "TestPrometheusMetrics"
+//
+func TestPrometheusMetrics(t *testing.T) {
+	r := newRetryTestRequest("prom_typo:get_user", 1)
+	observeRequestMetrics(r, 3000)
+	observeRequestMetrics(r, 20000)
+	r.Response.Err = r.NewTimeoutError()
+	observeRequestMetrics(r, 5000000)
+
+	// 心跳不计入
+	hb := newRetryTestRequest("prom_typo:ping", 2)
+	hb.Request.TypeId = MESSAGE_TYPE_HEART_BEAT
+	observeRequestMetrics(hb, 1000)
+
+	session := &Session{}
+	registerSession(session)
+	defer unregisterSession(session)
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "version=0.0.4")
+
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE rpc_requests_total counter\n")
+	assert.Contains(t, body, `rpc_requests_total{service="prom_typo",method="get_user",outcome="success"} 2`+"\n")
+	assert.Contains(t, body, `rpc_requests_total{service="prom_typo",method="get_user",outcome="timeout"} 1`+"\n")
+	assert.False(t, strings.Contains(body, `method="ping"`))
+
+	// buckets是累计的
+	assert.Contains(t, body, `rpc_request_duration_seconds_bucket{service="prom_typo",method="get_user",outcome="success",le="0.005"} 1`+"\n")
+	assert.Contains(t, body, `rpc_request_duration_seconds_bucket{service="prom_typo",method="get_user",outcome="success",le="0.025"} 2`+"\n")
+	assert.Contains(t, body, `rpc_request_duration_seconds_bucket{service="prom_typo",method="get_user",outcome="timeout",le="2.5"} 0`+"\n")
+	assert.Contains(t, body, `rpc_request_duration_seconds_bucket{service="prom_typo",method="get_user",outcome="timeout",le="+Inf"} 1`+"\n")
+	assert.Contains(t, body, `rpc_request_duration_seconds_sum{service="prom_typo",method="get_user",outcome="success"} 0.023`+"\n")
+	assert.Contains(t, body, `rpc_request_duration_seconds_count{service="prom_typo",method="get_user",outcome="success"} 2`+"\n")
+
+	assert.Contains(t, body, `rpc_sessions{type="proxy"} `)
+	assert.Contains(t, body, `rpc_memory_pool_gets_total{pool="1024",result="hit"} `)
+	assert.Contains(t, body, `rpc_registry_watch_events_total{type="session_expired"} `)
+
+	// 没有找到Service/Worker的请求: method统一为other
+	nf := newRetryTestRequest("prom_typo:random_1234", 3)
+	nf.Response.Data = GetServiceNotFoundData(nf)
+	observeRequestMetrics(nf, 1000)
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	body = w.Body.String()
+	assert.Contains(t, body, `rpc_requests_total{service="prom_typo",method="other",outcome="no_worker"} 1`+"\n")
+	assert.False(t, strings.Contains(body, "random_1234"))
+
+	// label需要转义
+	assert.Equal(t, `a\"b\\c\nd`, prometheusLabelEscaper.Replace("a\"b\\c\nd"))
+}
+
+//
+// go test proxy -v -run "TestPrometheusMethodLimit"
+//
+func TestPrometheusMethodLimit(t *testing.T) {
+	requestMetrics.lock.Lock()
+	series, methods, services := requestMetrics.series, requestMetrics.methods, requestMetrics.services
+	requestMetrics.series = make(map[requestSeriesKey]*requestSeries)
+	requestMetrics.methods = make(map[opStatsKey]bool)
+	requestMetrics.services = make(map[string]bool)
+	requestMetrics.lock.Unlock()
+	defer func() {
+		requestMetrics.lock.Lock()
+		requestMetrics.series, requestMetrics.methods, requestMetrics.services = series, methods, services
+		requestMetrics.lock.Unlock()
+	}()
+
+	for i := 0; i < PROMETHEUS_MAX_METHODS; i++ {
+		observeRequestMetrics(newRetryTestRequest(fmt.Sprintf("limit_typo:m%d", i), 1), 1000)
+	}
+	// 超过上限之后, 新的method合并到other中; 已有的method不受影响
+	observeRequestMetrics(newRetryTestRequest("limit_typo:new_method", 1), 1000)
+	observeRequestMetrics(newRetryTestRequest("limit_random:new_method", 1), 1000)
+	observeRequestMetrics(newRetryTestRequest("limit_typo:m1", 1), 1000)
+
+	requestMetrics.lock.RLock()
+	defer requestMetrics.lock.RUnlock()
+	assert.Equal(t, PROMETHEUS_MAX_METHODS+2, len(requestMetrics.series))
+	assert.Equal(t, int64(1), requestMetrics.series[requestSeriesKey{"limit_typo", "other", OUTCOME_SUCCESS}].buckets[0].Get())
+	assert.Equal(t, int64(1), requestMetrics.series[requestSeriesKey{"other", "other", OUTCOME_SUCCESS}].buckets[0].Get())
+	assert.Equal(t, int64(2), requestMetrics.series[requestSeriesKey{"limit_typo", "m1", OUTCOME_SUCCESS}].buckets[0].Get())
+}
@@ -0,0 +1,336 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/wfxiang08/cyutils/utils"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	METRICS_SINK_NONE   = "none"
+	METRICS_SINK_FALCON = "falcon"
+	METRICS_SINK_STATSD = "statsd"
+	METRICS_SINK_FILE   = "file"
+
+	METRICS_DEFAULT_BATCH_SIZE     = 200
+	METRICS_DEFAULT_BUFFER_SIZE    = 20000 // 发送失败时最多缓存的数据点, 大约为10分钟的数据
+	METRICS_DEFAULT_RETRY_INTERVAL = 10 * time.Second
+
+	METRICS_FALCON_TIMEOUT = 10 * time.Second
+	METRICS_STATSD_PACKET  = 1400 // 一个UDP包的最大长度(避免IP分片)
+	METRICS_PENDING_INFOS  = 5    // 等待转换的OpStatsInfo, 超过时直接丢弃, 不阻塞rotateOpStats
+)
+
+//
+// 监控数据的输出: falcon, statsd, 本地文件等
+// Send失败时返回error, 由metricsPusher负责缓存和重试; Send的调用是串行的
+//
+type MetricsSink interface {
+	Name() string
+	Send(metrics []*utils.MetaData) error
+	Close() error
+}
+
+type MetricsConfig struct {
+	Sink          string // falcon, statsd, file, none
+	FalconClient  string
+	StatsdAddr    string
+	StatsdPrefix  string
+	File          string
+	BatchSize     int           // 每次Send最多的数据点
+	BufferSize    int           // 发送失败时最多缓存的数据点, 超过之后丢弃最老的数据
+	RetryInterval time.Duration // 发送失败之后重试的间隔
+}
+
+func NewMetricsSink(config *MetricsConfig) (MetricsSink, error) {
+	switch config.Sink {
+	case METRICS_SINK_FALCON:
+		if len(config.FalconClient) == 0 {
+			return nil, fmt.Errorf("falcon_client is missing")
+		}
+		return &falconSink{url: config.FalconClient, timeout: METRICS_FALCON_TIMEOUT}, nil
+	case METRICS_SINK_STATSD:
+		return newStatsdSink(config.StatsdAddr, config.StatsdPrefix)
+	case METRICS_SINK_FILE:
+		return newFileSink(config.File)
+	case METRICS_SINK_NONE, "":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown metrics sink: %s", config.Sink)
+}
+
+//
+// open-falcon的agent(http push)
+//
+type falconSink struct {
+	url     string
+	timeout time.Duration
+}
+
+func (s *falconSink) Name() string {
+	return METRICS_SINK_FALCON
+}
+
+func (s *falconSink) Send(metrics []*utils.MetaData) error {
+	_, err := utils.SendData(metrics, s.url, s.timeout)
+	return err
+}
+
+func (s *falconSink) Close() error {
+	return nil
+}
+
+//
+// statsd(UDP): 所有的数据都作为gauge, 多个数据点合并到一个包中
+//     <prefix><metric>:<value>|g
+//
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+func newStatsdSink(addr string, prefix string) (*statsdSink, error) {
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("statsd_addr is missing")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{conn: conn, prefix: prefix}, nil
+}
+
+func (s *statsdSink) Name() string {
+	return METRICS_SINK_STATSD
+}
+
+func (s *statsdSink) Send(metrics []*utils.MetaData) error {
+	var packet bytes.Buffer
+	for _, m := range metrics {
+		line := fmt.Sprintf("%s%s:%v|g", s.prefix, m.Metric, m.Value)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > METRICS_STATSD_PACKET {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
+
+//
+// 本地文件: 每行一个JSON(格式和falcon的数据点一致), 由日志收集工具处理
+//
+type fileSink struct {
+	file *os.File
+}
+
+func newFileSink(filename string) (*fileSink, error) {
+	if len(filename) == 0 {
+		return nil, fmt.Errorf("metrics_file is missing")
+	}
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Name() string {
+	return METRICS_SINK_FILE
+}
+
+func (s *fileSink) Send(metrics []*utils.MetaData) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, m := range metrics {
+		if err := encoder.Encode(m); err != nil {
+			return err
+		}
+	}
+	_, err := s.file.Write(buf.Bytes())
+	return err
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+//
+// 将每分钟的OpStatsInfo转换成数据点, 按照batchSize交给MetricsSink
+// 发送失败的数据点保留在pending中(最多bufferSize个, 超过之后丢弃最老的数据), 每隔retryInterval重试
+//
+type metricsPusher struct {
+	sink          MetricsSink
+	service       string // 没有service的统计(例如: 心跳)使用的前缀
+	hostname      string
+	batchSize     int
+	bufferSize    int
+	retryInterval time.Duration
+
+	infos   chan *OpStatsInfo
+	lock    sync.Mutex
+	pending []*utils.MetaData
+
+	sent     atomic2.Int64 // 发送成功的数据点
+	dropped  atomic2.Int64 // 丢弃的数据点
+	failures atomic2.Int64 // 失败的Send
+}
+
+func newMetricsPusher(sink MetricsSink, config *MetricsConfig, service string) *metricsPusher {
+	p := &metricsPusher{
+		sink:          sink,
+		service:       service,
+		hostname:      utils.Hostname(),
+		batchSize:     config.BatchSize,
+		bufferSize:    config.BufferSize,
+		retryInterval: config.RetryInterval,
+		infos:         make(chan *OpStatsInfo, METRICS_PENDING_INFOS),
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = METRICS_DEFAULT_BATCH_SIZE
+	}
+	if p.bufferSize <= 0 {
+		p.bufferSize = METRICS_DEFAULT_BUFFER_SIZE
+	}
+	if p.retryInterval <= 0 {
+		p.retryInterval = METRICS_DEFAULT_RETRY_INTERVAL
+	}
+	return p
+}
+
+//
+// 在rotateOpStats中调用, 不阻塞: sink处理不过来时直接丢弃(计入dropped)
+//
+func (p *metricsPusher) enqueue(info *OpStatsInfo) {
+	select {
+	case p.infos <- info:
+	default:
+		p.dropped.Add(int64(len(p.toMetrics(info))))
+	}
+}
+
+func (p *metricsPusher) run() {
+	retry := time.NewTicker(p.retryInterval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case info := <-p.infos:
+			p.buffer(p.toMetrics(info))
+			p.flush()
+		case <-retry.C:
+			p.flush()
+		}
+	}
+}
+
+func (p *metricsPusher) buffer(metrics []*utils.MetaData) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pending = append(p.pending, metrics...)
+	if overflow := len(p.pending) - p.bufferSize; overflow > 0 {
+		p.dropped.Add(int64(overflow))
+		p.pending = append([]*utils.MetaData(nil), p.pending[overflow:]...)
+	}
+}
+
+//
+// 按批发送pending中的数据点, 遇到错误时停止, 剩下的数据等待下一次重试
+// pending只在run中修改, Send时不持有锁(falcon可能需要等待10s)
+//
+func (p *metricsPusher) flush() {
+	for {
+		p.lock.Lock()
+		n := p.batchSize
+		if n > len(p.pending) {
+			n = len(p.pending)
+		}
+		batch := p.pending[:n]
+		p.lock.Unlock()
+
+		if n == 0 {
+			return
+		}
+		if err := p.sink.Send(batch); err != nil {
+			p.failures.Incr()
+			log.ErrorErrorf(err, "Send %d Metrics to %s failed, %d pending", n, p.sink.Name(), p.Pending())
+			return
+		}
+		p.sent.Add(int64(n))
+
+		p.lock.Lock()
+		p.pending = p.pending[n:]
+		if len(p.pending) == 0 {
+			p.pending = nil
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *metricsPusher) Pending() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.pending)
+}
+
+func (p *metricsPusher) toMetrics(info *OpStatsInfo) []*utils.MetaData {
+	metrics := make([]*utils.MetaData, 0, len(info.opmap)*(2+int(OUTCOME_COUNT)+len(opStatsPercentiles)))
+	t := info.timestamp.Unix()
+
+	for _, stats := range info.opmap {
+		prefix := stats.OpStr()
+		if len(stats.Service()) == 0 {
+			prefix = fmt.Sprintf("%s.%s", p.service, stats.Method())
+		}
+		gauge := func(name string, value interface{}) {
+			metrics = append(metrics, &utils.MetaData{
+				Metric:      fmt.Sprintf("%s.%s", prefix, name),
+				Endpoint:    p.hostname,
+				Value:       value,
+				CounterType: utils.DATA_TYPE_GAUGE,
+				Tags:        EMPTY_STR,
+				Timestamp:   t,
+				Step:        60, // 一分钟一次采样
+			})
+		}
+
+		gauge("calls", stats.Calls())
+		gauge("avgrt", float64(stats.USecsPerCall())*0.001) // 单位: ms
+		for i, name := range opStatsOutcomeNames {
+			gauge(name, stats.Outcome(RequestOutcome(i)))
+		}
+		for i, value := range stats.Percentiles() {
+			gauge(opStatsPercentileNames[i], float64(value)*0.001)
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,196 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/cyutils/utils"
+)
+
+type fakeMetricsSink struct {
+	fails   int // 前几次Send失败
+	batches [][]*utils.MetaData
+}
+
+func (s *fakeMetricsSink) Name() string {
+	return "fake"
+}
+
+func (s *fakeMetricsSink) Send(metrics []*utils.MetaData) error {
+	if s.fails > 0 {
+		s.fails--
+		return errors.New("sink unavailable")
+	}
+	s.batches = append(s.batches, append([]*utils.MetaData(nil), metrics...))
+	return nil
+}
+
+func (s *fakeMetricsSink) Close() error {
+	return nil
+}
+
+func newMetricsTestInfo(name string, calls int) *OpStatsInfo {
+	s := newOpStats("sink_typo", name)
+	for i := 0; i < calls; i++ {
+		s.calls.Incr()
+		s.usecs.Add(1000)
+		s.outcomes[OUTCOME_SUCCESS].Incr()
+		s.hist.Record(1000)
+	}
+	return &OpStatsInfo{
+		opmap:     map[opStatsKey]*OpStats{{service: "sink_typo", method: name}: s},
+		timestamp: time.Now(),
+	}
+}
+
+//
+// go test proxy -v -run "TestMetricsPusher"
+//
+func TestMetricsPusher(t *testing.T) {
+	sink := &fakeMetricsSink{fails: 2}
+	config := &MetricsConfig{BatchSize: 4, BufferSize: 20}
+	p := newMetricsPusher(sink, config, "rpc_proxy")
+
+	info := newMetricsTestInfo("get_user", 10)
+	metrics := p.toMetrics(info)
+	perOp := len(metrics)
+	assert.Equal(t, 2+int(OUTCOME_COUNT)+len(opStatsPercentiles), perOp)
+	assert.Equal(t, "sink_typo.get_user.calls", metrics[0].Metric)
+	assert.Equal(t, int64(10), metrics[0].Value)
+
+	// 1. 发送失败时数据保留在buffer中
+	p.buffer(metrics)
+	p.flush()
+	assert.Equal(t, perOp, p.Pending())
+	assert.Equal(t, int64(1), p.failures.Get())
+	assert.Equal(t, 0, len(sink.batches))
+
+	// 2. 超过BufferSize时丢弃最老的数据
+	p.buffer(p.toMetrics(newMetricsTestInfo("set_user", 1)))
+	p.buffer(p.toMetrics(newMetricsTestInfo("del_user", 1)))
+	assert.Equal(t, 20, p.Pending())
+	assert.Equal(t, int64(3*perOp-20), p.dropped.Get())
+
+	p.flush()
+	assert.Equal(t, int64(2), p.failures.Get())
+
+	// 3. 恢复之后按照BatchSize分批发送, 最新的数据在最后
+	p.flush()
+	assert.Equal(t, 0, p.Pending())
+	assert.Equal(t, int64(20), p.sent.Get())
+	assert.Equal(t, 5, len(sink.batches))
+	for _, batch := range sink.batches {
+		assert.Equal(t, 4, len(batch))
+	}
+	assert.True(t, strings.HasPrefix(sink.batches[4][3].Metric, "sink_typo.del_user."))
+
+	// 4. 没有service的统计(例如: 心跳)使用默认的前缀
+	heartbeat := &OpStatsInfo{
+		opmap:     map[opStatsKey]*OpStats{{method: "ping"}: newOpStats("", "ping")},
+		timestamp: time.Now(),
+	}
+	assert.Equal(t, "rpc_proxy.ping.calls", p.toMetrics(heartbeat)[0].Metric)
+}
+
+//
+// go test proxy -v -run "TestRotateOpStatsNotBlocked"
+//
+func TestRotateOpStatsNotBlocked(t *testing.T) {
+	// pusher没有运行(相当于sink卡住了), rotateOpStats不能被阻塞
+	p := newMetricsPusher(&fakeMetricsSink{}, &MetricsConfig{}, "rpc_proxy")
+	cmdstats.rwlck.Lock()
+	cmdstats.pusher = p
+	cmdstats.rwlck.Unlock()
+	defer func() {
+		cmdstats.rwlck.Lock()
+		cmdstats.pusher = nil
+		cmdstats.rwlck.Unlock()
+	}()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < METRICS_PENDING_INFOS+3; i++ {
+			incrOpStats(newRetryTestRequest("sink_typo:get_user", int32(i)), 1000)
+			rotateOpStats(time.Now())
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotateOpStats blocked by metrics sink")
+	}
+	assert.Equal(t, METRICS_PENDING_INFOS, len(p.infos))
+	assert.True(t, p.dropped.Get() >= int64(3*(2+int(OUTCOME_COUNT)+len(opStatsPercentiles))))
+}
+
+//
+// go test proxy -v -run "TestMetricsSinks"
+//
+func TestMetricsSinks(t *testing.T) {
+	metrics := []*utils.MetaData{
+		{Metric: "typo.get_user.calls", Endpoint: "host1", Value: int64(10), Timestamp: 100, Step: 60},
+		{Metric: "typo.get_user.avgrt", Endpoint: "host1", Value: 1.5, Timestamp: 100, Step: 60},
+	}
+
+	// 1. 本地文件: 每行一个JSON
+	dir, _ := ioutil.TempDir("", "metrics_sink")
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "log", "metrics.log")
+
+	sink, err := NewMetricsSink(&MetricsConfig{Sink: METRICS_SINK_FILE, File: filename})
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Send(metrics))
+	assert.NoError(t, sink.Send(metrics[:1]))
+	sink.Close()
+
+	f, _ := os.Open(filename)
+	defer f.Close()
+	var lines []utils.MetaData
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var m utils.MetaData
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &m))
+		lines = append(lines, m)
+	}
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "typo.get_user.avgrt", lines[1].Metric)
+	assert.Equal(t, "host1", lines[1].Endpoint)
+
+	// 2. statsd: 多个数据点合并到一个UDP包中
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	sink, err = NewMetricsSink(&MetricsConfig{Sink: METRICS_SINK_STATSD, StatsdAddr: conn.LocalAddr().String(), StatsdPrefix: "rpc."})
+	assert.NoError(t, err)
+	defer sink.Close()
+	assert.NoError(t, sink.Send(metrics))
+
+	buf := make([]byte, METRICS_STATSD_PACKET)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "rpc.typo.get_user.calls:10|g\nrpc.typo.get_user.avgrt:1.5|g", string(buf[:n]))
+
+	// 3. 配置错误
+	_, err = NewMetricsSink(&MetricsConfig{Sink: METRICS_SINK_FALCON})
+	assert.True(t, err != nil)
+	_, err = NewMetricsSink(&MetricsConfig{Sink: "kafka"})
+	assert.True(t, err != nil)
+	sink, err = NewMetricsSink(&MetricsConfig{Sink: METRICS_SINK_NONE})
+	assert.NoError(t, err)
+	assert.Nil(t, sink)
+}
@@ -0,0 +1,204 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	OUTLIER_DEFAULT_INTERVAL       = 10 * time.Second
+	OUTLIER_DEFAULT_MIN_REQUESTS   = 20
+	OUTLIER_DEFAULT_MIN_HOSTS      = 3
+	OUTLIER_DEFAULT_LATENCY_FACTOR = 3.0
+	OUTLIER_DEFAULT_ERROR_RATE     = 0.2
+	OUTLIER_DEFAULT_BASE_EJECTION  = 30 * time.Second
+	OUTLIER_DEFAULT_MAX_EJECTION   = 0.3
+
+	OUTLIER_MAX_EJECTION_MULTIPLIER = 10   // 摘除的时间最多为: BaseEjection * 10
+	OUTLIER_LATENCY_SAMPLES         = 1024 // 每个时间间隔内最多保留的latency样本
+)
+
+//
+// 异常节点检测(只用于rpc_proxy): 将同一个服务的BackendConn相互比较
+// p99 latency >= 中位数 * LatencyFactor, 或者错误率 >= 中位数 + ErrorRate的节点被暂时摘除
+// 摘除的时间随着摘除的次数增加: BaseEjection * 次数; 同时被摘除的节点的比例不超过MaxEjection
+//
+// 和熔断的区别: 熔断只看自身的错误率; 后端整体变慢/出错时, 异常节点检测不会摘除节点
+//
+type OutlierConfig struct {
+	Enabled       bool
+	Interval      time.Duration // 检测的时间间隔, 每次检测只使用这段时间内的统计数据
+	MinRequests   int           // 请求数太少的节点不参与检测
+	MinHosts      int           // 参与检测的节点太少时, 中位数没有意义
+	LatencyFactor float64
+	ErrorRate     float64
+	BaseEjection  time.Duration
+	MaxEjection   float64 // 同时被摘除的节点的最大比例
+}
+
+//
+// BackendConn在一个检测周期内的统计数据
+//
+type OutlierStats struct {
+	lock      sync.Mutex
+	total     int
+	failures  int
+	latencies []int64 // microseconds, 超过OUTLIER_LATENCY_SAMPLES之后随机替换(reservoir sampling)
+}
+
+func (s *OutlierStats) Record(success bool, latency int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.total++
+	if !success {
+		s.failures++
+	}
+	if len(s.latencies) < OUTLIER_LATENCY_SAMPLES {
+		s.latencies = append(s.latencies, latency)
+	} else if i := rand.Intn(s.total); i < OUTLIER_LATENCY_SAMPLES {
+		s.latencies[i] = latency
+	}
+}
+
+//
+// 返回当前周期的统计数据, 并且开始新的周期
+//
+func (s *OutlierStats) Reset() (total int, failures int, p99 int64) {
+	s.lock.Lock()
+	total, failures = s.total, s.failures
+	latencies := s.latencies
+	s.total, s.failures, s.latencies = 0, 0, nil
+	s.lock.Unlock()
+
+	return total, failures, percentile(latencies, 0.99)
+}
+
+func percentile(values []int64, p float64) int64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]int64, len(values))
+	copy(sorted, values)
+	sort.Sort(int64Slice(sorted))
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func median(values []float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+//
+// 定时检测异常节点(直到BackService停止)
+//
+func (s *BackService) runOutlierDetector() {
+	ticker := time.NewTicker(s.outlierConfig.Interval)
+	defer ticker.Stop()
+
+	for !s.stop.Get() {
+		<-ticker.C
+		s.detectOutliers(microseconds())
+	}
+}
+
+//
+// 检测异常节点(只在runOutlierDetector中调用, s.ejectedConns不需要加锁)
+//
+func (s *BackService) detectOutliers(now int64) {
+	config := s.outlierConfig
+
+	// 1. 摘除的时间已经结束的节点重新上线
+	ejected := s.ejectedConns[:0]
+	for _, conn := range s.ejectedConns {
+		if conn.IsMarkOffline.Get() {
+			continue
+		}
+		if now >= conn.ejectedUntil {
+			log.Printf(Green("[%s]Outlier: %s returned after ejection"), s.serviceName, conn.addr)
+			conn.outlier.Reset()
+			conn.ejected.Set(false)
+			s.StateChanged(conn)
+		} else {
+			ejected = append(ejected, conn)
+		}
+	}
+	s.ejectedConns = ejected
+
+	// 2. 统计正常节点在这个周期内的数据
+	s.activeConnsLock.Lock()
+	conns := make([]*BackendConn, len(s.activeConns))
+	copy(conns, s.activeConns)
+	s.activeConnsLock.Unlock()
+
+	candidates := make([]*BackendConn, 0, len(conns))
+	p99s := make([]float64, 0, len(conns))
+	errorRates := make([]float64, 0, len(conns))
+	for _, conn := range conns {
+		total, failures, p99 := conn.outlier.Reset()
+		if total < config.MinRequests {
+			continue
+		}
+		candidates = append(candidates, conn)
+		p99s = append(p99s, float64(p99))
+		errorRates = append(errorRates, float64(failures)/float64(total))
+	}
+	if len(candidates) < config.MinHosts {
+		return
+	}
+
+	// 3. 和中位数比较
+	medianP99, medianErrorRate := median(p99s), median(errorRates)
+	// 至少允许摘除一个节点, 否则节点较少时(例如: 3个节点, 30%)永远不会摘除; 节点数由MinHosts保证
+	maxEjected := int(float64(len(conns)+len(s.ejectedConns)) * config.MaxEjection)
+	if maxEjected < 1 {
+		maxEjected = 1
+	}
+	for i, conn := range candidates {
+		isOutlier := (medianP99 > 0 && p99s[i] >= medianP99*config.LatencyFactor) ||
+			errorRates[i] >= medianErrorRate+config.ErrorRate
+		if !isOutlier {
+			// 一段时间内表现正常, 逐渐恢复摘除的时间
+			if conn.ejections > 0 {
+				conn.ejections--
+			}
+			continue
+		}
+		if len(s.ejectedConns) >= maxEjected {
+			log.Warnf("[%s]Outlier: %s not ejected, too many ejected: %d", s.serviceName, conn.addr, len(s.ejectedConns))
+			continue
+		}
+
+		if conn.ejections < OUTLIER_MAX_EJECTION_MULTIPLIER {
+			conn.ejections++
+		}
+		ejection := config.BaseEjection * time.Duration(conn.ejections)
+		conn.ejectedUntil = now + int64(ejection/time.Microsecond)
+
+		log.Printf(Red("[%s]Outlier: %s ejected for %v, p99: %.3fms vs. %.3fms, error rate: %.3f vs. %.3f"),
+			s.serviceName, conn.addr, ejection, p99s[i]*0.001, medianP99*0.001, errorRates[i], medianErrorRate)
+
+		conn.ejected.Set(true)
+		s.StateChanged(conn)
+		s.ejectedConns = append(s.ejectedConns, conn)
+	}
+}
@@ -0,0 +1,181 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//
+// go test proxy -v -run "TestOutlierStats"
+//
+func TestOutlierStats(t *testing.T) {
+	var stats OutlierStats
+	for i := 1; i <= 2000; i++ {
+		stats.Record(i%10 != 0, int64(i%100))
+	}
+	total, failures, p99 := stats.Reset()
+	assert.Equal(t, 2000, total)
+	assert.Equal(t, 200, failures)
+	assert.True(t, p99 >= 95 && p99 <= 99)
+
+	// Reset之后开始新的周期
+	total, _, p99 = stats.Reset()
+	assert.Equal(t, 0, total)
+	assert.Equal(t, int64(0), p99)
+
+	assert.Equal(t, 2.0, median([]float64{3, 1, 2}))
+	assert.Equal(t, 2.5, median([]float64{4, 1, 2, 3}))
+}
+
+//
+// go test proxy -v -run "TestDetectOutliers"
+//
+func TestDetectOutliers(t *testing.T) {
+	config := &OutlierConfig{
+		Enabled:       true,
+		Interval:      10 * time.Second,
+		MinRequests:   10,
+		MinHosts:      3,
+		LatencyFactor: 3,
+		ErrorRate:     0.2,
+		BaseEjection:  30 * time.Second,
+		MaxEjection:   0.3,
+	}
+	s := &BackService{
+		serviceName:   "typo",
+		activeConns:   make([]*BackendConn, 0, 10),
+		balancer:      newRoundRobinBalancer(),
+		outlierConfig: config,
+	}
+
+	conns := make([]*BackendConn, 5)
+	for i := range conns {
+		addr := fmt.Sprintf("10.0.0.%d:5555", i)
+		conns[i] = &BackendConn{addr: addr, service: "typo", Index: INVALID_ARRAY_INDEX, delegate: s}
+		conns[i].breaker = NewCircuitBreaker(addr, &CircuitBreakerConfig{}, nil)
+		defer unregisterBreaker(conns[i].breaker)
+		conns[i].IsConnActive.Set(true)
+		s.StateChanged(conns[i])
+	}
+
+	record := func(slow ...int) {
+		for i, conn := range conns {
+			for k := 0; k < 20; k++ {
+				latency := int64(1000)
+				for _, j := range slow {
+					if i == j {
+						latency = 10000
+					}
+				}
+				conn.outlier.Record(true, latency)
+			}
+		}
+	}
+
+	// 1. 整体都比较慢时不摘除
+	now := microseconds()
+	record()
+	s.detectOutliers(now)
+	assert.Equal(t, 5, s.Active())
+
+	// 2. conns[1]和conns[3]的p99明显高于中位数, 但最多只能摘除30%(1个)
+	record(1, 3)
+	s.detectOutliers(now)
+	assert.Equal(t, 4, s.Active())
+	assert.Equal(t, []*BackendConn{conns[1]}, s.ejectedConns)
+	assert.False(t, conns[1].IsAvailable())
+	assert.Equal(t, now+int64(30*time.Second/time.Microsecond), conns[1].ejectedUntil)
+
+	// 3. conns[4]的错误率明显高于中位数, 但是已经达到摘除的上限(conns[1]还在摘除的时间内)
+	record()
+	for k := 0; k < 10; k++ {
+		conns[4].outlier.Record(false, 1000)
+	}
+	s.detectOutliers(now + int64(10*time.Second/time.Microsecond))
+	assert.Equal(t, 4, s.Active())
+	assert.True(t, conns[4].IsAvailable())
+
+	// 4. 摘除的时间结束之后重新上线; 再次被摘除时, 摘除的时间增加
+	now += int64(30 * time.Second / time.Microsecond)
+	record(1)
+	conns[1].outlier.Record(true, 10000) // 摘除期间的数据被丢弃
+	s.detectOutliers(now)
+	assert.Equal(t, 5, s.Active())
+	assert.True(t, conns[1].IsAvailable())
+
+	record(1)
+	s.detectOutliers(now)
+	assert.Equal(t, 4, s.Active())
+	assert.Equal(t, now+int64(60*time.Second/time.Microsecond), conns[1].ejectedUntil)
+
+	// 5. 错误率明显高于中位数也会被摘除
+	config.MaxEjection = 0.5
+	record()
+	for k := 0; k < 10; k++ {
+		conns[4].outlier.Record(false, 1000)
+	}
+	s.detectOutliers(now)
+	assert.Equal(t, 3, s.Active())
+	assert.False(t, conns[4].IsAvailable())
+}
+
+//
+// go test proxy -v -run "TestDetectOutliersMinHosts"
+//
+func TestDetectOutliersMinHosts(t *testing.T) {
+	// 默认配置: 节点数正好为min_hosts时, 30%不足一个节点, 仍然可以摘除一个
+	config := &OutlierConfig{
+		Enabled:       true,
+		Interval:      10 * time.Second,
+		MinRequests:   10,
+		MinHosts:      3,
+		LatencyFactor: 3,
+		ErrorRate:     0.2,
+		BaseEjection:  30 * time.Second,
+		MaxEjection:   0.3,
+	}
+	s := &BackService{
+		serviceName:   "typo",
+		activeConns:   make([]*BackendConn, 0, 10),
+		balancer:      newRoundRobinBalancer(),
+		outlierConfig: config,
+	}
+
+	conns := make([]*BackendConn, config.MinHosts)
+	for i := range conns {
+		addr := fmt.Sprintf("10.0.0.%d:5555", i)
+		conns[i] = &BackendConn{addr: addr, service: "typo", Index: INVALID_ARRAY_INDEX, delegate: s}
+		conns[i].breaker = NewCircuitBreaker(addr, &CircuitBreakerConfig{}, nil)
+		defer unregisterBreaker(conns[i].breaker)
+		conns[i].IsConnActive.Set(true)
+		s.StateChanged(conns[i])
+	}
+
+	record := func() {
+		for i, conn := range conns {
+			for k := 0; k < 20; k++ {
+				latency := int64(1000)
+				if i == 2 {
+					latency = 10000
+				}
+				conn.outlier.Record(true, latency)
+			}
+		}
+	}
+
+	now := microseconds()
+	record()
+	s.detectOutliers(now)
+	assert.Equal(t, 2, s.Active())
+	assert.Equal(t, []*BackendConn{conns[2]}, s.ejectedConns)
+	assert.False(t, conns[2].IsAvailable())
+
+	// 剩余的节点少于min_hosts, 不再继续检测
+	record()
+	s.detectOutliers(now)
+	assert.Equal(t, 2, s.Active())
+}
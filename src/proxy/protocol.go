@@ -0,0 +1,324 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// Client和proxy/lb之间使用的thrift协议
+//
+// proxy/lb内部(SeqId的替换, Exception, Hash Key, Trace等)以及和后端之间统一使用TBinaryProtocol;
+// TCompactProtocol的请求在NewRequest时转换成为TBinaryProtocol, 返回给Client之前再转换回来,
+// 因此binary和compact的Client可以共享同一组后端
+//
+type ThriftProtocol int
+
+const (
+	PROTOCOL_BINARY ThriftProtocol = iota
+	PROTOCOL_COMPACT
+)
+
+const (
+	// TCompactProtocol的Message以PROTOCOL_ID开始;
+	// strict TBinaryProtocol的Message以VERSION_1(0x80010000)开始, 第一个字节为0x80
+	COMPACT_PROTOCOL_ID = 0x82
+
+	// 转码时嵌套的最大深度
+	TRANSCODE_MAX_DEPTH = 64
+)
+
+func (p ThriftProtocol) String() string {
+	switch p {
+	case PROTOCOL_BINARY:
+		return "binary"
+	case PROTOCOL_COMPACT:
+		return "compact"
+	default:
+		return "unknown"
+	}
+}
+
+//
+// 根据Message的第一个字节判断thrift协议
+// 同一个Session中的Message使用同一个协议, 但是逐个判断的代价很小, 也不要求Client在建立连接时协商
+//
+func DetectProtocol(data []byte) ThriftProtocol {
+	if len(data) > 0 && data[0] == COMPACT_PROTOCOL_ID {
+		return PROTOCOL_COMPACT
+	}
+	return PROTOCOL_BINARY
+}
+
+func newThriftProtocol(p ThriftProtocol, transport thrift.TTransport) thrift.TProtocol {
+	if p == PROTOCOL_COMPACT {
+		return thrift.NewTCompactProtocol(transport)
+	}
+	return thrift.NewTBinaryProtocolTransport(transport)
+}
+
+//
+// 将一个完整的thrift Message从from协议转换成为to协议
+// 返回的数据通过getSlice分配, 可以由Request.Recycle归还
+//
+func transcodeThriftMessage(data []byte, from ThriftProtocol, to ThriftProtocol) ([]byte, error) {
+	input := NewTMemoryBufferWithBuf(data)
+	in := newThriftProtocol(from, input)
+
+	output := NewTMemoryBufferLen(len(data) + 16)
+	out := newThriftProtocol(to, output)
+
+	name, typeId, seqId, err := in.ReadMessageBegin()
+	if err != nil {
+		return nil, err
+	}
+	if to == PROTOCOL_COMPACT && typeId > thrift.ONEWAY {
+		// compact中TypeId只有3bits, 心跳等内部的消息不能转换
+		return nil, thrift.NewTProtocolException(fmt.Errorf("Message type %d not supported by compact protocol", typeId))
+	}
+	if err = out.WriteMessageBegin(name, typeId, seqId); err != nil {
+		return nil, err
+	}
+
+	// 心跳等消息只有Message Header
+	if input.Len() > 0 {
+		if err = copyThriftValue(in, out, thrift.STRUCT, TRANSCODE_MAX_DEPTH); err != nil {
+			return nil, err
+		}
+	}
+	if err = in.ReadMessageEnd(); err != nil {
+		return nil, err
+	}
+	if err = out.WriteMessageEnd(); err != nil {
+		return nil, err
+	}
+	if err = out.Flush(); err != nil {
+		return nil, err
+	}
+
+	result := getSlice(output.Len(), output.Len())
+	copy(result, output.Bytes())
+	return result, nil
+}
+
+//
+// 从in中读取一个typeId类型的值, 写入out
+//
+func copyThriftValue(in thrift.TProtocol, out thrift.TProtocol, typeId thrift.TType, maxDepth int) (err error) {
+	if maxDepth <= 0 {
+		return thrift.NewTProtocolException(errors.New("Depth limit exceeded"))
+	}
+
+	switch typeId {
+	case thrift.BOOL:
+		var v bool
+		if v, err = in.ReadBool(); err == nil {
+			err = out.WriteBool(v)
+		}
+	case thrift.BYTE:
+		var v int8
+		if v, err = in.ReadByte(); err == nil {
+			err = out.WriteByte(v)
+		}
+	case thrift.I16:
+		var v int16
+		if v, err = in.ReadI16(); err == nil {
+			err = out.WriteI16(v)
+		}
+	case thrift.I32:
+		var v int32
+		if v, err = in.ReadI32(); err == nil {
+			err = out.WriteI32(v)
+		}
+	case thrift.I64:
+		var v int64
+		if v, err = in.ReadI64(); err == nil {
+			err = out.WriteI64(v)
+		}
+	case thrift.DOUBLE:
+		var v float64
+		if v, err = in.ReadDouble(); err == nil {
+			err = out.WriteDouble(v)
+		}
+	case thrift.STRING:
+		var v []byte
+		if v, err = in.ReadBinary(); err == nil {
+			err = out.WriteBinary(v)
+		}
+	case thrift.STRUCT:
+		var name string
+		if name, err = in.ReadStructBegin(); err != nil {
+			return err
+		}
+		if err = out.WriteStructBegin(name); err != nil {
+			return err
+		}
+		for {
+			fieldName, fieldType, fieldId, err := in.ReadFieldBegin()
+			if err != nil {
+				return err
+			}
+			if fieldType == thrift.STOP {
+				break
+			}
+			if err = out.WriteFieldBegin(fieldName, fieldType, fieldId); err != nil {
+				return err
+			}
+			if err = copyThriftValue(in, out, fieldType, maxDepth-1); err != nil {
+				return err
+			}
+			if err = in.ReadFieldEnd(); err != nil {
+				return err
+			}
+			if err = out.WriteFieldEnd(); err != nil {
+				return err
+			}
+		}
+		if err = out.WriteFieldStop(); err != nil {
+			return err
+		}
+		if err = in.ReadStructEnd(); err != nil {
+			return err
+		}
+		err = out.WriteStructEnd()
+	case thrift.MAP:
+		keyType, valueType, size, err := in.ReadMapBegin()
+		if err != nil {
+			return err
+		}
+		if err = out.WriteMapBegin(keyType, valueType, size); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err = copyThriftValue(in, out, keyType, maxDepth-1); err != nil {
+				return err
+			}
+			if err = copyThriftValue(in, out, valueType, maxDepth-1); err != nil {
+				return err
+			}
+		}
+		if err = in.ReadMapEnd(); err != nil {
+			return err
+		}
+		err = out.WriteMapEnd()
+	case thrift.SET:
+		elemType, size, err := in.ReadSetBegin()
+		if err != nil {
+			return err
+		}
+		if err = out.WriteSetBegin(elemType, size); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err = copyThriftValue(in, out, elemType, maxDepth-1); err != nil {
+				return err
+			}
+		}
+		if err = in.ReadSetEnd(); err != nil {
+			return err
+		}
+		err = out.WriteSetEnd()
+	case thrift.LIST:
+		elemType, size, err := in.ReadListBegin()
+		if err != nil {
+			return err
+		}
+		if err = out.WriteListBegin(elemType, size); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err = copyThriftValue(in, out, elemType, maxDepth-1); err != nil {
+				return err
+			}
+		}
+		if err = in.ReadListEnd(); err != nil {
+			return err
+		}
+		err = out.WriteListEnd()
+	default:
+		err = thrift.NewTProtocolException(fmt.Errorf("Unknown data type %d", typeId))
+	}
+	return err
+}
+
+//
+// 在返回给Client之前, 将Response.Data转换成为Client使用的协议(以及THeader transport)
+// 后端返回的数据不合法时, 返回对应的Exception
+//
+func (r *Request) EncodeResponse(module string) {
+	if r.Response.Data == nil {
+		return
+	}
+
+	// 原来的Response.Data可能和Request.Data共享内存(例如: 心跳), 不主动归还
+	if r.Protocol != PROTOCOL_BINARY {
+		data, err := transcodeThriftMessage(r.Response.Data, PROTOCOL_BINARY, r.Protocol)
+		if err != nil {
+			// 无法转换: 直接按照Client的协议返回Exception
+			if r.Response.Err == nil {
+				r.Response.Err = err
+			}
+			data = getThriftException(r, module, r.Protocol)
+		}
+		r.Response.Data = data
+	}
+
+	if r.THeader {
+		frame, err := encodeTHeaderFrame(r.Protocol, r.Request.SeqId, r.Response.Headers, r.Response.Data)
+		if err != nil {
+			// 后端返回的headers太大: 只返回结果, 不带headers
+			log.Warnf("[%s]%s.%s response headers dropped: %v", module, r.Service, r.Request.Name, err)
+			frame, _ = encodeTHeaderFrame(r.Protocol, r.Request.SeqId, nil, r.Response.Data)
+		}
+		r.Response.Data = frame
+	}
+}
+
+//
+// 解码TCompactProtocol的Message Header: PROTOCOL_ID, VERSION|TYPE, varint(seqId), varint(len(name)), name
+//
+func decodeCompactTypIdSeqId(data []byte) (typeId thrift.TMessageType, method string, seqId int32, err error) {
+	if len(data) < 2 {
+		err = thrift.NewTProtocolException(io.ErrUnexpectedEOF)
+		return
+	}
+	typeId = thrift.TMessageType((data[1] >> 5) & 0x07)
+
+	var v uint64
+	idx := 2
+	if v, idx, err = readVarint(data, idx); err != nil {
+		return
+	}
+	seqId = int32(v)
+	if v, idx, err = readVarint(data, idx); err != nil {
+		return
+	}
+	if len(data) < idx+int(v) {
+		err = thrift.NewTProtocolException(io.ErrUnexpectedEOF)
+		return
+	}
+	method = string(data[idx : idx+int(v)])
+	return
+}
+
+func readVarint(data []byte, idx int) (uint64, int, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if idx >= len(data) {
+			return 0, idx, thrift.NewTProtocolException(io.ErrUnexpectedEOF)
+		}
+		b := data[idx]
+		idx++
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, idx, nil
+		}
+	}
+	return 0, idx, thrift.NewTProtocolException(errors.New("Variable-length int over 10 bytes"))
+}
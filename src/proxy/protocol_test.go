@@ -0,0 +1,138 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// 覆盖各种数据类型的参数
+//
+var protocolTestArgs = []fakeField{
+	{"user_name", thrift.STRING, 1, "u1"},
+	{"verbose", thrift.BOOL, 2, true},
+	{"scores", thrift.MAP, 3, func(protocol thrift.TProtocol) {
+		protocol.WriteMapBegin(thrift.STRING, thrift.LIST, 1)
+		protocol.WriteString("k1")
+		protocol.WriteListBegin(thrift.I64, 20)
+		for i := 0; i < 20; i++ {
+			protocol.WriteI64(int64(i) - 10)
+		}
+		protocol.WriteListEnd()
+		protocol.WriteMapEnd()
+	}},
+	{"ratio", thrift.DOUBLE, 4, 0.25},
+	// field id的差值超过15
+	{"options", thrift.STRUCT, 20, func(protocol thrift.TProtocol) {
+		writeFakeStruct(protocol, "options", []fakeField{
+			{"tags", thrift.SET, 1, func(protocol thrift.TProtocol) {
+				protocol.WriteSetBegin(thrift.I16, 2)
+				protocol.WriteI16(-1)
+				protocol.WriteI16(300)
+				protocol.WriteSetEnd()
+			}},
+			{"flag", thrift.BOOL, 2, false},
+			{"level", thrift.BYTE, 3, int8(-3)},
+		})
+	}},
+}
+
+//
+// go test proxy -v -run "TestCompactRequest"
+//
+func TestCompactRequest(t *testing.T) {
+	compact := fakeArgsData(PROTOCOL_COMPACT, "typo:get_user", thrift.CALL, 7, protocolTestArgs...)
+	assert.Equal(t, PROTOCOL_COMPACT, DetectProtocol(compact))
+
+	typeId, method, seqId, err := DecodeThriftTypIdSeqId(compact)
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.CALL, typeId)
+	assert.Equal(t, "typo:get_user", method)
+	assert.Equal(t, int32(7), seqId)
+
+	// 1. compact的请求在proxy内部转换成为binary
+	r, err := NewRequest(compact, true)
+	assert.NoError(t, err)
+	assert.Equal(t, PROTOCOL_COMPACT, r.Protocol)
+	assert.Equal(t, "typo", r.Service)
+	assert.Equal(t, "get_user", r.Request.Name)
+	assert.Equal(t, int32(7), r.Request.SeqId)
+	assert.Equal(t, fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, protocolTestArgs...), r.Request.Data)
+
+	// 2. 后端按照binary处理: 替换SeqId
+	r.ReplaceSeqId(1000)
+	assert.Equal(t, fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.CALL, 1000, protocolTestArgs...), r.Request.Data)
+
+	// 3. 后端返回binary的结果, 恢复SeqId之后按照compact返回给Client
+	r.Response.Data = fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.REPLY, 1000, protocolTestArgs...)
+	r.RestoreSeqId()
+	r.EncodeResponse("proxy_session")
+	assert.Equal(t, fakeArgsData(PROTOCOL_COMPACT, "get_user", thrift.REPLY, 7, protocolTestArgs...), r.Response.Data)
+
+	// 4. binary的请求不受影响
+	binary := fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 8, protocolTestArgs...)
+	r, _ = NewRequest(append([]byte(nil), binary...), true)
+	assert.Equal(t, PROTOCOL_BINARY, r.Protocol)
+	r.Response.Data = binary
+	r.EncodeResponse("proxy_session")
+	assert.Equal(t, binary, r.Response.Data)
+}
+
+//
+// go test proxy -v -run "TestCompactException"
+//
+func TestCompactException(t *testing.T) {
+	readException := func(data []byte) (string, thrift.TMessageType, int32, thrift.TApplicationException) {
+		protocol := thrift.NewTCompactProtocol(NewTMemoryBufferWithBuf(data))
+		name, typeId, seqId, err := protocol.ReadMessageBegin()
+		assert.NoError(t, err)
+		exc, err := thrift.NewTApplicationException(0, "").Read(protocol)
+		assert.NoError(t, err)
+		return name, typeId, seqId, exc
+	}
+
+	// 1. 超时等错误: Exception按照Client的协议返回
+	r, _ := NewRequest(fakeArgsData(PROTOCOL_COMPACT, "typo:get_user", thrift.CALL, 7, protocolTestArgs...), true)
+	r.Response.Err = r.NewTimeoutError()
+	r.Response.Data = GetThriftException(r, "proxy_session")
+	r.EncodeResponse("proxy_session")
+
+	name, typeId, seqId, exc := readException(r.Response.Data)
+	assert.Equal(t, "get_user", name)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+	assert.Equal(t, int32(7), seqId)
+	assert.Equal(t, int32(TIMEOUT_APPLICATION_EXCEPTION), exc.TypeId())
+	assert.Equal(t, OUTCOME_TIMEOUT, r.Outcome())
+
+	// 2. 后端返回的数据不完整, 无法转换: 返回Exception
+	r, _ = NewRequest(fakeArgsData(PROTOCOL_COMPACT, "typo:get_user", thrift.CALL, 8, protocolTestArgs...), true)
+	reply := fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.REPLY, 8, protocolTestArgs...)
+	r.Response.Data = reply[:len(reply)-5]
+	r.EncodeResponse("proxy_session")
+
+	_, typeId, seqId, exc = readException(r.Response.Data)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+	assert.Equal(t, int32(8), seqId)
+	assert.Equal(t, int32(thrift.INTERNAL_ERROR), exc.TypeId())
+	assert.Equal(t, OUTCOME_TRANSPORT_ERROR, r.Outcome())
+
+	// 3. 已经是Exception, 但是仍然无法转换: 不返回空的数据
+	r.Response.Data = reply[:len(reply)-5]
+	r.EncodeResponse("proxy_session")
+	_, typeId, _, _ = readException(r.Response.Data)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+
+	// 4. 无法解析的请求: 仍然返回Request, 用于返回Exception
+	r, err := NewRequest([]byte{COMPACT_PROTOCOL_ID, 0x21, 0xff}, true)
+	assert.True(t, err != nil)
+	assert.Equal(t, PROTOCOL_COMPACT, r.Protocol)
+	r.Response.Err = err
+	r.Response.Data = GetThriftException(r, "proxy_session")
+	r.EncodeResponse("proxy_session")
+	_, typeId, _, _ = readException(r.Response.Data)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+}
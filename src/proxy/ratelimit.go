@@ -0,0 +1,429 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	RATE_LIMIT_RULE_DEFAULT = "*" // 每一个service默认的限流(每个service独立计数)
+)
+
+//
+// 限流规则: 每秒rate个请求, 最多允许burst个请求的突发
+//
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) String() string {
+	return fmt.Sprintf("%g/%d", l.Rate, l.Burst)
+}
+
+type RateLimitConfig struct {
+	Limits        map[string]RateLimit // service/service.method/* --> limit, 所有Client共享
+	SessionLimits map[string]RateLimit // 同上, 每一个Client Session单独计数
+	InZk          bool                 // 是否从zk读取限流配置
+}
+
+//
+// Token Bucket: 每秒补充rate个token, 最多保留burst个
+//
+type TokenBucket struct {
+	limit RateLimit
+
+	lock   sync.Mutex
+	tokens float64
+	last   int64 // 上一次补充token的时间(microsecond)
+}
+
+func NewTokenBucket(limit RateLimit, now int64) *TokenBucket {
+	return &TokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   now,
+	}
+}
+
+//
+// 获取一个token, 失败时返回false
+//
+func (b *TokenBucket) Take(now int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if elapsed := now - b.last; elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+float64(elapsed)*b.limit.Rate/1e6)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true
+	}
+	return false
+}
+
+//
+// 归还Take获取的token(同一个请求的其他规则拒绝了请求)
+//
+func (b *TokenBucket) Refund() {
+	b.lock.Lock()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+1)
+	b.lock.Unlock()
+}
+
+//
+// 一组TokenBucket, 规则变化之后对应的bucket重新创建
+//
+type tokenBuckets struct {
+	lock    sync.RWMutex
+	buckets map[string]*TokenBucket
+}
+
+func (t *tokenBuckets) get(key string, limit RateLimit, now int64) *TokenBucket {
+	t.lock.RLock()
+	bucket := t.buckets[key]
+	t.lock.RUnlock()
+
+	if bucket == nil || bucket.limit != limit {
+		t.lock.Lock()
+		if bucket = t.buckets[key]; bucket == nil || bucket.limit != limit {
+			if t.buckets == nil {
+				t.buckets = make(map[string]*TokenBucket)
+			}
+			bucket = NewTokenBucket(limit, now)
+			t.buckets[key] = bucket
+		}
+		t.lock.Unlock()
+	}
+	return bucket
+}
+
+//
+// 每一个Client Session自己的TokenBucket(由Session创建, 通过Request.SessionLimits传递给Router)
+//
+type SessionRateLimits struct {
+	tokenBuckets
+}
+
+func NewSessionRateLimits() *SessionRateLimits {
+	return &SessionRateLimits{}
+}
+
+//
+// 请求被限流, Client可以稍后重试; 最终返回给Client的是专门的RateLimited Exception
+//
+type RateLimitedError struct {
+	Service    string
+	Method     string
+	Rule       string // 触发限流的规则
+	PerSession bool
+}
+
+func (e *RateLimitedError) Error() string {
+	if e.PerSession {
+		return fmt.Sprintf("Rate Limited, %s.%s, session rule: %s", e.Service, e.Method, e.Rule)
+	}
+	return fmt.Sprintf("Rate Limited, %s.%s, rule: %s", e.Service, e.Method, e.Rule)
+}
+
+func IsRateLimitedError(err error) bool {
+	_, ok := err.(*RateLimitedError)
+	return ok
+}
+
+//
+// 按照(service, method)限流, 在Router.Dispatch中选择BackendConn之前执行
+// service.method和service(或者*)的规则同时生效, 任何一个没有token都拒绝请求
+//
+// 规则有两个来源:
+// 1. 配置文件: rate_limits=typo:1000,typo.get_user_info:200/50
+//             rate_limits_per_session=typo.get_user_info:20
+// 2. zk(可选): /zk/product/ProductName/config/rate_limits -->
+//             {"limits": {"typo": "1000"}, "session_limits": {"typo.get_user_info": "20"}}
+//    zk中的规则优先级更高, 修改之后实时生效
+//
+type RateLimiter struct {
+	configLimits        map[string]RateLimit
+	configSessionLimits map[string]RateLimit
+
+	// 只用于保护: limits, sessionLimits
+	lock          sync.RWMutex
+	limits        map[string]RateLimit
+	sessionLimits map[string]RateLimit
+
+	buckets tokenBuckets
+}
+
+func NewRateLimiter(limits map[string]RateLimit, sessionLimits map[string]RateLimit) *RateLimiter {
+	l := &RateLimiter{
+		configLimits:        limits,
+		configSessionLimits: sessionLimits,
+	}
+	l.Update(nil, nil)
+	return l
+}
+
+//
+// 根据配置创建RateLimiter, 如果配置了rate_limits_zk, 则同时监听zk中的限流配置
+//
+func NewRateLimiterWithConf(conf *RateLimitConfig, topo Registry) *RateLimiter {
+	l := NewRateLimiter(conf.Limits, conf.SessionLimits)
+	if conf.InZk {
+		if top, ok := topo.(*Topology); ok {
+			l.WatchZk(top)
+		} else {
+			log.Warnf("rate_limits_zk ignored, registry is not zk")
+		}
+	}
+	return l
+}
+
+//
+// 检查请求是否超过限制, 超过时返回RateLimitedError
+//
+func (l *RateLimiter) Allow(r *Request) error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.RLock()
+	limits, sessionLimits := l.limits, l.sessionLimits
+	l.lock.RUnlock()
+
+	service, method := r.Service, r.Request.Name
+	now := microseconds()
+	taken, rule, ok := takeRateLimits(&l.buckets, limits, service, method, now)
+	if !ok {
+		return &RateLimitedError{Service: service, Method: method, Rule: rule}
+	}
+	if r.SessionLimits != nil {
+		if _, rule, ok := takeRateLimits(&r.SessionLimits.tokenBuckets, sessionLimits, service, method, now); !ok {
+			// 请求被拒绝, 不占用全局的配额
+			taken.refund()
+			return &RateLimitedError{Service: service, Method: method, Rule: rule, PerSession: true}
+		}
+	}
+	return nil
+}
+
+// 一个请求获取token的buckets: service.method, service(或者*)
+type rateLimitTokens [2]*TokenBucket
+
+func (t rateLimitTokens) refund() {
+	for _, bucket := range t {
+		if bucket != nil {
+			bucket.Refund()
+		}
+	}
+}
+
+//
+// 依次检查service.method, service(或者*)的规则; 返回没有token的规则
+// 任何一个规则拒绝时, 之前已经获取的token被归还, 不会多扣其他规则的配额
+//
+func takeRateLimits(buckets *tokenBuckets, limits map[string]RateLimit, service string, method string,
+	now int64) (taken rateLimitTokens, rule string, ok bool) {
+	if len(limits) == 0 {
+		return taken, "", true
+	}
+
+	key := service + "." + method
+	if limit, ok := limits[key]; ok {
+		if bucket := buckets.get(key, limit, now); bucket.Take(now) {
+			taken[0] = bucket
+		} else {
+			return rateLimitTokens{}, key, false
+		}
+	}
+
+	rule = service
+	limit, ok := limits[service]
+	if !ok {
+		rule = RATE_LIMIT_RULE_DEFAULT
+		limit, ok = limits[RATE_LIMIT_RULE_DEFAULT]
+	}
+	// *按照service分别计数
+	if ok {
+		if bucket := buckets.get(service, limit, now); bucket.Take(now) {
+			taken[1] = bucket
+		} else {
+			taken.refund()
+			return rateLimitTokens{}, rule, false
+		}
+	}
+	return taken, "", true
+}
+
+//
+// 用新的动态规则(例如: 来自zk)覆盖配置文件中的规则
+//
+func (l *RateLimiter) Update(dynamicLimits map[string]RateLimit, dynamicSessionLimits map[string]RateLimit) {
+	limits := mergeRateLimits(l.configLimits, dynamicLimits)
+	sessionLimits := mergeRateLimits(l.configSessionLimits, dynamicSessionLimits)
+
+	l.lock.Lock()
+	l.limits = limits
+	l.sessionLimits = sessionLimits
+	l.lock.Unlock()
+}
+
+func mergeRateLimits(configLimits map[string]RateLimit, dynamicLimits map[string]RateLimit) map[string]RateLimit {
+	limits := make(map[string]RateLimit, len(configLimits)+len(dynamicLimits))
+	for key, limit := range configLimits {
+		limits[key] = limit
+	}
+	for key, limit := range dynamicLimits {
+		limits[key] = limit
+	}
+	return limits
+}
+
+// 用于admin api
+func (l *RateLimiter) MarshalJSON() ([]byte, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	var m = make(map[string]interface{})
+	m["limits"] = rateLimitStrings(l.limits)
+	m["session_limits"] = rateLimitStrings(l.sessionLimits)
+	return json.Marshal(m)
+}
+
+func rateLimitStrings(limits map[string]RateLimit) map[string]string {
+	values := make(map[string]string, len(limits))
+	for key, limit := range limits {
+		values[key] = limit.String()
+	}
+	return values
+}
+
+//
+// 监听zk中的限流配置, 节点不存在时只使用配置文件中的规则
+//
+func (l *RateLimiter) WatchZk(top *Topology) {
+	path := productRateLimitsPath(top.ProductName)
+	evtbus := make(chan interface{}, 2)
+
+	go func() {
+		for true {
+			data, err := top.WatchNodeIfExists(path, evtbus)
+			if err != nil {
+				log.WarnErrorf(err, "zk watch rate limits error: %s", path)
+				time.Sleep(time.Duration(5) * time.Second)
+				continue
+			}
+
+			limits, sessionLimits, err := parseRateLimitsJson(data)
+			if err != nil {
+				// 格式错误时保留之前的规则
+				log.ErrorErrorf(err, "invalid rate limits in zk: %s", string(data))
+			} else {
+				log.Printf(Green("Load rate limits from zk: %s"), string(data))
+				l.Update(limits, sessionLimits)
+			}
+
+			// 等待事件
+			<-evtbus
+		}
+	}()
+}
+
+func productRateLimitsPath(productName string) string {
+	return fmt.Sprintf("%s/config/rate_limits", productBasePath(productName))
+}
+
+//
+// 解析限流规则: rate[/burst], rate为每秒的请求数; 默认的burst为rate(至少为1)
+// rate为0表示拒绝所有的请求; rate大于0时burst至少为1(burst为0的bucket永远不会有token)
+//
+func ParseRateLimit(value string) (RateLimit, error) {
+	value = strings.TrimSpace(value)
+	items := strings.SplitN(value, "/", 2)
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(items[0]), 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return RateLimit{}, fmt.Errorf("invalid rate limit: %s", value)
+	}
+
+	limit := RateLimit{Rate: rate}
+	if len(items) == 2 {
+		if limit.Burst, err = strconv.Atoi(strings.TrimSpace(items[1])); err != nil || limit.Burst < 0 ||
+			(limit.Burst == 0 && rate > 0) {
+			return RateLimit{}, fmt.Errorf("invalid rate limit: %s", value)
+		}
+	} else if rate > 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return limit, nil
+}
+
+//
+// 解析配置文件中的规则: typo:1000,typo.get_user_info:200/50
+//
+func ParseRateLimitRules(value string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rate limit rule: %s", item)
+		}
+		limit, err := ParseRateLimit(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(kv[0])] = limit
+	}
+	return limits, nil
+}
+
+func parseRateLimitsJson(data []byte) (map[string]RateLimit, map[string]RateLimit, error) {
+	if len(data) == 0 {
+		return nil, nil, nil
+	}
+
+	var values struct {
+		Limits        map[string]string `json:"limits"`
+		SessionLimits map[string]string `json:"session_limits"`
+	}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, nil, err
+	}
+
+	limits, err := parseRateLimitValues(values.Limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	sessionLimits, err := parseRateLimitValues(values.SessionLimits)
+	if err != nil {
+		return nil, nil, err
+	}
+	return limits, sessionLimits, nil
+}
+
+func parseRateLimitValues(values map[string]string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit, len(values))
+	for key, value := range values {
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(key)] = limit
+	}
+	return limits, nil
+}
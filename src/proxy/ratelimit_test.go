@@ -0,0 +1,184 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// go test proxy -v -run "TestParseRateLimit"
+//
+func TestParseRateLimit(t *testing.T) {
+	limit, err := ParseRateLimit("200")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{Rate: 200, Burst: 200}, limit)
+
+	limit, _ = ParseRateLimit(" 0.5 ")
+	assert.Equal(t, RateLimit{Rate: 0.5, Burst: 1}, limit)
+
+	limit, _ = ParseRateLimit("200/50")
+	assert.Equal(t, RateLimit{Rate: 200, Burst: 50}, limit)
+
+	limit, _ = ParseRateLimit("0")
+	assert.Equal(t, RateLimit{}, limit)
+
+	limit, _ = ParseRateLimit("0/0")
+	assert.Equal(t, RateLimit{}, limit)
+
+	for _, value := range []string{"", "abc", "-1", "10/-1", "10/abc", "10/0"} {
+		_, err = ParseRateLimit(value)
+		assert.True(t, err != nil, value)
+	}
+
+	limits, err := ParseRateLimitRules("typo:1000, typo.get_user_info:200/50,")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(limits))
+	assert.Equal(t, RateLimit{Rate: 200, Burst: 50}, limits["typo.get_user_info"])
+
+	_, err = ParseRateLimitRules("typo")
+	assert.True(t, err != nil)
+
+	limits, sessionLimits, err := parseRateLimitsJson([]byte(`{"limits": {"*": "10"}, "session_limits": {"typo": "1/2"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 10}, limits["*"])
+	assert.Equal(t, RateLimit{Rate: 1, Burst: 2}, sessionLimits["typo"])
+
+	_, _, err = parseRateLimitsJson([]byte(`{"limits": {"typo": "x"}}`))
+	assert.True(t, err != nil)
+}
+
+//
+// go test proxy -v -run "TestTokenBucket"
+//
+func TestTokenBucket(t *testing.T) {
+	now := int64(1000000)
+	b := NewTokenBucket(RateLimit{Rate: 10, Burst: 2}, now)
+	assert.True(t, b.Take(now))
+	assert.True(t, b.Take(now))
+	assert.False(t, b.Take(now))
+
+	// 100ms补充一个token
+	assert.False(t, b.Take(now+50000))
+	assert.True(t, b.Take(now+100000))
+	assert.False(t, b.Take(now+100000))
+
+	// 最多保留burst个
+	now += 10 * 1000000
+	assert.True(t, b.Take(now))
+	assert.True(t, b.Take(now))
+	assert.False(t, b.Take(now))
+
+	// rate为0: 拒绝所有的请求
+	b = NewTokenBucket(RateLimit{}, now)
+	assert.False(t, b.Take(now+1000000))
+}
+
+func newRateLimitTestRequest(name string, limits *SessionRateLimits) *Request {
+	r := newRetryTestRequest(name, 1)
+	r.SessionLimits = limits
+	return r
+}
+
+//
+// go test proxy -v -run "TestRateLimiter"
+//
+func TestRateLimiter(t *testing.T) {
+	limits, _ := ParseRateLimitRules("typo.get_user:0.001/2,typo:0.001/3,*:0.001/1")
+	sessionLimits, _ := ParseRateLimitRules("user.get_user:0.001/1")
+	l := NewRateLimiter(limits, sessionLimits)
+
+	// 1. service.method和service的规则同时生效
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("typo:get_user", nil)))
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("typo:get_user", nil)))
+	err := l.Allow(newRateLimitTestRequest("typo:get_user", nil))
+	assert.True(t, IsRateLimitedError(err))
+	assert.Equal(t, "typo.get_user", err.(*RateLimitedError).Rule)
+
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("typo:get_list", nil)))
+	err = l.Allow(newRateLimitTestRequest("typo:get_list", nil))
+	assert.Equal(t, "typo", err.(*RateLimitedError).Rule)
+
+	// 较粗的规则拒绝时, service.method的token被归还
+	l.Update(map[string]RateLimit{"account.get_user": {Rate: 0.001, Burst: 1}, "account": {Rate: 0.001, Burst: 1}}, nil)
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("account:get_list", nil)))
+	err = l.Allow(newRateLimitTestRequest("account:get_user", nil))
+	assert.Equal(t, "account", err.(*RateLimitedError).Rule)
+	l.Update(map[string]RateLimit{"account.get_user": {Rate: 0.001, Burst: 1}, "account": {Rate: 1000, Burst: 1000}}, nil)
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("account:get_user", nil)))
+	l.Update(nil, nil)
+
+	// 2. *按照service分别计数
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("user:get_user", nil)))
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("analytics:report", nil)))
+	err = l.Allow(newRateLimitTestRequest("analytics:report", nil))
+	assert.Equal(t, "*", err.(*RateLimitedError).Rule)
+
+	// 3. 每一个Session单独计数
+	l.Update(map[string]RateLimit{"*": {Rate: 1000, Burst: 1000}}, nil)
+	session1, session2 := NewSessionRateLimits(), NewSessionRateLimits()
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("user:get_user", session1)))
+	err = l.Allow(newRateLimitTestRequest("user:get_user", session1))
+	assert.True(t, err.(*RateLimitedError).PerSession)
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("user:get_user", session2)))
+	// 没有Session的请求(例如: http gateway)
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("user:get_user", nil)))
+
+	// 4. 规则修改之后bucket重新创建
+	assert.True(t, IsRateLimitedError(l.Allow(newRateLimitTestRequest("typo:get_user", nil))))
+	l.Update(map[string]RateLimit{"typo.get_user": {Rate: 1000, Burst: 1000}, "typo": {Rate: 1000, Burst: 1000}}, nil)
+	assert.NoError(t, l.Allow(newRateLimitTestRequest("typo:get_user", nil)))
+
+	// 没有配置限流
+	var nilLimiter *RateLimiter
+	assert.NoError(t, nilLimiter.Allow(newRateLimitTestRequest("typo:get_user", nil)))
+}
+
+//
+// go test proxy -v -run "TestRouterRateLimited"
+//
+func TestRouterRateLimited(t *testing.T) {
+	s := &BackService{
+		serviceName: "typo",
+		activeConns: make([]*BackendConn, 0, 10),
+		balancer:    newRoundRobinBalancer(),
+		retry:       &RetryPolicy{},
+		retryBudget: NewRetryBudget(RETRY_DEFAULT_BUDGET_RATIO),
+		addr2Conn:   make(map[string]*BackendConn),
+	}
+	router := &Router{
+		productName: "test",
+		services:    map[string]*BackService{"typo": s},
+		timeouts:    NewRequestTimeouts(time.Second, nil),
+		limiter:     NewRateLimiter(map[string]RateLimit{"typo": {Rate: 0.001, Burst: 1}}, nil),
+	}
+
+	// 第一个请求转发给BackService(没有可用的Worker)
+	r := newRateLimitTestRequest("typo:get_user", nil)
+	assert.NoError(t, router.Dispatch(r))
+	assert.Equal(t, OUTCOME_NO_WORKER, r.Outcome())
+
+	// 超过限流: 返回专门的Exception
+	r = newRateLimitTestRequest("typo:get_user", nil)
+	assert.NoError(t, router.Dispatch(r))
+	assert.Equal(t, OUTCOME_RATE_LIMITED, r.Outcome())
+	assert.Equal(t, "rate_limited", r.Outcome().String())
+
+	data := GetThriftException(r, "proxy")
+	protocol := thrift.NewTBinaryProtocolTransport(NewTMemoryBufferWithBuf(data))
+	_, typeId, _, err := protocol.ReadMessageBegin()
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+	exc, err := thrift.NewTApplicationException(thrift.UNKNOWN_APPLICATION_EXCEPTION, "").Read(protocol)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(RATE_LIMITED_APPLICATION_EXCEPTION), exc.TypeId())
+
+	// 统计
+	incrOpStats(r, 1000)
+	stats := GetOpStats("typo", "get_user", false)
+	assert.True(t, stats != nil && stats.Outcome(OUTCOME_RATE_LIMITED) >= 1)
+}
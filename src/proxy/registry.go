@@ -0,0 +1,193 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	REGISTRY_ZK     = "zk"
+	REGISTRY_ETCD   = "etcd"
+	REGISTRY_MEMORY = "memory"
+	REGISTRY_FILE   = "file"
+)
+
+type RegistryEventType int
+
+const (
+	REGISTRY_EVENT_CHANGED         RegistryEventType = iota // 服务列表/Endpoints列表/节点数据出现变化
+	REGISTRY_EVENT_SESSION_EXPIRED                          // Session过期, 之前注册的Endpoint已经丢失
+)
+
+//
+// 各种Registry的事件统一转换成为RegistryEvent, 再通过evtbus传递给Router, BackService等
+//
+type RegistryEvent struct {
+	Type RegistryEventType
+	Path string
+}
+
+func (t RegistryEventType) String() string {
+	switch t {
+	case REGISTRY_EVENT_CHANGED:
+		return "changed"
+	case REGISTRY_EVENT_SESSION_EXPIRED:
+		return "session_expired"
+	default:
+		return "unknown"
+	}
+}
+
+// 各种类型的RegistryEvent的次数, 用于metrics
+var registryEventCounts [2]atomic2.Int64
+
+func newRegistryEvent(eventType RegistryEventType, path string) *RegistryEvent {
+	registryEventCounts[eventType].Incr()
+	return &RegistryEvent{Type: eventType, Path: path}
+}
+
+//
+// 服务注册和发现:
+// 1. ThriftRpcServer, rpc_lb 通过 AddServiceEndpoint 注册自己(临时的，和Registry的Session绑定)
+// 2. rpc_proxy 通过 WatchServices, WatchServiceEndpoints 来发现服务
+//
+// Watch系列的函数和zk的语义保持一致:
+//    返回当前的children, 之后第一次出现变化时往evtbus中发送一个事件; 如果需要继续监听，则需要重新Watch
+//
+type Registry interface {
+	GetProductName() string
+
+	// 注册/注销
+	AddServiceEndpoint(endpoint *ServiceEndpoint) error
+	DeleteServiceEndpoint(service string, serviceId string) error
+
+	// 读取服务列表和服务的Endpoints
+	ListServices() ([]string, error)
+	ListServiceEndpoints(service string) ([]string, error)
+	GetServiceEndpoint(service string, serviceId string) (*ServiceEndpoint, error)
+
+	// 监听服务列表的变化
+	WatchServices(evtbus chan interface{}) ([]string, error)
+	// 监听某个服务的Endpoints的变化
+	WatchServiceEndpoints(service string, evtbus chan interface{}) ([]string, error)
+	// 监听某个Endpoint的数据的变化(例如: weight的调整), Endpoint被删除时也会触发
+	WatchServiceEndpoint(service string, serviceId string, evtbus chan interface{}) (*ServiceEndpoint, error)
+	// 监听当前进程的注册状态, 如果注册信息可能丢失(例如: zk session过期), 则发送: REGISTRY_EVENT_SESSION_EXPIRED
+	WatchRegistration(service string, evtbus chan interface{}) error
+
+	Close()
+}
+
+//
+// 根据配置创建Registry, 默认为zk
+//
+func NewRegistry(config *ProductConfig) Registry {
+	switch config.Registry {
+	case "", REGISTRY_ZK:
+		return NewTopology(config.ProductName, config.ZkAddr)
+	case REGISTRY_ETCD:
+		return NewEtcdRegistry(config.ProductName, config.EtcdAddr)
+	case REGISTRY_MEMORY:
+		return NewMemoryRegistry(config.ProductName)
+	case REGISTRY_FILE:
+		return NewFileRegistry(config.ProductName, config.ServicesFile)
+	default:
+		log.Panicf("invalid config: unknown registry %s", config.Registry)
+		return nil
+	}
+}
+
+//
+// 一组一次性的Watch(zk, etcd等), 用于同时监听多个Path(例如: BackService的Endpoints列表和每一个Endpoint)
+// 每一个Watch使用单独的channel, registry发送事件时不会阻塞; 事件到达之后对应的Watch标记为失效,
+// 多个事件(例如: Session过期时所有的Watch都会收到事件)合并成为notify中的一次通知
+//
+type registryWatches struct {
+	lock    sync.Mutex
+	watched map[string]bool // path --> Watch是否有效
+	notify  chan interface{}
+}
+
+func newRegistryWatches() *registryWatches {
+	return &registryWatches{
+		watched: make(map[string]bool),
+		notify:  make(chan interface{}, 1),
+	}
+}
+
+//
+// path的Watch仍然有效时返回nil, 不需要重新Watch; 否则返回新的Watch使用的channel
+// Watch失败时需要调用cancel
+//
+func (w *registryWatches) arm(path string) (chan interface{}, func()) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.watched[path] {
+		return nil, nil
+	}
+	w.watched[path] = true
+
+	evtbus := make(chan interface{}, 1)
+	canceled := make(chan struct{})
+	go func() {
+		select {
+		case <-evtbus:
+			w.lock.Lock()
+			delete(w.watched, path)
+			w.lock.Unlock()
+			w.wakeup()
+		case <-canceled:
+		}
+	}()
+
+	cancel := func() {
+		w.lock.Lock()
+		delete(w.watched, path)
+		w.lock.Unlock()
+		close(canceled)
+	}
+	return evtbus, cancel
+}
+
+// 通知notify, 已经有通知没有处理时直接合并
+func (w *registryWatches) wakeup() {
+	select {
+	case w.notify <- true:
+	default:
+	}
+}
+
+// 春雨产品服务列表对应的Path(zk和etcd共用相同的目录结构)
+func productBasePath(productName string) string {
+	return fmt.Sprintf("/zk/product/%s", productName)
+}
+
+func productServicesPath(productName string) string {
+	return fmt.Sprintf("%s/services", productBasePath(productName))
+}
+
+func productServicePath(productName string, service string) string {
+	return fmt.Sprintf("%s/services/%s", productBasePath(productName), service)
+}
+
+func productServiceEndPointPath(productName string, service string, endpoint string) string {
+	return fmt.Sprintf("%s/services/%s/%s", productBasePath(productName), service, endpoint)
+}
+
+// 将 "a,b, c" 拆分成为: ["a", "b", "c"]
+func splitAddrs(addrs string) []string {
+	results := make([]string, 0, 3)
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if len(addr) > 0 {
+			results = append(results, addr)
+		}
+	}
+	return results
+}
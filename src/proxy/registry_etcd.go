@@ -0,0 +1,313 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	ETCD_DIAL_TIMEOUT    = 5 * time.Second
+	ETCD_REQUEST_TIMEOUT = 5 * time.Second
+	ETCD_LEASE_TTL       = 10 // 单位: 秒; Endpoint和Lease绑定, 进程挂了之后10s左右自动下线
+)
+
+//
+// Registry的etcd v3实现
+// 目录结构和zk保持一致:
+//    /zk/product/ProductName/services/Service1/ServiceId1 --> ServiceEndpoint(json)
+//
+// etcd中没有"目录"的概念，服务列表由Endpoints的key推导出来
+//
+type EtcdRegistry struct {
+	productName string
+	etcdAddr    string
+	client      *clientv3.Client
+
+	// 保护: leaseId, registrationWatchers
+	lock                 sync.Mutex
+	leaseId              clientv3.LeaseID
+	registrationWatchers map[chan interface{}]bool
+}
+
+func NewEtcdRegistry(productName string, etcdAddr string) *EtcdRegistry {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   splitAddrs(etcdAddr),
+		DialTimeout: ETCD_DIAL_TIMEOUT,
+	})
+	if err != nil {
+		log.PanicErrorf(err, "init etcd client failed: %s", etcdAddr)
+	}
+
+	return &EtcdRegistry{
+		productName:          productName,
+		etcdAddr:             etcdAddr,
+		client:               client,
+		leaseId:              clientv3.NoLease,
+		registrationWatchers: make(map[chan interface{}]bool),
+	}
+}
+
+func (r *EtcdRegistry) GetProductName() string {
+	return r.productName
+}
+
+func (r *EtcdRegistry) AddServiceEndpoint(endpoint *ServiceEndpoint) error {
+	data, err := json.Marshal(endpoint)
+	if err != nil {
+		return err
+	}
+
+	leaseId, err := r.ensureLease()
+	if err != nil {
+		return err
+	}
+
+	path := productServiceEndPointPath(r.productName, endpoint.Service, endpoint.ServiceId)
+	ctx, cancel := context.WithTimeout(context.Background(), ETCD_REQUEST_TIMEOUT)
+	_, err = r.client.Put(ctx, path, string(data), clientv3.WithLease(leaseId))
+	cancel()
+
+	log.Println(Green("AddServiceEndpoint"), "Path: ", path, ", Error: ", err)
+	return err
+}
+
+func (r *EtcdRegistry) DeleteServiceEndpoint(service string, serviceId string) error {
+	path := productServiceEndPointPath(r.productName, service, serviceId)
+	ctx, cancel := context.WithTimeout(context.Background(), ETCD_REQUEST_TIMEOUT)
+	resp, err := r.client.Delete(ctx, path)
+	cancel()
+
+	if err == nil && resp.Deleted > 0 {
+		log.Println(Red("DeleteServiceEndpoint"), "Path: ", path)
+	}
+	return err
+}
+
+func (r *EtcdRegistry) ListServices() ([]string, error) {
+	services, _, err := r.listServices()
+	return services, err
+}
+
+func (r *EtcdRegistry) ListServiceEndpoints(service string) ([]string, error) {
+	serviceIds, _, err := r.listServiceEndpoints(service)
+	return serviceIds, err
+}
+
+func (r *EtcdRegistry) GetServiceEndpoint(service string, serviceId string) (*ServiceEndpoint, error) {
+	path := productServiceEndPointPath(r.productName, service, serviceId)
+	ctx, cancel := context.WithTimeout(context.Background(), ETCD_REQUEST_TIMEOUT)
+	resp, err := r.client.Get(ctx, path)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("Endpoint Not Found: %s", path)
+	}
+
+	endpoint := &ServiceEndpoint{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (r *EtcdRegistry) WatchServices(evtbus chan interface{}) ([]string, error) {
+	services, revision, err := r.listServices()
+	if err != nil {
+		return nil, err
+	}
+	r.watchPrefix(productServicesPath(r.productName)+"/", revision, evtbus)
+	return services, nil
+}
+
+func (r *EtcdRegistry) WatchServiceEndpoints(service string, evtbus chan interface{}) ([]string, error) {
+	serviceIds, revision, err := r.listServiceEndpoints(service)
+	if err != nil {
+		return nil, err
+	}
+	r.watchPrefix(productServicePath(r.productName, service)+"/", revision, evtbus)
+	return serviceIds, nil
+}
+
+func (r *EtcdRegistry) WatchServiceEndpoint(service string, serviceId string, evtbus chan interface{}) (*ServiceEndpoint, error) {
+	path := productServiceEndPointPath(r.productName, service, serviceId)
+	ctx, cancel := context.WithTimeout(context.Background(), ETCD_REQUEST_TIMEOUT)
+	resp, err := r.client.Get(ctx, path)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("Endpoint Not Found: %s", path)
+	}
+
+	endpoint := &ServiceEndpoint{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, endpoint); err != nil {
+		return nil, err
+	}
+	r.watch(path, resp.Header.Revision, evtbus)
+	return endpoint, nil
+}
+
+//
+// Lease过期(相当于zk session过期)之后, evtbus会收到: REGISTRY_EVENT_SESSION_EXPIRED
+//
+func (r *EtcdRegistry) WatchRegistration(service string, evtbus chan interface{}) error {
+	r.lock.Lock()
+	r.registrationWatchers[evtbus] = true
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *EtcdRegistry) Close() {
+	r.lock.Lock()
+	leaseId := r.leaseId
+	r.leaseId = clientv3.NoLease
+	r.registrationWatchers = make(map[chan interface{}]bool)
+	r.lock.Unlock()
+
+	// 主动释放Lease, 这样Endpoints立即下线
+	if leaseId != clientv3.NoLease {
+		ctx, cancel := context.WithTimeout(context.Background(), ETCD_REQUEST_TIMEOUT)
+		r.client.Revoke(ctx, leaseId)
+		cancel()
+	}
+	r.client.Close()
+}
+
+//
+// 所有的Endpoints共用一个Lease, 通过KeepAlive来续约
+//
+func (r *EtcdRegistry) ensureLease() (clientv3.LeaseID, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.leaseId != clientv3.NoLease {
+		return r.leaseId, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ETCD_REQUEST_TIMEOUT)
+	grant, err := r.client.Grant(ctx, ETCD_LEASE_TTL)
+	cancel()
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	keepAlive, err := r.client.KeepAlive(context.Background(), grant.ID)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	r.leaseId = grant.ID
+	go r.keepAlive(grant.ID, keepAlive)
+	return grant.ID, nil
+}
+
+func (r *EtcdRegistry) keepAlive(leaseId clientv3.LeaseID, keepAlive <-chan *clientv3.LeaseKeepAliveResponse) {
+	for range keepAlive {
+		// 续约成功
+	}
+
+	// KeepAlive结束: Lease过期，或者和etcd的连接断开太久
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.leaseId != leaseId {
+		// 已经Close, 或者已经有了新的Lease
+		return
+	}
+	log.Warnf(Red("etcd lease expired: %x"), int64(leaseId))
+	r.leaseId = clientv3.NoLease
+
+	watchers := r.registrationWatchers
+	r.registrationWatchers = make(map[chan interface{}]bool)
+	for evtbus := range watchers {
+		go sendRegistryEvent(evtbus, REGISTRY_EVENT_SESSION_EXPIRED, "")
+	}
+}
+
+//
+// 读取prefix下所有的keys(去掉prefix), 同时返回读取时的revision, 以便之后从该revision开始watch
+//
+func (r *EtcdRegistry) listKeys(prefix string) ([]string, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ETCD_REQUEST_TIMEOUT)
+	resp, err := r.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		keys = append(keys, strings.TrimPrefix(string(kv.Key), prefix))
+	}
+	return keys, resp.Header.Revision, nil
+}
+
+func (r *EtcdRegistry) listServices() ([]string, int64, error) {
+	keys, revision, err := r.listKeys(productServicesPath(r.productName) + "/")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// service/serviceId --> service
+	serviceSet := make(map[string]bool)
+	for _, key := range keys {
+		if idx := strings.Index(key, "/"); idx > 0 {
+			serviceSet[key[0:idx]] = true
+		}
+	}
+	services := make([]string, 0, len(serviceSet))
+	for service := range serviceSet {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services, revision, nil
+}
+
+func (r *EtcdRegistry) listServiceEndpoints(service string) ([]string, int64, error) {
+	serviceIds, revision, err := r.listKeys(productServicePath(r.productName, service) + "/")
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Strings(serviceIds)
+	return serviceIds, revision, nil
+}
+
+func (r *EtcdRegistry) watchPrefix(prefix string, revision int64, evtbus chan interface{}) {
+	r.watch(prefix, revision, evtbus, clientv3.WithPrefix())
+}
+
+//
+// 和zk的Watch语义保持一致: 从revision之后第一次出现变化时，往evtbus中发送一个事件，然后结束watch
+//
+func (r *EtcdRegistry) watch(prefix string, revision int64, evtbus chan interface{}, opts ...clientv3.OpOption) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opts = append(opts, clientv3.WithRev(revision+1))
+	watchChan := r.client.Watch(ctx, prefix, opts...)
+
+	go func() {
+		defer cancel()
+		for resp := range watchChan {
+			if err := resp.Err(); err != nil {
+				log.WarnErrorf(err, "etcd watch error: %s", prefix)
+			} else if len(resp.Events) == 0 {
+				continue
+			}
+			break
+		}
+		// 出错，或者watchChan被关闭也通知外部，外部重新读取 & watch
+		evtbus <- newRegistryEvent(REGISTRY_EVENT_CHANGED, prefix)
+	}()
+}
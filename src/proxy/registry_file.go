@@ -0,0 +1,204 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FILE_REGISTRY_RELOAD_INTERVAL = time.Second
+)
+
+var ErrReadOnlyRegistry = errors.New("registry is read only")
+
+//
+// 基于静态文件的服务发现, 主要给rpc_proxy在本地开发环境，或者CI中使用(不依赖zk)
+// 文件格式根据扩展名来区分:
+//   services.json:
+//       {"typo": ["127.0.0.1:5555", "127.0.0.1:5556"], "account": ["run/account.sock"]}
+//   services.yaml/services.yml:
+//       typo: ["127.0.0.1:5555", "127.0.0.1:5556"]
+//   services.ini(或其他):
+//       typo=127.0.0.1:5555,127.0.0.1:5556
+//
+// 文件修改之后自动重新加载; 文件的内容同步到一个私有的MemoryRegistry中，
+// 因此Router/BackService看到的Watch语义和zk完全一致
+//
+type FileRegistry struct {
+	*MemoryRegistry
+
+	filename       string
+	content        []byte
+	reloadInterval time.Duration
+	exitEvt        chan bool
+}
+
+func NewFileRegistry(productName string, filename string) *FileRegistry {
+	r := newFileRegistry(productName, filename, FILE_REGISTRY_RELOAD_INTERVAL)
+	if err := r.reload(); err != nil {
+		log.PanicErrorf(err, "load services file failed: %s", filename)
+	}
+	go r.watchFile()
+	return r
+}
+
+func newFileRegistry(productName string, filename string, reloadInterval time.Duration) *FileRegistry {
+	return &FileRegistry{
+		MemoryRegistry: newMemoryRegistryWithStore(productName, newMemoryStore()),
+		filename:       filename,
+		reloadInterval: reloadInterval,
+		exitEvt:        make(chan bool),
+	}
+}
+
+// 服务列表由文件控制, 不接受注册
+func (r *FileRegistry) AddServiceEndpoint(endpoint *ServiceEndpoint) error {
+	return ErrReadOnlyRegistry
+}
+
+func (r *FileRegistry) DeleteServiceEndpoint(service string, serviceId string) error {
+	return ErrReadOnlyRegistry
+}
+
+func (r *FileRegistry) Close() {
+	close(r.exitEvt)
+	r.MemoryRegistry.Close()
+}
+
+func (r *FileRegistry) watchFile() {
+	ticker := time.NewTicker(r.reloadInterval)
+	defer ticker.Stop()
+
+	for true {
+		select {
+		case <-r.exitEvt:
+			return
+		case <-ticker.C:
+			// 文件读取/解析失败时保留之前的服务列表
+			if err := r.reload(); err != nil {
+				log.ErrorErrorf(err, "reload services file failed: %s", r.filename)
+			}
+		}
+	}
+}
+
+//
+// 重新读取文件, 和当前的服务列表进行对比，然后增删Endpoints
+//
+func (r *FileRegistry) reload() error {
+	content, err := ioutil.ReadFile(r.filename)
+	if err != nil {
+		return err
+	}
+	if r.content != nil && bytes.Equal(content, r.content) {
+		return nil
+	}
+
+	services, err := parseServicesFile(r.filename, content)
+	if err != nil {
+		return err
+	}
+	r.content = content
+	log.Printf(Green("Load services file: %s, %d services"), r.filename, len(services))
+
+	// 1. 删除下线的服务和Endpoints
+	oldServices, _ := r.MemoryRegistry.ListServices()
+	for _, service := range oldServices {
+		addrs, ok := services[service]
+		if !ok {
+			r.store.lock.Lock()
+			r.deleteService(service)
+			r.store.lock.Unlock()
+			continue
+		}
+		serviceIds, _ := r.MemoryRegistry.ListServiceEndpoints(service)
+		for _, serviceId := range serviceIds {
+			if !containsServiceId(addrs, serviceId) {
+				r.MemoryRegistry.DeleteServiceEndpoint(service, serviceId)
+			}
+		}
+	}
+
+	// 2. 添加新的Endpoints(已经存在的Endpoint不会产生新的事件)
+	for service, addrs := range services {
+		for _, addr := range addrs {
+			serviceId := fileServiceId(addr)
+			if _, err := r.MemoryRegistry.GetServiceEndpoint(service, serviceId); err != nil {
+				endpoint := NewServiceEndpoint(service, serviceId, addr, "", "")
+				r.MemoryRegistry.AddServiceEndpoint(endpoint)
+			}
+		}
+	}
+	return nil
+}
+
+//
+// 解析文件: service --> addrs
+//
+func parseServicesFile(filename string, content []byte) (map[string][]string, error) {
+	services := make(map[string][]string)
+
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		err = json.Unmarshal(content, &services)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &services)
+	default:
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("%s:%d invalid line: %s", filename, lineNo, line)
+			}
+			service := strings.TrimSpace(kv[0])
+			services[service] = append(services[service], splitAddrs(kv[1])...)
+		}
+		err = scanner.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 统一去掉空格
+	for service, addrs := range services {
+		for i := range addrs {
+			addrs[i] = strings.TrimSpace(addrs[i])
+		}
+		services[service] = addrs
+	}
+	return services, nil
+}
+
+//
+// 文件中的Endpoint没有ServiceId, 直接根据地址生成(不截断, 避免unix domain socket的冲突)
+// 例如: 127.0.0.1:5555 --> 127_0_0_1_5555
+//
+func fileServiceId(addr string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "/", "_").Replace(addr)
+}
+
+func containsServiceId(addrs []string, serviceId string) bool {
+	for _, addr := range addrs {
+		if fileServiceId(addr) == serviceId {
+			return true
+		}
+	}
+	return false
+}
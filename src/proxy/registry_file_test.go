@@ -0,0 +1,84 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+//
+// go test proxy -v -run "TestParseServicesFile"
+//
+func TestParseServicesFile(t *testing.T) {
+	services, err := parseServicesFile("services.json", []byte(`{"typo": ["127.0.0.1:5555", " 127.0.0.1:5556"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:5555", "127.0.0.1:5556"}, services["typo"])
+
+	services, err = parseServicesFile("services.ini", []byte("# comment\ntypo = 127.0.0.1:5555, 127.0.0.1:5556\naccount=run/account.sock\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:5555", "127.0.0.1:5556"}, services["typo"])
+	assert.Equal(t, []string{"run/account.sock"}, services["account"])
+
+	_, err = parseServicesFile("services.ini", []byte("typo\n"))
+	assert.True(t, err != nil)
+}
+
+//
+// go test proxy -v -run "TestFileRegistry"
+//
+func TestFileRegistry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "file_registry")
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "services.json")
+	ioutil.WriteFile(filename, []byte(`{"typo": ["127.0.0.1:5555"]}`), 0644)
+
+	r := newFileRegistry("test", filename, 10*time.Millisecond)
+	assert.NoError(t, r.reload())
+	go r.watchFile()
+	defer r.Close()
+
+	evtbus := make(chan interface{}, 2)
+	services, _ := r.WatchServices(evtbus)
+	assert.Equal(t, []string{"typo"}, services)
+
+	serviceIds, _ := r.WatchServiceEndpoints("typo", evtbus)
+	assert.Equal(t, []string{"127_0_0_1_5555"}, serviceIds)
+
+	endpoint, err := r.GetServiceEndpoint("typo", "127_0_0_1_5555")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5555", endpoint.Frontend)
+
+	// 不接受注册
+	assert.Equal(t, ErrReadOnlyRegistry, r.AddServiceEndpoint(endpoint))
+
+	// 文件修改之后自动加载
+	ioutil.WriteFile(filename, []byte(`{"typo": ["127.0.0.1:5556"], "account": ["127.0.0.1:6666"]}`), 0644)
+	assert.True(t, waitRegistryEvent(evtbus) != nil)
+	assert.True(t, waitRegistryEvent(evtbus) != nil)
+
+	services, _ = r.ListServices()
+	assert.Equal(t, []string{"account", "typo"}, services)
+	serviceIds, _ = r.ListServiceEndpoints("typo")
+	assert.Equal(t, []string{"127_0_0_1_5556"}, serviceIds)
+
+	// 格式错误时保留之前的服务列表
+	ioutil.WriteFile(filename, []byte(`{"typo": `), 0644)
+	time.Sleep(50 * time.Millisecond)
+	serviceIds, _ = r.ListServiceEndpoints("typo")
+	assert.Equal(t, []string{"127_0_0_1_5556"}, serviceIds)
+
+	// 服务从文件中删除之后, 整个服务下线
+	r.WatchServices(evtbus)
+	ioutil.WriteFile(filename, []byte(`{"typo": ["127.0.0.1:5556"]}`), 0644)
+	assert.True(t, waitRegistryEvent(evtbus) != nil)
+	services, _ = r.ListServices()
+	assert.Equal(t, []string{"typo"}, services)
+	_, err = r.ListServiceEndpoints("account")
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,290 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+//
+// 进程内的服务注册中心, 同一个进程内相同ProductName的MemoryRegistry共享数据
+// 主要用于单元测试, 以及不需要zk的本地开发环境(rpc_proxy, rpc_lb, ThriftRpcServer在同一个进程中)
+//
+type memoryStore struct {
+	// 保护下面所有的字段
+	lock sync.Mutex
+
+	// service --> serviceId --> endpoint
+	services map[string]map[string]*memoryEndpoint
+
+	// path --> 一次性的watchers(和zk的语义保持一致)
+	watchers map[string]map[chan interface{}]bool
+}
+
+type memoryEndpoint struct {
+	data  []byte
+	owner *MemoryRegistry
+}
+
+var (
+	memoryStores     = make(map[string]*memoryStore)
+	memoryStoresLock sync.Mutex
+)
+
+func getMemoryStore(productName string) *memoryStore {
+	memoryStoresLock.Lock()
+	defer memoryStoresLock.Unlock()
+
+	store, ok := memoryStores[productName]
+	if !ok {
+		store = newMemoryStore()
+		memoryStores[productName] = store
+	}
+	return store
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		services: make(map[string]map[string]*memoryEndpoint),
+		watchers: make(map[string]map[chan interface{}]bool),
+	}
+}
+
+//
+// 每一个MemoryRegistry相当于zk中的一个Session, 它注册的Endpoint在Close/ExpireSession之后自动删除
+//
+type MemoryRegistry struct {
+	productName string
+	store       *memoryStore
+
+	// 由 store.lock 保护
+	registrationWatchers map[chan interface{}]bool
+}
+
+func NewMemoryRegistry(productName string) *MemoryRegistry {
+	return newMemoryRegistryWithStore(productName, getMemoryStore(productName))
+}
+
+func newMemoryRegistryWithStore(productName string, store *memoryStore) *MemoryRegistry {
+	return &MemoryRegistry{
+		productName:          productName,
+		store:                store,
+		registrationWatchers: make(map[chan interface{}]bool),
+	}
+}
+
+func (r *MemoryRegistry) GetProductName() string {
+	return r.productName
+}
+
+func (r *MemoryRegistry) AddServiceEndpoint(endpoint *ServiceEndpoint) error {
+	data, err := json.Marshal(endpoint)
+	if err != nil {
+		return err
+	}
+
+	r.store.lock.Lock()
+	defer r.store.lock.Unlock()
+
+	if _, ok := r.store.services[endpoint.Service]; !ok {
+		r.store.services[endpoint.Service] = make(map[string]*memoryEndpoint)
+		r.notify(productServicesPath(r.productName), REGISTRY_EVENT_CHANGED)
+	}
+	if _, ok := r.store.services[endpoint.Service][endpoint.ServiceId]; ok {
+		// 已经存在: 只是数据发生变化
+		r.notify(productServiceEndPointPath(r.productName, endpoint.Service, endpoint.ServiceId), REGISTRY_EVENT_CHANGED)
+	}
+	r.store.services[endpoint.Service][endpoint.ServiceId] = &memoryEndpoint{data: data, owner: r}
+	r.notify(productServicePath(r.productName, endpoint.Service), REGISTRY_EVENT_CHANGED)
+
+	log.Println(Green("AddServiceEndpoint"), "Service: ", endpoint.Service, ", ServiceId: ", endpoint.ServiceId)
+	return nil
+}
+
+func (r *MemoryRegistry) DeleteServiceEndpoint(service string, serviceId string) error {
+	r.store.lock.Lock()
+	defer r.store.lock.Unlock()
+
+	r.deleteServiceEndpoint(service, serviceId)
+	return nil
+}
+
+func (r *MemoryRegistry) ListServices() ([]string, error) {
+	r.store.lock.Lock()
+	defer r.store.lock.Unlock()
+
+	services := make([]string, 0, len(r.store.services))
+	for service := range r.store.services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+func (r *MemoryRegistry) ListServiceEndpoints(service string) ([]string, error) {
+	r.store.lock.Lock()
+	defer r.store.lock.Unlock()
+
+	return r.listServiceEndpoints(service)
+}
+
+func (r *MemoryRegistry) GetServiceEndpoint(service string, serviceId string) (*ServiceEndpoint, error) {
+	r.store.lock.Lock()
+	ep, ok := r.store.services[service][serviceId]
+	r.store.lock.Unlock()
+
+	return decodeMemoryEndpoint(service, serviceId, ep, ok)
+}
+
+func decodeMemoryEndpoint(service string, serviceId string, ep *memoryEndpoint, ok bool) (*ServiceEndpoint, error) {
+	if !ok {
+		return nil, fmt.Errorf("Endpoint Not Found: %s/%s", service, serviceId)
+	}
+	endpoint := &ServiceEndpoint{}
+	if err := json.Unmarshal(ep.data, endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+func (r *MemoryRegistry) WatchServices(evtbus chan interface{}) ([]string, error) {
+	services, _ := r.ListServices()
+
+	r.store.lock.Lock()
+	r.addWatcher(productServicesPath(r.productName), evtbus)
+	r.store.lock.Unlock()
+	return services, nil
+}
+
+func (r *MemoryRegistry) WatchServiceEndpoints(service string, evtbus chan interface{}) ([]string, error) {
+	r.store.lock.Lock()
+	defer r.store.lock.Unlock()
+
+	serviceIds, err := r.listServiceEndpoints(service)
+	if err != nil {
+		return nil, err
+	}
+	r.addWatcher(productServicePath(r.productName, service), evtbus)
+	return serviceIds, nil
+}
+
+func (r *MemoryRegistry) WatchServiceEndpoint(service string, serviceId string, evtbus chan interface{}) (*ServiceEndpoint, error) {
+	r.store.lock.Lock()
+	ep, ok := r.store.services[service][serviceId]
+	if ok {
+		r.addWatcher(productServiceEndPointPath(r.productName, service, serviceId), evtbus)
+	}
+	r.store.lock.Unlock()
+
+	return decodeMemoryEndpoint(service, serviceId, ep, ok)
+}
+
+func (r *MemoryRegistry) WatchRegistration(service string, evtbus chan interface{}) error {
+	r.store.lock.Lock()
+	r.registrationWatchers[evtbus] = true
+	r.store.lock.Unlock()
+	return nil
+}
+
+//
+// 模拟zk session过期: 删除当前Registry注册的所有的Endpoints, 并且通知 WatchRegistration
+//
+func (r *MemoryRegistry) ExpireSession() {
+	r.store.lock.Lock()
+	defer r.store.lock.Unlock()
+
+	r.deleteOwnedEndpoints()
+
+	watchers := r.registrationWatchers
+	r.registrationWatchers = make(map[chan interface{}]bool)
+	for evtbus := range watchers {
+		go sendRegistryEvent(evtbus, REGISTRY_EVENT_SESSION_EXPIRED, "")
+	}
+}
+
+func (r *MemoryRegistry) Close() {
+	r.store.lock.Lock()
+	defer r.store.lock.Unlock()
+
+	r.deleteOwnedEndpoints()
+	r.registrationWatchers = make(map[chan interface{}]bool)
+}
+
+// 以下函数需要在 store.lock 的保护下调用
+func (r *MemoryRegistry) listServiceEndpoints(service string) ([]string, error) {
+	endpoints, ok := r.store.services[service]
+	if !ok {
+		return nil, fmt.Errorf("Service Not Found: %s", service)
+	}
+
+	serviceIds := make([]string, 0, len(endpoints))
+	for serviceId := range endpoints {
+		serviceIds = append(serviceIds, serviceId)
+	}
+	sort.Strings(serviceIds)
+	return serviceIds, nil
+}
+
+func (r *MemoryRegistry) deleteServiceEndpoint(service string, serviceId string) {
+	if _, ok := r.store.services[service][serviceId]; ok {
+		delete(r.store.services[service], serviceId)
+		r.notify(productServiceEndPointPath(r.productName, service, serviceId), REGISTRY_EVENT_CHANGED)
+		r.notify(productServicePath(r.productName, service), REGISTRY_EVENT_CHANGED)
+		log.Println(Red("DeleteServiceEndpoint"), "Service: ", service, ", ServiceId: ", serviceId)
+	}
+}
+
+//
+// 删除整个服务(FileRegistry中服务从文件中删除时使用), Router看到服务下线之后停止对应的BackService
+//
+func (r *MemoryRegistry) deleteService(service string) {
+	endpoints, ok := r.store.services[service]
+	if !ok {
+		return
+	}
+	for serviceId := range endpoints {
+		r.deleteServiceEndpoint(service, serviceId)
+	}
+	delete(r.store.services, service)
+	r.notify(productServicePath(r.productName, service), REGISTRY_EVENT_CHANGED)
+	r.notify(productServicesPath(r.productName), REGISTRY_EVENT_CHANGED)
+	log.Println(Red("DeleteService"), "Service: ", service)
+}
+
+func (r *MemoryRegistry) deleteOwnedEndpoints() {
+	for service, endpoints := range r.store.services {
+		for serviceId, ep := range endpoints {
+			if ep.owner == r {
+				r.deleteServiceEndpoint(service, serviceId)
+			}
+		}
+	}
+}
+
+func (r *MemoryRegistry) addWatcher(path string, evtbus chan interface{}) {
+	watchers, ok := r.store.watchers[path]
+	if !ok {
+		watchers = make(map[chan interface{}]bool)
+		r.store.watchers[path] = watchers
+	}
+	watchers[evtbus] = true
+}
+
+// Watcher只触发一次
+func (r *MemoryRegistry) notify(path string, eventType RegistryEventType) {
+	watchers := r.store.watchers[path]
+	delete(r.store.watchers, path)
+	for evtbus := range watchers {
+		go sendRegistryEvent(evtbus, eventType, path)
+	}
+}
+
+// 在goroutine中调用(evtbus可能没有buffer, 不能在锁内block)
+func sendRegistryEvent(evtbus chan interface{}, eventType RegistryEventType, path string) {
+	evtbus <- newRegistryEvent(eventType, path)
+}
@@ -0,0 +1,170 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	"testing"
+	"time"
+)
+
+//
+// go test proxy -v -run "TestMemoryRegistry"
+//
+func TestMemoryRegistry(t *testing.T) {
+	server := NewMemoryRegistry("test_memory_registry")
+	proxy := NewMemoryRegistry("test_memory_registry")
+
+	// 1. 服务列表的变化
+	evtbus := make(chan interface{}, 2)
+	services, err := proxy.WatchServices(evtbus)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(services))
+
+	endpoint := NewServiceEndpoint("typo", "127_0_0_1_5555", "127.0.0.1:5555", "", "")
+	assert.NoError(t, endpoint.AddServiceEndpoint(server))
+	assert.True(t, waitRegistryEvent(evtbus) != nil)
+
+	services, _ = proxy.WatchServices(evtbus)
+	assert.Equal(t, []string{"typo"}, services)
+
+	// 2. Endpoints的变化
+	serviceIds, err := proxy.WatchServiceEndpoints("typo", evtbus)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127_0_0_1_5555"}, serviceIds)
+
+	endpoint2, err := GetServiceEndpoint(proxy, "typo", "127_0_0_1_5555")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:5555", endpoint2.Frontend)
+
+	// Close之后, server注册的Endpoint自动删除
+	server.Close()
+	assert.True(t, waitRegistryEvent(evtbus) != nil)
+
+	serviceIds, _ = proxy.ListServiceEndpoints("typo")
+	assert.Equal(t, 0, len(serviceIds))
+
+	// Watcher只触发一次
+	assert.True(t, waitRegistryEvent(evtbus) == nil)
+}
+
+//
+// go test proxy -v -run "TestRegisterServiceSessionExpired"
+//
+func TestRegisterServiceSessionExpired(t *testing.T) {
+	server := NewMemoryRegistry("test_register_service")
+	proxy := NewMemoryRegistry("test_register_service")
+
+	var state atomic2.Bool
+	state.Set(true)
+	evtExit := make(chan interface{})
+	defer close(evtExit)
+
+	RegisterService("typo", "127.0.0.1:5555", "127_0_0_1_5555", server, evtExit, "", "", DEFAULT_ENDPOINT_WEIGHT, &state, make(chan bool))
+
+	serviceIds, _ := proxy.ListServiceEndpoints("typo")
+	assert.Equal(t, []string{"127_0_0_1_5555"}, serviceIds)
+
+	// Session过期之后，RegisterService负责重新注册
+	evtbus := make(chan interface{}, 2)
+	proxy.WatchServiceEndpoints("typo", evtbus)
+	time.Sleep(10 * time.Millisecond)
+	server.ExpireSession()
+
+	for i := 0; i < 100; i++ {
+		serviceIds, _ = proxy.ListServiceEndpoints("typo")
+		if len(serviceIds) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"127_0_0_1_5555"}, serviceIds)
+}
+
+//
+// go test proxy -v -run "TestWatchServiceEndpointWeight"
+//
+func TestWatchServiceEndpointWeight(t *testing.T) {
+	server := NewMemoryRegistry("test_endpoint_weight")
+	proxy := NewMemoryRegistry("test_endpoint_weight")
+
+	endpoint := NewServiceEndpoint("typo", "127_0_0_1_5555", "127.0.0.1:5555", "", "")
+	assert.NoError(t, endpoint.AddServiceEndpoint(server))
+
+	evtbus := make(chan interface{}, 2)
+	endpoint2, err := proxy.WatchServiceEndpoint("typo", "127_0_0_1_5555", evtbus)
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_ENDPOINT_WEIGHT, endpoint2.GetWeight())
+
+	// 1. 调整权重
+	endpoint.Weight = 5
+	assert.NoError(t, endpoint.AddServiceEndpoint(server))
+	e := waitRegistryEvent(evtbus)
+	assert.True(t, e != nil)
+	assert.Equal(t, productServiceEndPointPath("test_endpoint_weight", "typo", "127_0_0_1_5555"), e.Path)
+
+	endpoint2, err = proxy.WatchServiceEndpoint("typo", "127_0_0_1_5555", evtbus)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, endpoint2.GetWeight())
+
+	// 2. Endpoint被删除
+	server.Close()
+	assert.True(t, waitRegistryEvent(evtbus) != nil)
+	assert.True(t, waitRegistryEvent(evtbus) == nil)
+}
+
+func waitRegistryEvent(evtbus chan interface{}) *RegistryEvent {
+	select {
+	case e := <-evtbus:
+		return e.(*RegistryEvent)
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+//
+// go test proxy -v -run "TestRegistryWatches"
+//
+func TestRegistryWatches(t *testing.T) {
+	server := NewMemoryRegistry("test_registry_watches")
+	proxy := NewMemoryRegistry("test_registry_watches")
+
+	endpoint1 := NewServiceEndpoint("typo", "127_0_0_1_5555", "127.0.0.1:5555", "", "")
+	endpoint2 := NewServiceEndpoint("typo", "127_0_0_1_5556", "127.0.0.1:5556", "", "")
+	assert.NoError(t, endpoint1.AddServiceEndpoint(server))
+	assert.NoError(t, endpoint2.AddServiceEndpoint(server))
+
+	watches := newRegistryWatches()
+	for _, serviceId := range []string{"127_0_0_1_5555", "127_0_0_1_5556"} {
+		evtbus, _ := watches.arm(serviceId)
+		_, err := proxy.WatchServiceEndpoint("typo", serviceId, evtbus)
+		assert.NoError(t, err)
+
+		// 仍然有效的Watch不需要重新Watch
+		evtbus, _ = watches.arm(serviceId)
+		assert.True(t, evtbus == nil)
+	}
+
+	// 1. 多个Watch同时触发: 合并成为一次通知, 只有触发的Watch需要重新Watch
+	server.Close()
+	watched := -1
+	for i := 0; i < 100 && watched != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		watches.lock.Lock()
+		watched = len(watches.watched)
+		watches.lock.Unlock()
+	}
+	assert.Equal(t, 0, watched)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, len(watches.notify))
+	<-watches.notify
+
+	// 2. Watch失败之后可以重新Watch
+	evtbus, cancel := watches.arm("127_0_0_1_5555")
+	assert.True(t, evtbus != nil)
+	cancel()
+	evtbus, _ = watches.arm("127_0_0_1_5555")
+	assert.True(t, evtbus != nil)
+	assert.Equal(t, 0, len(watches.notify))
+}
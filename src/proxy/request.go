@@ -11,6 +11,7 @@ import (
 	"io"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Dispatcher interface {
@@ -22,11 +23,20 @@ const (
 	MESSAGE_TYPE_HEART_BEAT   thrift.TMessageType = 20
 	MESSAGE_TYPE_STOP         thrift.TMessageType = 21
 	MESSAGE_TYPE_STOP_CONFIRM thrift.TMessageType = 22
+
+	// Worker连接到rpc_lb之后发送的第一个message, name为Worker提供的服务(参考: BackServiceLBMux)
+	MESSAGE_TYPE_REGISTER thrift.TMessageType = 23
 )
 
 type Request struct {
-	Service      string // 服务
-	ProxyRequest bool   // Service是否出现在Request.Data中，默认为true, 但是心跳等信号中没有service
+	Service      string         // 服务
+	ProxyRequest bool           // Service是否出现在Request.Data中，默认为true, 但是心跳等信号中没有service
+	Protocol     ThriftProtocol // Client使用的协议; Request.Data/Response.Data在proxy/lb内部总是TBinaryProtocol
+
+	// Client使用THeader transport时, 返回的数据也使用THeader
+	// Headers(caller, trace id, deadline等)转发给支持THeader的后端
+	THeader bool
+	Headers map[string]string
 
 	// 原始的数据(虽然拷贝有点点效率低，但是和zeromq相比也差不多)
 	Request struct {
@@ -37,14 +47,23 @@ type Request struct {
 		DataOrig []byte
 	}
 
-	Start int64
+	Start        int64
+	AttemptStart int64 // 最后一次分配给BackendConn的时间, 用于统计后端的latency(不包括之前失败的尝试)
+	Deadline     int64 // 以microsecond为单位; 0表示使用默认的超时时间
+	Attempts     int   // 分配给BackendConn的次数(包括重试)
+
+	Trace         *RequestTrace      // 没有采样时为nil
+	SessionLimits *SessionRateLimits // Client Session单独计数的限流, 没有Session时为nil
+	BackendAddr   string             // 最后一次分配的BackendConn(BackendConnLB)的地址
 
 	// 返回的数据类型
 	Response struct {
-		Data   []byte
-		Err    error
-		SeqId  int32 // -1保留，表示没有对应的SeqNum
-		TypeId thrift.TMessageType
+		Data     []byte
+		Err      error
+		SeqId    int32 // -1保留，表示没有对应的SeqNum
+		TypeId   thrift.TMessageType
+		NotFound bool              // 没有找到对应的Service或者Worker, Data为proxy/lb自己生成的Exception
+		Headers  map[string]string // 支持THeader的后端返回的headers
 	}
 
 	Wait sync.WaitGroup
@@ -52,29 +71,155 @@ type Request struct {
 
 //
 // 给定一个thrift message，构建一个Request对象
+// THeader frame中的headers被剥离出来, TCompactProtocol的message被转换成为TBinaryProtocol(参考: Request.EncodeResponse)
+// 数据不合法时也返回Request(以及error), 用于按照Client的协议返回Exception
 //
 func NewRequest(data []byte, serviceInReq bool) (*Request, error) {
 	request := &Request{
 		ProxyRequest: serviceInReq,
 		Start:        microseconds(),
 	}
+	request.AttemptStart = request.Start
+	if IsTHeaderFrame(data) {
+		request.THeader = true
+		headers, payload, err := unwrapTHeaderFrame(data)
+		if err != nil {
+			return request, err
+		}
+		request.Headers = headers
+		data = payload
+	}
+
+	request.Protocol = DetectProtocol(data)
+	if request.Protocol != PROTOCOL_BINARY {
+		binaryData, err := transcodeThriftMessage(data, request.Protocol, PROTOCOL_BINARY)
+		if err != nil {
+			return request, err
+		}
+		returnSlice(data)
+		data = binaryData
+	}
 	request.Request.Data = data
 	err := request.DecodeRequest()
 
 	if err != nil {
-		return nil, err
+		return request, err
 	} else {
 		return request, nil
 	}
 
 }
 
+//
+// 设置请求的超时时间(从Request创建开始计算)
+//
+func (r *Request) SetTimeout(timeout time.Duration) {
+	r.Deadline = r.Start + int64(timeout/time.Microsecond)
+}
+
+//
+// 请求的超时时间点(以microsecond为单位), 没有设置时使用默认的超时时间
+//
+func (r *Request) GetDeadline() int64 {
+	if r.Deadline == 0 {
+		return r.Start + REQUEST_EXPIRED_TIME_MICRO
+	}
+	return r.Deadline
+}
+
+//
+// 请求在now(以microsecond为单位)时是否已经超时
+//
+func (r *Request) IsExpired(now int64) bool {
+	return now >= r.GetDeadline()
+}
+
+//
+// 请求的结果, 用于统计
+//
+type RequestOutcome int
+
+const (
+	OUTCOME_SUCCESS         RequestOutcome = iota
+	OUTCOME_EXCEPTION                      // 后端返回的Exception
+	OUTCOME_TRANSPORT_ERROR                // 连接断开, 写失败等
+	OUTCOME_TIMEOUT
+	OUTCOME_NO_WORKER    // 没有对应的Service或者可用的Worker
+	OUTCOME_RATE_LIMITED // 超过限流, 没有转发给后端
+	OUTCOME_OVERLOADED   // BackendConn的队列满了, 没有转发给后端
+	OUTCOME_COUNT
+)
+
+func (o RequestOutcome) String() string {
+	switch o {
+	case OUTCOME_SUCCESS:
+		return "success"
+	case OUTCOME_EXCEPTION:
+		return "exception"
+	case OUTCOME_TRANSPORT_ERROR:
+		return "transport_error"
+	case OUTCOME_TIMEOUT:
+		return "timeout"
+	case OUTCOME_NO_WORKER:
+		return "no_worker"
+	case OUTCOME_RATE_LIMITED:
+		return "rate_limited"
+	case OUTCOME_OVERLOADED:
+		return "overloaded"
+	default:
+		return "unknown"
+	}
+}
+
+//
+// 请求处理完毕之后的结果(Response.Err转换成为Exception之后依然有效)
+//
+func (r *Request) Outcome() RequestOutcome {
+	switch {
+	case r.Response.Err != nil && IsRateLimitedError(r.Response.Err):
+		return OUTCOME_RATE_LIMITED
+	case r.Response.Err != nil && IsOverloadedError(r.Response.Err):
+		return OUTCOME_OVERLOADED
+	case r.Response.Err != nil && IsTimeoutError(r.Response.Err):
+		return OUTCOME_TIMEOUT
+	case r.Response.Err != nil:
+		return OUTCOME_TRANSPORT_ERROR
+	case r.Response.NotFound:
+		return OUTCOME_NO_WORKER
+	case r.Response.TypeId == thrift.EXCEPTION:
+		return OUTCOME_EXCEPTION
+	default:
+		return OUTCOME_SUCCESS
+	}
+}
+
+//
+// 请求超时, 和其他的错误区分开, 最终返回给Client的是专门的Timeout Exception
+//
+type TimeoutError struct {
+	Service string
+	Method  string
+	SeqId   int32
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("Timeout Exception, %s.%s.%d", e.Service, e.Method, e.SeqId)
+}
+
+func IsTimeoutError(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
 //
 // 利用自身信息生成 timeout Error(注意: 其中的SeqId必须为r.Request.SeqId(它不是从后台返回，不会进行SeqId的replace)
 //
 func (r *Request) NewTimeoutError() error {
-	return errors.New(fmt.Sprintf("Timeout Exception, %s.%s.%d",
-		r.Service, r.Request.Name, r.Request.SeqId))
+	return &TimeoutError{
+		Service: r.Service,
+		Method:  r.Request.Name,
+		SeqId:   r.Request.SeqId,
+	}
 }
 
 func (r *Request) NewInvalidResponseError(method string, module string) error {
@@ -112,6 +257,13 @@ func (r *Request) DecodeRequest() error {
 // 将Request中的SeqNum进行替换（修改Request部分的数据)
 //
 func (r *Request) ReplaceSeqId(newSeq int32) {
+	r.replaceSeqId(newSeq, false)
+}
+
+//
+// keepService: 后端为rpc_lb(multiplexed), 保留Data中的service前缀, 只替换SeqId
+//
+func (r *Request) replaceSeqId(newSeq int32, keepService bool) {
 	if r.Request.Data != nil {
 		//		log.Printf(Green("Replace SeqNum: %d --> %d"), r.Request.SeqId, newSeq)
 		if r.Response.SeqId != 0 {
@@ -121,7 +273,14 @@ func (r *Request) ReplaceSeqId(newSeq int32) {
 
 		start := 0
 
-		if r.ProxyRequest {
+		// 重试时service可能已经从Data中剥离(参考: ResetForRetry)
+		if r.hasServicePrefix() {
+			if keepService {
+				// version(4) + name len(4) + service:name + seqId(4)
+				offset := 8 + len(r.Service) + len(thrift.MULTIPLEXED_SEPARATOR) + len(r.Request.Name)
+				binary.BigEndian.PutUint32(r.Request.Data[offset:offset+4], uint32(newSeq))
+				return
+			}
 			start = len(r.Service)
 		}
 		if start > 0 {
@@ -143,6 +302,26 @@ func (r *Request) ReplaceSeqId(newSeq int32) {
 	}
 }
 
+//
+// Request.Data中是否包含service前缀(service:method)
+//
+func (r *Request) hasServicePrefix() bool {
+	return r.ProxyRequest && r.Request.DataOrig == nil && len(r.Service) > 0
+}
+
+//
+// 请求失败之后重新分配给其他的BackendConn之前, 清除上一次的结果
+// Request.Data已经被ReplaceSeqId修改(service可能被剥离), 可以直接再次ReplaceSeqId
+//
+func (r *Request) ResetForRetry() {
+	r.Response.Data = nil
+	r.Response.Err = nil
+	r.Response.SeqId = 0
+	r.Response.TypeId = 0
+	r.Response.NotFound = false
+	r.Response.Headers = nil
+}
+
 func (r *Request) Recycle() {
 	var sliceId uintptr = 0
 	// 将其中的Buffer归还(returnSlice)
@@ -187,6 +366,9 @@ func (r *Request) RestoreSeqId() {
 // 给定thrift Message, 解码出: typeId, seqId
 //
 func DecodeThriftTypIdSeqId(data []byte) (typeId thrift.TMessageType, method string, seqId int32, err error) {
+	if DetectProtocol(data) == PROTOCOL_COMPACT {
+		return decodeCompactTypIdSeqId(data)
+	}
 
 	// 解码typeId
 	if len(data) < 4 {
@@ -8,6 +8,7 @@ import (
 	"errors"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"sync"
+	"time"
 )
 
 //
@@ -24,12 +25,20 @@ type RequestMap struct {
 	evictList *list.List
 	items     map[int32]*list.Element
 	lock      sync.RWMutex
+
+	// 不为nil时, 每一个Request到了Deadline之后自动删除, 并且返回Timeout Exception
+	timingWheel *TimingWheel
+	// 请求超时之后的回调(例如: 熔断的统计)
+	expiredHandler func(r *Request)
 }
 
 // 列表中的元素类型
 type Entry struct {
 	key   int32
 	value *Request
+	timer *Timer
+	// 每次startTimer时加1; 已经被取出, 但是还没有执行的旧Timer不能让新的请求超时
+	generation int64
 }
 
 func NewRequestMap(size int) (*RequestMap, error) {
@@ -44,6 +53,25 @@ func NewRequestMap(size int) (*RequestMap, error) {
 	return c, nil
 }
 
+//
+// 请求超时通过TimingWheel来处理: 精确到ms, 请求返回时O(1)取消
+//
+func NewExpiringRequestMap(size int, timingWheel *TimingWheel) (*RequestMap, error) {
+	c, err := NewRequestMap(size)
+	if err != nil {
+		return nil, err
+	}
+	c.timingWheel = timingWheel
+	return c, nil
+}
+
+//
+// 设置请求超时之后的回调, 需要在使用RequestMap之前设置
+//
+func (c *RequestMap) SetExpiredHandler(handler func(r *Request)) {
+	c.expiredHandler = handler
+}
+
 // 返回所有元素，重新初始化List/Map
 func (c *RequestMap) Purge() []*Request {
 	c.lock.Lock()
@@ -51,7 +79,9 @@ func (c *RequestMap) Purge() []*Request {
 	// 拷贝剩余的Requests
 	results := make([]*Request, 0, len(c.items))
 	for _, element := range c.items {
-		results = append(results, element.Value.(*Entry).value)
+		entry := element.Value.(*Entry)
+		entry.stopTimer()
+		results = append(results, entry.value)
 	}
 
 	// 重新初始化
@@ -73,6 +103,7 @@ func (c *RequestMap) Add(key int32, value *Request) bool {
 	if ent, ok := c.items[key]; ok {
 		c.evictList.MoveToFront(ent)
 		ent.Value.(*Entry).value = value
+		c.startTimer(ent)
 		log.Errorf(Red("Duplicated Key Found in RequestOrderedMap: %d"), key)
 
 		c.lock.Unlock()
@@ -80,9 +111,10 @@ func (c *RequestMap) Add(key int32, value *Request) bool {
 	}
 
 	// Add new item
-	ent := &Entry{key, value}
+	ent := &Entry{key: key, value: value}
 	entry := c.evictList.PushFront(ent)
 	c.items[key] = entry
+	c.startTimer(entry)
 
 	// 如果超过指定的大小，则清除元素
 	evict := c.evictList.Len() > c.size
@@ -181,42 +213,6 @@ func (c *RequestMap) Len() int {
 	return result
 }
 
-//
-// 清除过期的Request
-//
-func (c *RequestMap) RemoveExpired(expiredInMicro int64) {
-	c.lock.Lock()
-
-	for true {
-		ent := c.evictList.Back()
-
-		// 如果Map为空，则返回
-		if ent == nil {
-			break
-		}
-
-		// 如果请求还没有过期，则不再返回
-		entry := ent.Value.(*Entry)
-		request := entry.value
-		if request.Start > expiredInMicro {
-			break
-		}
-
-		// 1. 准备删除当前的元素
-		c.removeElement(ent)
-
-		// 2. 如果出问题了，则打印原始的请求的数据
-		log.Warnf(Red("Remove Expired Request: %s.%s [%d]"),
-			request.Service, request.Request.Name, request.Response.SeqId)
-
-		// 3. 处理Request
-		request.Response.Err = request.NewTimeoutError()
-		request.Wait.Done()
-	}
-
-	c.lock.Unlock()
-}
-
 //
 // 读取最旧的元素
 //
@@ -248,7 +244,57 @@ func (c *RequestMap) removeElement(e *list.Element) {
 
 	c.evictList.Remove(e)
 	kv := e.Value.(*Entry)
+	kv.stopTimer()
 
 	//	log.Printf("Remove Element: %s, With key: %d", kv.value.Request.Name, kv.key)
 	delete(c.items, kv.key)
 }
+
+// 给元素设置Deadline对应的Timer
+func (c *RequestMap) startTimer(e *list.Element) {
+	if c.timingWheel == nil {
+		return
+	}
+	entry := e.Value.(*Entry)
+	entry.stopTimer()
+
+	entry.generation++
+	generation := entry.generation
+	timeout := time.Duration(entry.value.GetDeadline()-microseconds()) * time.Microsecond
+	entry.timer = c.timingWheel.AfterFunc(timeout, func() {
+		c.expire(e, generation)
+	})
+}
+
+//
+// Timer触发: 如果请求还没有返回, 则直接返回Timeout Exception
+//
+func (c *RequestMap) expire(e *list.Element, generation int64) {
+	c.lock.Lock()
+
+	// 请求已经返回, key已经被其他的请求使用, 或者Timer已经被新的请求替换
+	entry := e.Value.(*Entry)
+	if ent, ok := c.items[entry.key]; !ok || ent != e || entry.generation != generation {
+		c.lock.Unlock()
+		return
+	}
+	c.removeElement(e)
+	c.lock.Unlock()
+
+	request := entry.value
+	log.Warnf(Red("Remove Expired Request: %s.%s [%d]"),
+		request.Service, request.Request.Name, request.Response.SeqId)
+
+	if c.expiredHandler != nil {
+		c.expiredHandler(request)
+	}
+	request.Response.Err = request.NewTimeoutError()
+	request.Wait.Done()
+}
+
+func (e *Entry) stopTimer() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+}
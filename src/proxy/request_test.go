@@ -19,6 +19,59 @@ func fakeData(name string, typeId thrift.TMessageType, seqId int32, buf []byte)
 
 }
 
+//
+// 测试用的参数: value为基本类型, 或者写入复杂类型(list, map, struct等)的函数
+//
+type fakeField struct {
+	name  string
+	typ   thrift.TType
+	id    int16
+	value interface{}
+}
+
+//
+// 写入一个完整的Thrift消息(参数为fields), p为binary或者compact
+//
+func fakeArgsData(p ThriftProtocol, name string, typeId thrift.TMessageType, seqId int32, fields ...fakeField) []byte {
+	transport := NewTMemoryBufferLen(200)
+	protocol := newThriftProtocol(p, transport)
+	protocol.WriteMessageBegin(name, typeId, seqId)
+	writeFakeStruct(protocol, "args", fields)
+	protocol.WriteMessageEnd()
+	protocol.Flush()
+	return append([]byte(nil), transport.Bytes()...)
+}
+
+func writeFakeStruct(protocol thrift.TProtocol, name string, fields []fakeField) {
+	protocol.WriteStructBegin(name)
+	for _, f := range fields {
+		protocol.WriteFieldBegin(f.name, f.typ, f.id)
+		switch v := f.value.(type) {
+		case bool:
+			protocol.WriteBool(v)
+		case int8:
+			protocol.WriteByte(v)
+		case int16:
+			protocol.WriteI16(v)
+		case int32:
+			protocol.WriteI32(v)
+		case int64:
+			protocol.WriteI64(v)
+		case float64:
+			protocol.WriteDouble(v)
+		case string:
+			protocol.WriteString(v)
+		case func(thrift.TProtocol):
+			v(protocol)
+		default:
+			panic(fmt.Sprintf("unsupported fake field: %s", f.name))
+		}
+		protocol.WriteFieldEnd()
+	}
+	protocol.WriteFieldStop()
+	protocol.WriteStructEnd()
+}
+
 //
 // go test proxy -v -run "TestRequest"
 //
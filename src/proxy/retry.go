@@ -0,0 +1,143 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RETRY_DEFAULT_MAX_ATTEMPTS = 2                     // 包括第一次请求
+	RETRY_DEFAULT_BUDGET_RATIO = 0.2                   // 重试的请求最多占正常请求的20%
+	RETRY_DEFAULT_BACKOFF      = 10 * time.Millisecond // 第一次重试之前等待的时间, 之后按照指数增长
+	RETRY_MAX_BACKOFF          = time.Second
+
+	RETRY_BUDGET_MIN_TOKENS = 10  // 请求很少时也允许少量的重试
+	RETRY_BUDGET_MAX_TOKENS = 100 // 避免长时间积累的token在故障时导致大量的重试
+)
+
+//
+// 请求的重试策略
+// 1. 请求还没有写到后端(例如: 分配到了inactive的BackendConn, 或者还在BackendConn#input中), 总是可以重试
+// 2. 请求已经写到后端(例如: 连接断开时还没有返回的请求), 只有幂等的方法才重试
+// 3. 超时的请求不重试; 重试的总次数受MaxAttempts和重试预算的限制
+//
+// MaxAttempts可以按照service, service.method覆盖, Idempotent中的service表示该服务的所有方法都是幂等的
+//
+type RetryPolicy struct {
+	MaxAttempts int
+	Attempts    map[string]int  // service/service.method --> max attempts
+	Idempotent  map[string]bool // service/service.method
+	BudgetRatio float64
+	Backoff     time.Duration
+}
+
+func (p *RetryPolicy) GetMaxAttempts(service string, method string) int {
+	if attempts, ok := p.Attempts[service+"."+method]; ok {
+		return attempts
+	}
+	if attempts, ok := p.Attempts[service]; ok {
+		return attempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) IsIdempotent(service string, method string) bool {
+	return p.Idempotent[service+"."+method] || p.Idempotent[service]
+}
+
+//
+// 第attempts次重试之前等待的时间: Backoff * 2^(attempts - 1), 加上随机的抖动
+//
+func (p *RetryPolicy) GetBackoff(attempts int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < attempts && backoff < RETRY_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > RETRY_MAX_BACKOFF {
+		backoff = RETRY_MAX_BACKOFF
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	// [backoff / 2, backoff * 3 / 2)
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+//
+// 重试预算(参考: finagle RetryBudget): 每个请求存入BudgetRatio个token, 每次重试消耗一个token
+// 避免后端整体出现问题时, 重试放大请求量
+//
+type RetryBudget struct {
+	ratio float64
+
+	lock   sync.Mutex
+	tokens float64
+}
+
+func NewRetryBudget(ratio float64) *RetryBudget {
+	return &RetryBudget{
+		ratio:  ratio,
+		tokens: RETRY_BUDGET_MIN_TOKENS,
+	}
+}
+
+func (b *RetryBudget) Deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens += b.ratio
+	if b.tokens > RETRY_BUDGET_MAX_TOKENS {
+		b.tokens = RETRY_BUDGET_MAX_TOKENS
+	}
+}
+
+func (b *RetryBudget) TryWithdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true
+	}
+	return false
+}
+
+//
+// 解析: typo:3,typo.get_user_info:1
+//
+func ParseRetryAttempts(value string) (map[string]int, error) {
+	rules, err := parseServiceRules(value)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts := make(map[string]int, len(rules))
+	for key, value := range rules {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid retry attempts: %s:%s", key, value)
+		}
+		attempts[key] = n
+	}
+	return attempts, nil
+}
+
+//
+// 解析: typo.get_user_info,analytics
+//
+func ParseIdempotentMethods(value string) map[string]bool {
+	methods := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			methods[item] = true
+		}
+	}
+	return methods
+}
@@ -0,0 +1,172 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+	"testing"
+	"time"
+)
+
+//
+// 后端服务: 将请求原样返回; closeAfterRequest时, 收到第一个请求之后直接关闭(模拟后端挂掉)
+//
+func startRetryTestServer(t *testing.T, closeAfterRequest bool) string {
+	transport, err := thrift.NewTServerSocket("127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.NoError(t, transport.Listen())
+
+	go func() {
+		for {
+			tran, err := transport.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				bt := NewTBufferedFramedTransport(tran, time.Microsecond*100, 2)
+				defer bt.Close()
+				for {
+					request, err := bt.ReadFrame()
+					if err != nil {
+						return
+					}
+					typeId, _, _, _ := DecodeThriftTypIdSeqId(request)
+					if closeAfterRequest && typeId != MESSAGE_TYPE_HEART_BEAT {
+						transport.Close()
+						return
+					}
+					bt.Write(request)
+					bt.FlushBuffer(true)
+				}
+			}()
+		}
+	}()
+	return transport.Addr().String()
+}
+
+func newRetryTestRequest(name string, seqId int32) *Request {
+	buf := make([]byte, 100, 100)
+	l := fakeData(name, thrift.CALL, seqId, buf[0:0])
+	r, _ := NewRequest(buf[0:l], true)
+	r.SetTimeout(5 * time.Second)
+	return r
+}
+
+func waitActiveConns(s *BackService, n int) {
+	for i := 0; i < 300 && s.Active() != n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//
+// go test proxy -v -run "TestRetryPolicy"
+//
+func TestRetryPolicy(t *testing.T) {
+	attempts, err := ParseRetryAttempts("typo:3, typo.get_user:1")
+	assert.NoError(t, err)
+	_, err = ParseRetryAttempts("typo:0")
+	assert.True(t, err != nil)
+
+	policy := &RetryPolicy{
+		MaxAttempts: RETRY_DEFAULT_MAX_ATTEMPTS,
+		Attempts:    attempts,
+		Idempotent:  ParseIdempotentMethods("typo.get_user, analytics"),
+		Backoff:     10 * time.Millisecond,
+	}
+	assert.Equal(t, 1, policy.GetMaxAttempts("typo", "get_user"))
+	assert.Equal(t, 3, policy.GetMaxAttempts("typo", "set_user"))
+	assert.Equal(t, RETRY_DEFAULT_MAX_ATTEMPTS, policy.GetMaxAttempts("analytics", "track"))
+
+	assert.True(t, policy.IsIdempotent("typo", "get_user"))
+	assert.False(t, policy.IsIdempotent("typo", "set_user"))
+	assert.True(t, policy.IsIdempotent("analytics", "track"))
+
+	// 指数增长 + 抖动
+	for i := 0; i < 10; i++ {
+		backoff := policy.GetBackoff(3)
+		assert.True(t, backoff >= 20*time.Millisecond && backoff < 60*time.Millisecond)
+		assert.True(t, policy.GetBackoff(100) < RETRY_MAX_BACKOFF*3/2)
+	}
+
+	// 重试预算
+	budget := NewRetryBudget(0.5)
+	for i := 0; i < RETRY_BUDGET_MIN_TOKENS; i++ {
+		assert.True(t, budget.TryWithdraw())
+	}
+	assert.False(t, budget.TryWithdraw())
+	budget.Deposit()
+	budget.Deposit()
+	assert.True(t, budget.TryWithdraw())
+	assert.False(t, budget.TryWithdraw())
+}
+
+//
+// go test proxy -v -run "TestBackServiceRetry"
+//
+func TestBackServiceRetry(t *testing.T) {
+	s := &BackService{
+		serviceName: "typo",
+		activeConns: make([]*BackendConn, 0, 10),
+		balancer:    newRoundRobinBalancer(),
+		retry: &RetryPolicy{
+			MaxAttempts: 2,
+			Idempotent:  map[string]bool{"typo.get_user": true},
+			Backoff:     time.Millisecond,
+		},
+		retryBudget: NewRetryBudget(RETRY_DEFAULT_BUDGET_RATIO),
+		addr2Conn:   make(map[string]*BackendConn),
+	}
+
+	goodConn := NewBackendConn(startRetryTestServer(t, false), DEFAULT_ENDPOINT_WEIGHT, s, "typo", nil, nil, false, false)
+	defer goodConn.MarkOffline()
+	badConn := NewBackendConn(startRetryTestServer(t, true), DEFAULT_ENDPOINT_WEIGHT, s, "typo", nil, nil, false, false)
+	defer badConn.MarkOffline()
+	waitActiveConns(s, 2)
+
+	// 1. 幂等的方法: 已经发送的请求在连接断开之后, 重试到其他的BackendConn
+	r1 := newRetryTestRequest("typo:get_user", 1)
+	s.dispatch(r1, goodConn)
+	r1.Wait.Wait()
+	assert.NoError(t, r1.Response.Err)
+	assert.Equal(t, 2, r1.Attempts)
+	_, _, seqId, err := DecodeThriftTypIdSeqId(r1.Response.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), seqId)
+
+	// 2. 非幂等的方法: 已经发送的请求不重试
+	waitActiveConns(s, 1)
+	badConn2 := NewBackendConn(startRetryTestServer(t, true), DEFAULT_ENDPOINT_WEIGHT, s, "typo", nil, nil, false, false)
+	defer badConn2.MarkOffline()
+	waitActiveConns(s, 2)
+
+	r2 := newRetryTestRequest("typo:set_user", 2)
+	s.dispatch(r2, goodConn)
+	r2.Wait.Wait()
+	assert.True(t, r2.Response.Err != nil)
+	assert.Equal(t, 1, r2.Attempts)
+
+	// 3. 还没有发送的请求总是可以重试
+	waitActiveConns(s, 1)
+	r3 := newRetryTestRequest("typo:set_user", 3)
+	r3.Attempts = 1
+	r3.Wait.Add(1)
+	assert.True(t, s.Retry(badConn, r3, errors.New("inactive"), false))
+	r3.Wait.Wait()
+	assert.NoError(t, r3.Response.Err)
+	assert.Equal(t, 2, r3.Attempts)
+
+	// 4. 超过最大的重试次数
+	r4 := newRetryTestRequest("typo:get_user", 4)
+	r4.Attempts = 2
+	assert.False(t, s.Retry(badConn, r4, errors.New("inactive"), false))
+
+	// 5. 后端的latency只统计最后一次尝试(不包括请求之前等待/重试的时间)
+	r5 := newRetryTestRequest("typo:get_user", 5)
+	r5.Start -= 10 * 1000000
+	s.dispatch(r5, goodConn)
+	r5.Wait.Wait()
+	assert.NoError(t, r5.Response.Err)
+	assert.True(t, goodConn.Latency().Get() < 1000000)
+}
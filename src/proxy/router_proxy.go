@@ -4,7 +4,9 @@
 package proxy
 
 import (
+	"encoding/json"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -16,15 +18,34 @@ type Router struct {
 	serviceLock sync.RWMutex
 	services    map[string]*BackService
 
-	topo    *Topology
-	verbose bool
+	topo      Registry
+	timeouts  *RequestTimeouts
+	balancers *BalancerPolicies
+	retry     *RetryPolicy
+	breaker   *CircuitBreakerConfig
+	outlier   *OutlierConfig
+	limiter   *RateLimiter
+	queue     *BackendQueueConfig
+	theader   THeaderBackends
+	verbose   bool
 }
 
-func NewRouter(productName string, topo *Topology, verbose bool) *Router {
+func NewRouter(productName string, topo Registry, timeouts *RequestTimeouts,
+	balancers *BalancerPolicies, retry *RetryPolicy, breaker *CircuitBreakerConfig,
+	outlier *OutlierConfig, limiter *RateLimiter, queue *BackendQueueConfig, theader THeaderBackends,
+	verbose bool) *Router {
 	r := &Router{
 		productName: productName,
 		services:    make(map[string]*BackService),
 		topo:        topo,
+		timeouts:    timeouts,
+		balancers:   balancers,
+		retry:       retry,
+		breaker:     breaker,
+		outlier:     outlier,
+		limiter:     limiter,
+		queue:       queue,
+		theader:     theader,
 		verbose:     verbose,
 	}
 
@@ -43,26 +64,27 @@ func (s *Router) Dispatch(r *Request) error {
 		log.Printf(Cyan("Service Not Found for: %s.%s\n"), r.Service, r.Request.Name)
 		r.Response.Data = GetServiceNotFoundData(r)
 		return nil
+	} else if err := s.limiter.Allow(r); err != nil {
+		// 超过限流: 不分配BackendConn, 直接返回RateLimited Exception
+		if s.verbose {
+			log.Printf(Magenta("%v"), err)
+		}
+		r.Response.Err = err
+		return nil
 	} else {
+		r.SetTimeout(s.timeouts.Get(r.Service, r.Request.Name))
 		return backService.HandleRequest(r)
 	}
 }
 
-// Router负责监听zk中服务列表的变化
+// Router负责监听Registry中服务列表的变化
 func (bk *Router) WatchServices() {
 	var evtbus chan interface{} = make(chan interface{}, 2)
 
-	// 1. 保证Service目录存在，否则会报错
-	servicesPath := bk.topo.ProductServicesPath()
-	_, e1 := bk.topo.CreateDir(servicesPath)
-	if e1 != nil {
-		log.PanicErrorf(e1, "Zk Path Create Failed: %s", servicesPath)
-	}
-
 	go func() {
 		for true {
 			// 无限监听
-			services, err := bk.topo.WatchChildren(servicesPath, evtbus)
+			services, err := bk.topo.WatchServices(evtbus)
 
 			if err == nil {
 				bk.serviceLock.Lock()
@@ -94,15 +116,14 @@ func (bk *Router) WatchServices() {
 				// 等待事件
 				<-evtbus
 			} else {
-				log.ErrorErrorf(err, "zk watch error: %s, error: %v\n",
-					servicesPath, err)
+				log.ErrorErrorf(err, "registry watch services error: %v\n", err)
 				time.Sleep(time.Duration(5) * time.Second)
 			}
 		}
 	}()
 
 	// 读取zk, 等待
-	log.Println("ProductName: ", Magenta(bk.topo.ProductName))
+	log.Println("ProductName: ", Magenta(bk.topo.GetProductName()))
 }
 
 // 添加一个后台服务(非线程安全)
@@ -110,7 +131,9 @@ func (bk *Router) addBackService(service string) {
 
 	backService, ok := bk.services[service]
 	if !ok {
-		backService = NewBackService(bk.productName, service, bk.topo, bk.verbose)
+		backService = NewBackService(bk.productName, service, bk.topo,
+			bk.balancers.NewBalancer(service), bk.retry, bk.breaker, bk.outlier, bk.queue,
+			bk.theader.Enabled(service), bk.verbose)
 		bk.services[service] = backService
 	}
 
@@ -126,3 +149,30 @@ func (bk *Router) GetBackService(service string) *BackService {
 		return nil
 	}
 }
+
+// 用于admin api
+func (bk *Router) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["product"] = bk.productName
+	m["services"] = bk.BackServices()
+	return json.Marshal(m)
+}
+
+//
+// Router当前知道的所有服务(按照服务名排序)
+//
+func (bk *Router) BackServices() []*BackService {
+	bk.serviceLock.RLock()
+	defer bk.serviceLock.RUnlock()
+
+	names := make([]string, 0, len(bk.services))
+	for name := range bk.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	services := make([]*BackService, 0, len(names))
+	for _, name := range names {
+		services = append(services, bk.services[name])
+	}
+	return services
+}
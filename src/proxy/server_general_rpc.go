@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
-	topozk "github.com/wfxiang08/go-zookeeper/zk"
 	"github.com/wfxiang08/go_thrift/thrift"
 	"github.com/wfxiang08/thrift_rpc_base/rpc_utils"
 	"os"
@@ -32,7 +31,7 @@ type ThriftRpcServer struct {
 	ProductName     string
 	ServiceName     string
 	FrontendAddr    string
-	Topo            *Topology
+	Topo            Registry
 	Processor       thrift.TProcessor
 	Verbose         bool
 	lastRequestTime atomic2.Int64
@@ -72,27 +71,30 @@ func GetServiceIdentity(frontendAddr string) string {
 }
 
 //
-// 去ZK注册当前的Service
+// 去Registry(zk, etcd等)注册当前的Service
 //
-func RegisterService(serviceName, frontendAddr, serviceId string, topo *Topology, evtExit chan interface{},
-workDir string, codeUrlVerion string, state *atomic2.Bool, stateChan chan bool) *ServiceEndpoint {
+func RegisterService(serviceName, frontendAddr, serviceId string, topo Registry, evtExit chan interface{},
+workDir string, codeUrlVerion string, weight int, state *atomic2.Bool, stateChan chan bool) *ServiceEndpoint {
 
-	// 1. 准备数据
-	// 记录Service Endpoint的信息
-	servicePath := topo.ProductServicePath(serviceName)
+	endpoint := NewServiceEndpoint(serviceName, serviceId, frontendAddr, workDir, codeUrlVerion)
+	endpoint.Weight = weight
 
-	// 确保东西存在
-	if ok, _ := topo.Exist(servicePath); !ok {
-		topo.CreateDir(servicePath)
-	}
+	RegisterServiceEndpoint(endpoint, topo, evtExit, state, stateChan)
+	return endpoint
+}
 
-	// 用来从zookeeper获取事件
-	evtbus := make(chan interface{})
+//
+// 将endpoint注册到Registry, 并且在session过期, state变化时重新注册
+//
+func RegisterServiceEndpoint(endpoint *ServiceEndpoint, topo Registry, evtExit chan interface{},
+state *atomic2.Bool, stateChan chan bool) {
 
-	// 2. 将信息添加到Zk中, 并且监控Zk的状态(如果添加失败会怎么样?)
-	endpoint := NewServiceEndpoint(serviceName, serviceId, frontendAddr, workDir, codeUrlVerion)
+	// 1. 准备数据
+	// 用来从Registry获取事件
+	evtbus := make(chan interface{})
+	serviceName := endpoint.Service
 
-	// deployPath
+	// 2. 将信息添加到Registry中, 并且监控Registry的状态(如果添加失败会怎么样?)
 
 	// 为了保证Add是干净的，需要先删除，保证自己才是Owner
 	endpoint.DeleteServiceEndpoint(topo)
@@ -105,11 +107,11 @@ workDir string, codeUrlVerion string, state *atomic2.Bool, stateChan chan bool)
 	go func() {
 
 		for true {
-			// Watch的目的是监控: 当前的zk session的状态, 如果session出现异常，则重新注册
-			_, err := topo.WatchNode(servicePath, evtbus)
+			// Watch的目的是监控: 当前的session的状态, 如果session出现异常，则重新注册
+			err := topo.WatchRegistration(serviceName, evtbus)
 
 			if err == nil {
-				// 如果成功添加Watch, 则等待退出，或者ZK Event
+				// 如果成功添加Watch, 则等待退出，或者Registry Event
 				select {
 				case <-evtExit:
 					return
@@ -120,9 +122,8 @@ workDir string, codeUrlVerion string, state *atomic2.Bool, stateChan chan bool)
 						endpoint.AddServiceEndpoint(topo)
 					}
 				case e := <-evtbus:
-					event := e.(topozk.Event)
-					if event.State == topozk.StateExpired ||
-							event.Type == topozk.EventNotWatching {
+					event, ok := e.(*RegistryEvent)
+					if ok && event.Type == REGISTRY_EVENT_SESSION_EXPIRED {
 						// Session过期了，则需要删除之前的数据，
 						// 因为当前的session不是之前的数据的Owner
 						endpoint.DeleteServiceEndpoint(topo)
@@ -148,7 +149,6 @@ workDir string, codeUrlVerion string, state *atomic2.Bool, stateChan chan bool)
 
 		}
 	}()
-	return endpoint
 }
 
 //
@@ -182,7 +182,7 @@ func (p *ThriftRpcServer) Run() {
 	// 有条件地做服务注册
 	registerService := !p.config.StandAlone // 不独立运行则注册服务
 	if registerService {
-		p.Topo = NewTopology(p.ProductName, p.ZkAddr)
+		p.Topo = NewRegistry(&p.config.ProductConfig)
 	}
 
 	// 127.0.0.1:5555 --> 127_0_0_1:5555
@@ -195,9 +195,10 @@ func (p *ThriftRpcServer) Run() {
 	// kill -9 pid
 	// kill -s SIGKILL pid 还是留给运维吧
 
-	if len(p.config.FalconClient) > 0 {
-		StartTicker(p.config.FalconClient, p.ServiceName)
-	}
+	StartTicker(&p.config.Metrics, p.ServiceName)
+	StartTracer(&p.config.Trace, p.ServiceName)
+	StartAccessLog(&p.config.AccessLog)
+	SetMaxInflight(p.config.MaxInflight)
 
 	// 初始状态为不上线
 	var state atomic2.Bool
@@ -211,7 +212,7 @@ func (p *ThriftRpcServer) Run() {
 	if registerService {
 		endpoint = RegisterService(p.ServiceName, p.FrontendAddr, lbServiceName,
 			p.Topo, evtExit, p.config.WorkDir, p.config.CodeUrlVersion,
-			&state, stateChan)
+			p.config.Weight, &state, stateChan)
 	}
 
 	// 3. 读取"前端"的配置
@@ -299,7 +300,7 @@ func (p *ThriftRpcServer) Run() {
 			// Session独立处理自己的请求
 			if registerService {
 				x := NewNonBlockSession(c, address, p.Verbose, &p.lastRequestTime)
-				go x.Serve(p, 1000)
+				go x.Serve(p, p.config.MaxInflightPerSession)
 			} else {
 				go func(c thrift.TTransport) {
 					// 打印异常信息
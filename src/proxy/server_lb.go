@@ -24,13 +24,19 @@ type ThriftLoadBalanceServer struct {
 	frontendAddr    string // 绑定的端口
 	backendAddr     string
 	lbServiceName   string
-	topo            *Topology // ZK相关
+	topo            Registry // 服务注册(zk, etcd等)
 	zkAddr          string
 	verbose         bool
 	backendService  *BackServiceLB
 	exitEvt         chan bool
 	lastRequestTime atomic2.Int64
 	config          *ServiceConfig
+
+	// 服务多个service时(config.Services), 每个service一个BackServiceLB, 由BackServiceLBMux分发请求
+	serviceNames    []string
+	multiplexed     bool
+	backServices    map[string]*BackServiceLB
+	dispatcher      Dispatcher
 }
 
 func NewThriftLoadBalanceServer(config *ServiceConfig) *ThriftLoadBalanceServer {
@@ -48,12 +54,36 @@ func NewThriftLoadBalanceServer(config *ServiceConfig) *ThriftLoadBalanceServer
 		exitEvt:      make(chan bool),
 	}
 
-	p.topo = NewTopology(p.productName, p.zkAddr)
+	p.topo = NewRegistry(&config.ProductConfig)
 	p.lbServiceName = GetServiceIdentity(p.frontendAddr)
 
 	// 后端对接: 各种python的rpc server
-	p.backendService = NewBackServiceLB(p.serviceName, p.backendAddr, p.verbose,
-		p.config.FalconClient, p.exitEvt)
+	timeouts := NewRequestTimeoutsWithConf(&config.ProductConfig, p.topo)
+	if len(config.Services) > 0 {
+		p.serviceNames = config.Services
+		p.serviceName = strings.Join(config.Services, ",")
+		p.multiplexed = true
+
+		mux := NewBackServiceLBMux(config.Services, p.backendAddr, timeouts, &config.Balancers, &config.BackendQueue,
+			config.THeaderBackends, p.verbose, &p.config.Metrics, p.exitEvt)
+		p.backServices = mux.services
+		p.dispatcher = mux
+		StartTracer(&config.Trace, "rpc_lb")
+	} else {
+		balancer := config.Balancers.NewBalancer(p.serviceName)
+		p.backendService = NewBackServiceLB(p.serviceName, p.backendAddr, timeouts, balancer, &config.BackendQueue,
+			config.THeaderBackends.Enabled(p.serviceName), p.verbose, &p.config.Metrics, p.exitEvt)
+
+		p.serviceNames = []string{p.serviceName}
+		p.backServices = map[string]*BackServiceLB{p.serviceName: p.backendService}
+		p.dispatcher = p.backendService
+		StartTracer(&config.Trace, p.serviceName)
+	}
+	for _, service := range p.serviceNames {
+		registerAdminLB(p.backServices[service])
+	}
+	StartAccessLog(&config.AccessLog)
+	SetMaxInflight(config.MaxInflight)
 	return p
 
 }
@@ -71,16 +101,22 @@ func (p *ThriftLoadBalanceServer) Run() {
 	// kill -s SIGKILL pid 还是留给运维吧
 	//
 
-	// 注册服务
+	// 注册服务(每个service一个endpoint, 各自上线)
 	evtExit := make(chan interface{})
 
-	// 初始状态为不上线
-	var state atomic2.Bool
-	state.Set(false)
-	stateChan := make(chan bool)
-
-	serviceEndpoint := RegisterService(p.serviceName, p.frontendAddr, p.lbServiceName,
-		p.topo, evtExit, p.config.WorkDir, p.config.CodeUrlVersion, &state, stateChan)
+	endpoints := make([]*ServiceEndpoint, len(p.serviceNames))
+	states := make([]atomic2.Bool, len(p.serviceNames))
+	stateChans := make([]chan bool, len(p.serviceNames))
+	for i, service := range p.serviceNames {
+		// 初始状态为不上线
+		states[i].Set(false)
+		stateChans[i] = make(chan bool)
+
+		endpoints[i] = NewServiceEndpoint(service, p.lbServiceName, p.frontendAddr, p.config.WorkDir, p.config.CodeUrlVersion)
+		endpoints[i].Weight = p.config.Weight
+		endpoints[i].Multiplexed = p.multiplexed
+		RegisterServiceEndpoint(endpoints[i], p.topo, evtExit, &states[i], stateChans[i])
+	}
 
 	//	var suideTime time.Time
 
@@ -126,7 +162,7 @@ START_WAIT:
 	for true {
 		select {
 		case <-waitTicker.C:
-			if p.backendService.Active() <= 0 {
+			if p.activeWorkers() <= 0 {
 				log.Infof("Sleep Waiting for back Service to Start")
 				time.Sleep(time.Second)
 			} else {
@@ -146,17 +182,26 @@ START_WAIT:
 	time.Sleep(time.Second * 5)
 
 	log.Infof("Begin to Reg To Zk...")
-	state.Set(true)
-	stateChan <- true
+	for i, service := range p.serviceNames {
+		if p.backServices[service].Active() > 0 {
+			states[i].Set(true)
+			stateChans[i] <- true
+		} else {
+			// 还没有Worker的service, 等Worker连接上来之后再上线
+			go p.waitOnline(service, &states[i], stateChans[i], evtExit)
+		}
+	}
 
 	// 强制退出? TODO: Graceful退出
 	go func() {
 		<-exitSignal
 
 		// 通知RegisterService终止循环
-		evtExit <- true
+		close(evtExit)
 		log.Info(Green("Receive Exit Signals...."))
-		serviceEndpoint.DeleteServiceEndpoint(p.topo)
+		for _, endpoint := range endpoints {
+			endpoint.DeleteServiceEndpoint(p.topo)
+		}
 
 		start := time.Now().Unix()
 		for true {
@@ -193,7 +238,7 @@ START_WAIT:
 			}
 			x := NewNonBlockSession(c, address, p.verbose, &p.lastRequestTime)
 			// Session独立处理自己的请求
-			go x.Serve(p.backendService, 1000)
+			go x.Serve(p.dispatcher, p.config.MaxInflightPerSession)
 		}
 	}()
 
@@ -208,3 +253,41 @@ START_WAIT:
 		}
 	}
 }
+
+// 所有service的Worker数目
+func (p *ThriftLoadBalanceServer) activeWorkers() int {
+	active := 0
+	for _, s := range p.backServices {
+		active += s.Active()
+	}
+	return active
+}
+
+//
+// 等待service的Worker连接上来, 再等5s之后向Registry注册
+//
+func (p *ThriftLoadBalanceServer) waitOnline(service string, state *atomic2.Bool, stateChan chan bool,
+	evtExit chan interface{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-evtExit:
+			return
+		case <-ticker.C:
+			if p.backServices[service].Active() <= 0 {
+				continue
+			}
+			time.Sleep(time.Second * 5)
+
+			log.Infof("[%s]Begin to Reg To Zk...", service)
+			state.Set(true)
+			select {
+			case stateChan <- true:
+			case <-evtExit:
+			}
+			return
+		}
+	}
+}
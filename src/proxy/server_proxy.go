@@ -20,10 +20,13 @@ type ProxyServer struct {
 	productName string
 	proxyAddr   string
 	zkAdresses  string
-	topo        *Topology
+	topo        Registry
 	verbose     bool
 	profile     bool
 	router      *Router
+
+	gateway     *HttpGateway
+	gatewayAddr string
 }
 
 func NewProxyServer(config *ProxyConfig) *ProxyServer {
@@ -34,8 +37,25 @@ func NewProxyServer(config *ProxyConfig) *ProxyServer {
 		verbose:     config.Verbose,
 		profile:     config.Profile,
 	}
-	p.topo = NewTopology(p.productName, p.zkAdresses)
-	p.router = NewRouter(p.productName, p.topo, p.verbose)
+	p.topo = NewRegistry(&config.ProductConfig)
+	timeouts := NewRequestTimeoutsWithConf(&config.ProductConfig, p.topo)
+	limiter := NewRateLimiterWithConf(&config.RateLimit, p.topo)
+	p.router = NewRouter(p.productName, p.topo, timeouts, &config.Balancers, &config.Retry, &config.Breaker, &config.Outlier,
+		limiter, &config.BackendQueue, config.THeaderBackends, p.verbose)
+	registerAdminRouter(p.router)
+
+	if len(config.HttpGateway.Addr) > 0 {
+		var err error
+		if p.gateway, err = NewHttpGateway(&config.HttpGateway, p.router, p.verbose); err != nil {
+			log.PanicErrorf(err, "create http gateway failed")
+		}
+		p.gatewayAddr = config.HttpGateway.Addr
+	}
+
+	// 没有service的统计(例如: 心跳)以rpc_proxy为前缀
+	StartTicker(&config.Metrics, "rpc_proxy")
+	StartTracer(&config.Trace, "rpc_proxy")
+	StartAccessLog(&config.AccessLog)
 	return p
 }
 
@@ -48,6 +68,9 @@ func (p *ProxyServer) Run() {
 	var err error
 
 	log.Printf(Magenta("Start Proxy at Address: %s"), p.proxyAddr)
+	if p.gateway != nil {
+		go p.gateway.Run(p.gatewayAddr)
+	}
 	// 读取后端服务的配置
 	isUnixDomain := false
 	if !strings.Contains(p.proxyAddr, ":") {
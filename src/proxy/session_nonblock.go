@@ -3,6 +3,7 @@
 package proxy
 
 import (
+	"encoding/json"
 	"github.com/wfxiang08/cyutils/utils/atomic2"
 	"github.com/wfxiang08/cyutils/utils/errors"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
@@ -18,6 +19,9 @@ type NonBlockSession struct {
 	*TBufferedFramedTransport
 
 	RemoteAddress   string
+	Ops             atomic2.Int64 // 可能被admin api读取
+	LastOpUnix      atomic2.Int64
+	CreateUnix      int64
 
 	closed          atomic2.Bool
 	verbose         bool
@@ -26,6 +30,10 @@ type NonBlockSession struct {
 	lastRequestTime *atomic2.Int64
 
 	lastSeqId       int32
+
+	// 正在处理的请求数: 当前Session的上限, 以及所有Session共享的上限(在Serve中创建)
+	inflight        *InflightLimiter
+	globalInflight  *InflightLimiter
 }
 
 func NewNonBlockSession(c thrift.TTransport, address string, verbose bool,
@@ -36,6 +44,7 @@ lastRequestTime *atomic2.Int64) *NonBlockSession {
 func NewNonBlockSessionSize(c thrift.TTransport, address string, verbose bool,
 lastRequestTime *atomic2.Int64, bufsize int, timeout int) *NonBlockSession {
 	s := &NonBlockSession{
+		CreateUnix:               time.Now().Unix(),
 		RemoteAddress:            address,
 		lastRequestTime:          lastRequestTime,
 		verbose:                  verbose,
@@ -49,6 +58,21 @@ lastRequestTime *atomic2.Int64, bufsize int, timeout int) *NonBlockSession {
 	return s
 }
 
+func (s *NonBlockSession) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["type"] = "nonblock"
+	m["remote"] = s.RemoteAddress
+	m["ops"] = s.Ops.Get()
+	m["create_unix"] = s.CreateUnix
+	m["last_op_unix"] = s.LastOpUnix.Get()
+	m["closed"] = s.closed.Get()
+	if inflight := s.inflight; inflight != nil {
+		m["in_flight"] = inflight.Inflight()
+		m["max_in_flight"] = inflight.Limit()
+	}
+	return json.Marshal(m)
+}
+
 func (s *NonBlockSession) Close() error {
 	s.closed.Set(true)
 	return s.TBufferedFramedTransport.Close()
@@ -58,10 +82,22 @@ func (s *NonBlockSession) IsClosed() bool {
 	return s.closed.Get()
 }
 
+//
+// maxPipeline: 当前Session正在处理的请求数的上限, 到达上限之后暂停读取socket
+// 配置文件中的值在加载时检查; 其他调用方传入的值不大于0时使用默认值, 保证每个Session总是有上限
+//
 func (s *NonBlockSession) Serve(d Dispatcher, maxPipeline int) {
 	var errlist errors.ErrorList
 
+	if maxPipeline <= 0 {
+		maxPipeline = DEFAULT_MAX_INFLIGHT_PER_SESSION
+	}
+	s.inflight = newSessionInflightLimiter(maxPipeline)
+	s.globalInflight = getGlobalInflight()
+
+	registerSession(s)
 	defer func() {
+		unregisterSession(s)
 		// 只限制第一个Error
 		if err := errlist.First(); err != nil {
 			log.Infof("Session [%p] closed, Error = %v", s, err)
@@ -72,7 +108,9 @@ func (s *NonBlockSession) Serve(d Dispatcher, maxPipeline int) {
 
 	// 来自connection的各种请求
 	tasks := make(chan *Request, maxPipeline)
+	writerDone := make(chan bool)
 	go func() {
+		defer close(writerDone)
 		defer func() {
 			// 出现错误了，直接关闭Session
 			s.Close()
@@ -81,7 +119,7 @@ func (s *NonBlockSession) Serve(d Dispatcher, maxPipeline int) {
 
 			for _ = range tasks {
 				// close(tasks)关闭for loop
-
+				s.releaseInflight()
 			}
 		}()
 		if err := s.loopWriter(tasks); err != nil {
@@ -92,18 +130,30 @@ func (s *NonBlockSession) Serve(d Dispatcher, maxPipeline int) {
 	// 用于等待for中的go func执行完毕
 	var wait sync.WaitGroup
 	for true {
+		// 到达上限之后等待, 不再读取新的请求
+		s.inflight.Acquire()
+
 		// Reader不停地解码， 将Request
 		request, err := s.ReadFrame()
 
 		if err != nil {
+			s.inflight.Release()
 			errlist.PushBack(err)
 			break
 		}
+		// 读取到请求之后才占用全局的上限, 避免空闲的Session占用
+		s.globalInflight.Acquire()
+
 		// 来自proxy的请求, request中不带有service
 		r, err1 := NewRequest(request, false)
+		s.Ops.Incr()
+		s.LastOpUnix.Set(time.Now().Unix())
 		if err1 != nil {
-			errlist.PushBack(err1)
-			break
+			// 请求无法解析: 按照Client的协议返回Exception, 不影响同一个连接上的其他请求
+			log.ErrorErrorf(err1, Red("Decode Request Error: %v"), err1)
+			r.Response.Err = err1
+			tasks <- r
+			continue
 		}
 
 		wait.Add(1)
@@ -128,9 +178,17 @@ func (s *NonBlockSession) Serve(d Dispatcher, maxPipeline int) {
 	// 等待go func执行完毕
 	wait.Wait()
 	close(tasks)
+	// 等待所有的结果写回(或者丢弃), 释放占用的上限
+	<-writerDone
 	return
 }
 
+// 请求的结果写回Client(或者丢弃)之后才释放
+func (s *NonBlockSession) releaseInflight() {
+	s.globalInflight.Release()
+	s.inflight.Release()
+}
+
 //
 //
 // NonBlock和Block的区别:
@@ -146,6 +204,7 @@ func (s *NonBlockSession) loopWriter(tasks <-chan *Request) error {
 		// 2. 将结果写回给Client
 		_, err := s.TBufferedFramedTransport.Write(r.Response.Data)
 		r.Recycle()
+		s.releaseInflight()
 		if err != nil {
 			log.ErrorErrorf(err, "SeqId: %d, Write back Data Error: %v\n", r.Request.SeqId, err)
 			return err
@@ -184,8 +243,14 @@ func (s *NonBlockSession) handleResponse(r *Request) {
 		log.Println("#handleResponse, Error ----> Reponse Data")
 		r.Response.Data = GetThriftException(r, "nonblock_session")
 	}
-
-	incrOpStats(r.Request.Name, microseconds() - r.Start)
+	// 按照Client的协议返回
+	r.EncodeResponse("nonblock_session")
+
+	usecs := microseconds() - r.Start
+	incrOpStats(r, usecs)
+	observeRequestMetrics(r, usecs)
+	logAccess(r, s.RemoteAddress, usecs)
+	finishRequestTrace(r, TRACE_SPAN_WORKER)
 }
 
 // 处理来自Client的请求
@@ -200,6 +265,7 @@ func (s *NonBlockSession) handleRequest(r *Request, d Dispatcher) error {
 		HandlePingRequest(r)
 		return nil
 	}
+	startRequestTrace(r)
 
 	//	if r.Request.SeqId-s.lastSeqId != 1 {
 	//		log.Errorf(Red("Invalid SedId: %d vs. %d"), r.Request.SeqId,
@@ -4,8 +4,11 @@ package proxy
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
 
+	"net"
 	"testing"
+	"time"
 )
 
 //
@@ -22,6 +25,7 @@ func TestSessionNonBlock(t *testing.T) {
 
 	// 确保SessionNonBlock创建的Request满足要求
 	r, err1 := NewRequest(typoHello, false)
+	assert.NoError(t, err1)
 	s.handleRequest(r, d)
 	assert.False(t, d.Request.ProxyRequest)
 }
@@ -34,3 +38,218 @@ func (d *testDispatcher1) Dispatch(r *Request) error {
 	d.Request = r
 	return nil
 }
+
+//
+// go test proxy -v -run "TestInflightLimiter"
+//
+func TestInflightLimiter(t *testing.T) {
+	l := NewInflightLimiter(2)
+	l.Acquire()
+	l.Acquire()
+	assert.Equal(t, int64(2), l.Inflight())
+
+	acquired := make(chan bool)
+	go func() {
+		l.Acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.Release()
+	<-acquired
+	assert.Equal(t, int64(1), l.Blocked())
+	assert.Equal(t, int64(2), l.Inflight())
+
+	// 不限制时只计数
+	l = NewInflightLimiter(0)
+	for i := 0; i < 10; i++ {
+		l.Acquire()
+	}
+	assert.Equal(t, int64(10), l.Inflight())
+	assert.Equal(t, int64(0), l.Blocked())
+}
+
+//
+// 阻塞在Dispatch中, 直到release
+//
+type blockingDispatcher struct {
+	dispatched chan int32
+	release    chan bool
+}
+
+func (d *blockingDispatcher) Dispatch(r *Request) error {
+	d.dispatched <- r.Request.SeqId
+	<-d.release
+	r.Response.Data = fakeArgsData(PROTOCOL_BINARY, r.Request.Name, thrift.REPLY, r.Request.SeqId, protocolTestArgs...)
+	return nil
+}
+
+//
+// go test proxy -v -run "TestNonBlockSessionInflight"
+//
+func TestNonBlockSessionInflight(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	s := NewNonBlockSession(thrift.NewTSocketFromConnTimeout(serverConn, 0), "test", false, nil)
+	d := &blockingDispatcher{dispatched: make(chan int32, 10), release: make(chan bool)}
+	done := make(chan bool)
+	go func() {
+		s.Serve(d, 3)
+		done <- true
+	}()
+
+	// net.Pipe没有缓存: Session不读取时, Client的写操作阻塞
+	c := NewTBufferedFramedTransport(thrift.NewTSocketFromConnTimeout(clientConn, 0), 100*time.Microsecond, 20)
+	written := make(chan int32, 10)
+	go func() {
+		for i := int32(1); i <= 5; i++ {
+			c.Write(fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.CALL, i, protocolTestArgs...))
+			if err := c.FlushBuffer(true); err != nil {
+				return
+			}
+			written <- i
+		}
+	}()
+
+	// 1. 到达上限之后, 不再读取新的请求
+	for i := 0; i < 3; i++ {
+		<-d.dispatched
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, len(d.dispatched))
+	assert.Equal(t, int64(3), s.inflight.Inflight())
+	assert.True(t, s.inflight.Blocked() >= 1)
+	assert.True(t, len(written) <= 4)
+
+	// 2. 请求返回之后继续读取
+	responses := make(chan int32, 10)
+	go func() {
+		for {
+			frame, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			_, _, seqId, _ := DecodeThriftTypIdSeqId(frame)
+			responses <- seqId
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		d.release <- true
+	}
+	for i := 0; i < 5; i++ {
+		<-responses
+	}
+	// 后面的2个请求也被读取了
+	assert.Equal(t, 2, len(d.dispatched))
+
+	clientConn.Close()
+	<-done
+	assert.Equal(t, int64(0), s.inflight.Inflight())
+	assert.Equal(t, int64(0), s.globalInflight.Inflight())
+}
+
+//
+// go test proxy -v -run "TestNonBlockSessionGlobalInflight"
+//
+func TestNonBlockSessionGlobalInflight(t *testing.T) {
+	SetMaxInflight(1)
+	defer SetMaxInflight(0)
+
+	d := &blockingDispatcher{dispatched: make(chan int32, 10), release: make(chan bool)}
+	replied := make(chan bool, 2)
+	var clients []net.Conn
+	for i := int32(1); i <= 2; i++ {
+		serverConn, clientConn := net.Pipe()
+		clients = append(clients, clientConn)
+		s := NewNonBlockSession(thrift.NewTSocketFromConnTimeout(serverConn, 0), "test", false, nil)
+		go s.Serve(d, 10)
+
+		c := NewTBufferedFramedTransport(thrift.NewTSocketFromConnTimeout(clientConn, 0), 100*time.Microsecond, 20)
+		go func(seqId int32) {
+			c.Write(fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.CALL, seqId, protocolTestArgs...))
+			c.FlushBuffer(true)
+			c.ReadFrame()
+			replied <- true
+		}(i)
+	}
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
+	// 两个Session共享一个上限: 一个请求处理完毕之后才读取另一个
+	<-d.dispatched
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, len(d.dispatched))
+	assert.Equal(t, int64(1), getGlobalInflight().Inflight())
+
+	d.release <- true
+	<-d.dispatched
+	d.release <- true
+	<-replied
+	<-replied
+	assert.True(t, getGlobalInflight().Blocked() >= 1)
+}
+
+type echoDispatcher struct {
+}
+
+func (d *echoDispatcher) Dispatch(r *Request) error {
+	r.Response.Data = append([]byte(nil), r.Request.Data...)
+	return nil
+}
+
+//
+// go test proxy -v -run "TestNonBlockSessionInvalidRequest"
+//
+func TestNonBlockSessionInvalidRequest(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	s := NewNonBlockSession(thrift.NewTSocketFromConnTimeout(serverConn, 0), "test", false, nil)
+	go s.Serve(&echoDispatcher{}, 10)
+	c := NewTBufferedFramedTransport(thrift.NewTSocketFromConnTimeout(clientConn, 0), 100*time.Microsecond, 20)
+
+	// 1. 无法解析的compact请求: 按照compact返回Exception, Session不受影响
+	c.Write([]byte{COMPACT_PROTOCOL_ID, 0x21, 0xff})
+	assert.NoError(t, c.FlushBuffer(true))
+	frame, err := c.ReadFrame()
+	assert.NoError(t, err)
+	protocol := thrift.NewTCompactProtocol(NewTMemoryBufferWithBuf(frame))
+	_, typeId, _, err := protocol.ReadMessageBegin()
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+
+	// 2. 之后的请求正常处理
+	request := fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.CALL, 7, protocolTestArgs...)
+	c.Write(request)
+	assert.NoError(t, c.FlushBuffer(true))
+	frame, err = c.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, request, frame)
+	assert.False(t, s.IsClosed())
+}
+
+//
+// go test proxy -v -run "TestNonBlockSessionDefaultInflight"
+//
+func TestNonBlockSessionDefaultInflight(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	s := NewNonBlockSession(thrift.NewTSocketFromConnTimeout(serverConn, 0), "test", false, nil)
+	done := make(chan bool)
+	go func() {
+		s.Serve(&echoDispatcher{}, 0)
+		done <- true
+	}()
+
+	clientConn.Close()
+	<-done
+
+	// 没有指定上限时使用默认值, 而不是不限制
+	assert.Equal(t, DEFAULT_MAX_INFLIGHT_PER_SESSION, s.inflight.Limit())
+}
@@ -3,8 +3,10 @@
 package proxy
 
 import (
-	"github.com/wfxiang08/go_thrift/thrift"
+	"encoding/json"
+	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/go_thrift/thrift"
 	"time"
 )
 
@@ -12,10 +14,13 @@ type Session struct {
 	*TBufferedFramedTransport
 
 	RemoteAddress string
-	Ops           int64
-	LastOpUnix    int64
+	Ops           atomic2.Int64 // 可能被admin api读取
+	LastOpUnix    atomic2.Int64
 	CreateUnix    int64
 	verbose       bool
+
+	// 只属于当前Client的限流计数
+	rateLimits *SessionRateLimits
 }
 
 // c： client <---> proxy之间的连接
@@ -30,6 +35,7 @@ bufsize int, timeout int) *Session {
 		CreateUnix:               time.Now().Unix(),
 		RemoteAddress:            address,
 		verbose:                  verbose,
+		rateLimits:               NewSessionRateLimits(),
 		TBufferedFramedTransport: NewTBufferedFramedTransport(c, time.Microsecond * 100, 20),
 	}
 
@@ -39,16 +45,28 @@ bufsize int, timeout int) *Session {
 	return s
 }
 
+func (s *Session) MarshalJSON() ([]byte, error) {
+	var m = make(map[string]interface{})
+	m["type"] = "proxy"
+	m["remote"] = s.RemoteAddress
+	m["ops"] = s.Ops.Get()
+	m["create_unix"] = s.CreateUnix
+	m["last_op_unix"] = s.LastOpUnix.Get()
+	return json.Marshal(m)
+}
+
 func (s *Session) Close() error {
 	log.Printf(Red("Close Proxy Session"))
 	return s.TBufferedFramedTransport.Close()
 }
 
 // Session是同步处理请求，因此没有必要搞多个
-func (s *Session) Serve(d *Router, maxPipeline int) {
+func (s *Session) Serve(d Dispatcher, maxPipeline int) {
+	registerSession(s)
 	defer func() {
+		unregisterSession(s)
 		s.Close()
-		log.Infof(Red("==> Session Over: %s, Total %d Ops"), s.RemoteAddress, s.Ops)
+		log.Infof(Red("==> Session Over: %s, Total %d Ops"), s.RemoteAddress, s.Ops.Get())
 		if err := recover(); err != nil {
 			log.Infof(Red("Catch session error: %v"), err)
 		}
@@ -93,7 +111,6 @@ func (s *Session) Serve(d *Router, maxPipeline int) {
 	for true {
 		// 1. 读取请求
 		request, err := s.ReadFrame()
-		s.Ops += 1
 
 		// 读取出错，直接退出
 		if err != nil {
@@ -132,13 +149,19 @@ func (s *Session) handleResponse(r *Request) {
 		r.Response.Data = GetThriftException(r, "proxy_session")
 		log.Infof(Magenta("---->Convert Error Back to Exception, Err: %v"), r.Response.Err)
 	}
+	// 按照Client的协议返回
+	r.EncodeResponse("proxy_session")
 
 	// 如何处理Data和Err呢?
-	incrOpStats(r.Request.Name, microseconds() - r.Start)
+	usecs := microseconds() - r.Start
+	incrOpStats(r, usecs)
+	observeRequestMetrics(r, usecs)
+	logAccess(r, s.RemoteAddress, usecs)
+	finishRequestTrace(r, TRACE_SPAN_WIRE)
 }
 
 // 处理来自Client的请求
-func (s *Session) handleRequest(request []byte, d *Router) (*Request, error) {
+func (s *Session) handleRequest(request []byte, d Dispatcher) (*Request, error) {
 	// 构建Request
 	if s.verbose {
 		log.Printf("HandleRequest: %s", string(request))
@@ -149,12 +172,14 @@ func (s *Session) handleRequest(request []byte, d *Router) (*Request, error) {
 	}
 
 	// 增加统计
-	s.LastOpUnix = time.Now().Unix()
-	s.Ops++
+	s.LastOpUnix.Set(time.Now().Unix())
+	s.Ops.Incr()
 	if r.Request.TypeId == MESSAGE_TYPE_HEART_BEAT {
 		HandleProxyPingRequest(r) // 直接返回数据
 		return r, nil
 	}
+	startRequestTrace(r)
+	r.SessionLimits = s.rateLimits
 
 	// 交给Dispatch
 	// Router
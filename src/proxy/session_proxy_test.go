@@ -72,7 +72,7 @@ func TestSession(t *testing.T) {
 	go func() {
 		// 模拟请求:
 		// 客户端代码
-		bc := NewBackendConn(addr, nil, "test", true)
+		bc := NewBackendConn(addr, DEFAULT_ENDPOINT_WEIGHT, nil, "test", nil, nil, false, true)
 		bc.currentSeqId = 10
 
 		// 上线 BackendConn
@@ -117,3 +117,47 @@ func TestSession(t *testing.T) {
 		assert.Equal(t, len(requests[i].Request.Data), len(requests[i].Response.Data))
 	}
 }
+
+//
+// go test proxy -v -run "TestSessionInvalidRequest"
+//
+func TestSessionInvalidRequest(t *testing.T) {
+	transport, err := thrift.NewTServerSocket("127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.NoError(t, transport.Open())
+	defer transport.Close()
+	assert.NoError(t, transport.Listen())
+
+	go func() {
+		tran, err := transport.Accept()
+		if err != nil {
+			return
+		}
+		session := NewSession(tran, "", false)
+		session.Serve(&fakeServer{}, 6)
+	}()
+
+	socket, err := thrift.NewTSocketTimeout(transport.Addr().String(), time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, socket.Open())
+	c := NewTBufferedFramedTransport(socket, 100*time.Microsecond, 20)
+
+	// 1. 无法解析的compact请求: 按照compact返回Exception, Session不受影响
+	c.Write([]byte{COMPACT_PROTOCOL_ID, 0x21, 0xff})
+	assert.NoError(t, c.FlushBuffer(true))
+	frame, err := c.ReadFrame()
+	assert.NoError(t, err)
+	protocol := thrift.NewTCompactProtocol(NewTMemoryBufferWithBuf(frame))
+	_, typeId, _, err := protocol.ReadMessageBegin()
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+
+	// 2. 之后的请求正常处理
+	request := fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, protocolTestArgs...)
+	c.Write(request)
+	assert.NoError(t, c.FlushBuffer(true))
+	frame, err = c.ReadFrame()
+	assert.NoError(t, err)
+	assert.Equal(t, request, frame)
+	c.Close()
+}
@@ -6,27 +6,83 @@ package proxy
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/wfxiang08/cyutils/utils"
 	"github.com/wfxiang08/cyutils/utils/atomic2"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 )
 
 //
-// 单个的统计指标
+// 单个的统计指标: 按照(service, method)区分, 不同的服务可能有同名的方法(例如: ping)
 //
 type OpStats struct {
-	opstr string
-	calls atomic2.Int64 // 次数
-	usecs atomic2.Int64 // 总时间(us)
+	service  string
+	method   string
+	opstr    string        // service.method
+	calls    atomic2.Int64 // 次数
+	usecs    atomic2.Int64 // 总时间(us)
+	outcomes [OUTCOME_COUNT]atomic2.Int64
+	hist     LatencyHistogram
+}
+
+type opStatsKey struct {
+	service string
+	method  string
+}
+
+// 对外提供的分位数
+var opStatsPercentiles = []float64{0.5, 0.9, 0.99, 0.999}
+var opStatsPercentileNames = []string{"p50", "p90", "p99", "p999"}
+
+// 各种结果在JSON, falcon中的名字: service.method.errors等
+var opStatsOutcomeNames = [OUTCOME_COUNT]string{"success", "exceptions", "errors", "timeouts", "no_worker", "rate_limited", "overloaded"}
+
+func newOpStats(service string, method string) *OpStats {
+	opstr := method
+	if len(service) > 0 {
+		opstr = service + "." + method
+	}
+	return &OpStats{service: service, method: method, opstr: opstr}
 }
 
 func (s *OpStats) OpStr() string {
 	return s.opstr
 }
 
+func (s *OpStats) Service() string {
+	return s.service
+}
+
+func (s *OpStats) Method() string {
+	return s.method
+}
+
+func (s *OpStats) Outcome(outcome RequestOutcome) int64 {
+	return s.outcomes[outcome].Get()
+}
+
+// 除了正常返回之外的请求数
+func (s *OpStats) Failures() int64 {
+	var failures int64
+	for i := range s.outcomes {
+		if RequestOutcome(i) != OUTCOME_SUCCESS {
+			failures += s.outcomes[i].Get()
+		}
+	}
+	return failures
+}
+
+func (s *OpStats) merge(other *OpStats) {
+	s.calls.Add(other.calls.Get())
+	s.usecs.Add(other.usecs.Get())
+	for i := range other.outcomes {
+		s.outcomes[i].Add(other.outcomes[i].Get())
+	}
+	s.hist.Merge(&other.hist)
+}
+
 func (s *OpStats) Calls() int64 {
 	return s.calls.Get()
 }
@@ -43,6 +99,15 @@ func (s *OpStats) USecsPerCall() int64 {
 	return perusecs
 }
 
+// p50, p90, p99, p999(单位: us)
+func (s *OpStats) Percentiles() []int64 {
+	return s.hist.Percentiles(opStatsPercentiles...)
+}
+
+func (s *OpStats) Histogram() *LatencyHistogram {
+	return &s.hist
+}
+
 func (s *OpStats) MarshalJSON() ([]byte, error) {
 	var m = make(map[string]interface{})
 	var calls = s.calls.Get()
@@ -54,121 +119,133 @@ func (s *OpStats) MarshalJSON() ([]byte, error) {
 	}
 
 	m["cmd"] = s.opstr
+	m["service"] = s.service
+	m["method"] = s.method
 	m["calls"] = calls
+	for i, name := range opStatsOutcomeNames {
+		m[name] = s.outcomes[i].Get()
+	}
 	m["usecs"] = usecs
 	m["usecs_percall"] = perusecs
+	for i, value := range s.Percentiles() {
+		m["usecs_"+opStatsPercentileNames[i]] = value
+	}
 	return json.Marshal(m)
 }
 
+const (
+	OP_STATS_WINDOW_MINUTES = 15 // 内存中保留最近15分钟的统计数据(每分钟一份)
+)
+
 //
 // 所有的Commands的统计信息
+// opmap每分钟轮转一次(不依赖falcon的配置), 之前的数据保存在history中, 用于1m/5m/15m等滑动窗口
 //
 var cmdstats struct {
 	requests atomic2.Int64
 
-	opmap map[string]*OpStats
+	opmap   map[opStatsKey]*OpStats // 当前这一分钟
+	history []*OpStatsInfo          // 最近的OP_STATS_WINDOW_MINUTES分钟, history[0]为上一分钟
 
-	histMaps chan *OpStatsInfo
-	rwlck    sync.RWMutex
-	ticker   *time.Ticker
-	start    sync.Once
+	pusher *metricsPusher // 监控数据的输出(StartTicker)
+	rwlck  sync.RWMutex
+	ticker *time.Ticker
 }
 
 type OpStatsInfo struct {
-	opmap     map[string]*OpStats
+	opmap     map[opStatsKey]*OpStats
 	timestamp time.Time
 }
 
 func init() {
-	cmdstats.opmap = make(map[string]*OpStats)
+	cmdstats.opmap = make(map[opStatsKey]*OpStats)
+	cmdstats.ticker = time.NewTicker(time.Minute)
+
+	go func() {
+		// 死循环: 最终进程退出时自动被杀掉
+		for t := range cmdstats.ticker.C {
+			rotateOpStats(t)
+		}
+	}()
+}
+
+//
+// 到了指定的时间点之后将过去一分钟的统计数据转移到history中(并且交给MetricsSink)
+//
+func rotateOpStats(t time.Time) {
+	cmdstats.rwlck.Lock()
+	info := &OpStatsInfo{
+		opmap:     cmdstats.opmap,
+		timestamp: t,
+	}
+	cmdstats.opmap = make(map[opStatsKey]*OpStats)
+
+	history := make([]*OpStatsInfo, 0, OP_STATS_WINDOW_MINUTES)
+	history = append(history, info)
+	for i := 0; i < len(cmdstats.history) && len(history) < OP_STATS_WINDOW_MINUTES; i++ {
+		history = append(history, cmdstats.history[i])
+	}
+	cmdstats.history = history
+	pusher := cmdstats.pusher
+	cmdstats.rwlck.Unlock()
+
+	// 不阻塞: sink处理不过来时丢弃
+	if pusher != nil {
+		pusher.enqueue(info)
+	}
 }
 
 const (
 	EMPTY_STR = ""
 )
 
-// 主动调用
-func StartTicker(falconClient string, service string) {
+//
+// 主动调用(service: 没有service的统计, 例如: 心跳, 在监控中的前缀)
+// 每分钟的统计数据通过MetricsSink(falcon, statsd, file)输出; 一个进程只启动一次
+//
+func StartTicker(config *MetricsConfig, service string) {
+	sink, err := NewMetricsSink(config)
+	if err != nil {
+		log.ErrorErrorf(err, "Create metrics sink %s failed", config.Sink)
+		return
+	}
 	// 如果没有监控配置，则直接返回
-	if len(falconClient) == 0 {
+	if sink == nil {
 		return
 	}
 
-	log.Printf(Green("Log to falconClient: %s"), falconClient)
+	pusher := newMetricsPusher(sink, config, service)
 
-	cmdstats.histMaps = make(chan *OpStatsInfo, 5)
-	cmdstats.ticker = time.NewTicker(time.Minute)
-
-	var statsInfo *OpStatsInfo
-	hostname := utils.Hostname()
-	go func() {
-		for true {
-			statsInfo = <-cmdstats.histMaps
-
-			// 准备发送
-			// 需要处理timeout
-			metrics := make([]*utils.MetaData, 0, 3)
-			t := statsInfo.timestamp.Unix()
-
-			for method, stats := range statsInfo.opmap {
-
-				metricCount := &utils.MetaData{
-					Metric:      fmt.Sprintf("%s.%s.calls", service, method),
-					Endpoint:    hostname,
-					Value:       stats.Calls(),
-					CounterType: utils.DATA_TYPE_GAUGE,
-					Tags:        EMPTY_STR,
-					Timestamp:   t,
-					Step:        60, // 一分钟一次采样
-				}
-
-				metricAvg := &utils.MetaData{
-					Metric:      fmt.Sprintf("%s.%s.avgrt", service, method),
-					Endpoint:    hostname,
-					Value:       float64(stats.USecsPerCall()) * 0.001, // 单位: ms
-					CounterType: utils.DATA_TYPE_GAUGE,
-					Tags:        EMPTY_STR,
-					Timestamp:   t,
-					Step:        60, // 一分钟一次采样
-				}
-
-				metrics = append(metrics, metricCount, metricAvg)
-			}
-
-			// 准备发送数据到Local Agent
-			// 10s timeout
-			log.Printf("Send %d Metrics....", len(metrics))
-			if len(metrics) > 0 {
-				utils.SendData(metrics, falconClient, time.Second*10)
-			}
-
-		}
+	cmdstats.rwlck.Lock()
+	if cmdstats.pusher != nil {
+		cmdstats.rwlck.Unlock()
+		sink.Close()
+		log.Warnf("Metrics sink already started: %s", cmdstats.pusher.sink.Name())
+		return
+	}
+	cmdstats.pusher = pusher
+	cmdstats.rwlck.Unlock()
 
-	}()
+	log.Printf(Green("Log to metrics sink: %s"), sink.Name())
+	go pusher.run()
+}
 
-	go func() {
-		// 死循环: 最终进程退出时自动被杀掉
-		var t time.Time
-		for t = range cmdstats.ticker.C {
-			// 到了指定的时间点之后将过去一分钟的统计数据转移到:
-			cmdstats.rwlck.Lock()
-			cmdstats.histMaps <- &OpStatsInfo{
-				opmap:     cmdstats.opmap,
-				timestamp: t,
-			}
-			cmdstats.opmap = make(map[string]*OpStats)
-			cmdstats.rwlck.Unlock()
-		}
-	}()
+// 监控数据的输出状态
+func metricsSinkPusher() *metricsPusher {
+	cmdstats.rwlck.RLock()
+	defer cmdstats.rwlck.RUnlock()
+	return cmdstats.pusher
 }
 
 func OpCounts() int64 {
 	return cmdstats.requests.Get()
 }
 
-func GetOpStats(methodName string, create bool) *OpStats {
+func GetOpStats(service string, method string, create bool) *OpStats {
+	key := opStatsKey{service: service, method: method}
+
 	cmdstats.rwlck.RLock()
-	s := cmdstats.opmap[methodName]
+	s := cmdstats.opmap[key]
 	cmdstats.rwlck.RUnlock()
 
 	if s != nil || !create {
@@ -176,15 +253,16 @@ func GetOpStats(methodName string, create bool) *OpStats {
 	}
 
 	cmdstats.rwlck.Lock()
-	s = cmdstats.opmap[methodName]
+	s = cmdstats.opmap[key]
 	if s == nil {
-		s = &OpStats{opstr: methodName}
-		cmdstats.opmap[methodName] = s
+		s = newOpStats(service, method)
+		cmdstats.opmap[key] = s
 	}
 	cmdstats.rwlck.Unlock()
 	return s
 }
 
+// 当前这一分钟的统计数据
 func GetAllOpStats() []*OpStats {
 	var all = make([]*OpStats, 0, 128)
 	cmdstats.rwlck.RLock()
@@ -195,9 +273,98 @@ func GetAllOpStats() []*OpStats {
 	return all
 }
 
-func incrOpStats(methodName string, usecs int64) {
-	s := GetOpStats(methodName, true)
+func incrOpStats(r *Request, usecs int64) {
+	s := GetOpStats(r.Service, r.Request.Name, true)
 	s.calls.Incr()
 	s.usecs.Add(usecs)
+	s.outcomes[r.Outcome()].Incr()
+	s.hist.Record(usecs)
 	cmdstats.requests.Incr()
 }
+
+//
+// 最近minutes个完整的分钟(不包括正在统计的当前这一分钟)的统计数据, 同一个(service, method)的数据合并在一起
+//
+func GetWindowOpStats(minutes int) []*OpStats {
+	if minutes < 1 {
+		minutes = 1
+	}
+	if minutes > OP_STATS_WINDOW_MINUTES {
+		minutes = OP_STATS_WINDOW_MINUTES
+	}
+
+	cmdstats.rwlck.RLock()
+	all := make([]*OpStats, 0, 128)
+	for i := 0; i < len(cmdstats.history) && i < minutes; i++ {
+		for _, s := range cmdstats.history[i].opmap {
+			all = append(all, s)
+		}
+	}
+	cmdstats.rwlck.RUnlock()
+
+	merged := make(map[opStatsKey]*OpStats)
+	for _, s := range all {
+		key := opStatsKey{service: s.service, method: s.method}
+		m := merged[key]
+		if m == nil {
+			m = newOpStats(s.service, s.method)
+			merged[key] = m
+		}
+		m.merge(s)
+	}
+
+	results := make([]*OpStats, 0, len(merged))
+	for _, s := range merged {
+		results = append(results, s)
+	}
+	return results
+}
+
+const (
+	OP_STATS_TOP_BY_CALLS   = "calls"
+	OP_STATS_TOP_BY_LATENCY = "latency" // p99
+	OP_STATS_TOP_BY_ERRORS  = "errors"  // 所有没有正常返回的请求
+)
+
+//
+// 最近minutes分钟内, 按照调用次数/latency/错误数排在前面的n个方法
+//
+func TopOpStats(minutes int, by string, n int) ([]*OpStats, error) {
+	all := GetWindowOpStats(minutes)
+
+	values := make(map[*OpStats]int64, len(all))
+	for _, s := range all {
+		switch by {
+		case OP_STATS_TOP_BY_CALLS:
+			values[s] = s.Calls()
+		case OP_STATS_TOP_BY_LATENCY:
+			values[s] = s.hist.Percentiles(0.99)[0]
+		case OP_STATS_TOP_BY_ERRORS:
+			values[s] = s.Failures()
+		default:
+			return nil, fmt.Errorf("Invalid top by: %s", by)
+		}
+	}
+
+	sort.Sort(&opStatsSorter{all, values})
+	if n > 0 && len(all) > n {
+		all = all[0:n]
+	}
+	return all, nil
+}
+
+// 按照values从大到小排列, 相同时按照名字排列
+type opStatsSorter struct {
+	all    []*OpStats
+	values map[*OpStats]int64
+}
+
+func (s *opStatsSorter) Len() int      { return len(s.all) }
+func (s *opStatsSorter) Swap(i, j int) { s.all[i], s.all[j] = s.all[j], s.all[i] }
+func (s *opStatsSorter) Less(i, j int) bool {
+	vi, vj := s.values[s.all[i]], s.values[s.all[j]]
+	if vi != vj {
+		return vi > vj
+	}
+	return s.all[i].opstr < s.all[j].opstr
+}
@@ -0,0 +1,109 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func findOpStats(all []*OpStats, service string, method string) *OpStats {
+	for _, s := range all {
+		if s.Service() == service && s.Method() == method {
+			return s
+		}
+	}
+	return nil
+}
+
+//
+// go test proxy -v -run "TestWindowOpStats"
+//
+func TestWindowOpStats(t *testing.T) {
+	record := func(name string, n int, usecs int64, err error) {
+		for i := 0; i < n; i++ {
+			r := newRetryTestRequest(name, int32(i))
+			r.Response.Err = err
+			incrOpStats(r, usecs)
+		}
+	}
+
+	// 第1分钟
+	record("window_typo:get_user", 10, 1000, nil)
+	record("window_typo:set_user", 5, 100000, nil)
+	rotateOpStats(time.Now())
+
+	// 第2分钟: 不同服务的同名方法分开统计
+	record("window_typo:get_user", 20, 1000, nil)
+	record("window_analytics:get_user", 2, 1000, nil)
+	rotateOpStats(time.Now())
+
+	// 第3分钟
+	record("window_typo:get_user", 1, 1000, nil)
+	record("window_analytics:get_user", 3, 1000, &TimeoutError{})
+	rotateOpStats(time.Now())
+
+	// 当前这一分钟: 还没有结束, 不计入窗口
+	record("window_typo:get_user", 100, 1000, nil)
+
+	// 1. 只有最近一个完整的分钟
+	all := GetWindowOpStats(1)
+	assert.Equal(t, int64(1), findOpStats(all, "window_typo", "get_user").Calls())
+	assert.Nil(t, findOpStats(all, "window_typo", "set_user"))
+
+	// 2. 合并最近的几分钟
+	all = GetWindowOpStats(3)
+	getUser := findOpStats(all, "window_typo", "get_user")
+	assert.Equal(t, int64(31), getUser.Calls())
+	assert.Equal(t, int64(31000), getUser.USecs())
+	assert.Equal(t, int64(31), getUser.Outcome(OUTCOME_SUCCESS))
+	assert.Equal(t, histogramUpperBound(histogramIndex(1000)), getUser.Percentiles()[2])
+
+	analytics := findOpStats(all, "window_analytics", "get_user")
+	assert.Equal(t, int64(5), analytics.Calls())
+	assert.Equal(t, int64(3), analytics.Failures())
+	assert.Equal(t, int64(3), analytics.Outcome(OUTCOME_TIMEOUT))
+
+	// 超过保留的时间之后, 数据被丢弃
+	assert.Equal(t, len(GetWindowOpStats(OP_STATS_WINDOW_MINUTES)), len(GetWindowOpStats(100)))
+	for i := 0; i < OP_STATS_WINDOW_MINUTES+1; i++ {
+		rotateOpStats(time.Now())
+	}
+	assert.Nil(t, findOpStats(GetWindowOpStats(OP_STATS_WINDOW_MINUTES), "window_typo", "get_user"))
+}
+
+//
+// go test proxy -v -run "TestTopOpStats"
+//
+func TestTopOpStats(t *testing.T) {
+	for i := 0; i < OP_STATS_WINDOW_MINUTES; i++ {
+		rotateOpStats(time.Now())
+	}
+	record := func(name string, n int, usecs int64, err error) {
+		for i := 0; i < n; i++ {
+			r := newRetryTestRequest(name, int32(i))
+			r.Response.Err = err
+			incrOpStats(r, usecs)
+		}
+	}
+	record("top_typo:a", 30, 1000, nil)
+	record("top_typo:b", 10, 500000, nil)
+	record("top_typo:c", 20, 2000, &TimeoutError{})
+	rotateOpStats(time.Now())
+
+	top, err := TopOpStats(5, OP_STATS_TOP_BY_CALLS, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(top))
+	assert.Equal(t, "top_typo.a", top[0].OpStr())
+	assert.Equal(t, "top_typo.c", top[1].OpStr())
+
+	top, _ = TopOpStats(5, OP_STATS_TOP_BY_LATENCY, 1)
+	assert.Equal(t, "top_typo.b", top[0].OpStr())
+
+	top, _ = TopOpStats(5, OP_STATS_TOP_BY_ERRORS, 1)
+	assert.Equal(t, "top_typo.c", top[0].OpStr())
+
+	_, err = TopOpStats(5, "unknown", 1)
+	assert.True(t, err != nil)
+}
@@ -0,0 +1,216 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+//
+// THeader transport(参考: thrift/doc/specs/HeaderFormatSpec.md)
+//
+// 在framed transport的基础上, frame的内容为:
+//   magic(0x0FFF, 2 bytes), flags(2 bytes), seqId(4 bytes), header size(2 bytes, 以4 bytes为单位),
+//   header: varint(protocol id), varint(transform数目), transform ids, info headers, padding
+//   payload: 一个完整的thrift message
+//
+// 同一个端口上: THeader的frame以0x0FFF开始, 普通的framed transport的frame以thrift message开始(0x80或者0x82), 可以逐个frame区分
+//
+const (
+	THEADER_MAGIC           = 0x0FFF
+	THEADER_FIXED_SIZE      = 10         // magic + flags + seqId + header size
+	THEADER_MAX_HEADER_SIZE = 0xFFFF * 4 // header size只有2 bytes, 以4 bytes为单位
+
+	THEADER_PROTOCOL_ID_BINARY  = 0
+	THEADER_PROTOCOL_ID_COMPACT = 2
+
+	THEADER_INFO_PADDING  = 0
+	THEADER_INFO_KEYVALUE = 1
+)
+
+//
+// 后端(rpc_lb, rpc server)是否支持THeader, 支持时转发请求中的headers
+// 配置: theader_backends=typo,user 或者 *
+//
+type THeaderBackends map[string]bool
+
+func ParseTHeaderBackends(value string) THeaderBackends {
+	backends := make(THeaderBackends)
+	for _, service := range strings.Split(value, ",") {
+		service = strings.TrimSpace(service)
+		if len(service) > 0 {
+			backends[service] = true
+		}
+	}
+	return backends
+}
+
+func (b THeaderBackends) Enabled(service string) bool {
+	return b[service] || b["*"]
+}
+
+func IsTHeaderFrame(frame []byte) bool {
+	return len(frame) >= THEADER_FIXED_SIZE && binary.BigEndian.Uint16(frame[0:2]) == THEADER_MAGIC
+}
+
+//
+// THeader frame中的seqId(和payload中thrift message的seqId一致), 在payload无法解析时用来找到对应的请求
+//
+func getTHeaderSeqId(frame []byte) int32 {
+	return int32(binary.BigEndian.Uint32(frame[4:8]))
+}
+
+//
+// 解析THeader frame, 返回其中的key/value headers和thrift message(payload和frame共享内存)
+//
+func decodeTHeaderFrame(frame []byte) (headers map[string]string, payload []byte, err error) {
+	if !IsTHeaderFrame(frame) {
+		return nil, nil, errors.New("Invalid THeader frame")
+	}
+
+	headerSize := int(binary.BigEndian.Uint16(frame[8:10])) * 4
+	if len(frame) < THEADER_FIXED_SIZE+headerSize {
+		return nil, nil, fmt.Errorf("THeader size %d exceeds frame size %d", headerSize, len(frame))
+	}
+	header := frame[THEADER_FIXED_SIZE : THEADER_FIXED_SIZE+headerSize]
+	payload = frame[THEADER_FIXED_SIZE+headerSize:]
+
+	var v uint64
+	idx := 0
+	if v, idx, err = readVarint(header, idx); err != nil {
+		return nil, nil, err
+	}
+	var protocol ThriftProtocol
+	switch v {
+	case THEADER_PROTOCOL_ID_BINARY:
+		protocol = PROTOCOL_BINARY
+	case THEADER_PROTOCOL_ID_COMPACT:
+		protocol = PROTOCOL_COMPACT
+	default:
+		return nil, nil, fmt.Errorf("THeader protocol %d not supported", v)
+	}
+	if DetectProtocol(payload) != protocol {
+		return nil, nil, fmt.Errorf("THeader protocol %s not match payload", protocol)
+	}
+
+	// zlib等transform暂不支持
+	if v, idx, err = readVarint(header, idx); err != nil {
+		return nil, nil, err
+	}
+	if v != 0 {
+		return nil, nil, fmt.Errorf("THeader transforms not supported")
+	}
+
+	for idx < len(header) {
+		var infoType, count uint64
+		if infoType, idx, err = readVarint(header, idx); err != nil {
+			return nil, nil, err
+		}
+		// 剩下的都是padding, 或者不认识的info
+		if infoType != THEADER_INFO_KEYVALUE {
+			break
+		}
+
+		if count, idx, err = readVarint(header, idx); err != nil {
+			return nil, nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			var key, value string
+			if key, idx, err = readVarintString(header, idx); err != nil {
+				return nil, nil, err
+			}
+			if value, idx, err = readVarintString(header, idx); err != nil {
+				return nil, nil, err
+			}
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[key] = value
+		}
+	}
+	return headers, payload, nil
+}
+
+//
+// 将THeader frame中的payload拷贝出来(通过getSlice分配), 归还frame
+//
+func unwrapTHeaderFrame(frame []byte) (map[string]string, []byte, error) {
+	headers, payload, err := decodeTHeaderFrame(frame)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := getSlice(len(payload), len(payload))
+	copy(data, payload)
+	returnSlice(frame)
+	return headers, data, nil
+}
+
+//
+// 生成THeader frame(不包含frame size), 返回的数据通过getSlice分配
+// headers超过THeader的上限时返回error
+//
+func encodeTHeaderFrame(protocol ThriftProtocol, seqId int32, headers map[string]string, payload []byte) ([]byte, error) {
+	header := make([]byte, 0, 64)
+	if protocol == PROTOCOL_COMPACT {
+		header = appendVarint(header, THEADER_PROTOCOL_ID_COMPACT)
+	} else {
+		header = appendVarint(header, THEADER_PROTOCOL_ID_BINARY)
+	}
+	header = appendVarint(header, 0) // transforms
+
+	if len(headers) > 0 {
+		keys := make([]string, 0, len(headers))
+		for key := range headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		header = appendVarint(header, THEADER_INFO_KEYVALUE)
+		header = appendVarint(header, uint64(len(keys)))
+		for _, key := range keys {
+			header = appendVarint(header, uint64(len(key)))
+			header = append(header, key...)
+			header = appendVarint(header, uint64(len(headers[key])))
+			header = append(header, headers[key]...)
+		}
+	}
+	for len(header)%4 != 0 {
+		header = append(header, THEADER_INFO_PADDING)
+	}
+	if len(header) > THEADER_MAX_HEADER_SIZE {
+		return nil, fmt.Errorf("THeader size %d exceeds %d", len(header), THEADER_MAX_HEADER_SIZE)
+	}
+
+	size := THEADER_FIXED_SIZE + len(header) + len(payload)
+	frame := getSlice(size, size)
+	binary.BigEndian.PutUint16(frame[0:2], THEADER_MAGIC)
+	binary.BigEndian.PutUint16(frame[2:4], 0)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(seqId))
+	binary.BigEndian.PutUint16(frame[8:10], uint16(len(header)/4))
+	copy(frame[THEADER_FIXED_SIZE:], header)
+	copy(frame[THEADER_FIXED_SIZE+len(header):], payload)
+	return frame, nil
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func readVarintString(data []byte, idx int) (string, int, error) {
+	size, idx, err := readVarint(data, idx)
+	if err != nil {
+		return "", idx, err
+	}
+	if uint64(len(data)-idx) < size {
+		return "", idx, errors.New("THeader string exceeds header size")
+	}
+	return string(data[idx : idx+int(size)]), idx + int(size), nil
+}
@@ -0,0 +1,205 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// go test proxy -v -run "TestTHeaderFrame"
+//
+func TestTHeaderFrame(t *testing.T) {
+	payload := fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, protocolTestArgs...)
+	assert.False(t, IsTHeaderFrame(payload))
+
+	headers := map[string]string{"caller": "web", "deadline": "1500", "trace_id": "4bf92f3577b34da6"}
+	frame, err := encodeTHeaderFrame(PROTOCOL_BINARY, 7, headers, payload)
+	assert.NoError(t, err)
+	assert.True(t, IsTHeaderFrame(frame))
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(frame[4:8]))
+
+	// header需要对齐到4 bytes
+	headerSize := int(binary.BigEndian.Uint16(frame[8:10])) * 4
+	assert.Equal(t, len(frame), THEADER_FIXED_SIZE+headerSize+len(payload))
+
+	decoded, data, err := decodeTHeaderFrame(frame)
+	assert.NoError(t, err)
+	assert.Equal(t, headers, decoded)
+	assert.Equal(t, int32(7), getTHeaderSeqId(frame))
+	assert.Equal(t, payload, data)
+
+	// 没有headers
+	decoded, data, err = decodeTHeaderFrame(newTHeaderTestFrame(PROTOCOL_BINARY, 7, nil, payload))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(decoded))
+	assert.Equal(t, payload, data)
+
+	// 不支持transform, 协议和数据不一致, header超过frame
+	invalid := append([]byte(nil), frame...)
+	invalid[THEADER_FIXED_SIZE+1] = 1
+	_, _, err = decodeTHeaderFrame(invalid)
+	assert.True(t, err != nil)
+
+	invalid = append([]byte(nil), frame...)
+	invalid[THEADER_FIXED_SIZE] = THEADER_PROTOCOL_ID_COMPACT
+	_, _, err = decodeTHeaderFrame(invalid)
+	assert.True(t, err != nil)
+
+	_, _, err = decodeTHeaderFrame(frame[:THEADER_FIXED_SIZE+2])
+	assert.True(t, err != nil)
+
+	// header超过上限(header size只有2 bytes)
+	_, err = encodeTHeaderFrame(PROTOCOL_BINARY, 7, map[string]string{"big": string(make([]byte, THEADER_MAX_HEADER_SIZE))}, payload)
+	assert.True(t, err != nil)
+}
+
+func newTHeaderTestFrame(protocol ThriftProtocol, seqId int32, headers map[string]string, payload []byte) []byte {
+	frame, err := encodeTHeaderFrame(protocol, seqId, headers, payload)
+	if err != nil {
+		panic(err)
+	}
+	return frame
+}
+
+//
+// go test proxy -v -run "TestTHeaderRequest"
+//
+func TestTHeaderRequest(t *testing.T) {
+	headers := map[string]string{"caller": "web"}
+
+	// 1. THeader + binary
+	payload := fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, protocolTestArgs...)
+	r, err := NewRequest(newTHeaderTestFrame(PROTOCOL_BINARY, 7, headers, payload), true)
+	assert.NoError(t, err)
+	assert.True(t, r.THeader)
+	assert.Equal(t, headers, r.Headers)
+	assert.Equal(t, PROTOCOL_BINARY, r.Protocol)
+	assert.Equal(t, "typo", r.Service)
+	assert.Equal(t, payload, r.Request.Data)
+
+	// 按照header选择后端
+	source, err := NewHashKeySource("header:caller")
+	assert.NoError(t, err)
+	key, err := source.ExtractRequest(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "web", string(key))
+	source, _ = NewHashKeySource("header:user_id")
+	_, err = source.ExtractRequest(r)
+	assert.True(t, err != nil)
+
+	// 返回给Client的数据也使用THeader
+	r.Response.Data = fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.REPLY, 7, protocolTestArgs...)
+	r.Response.Headers = map[string]string{"server": "w1"}
+	r.EncodeResponse("proxy_session")
+	respHeaders, data, err := decodeTHeaderFrame(r.Response.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, r.Response.Headers, respHeaders)
+	assert.Equal(t, fakeArgsData(PROTOCOL_BINARY, "get_user", thrift.REPLY, 7, protocolTestArgs...), data)
+
+	// 2. THeader + compact
+	payload = fakeArgsData(PROTOCOL_COMPACT, "typo:get_user", thrift.CALL, 8, protocolTestArgs...)
+	r, err = NewRequest(newTHeaderTestFrame(PROTOCOL_COMPACT, 8, headers, payload), true)
+	assert.NoError(t, err)
+	assert.True(t, r.THeader)
+	assert.Equal(t, PROTOCOL_COMPACT, r.Protocol)
+	assert.Equal(t, fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 8, protocolTestArgs...), r.Request.Data)
+
+	r.Response.Err = r.NewTimeoutError()
+	r.Response.Data = GetThriftException(r, "proxy_session")
+	r.EncodeResponse("proxy_session")
+	frame := r.Response.Data
+	assert.Equal(t, byte(THEADER_PROTOCOL_ID_COMPACT), frame[THEADER_FIXED_SIZE])
+	_, data, err = decodeTHeaderFrame(frame)
+	assert.NoError(t, err)
+	typeId, method, seqId, err := DecodeThriftTypIdSeqId(data)
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.EXCEPTION, typeId)
+	assert.Equal(t, "get_user", method)
+	assert.Equal(t, int32(8), seqId)
+
+	// 3. 同一个端口上的普通Client不受影响
+	r, _ = NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 9, protocolTestArgs...), true)
+	assert.False(t, r.THeader)
+	assert.Nil(t, r.Headers)
+}
+
+//
+// go test proxy -v -run "TestTHeaderBackend"
+//
+func TestTHeaderBackend(t *testing.T) {
+	transport, _ := thrift.NewTServerSocket("127.0.0.1:0")
+	assert.NoError(t, transport.Open())
+	defer transport.Close()
+	assert.NoError(t, transport.Listen())
+
+	// 支持THeader的后端: 检查headers, 原样返回请求的数据, 并带上自己的header
+	received := make(chan map[string]string, 1)
+	go func() {
+		trans, err := transport.Accept()
+		if err != nil {
+			return
+		}
+		defer trans.Close()
+		c := NewTBufferedFramedTransport(trans, 100*time.Microsecond, 20)
+		for {
+			frame, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			headers, payload, err := decodeTHeaderFrame(frame)
+			if err != nil {
+				return
+			}
+			typeId, _, seqId, _ := DecodeThriftTypIdSeqId(payload)
+			if typeId != MESSAGE_TYPE_HEART_BEAT {
+				received <- headers
+			}
+			resp := newTHeaderTestFrame(PROTOCOL_BINARY, seqId, map[string]string{"server": "w1"}, payload)
+			if headers["caller"] == "corrupt" {
+				resp[THEADER_FIXED_SIZE+1] = 1 // 不支持的transform
+			}
+			c.Write(resp)
+			c.FlushBuffer(true)
+		}
+	}()
+
+	bc := NewBackendConn(transport.Addr().String(), DEFAULT_ENDPOINT_WEIGHT, nil, "typo", nil, nil, true, false)
+	defer bc.MarkOffline()
+	for i := 0; i < 100 && !bc.IsConnActive.Get(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, bc.IsConnActive.Get())
+
+	payload := fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, protocolTestArgs...)
+	r, _ := NewRequest(newTHeaderTestFrame(PROTOCOL_BINARY, 7, map[string]string{"caller": "web"}, payload), true)
+	assert.NoError(t, bc.PushBack(r))
+	r.Wait.Wait()
+
+	assert.Equal(t, map[string]string{"caller": "web"}, <-received)
+	assert.NoError(t, r.Response.Err)
+	assert.Equal(t, map[string]string{"server": "w1"}, r.Response.Headers)
+
+	// 后端的SeqId被还原, 数据为普通的thrift message
+	typeId, method, seqId, err := DecodeThriftTypIdSeqId(r.Response.Data)
+	assert.NoError(t, err)
+	assert.Equal(t, thrift.CALL, typeId)
+	assert.Equal(t, "get_user", method)
+	assert.Equal(t, int32(7), seqId)
+
+	// 后端返回的THeader无法解析: 请求直接出错, 不用等到超时
+	r, _ = NewRequest(newTHeaderTestFrame(PROTOCOL_BINARY, 8, map[string]string{"caller": "corrupt"}, payload), true)
+	r.SetTimeout(10 * time.Second)
+	start := time.Now()
+	assert.NoError(t, bc.PushBack(r))
+	r.Wait.Wait()
+	<-received
+	assert.True(t, r.Response.Err != nil)
+	assert.Equal(t, OUTCOME_TRANSPORT_ERROR, r.Outcome())
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -7,11 +7,22 @@ import (
 	thrift "github.com/wfxiang08/go_thrift/thrift"
 )
 
+const (
+	// thrift的TApplicationException中没有超时的类型, 扩展一个(避开thrift已经使用的0~10)
+	// Client可以据此区分: 请求超时 vs. 其他的内部错误
+	TIMEOUT_APPLICATION_EXCEPTION = 100
+	// 请求被限流(没有转发给后端), Client可以稍后重试
+	RATE_LIMITED_APPLICATION_EXCEPTION = 101
+	// 后端的请求队列满了(没有转发给后端), Client可以稍后重试或者降级
+	OVERLOADED_APPLICATION_EXCEPTION = 102
+)
+
 //
 // 生成Thrift格式的Exception Message
 //
 func GetServiceNotFoundData(req *Request) []byte {
 	req.Response.TypeId = thrift.EXCEPTION
+	req.Response.NotFound = true
 
 	// 构建thrift的Transport
 	transport := thrift.NewTMemoryBufferLen(100)
@@ -32,6 +43,7 @@ func GetServiceNotFoundData(req *Request) []byte {
 
 func GetWorkerNotFoundData(req *Request, module string) []byte {
 	req.Response.TypeId = thrift.EXCEPTION
+	req.Response.NotFound = true
 
 	// 构建thrift的Transport
 	transport := thrift.NewTMemoryBufferLen(100)
@@ -50,16 +62,33 @@ func GetWorkerNotFoundData(req *Request, module string) []byte {
 }
 
 func GetThriftException(req *Request, module string) []byte {
+	return getThriftException(req, module, PROTOCOL_BINARY)
+}
+
+//
+// 按照指定的协议生成Exception(例如: 直接按照Client的协议返回)
+//
+func getThriftException(req *Request, module string, p ThriftProtocol) []byte {
 	req.Response.TypeId = thrift.EXCEPTION
 
 	// 构建thrift的Transport
 	transport := thrift.NewTMemoryBufferLen(256)
-	protocol := thrift.NewTBinaryProtocolTransport(transport)
+	protocol := newThriftProtocol(p, transport)
 
 	msg := fmt.Sprintf("Module: %s, Service: %s, Method: %s, Error: %v", module, req.Service, req.Request.Name, req.Response.Err)
 
+	// 超时, 限流, 过载单独返回对应的Exception
+	var excType int32 = thrift.INTERNAL_ERROR
+	if IsTimeoutError(req.Response.Err) {
+		excType = TIMEOUT_APPLICATION_EXCEPTION
+	} else if IsRateLimitedError(req.Response.Err) {
+		excType = RATE_LIMITED_APPLICATION_EXCEPTION
+	} else if IsOverloadedError(req.Response.Err) {
+		excType = OVERLOADED_APPLICATION_EXCEPTION
+	}
+
 	// 构建一个Message, 写入Exception
-	exc := thrift.NewTApplicationException(thrift.INTERNAL_ERROR, msg)
+	exc := thrift.NewTApplicationException(excType, msg)
 
 	// 注意消息的格式
 	protocol.WriteMessageBegin(req.Request.Name, thrift.EXCEPTION, req.Request.SeqId)
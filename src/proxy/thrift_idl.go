@@ -0,0 +1,582 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// Thrift IDL的解析(用于HTTP/JSON gateway), 只关心数据的结构:
+//   include, typedef, enum, struct, union, exception, service
+// namespace, const, annotation等直接跳过
+//
+type IdlType struct {
+	TType  thrift.TType
+	Name   string // 类型在IDL中的名字, 例如: i32, list<string>, shared.User
+	Binary bool   // binary和string在协议中相同, JSON中binary使用base64
+
+	Key  *IdlType // map的key
+	Elem *IdlType // list, set的元素; map的value
+
+	Struct *IdlStruct
+	Enum   *IdlEnum
+
+	// 解析时引用的名字(typedef, struct, enum), 在所有的文件读取完毕之后再确定
+	ref   string
+	scope string
+}
+
+type IdlField struct {
+	Id       int16
+	Name     string
+	Type     *IdlType
+	Required bool
+}
+
+type IdlStruct struct {
+	Name        string
+	IsException bool
+	Fields      []*IdlField
+}
+
+type IdlEnum struct {
+	Name   string
+	Values map[string]int32
+	Names  map[int32]string
+}
+
+type IdlFunction struct {
+	Name    string
+	Oneway  bool
+	Returns *IdlType // void时为nil
+	Args    *IdlStruct
+	Throws  []*IdlField
+}
+
+type IdlService struct {
+	Name      string
+	Extends   string
+	Functions map[string]*IdlFunction
+}
+
+//
+// 一组IDL文件(以及它们include的文件)
+// 名字都以文件名作为前缀, 例如: typo.thrift中的User为typo.User
+//
+type ThriftIdl struct {
+	structs  map[string]*IdlStruct
+	enums    map[string]*IdlEnum
+	typedefs map[string]*IdlType
+	services map[string]*IdlService
+	files    map[string]bool
+	types    []*IdlType // 需要确定引用的类型
+}
+
+func NewThriftIdl() *ThriftIdl {
+	return &ThriftIdl{
+		structs:  make(map[string]*IdlStruct),
+		enums:    make(map[string]*IdlEnum),
+		typedefs: make(map[string]*IdlType),
+		services: make(map[string]*IdlService),
+		files:    make(map[string]bool),
+	}
+}
+
+//
+// 读取IDL文件, 以及它include的文件
+//
+func LoadThriftIdl(filename string) (*ThriftIdl, error) {
+	idl := NewThriftIdl()
+	if err := idl.parseFile(filename); err != nil {
+		return nil, err
+	}
+	if err := idl.resolve(); err != nil {
+		return nil, err
+	}
+	return idl, nil
+}
+
+//
+// 直接从内容中解析IDL, scope为文件名(不带.thrift), 不支持include
+//
+func ParseThriftIdl(scope string, content string) (*ThriftIdl, error) {
+	idl := NewThriftIdl()
+	if err := idl.parse(scope, "", content); err != nil {
+		return nil, err
+	}
+	if err := idl.resolve(); err != nil {
+		return nil, err
+	}
+	return idl, nil
+}
+
+//
+// 查找service(包括extends的service)中名字为method的函数
+//
+func (idl *ThriftIdl) Function(service string, method string) *IdlFunction {
+	for s := idl.Service(service); s != nil; s = idl.services[s.Extends] {
+		if f, ok := s.Functions[method]; ok {
+			return f
+		}
+	}
+	return nil
+}
+
+//
+// 查找service: name为IDL中service的名字(不区分大小写, 可以省略文件名前缀);
+// 没有找到时(例如: name为rpc服务的名字), 如果IDL中只有一个service没有被其他的service extends, 则使用它
+// 有多个符合条件的service时返回nil
+//
+func (idl *ThriftIdl) Service(name string) *IdlService {
+	if s, ok := idl.services[name]; ok {
+		return s
+	}
+
+	var found *IdlService
+	for key, s := range idl.services {
+		if strings.EqualFold(s.Name, name) || strings.EqualFold(key, name) {
+			if found != nil {
+				return nil
+			}
+			found = s
+		}
+	}
+	if found != nil {
+		return found
+	}
+
+	extended := make(map[string]bool, len(idl.services))
+	for _, s := range idl.services {
+		extended[s.Extends] = true
+	}
+	for key, s := range idl.services {
+		if !extended[key] {
+			if found != nil {
+				return nil
+			}
+			found = s
+		}
+	}
+	return found
+}
+
+func (idl *ThriftIdl) parseFile(filename string) error {
+	filename = path.Clean(filename)
+	if idl.files[filename] {
+		return nil
+	}
+	idl.files[filename] = true
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	scope := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+	return idl.parse(scope, path.Dir(filename), string(content))
+}
+
+func (idl *ThriftIdl) parse(scope string, dir string, content string) error {
+	p := &idlParser{idl: idl, scope: scope, tokens: tokenizeThriftIdl(content)}
+	for !p.eof() {
+		token := p.next()
+		var err error
+		switch token {
+		case "include":
+			file := p.next()
+			if len(dir) == 0 {
+				return fmt.Errorf("%s: include %s not supported", scope, file)
+			}
+			err = idl.parseFile(path.Join(dir, strings.Trim(file, "\"'")))
+		case "cpp_include":
+			p.next()
+		case "namespace":
+			p.next()
+			p.next()
+		case "typedef":
+			t := p.parseType()
+			name := p.next()
+			idl.typedefs[p.qualify(name)] = t
+			p.skipAnnotations()
+		case "const":
+			p.parseType()
+			p.next()
+			p.expect("=")
+			p.skipValue()
+		case "enum":
+			err = p.parseEnum()
+		case "struct", "union", "exception":
+			var s *IdlStruct
+			if s, err = p.parseStruct(token == "exception"); err == nil {
+				idl.structs[p.qualify(s.Name)] = s
+			}
+		case "service":
+			err = p.parseService()
+		case ";", ",":
+		default:
+			err = fmt.Errorf("unexpected token: %s", token)
+		}
+		if err == nil {
+			err = p.err
+		}
+		if err != nil {
+			return fmt.Errorf("%s.thrift: %v", scope, err)
+		}
+	}
+	return nil
+}
+
+//
+// 确定typedef, struct, enum的引用
+//
+func (idl *ThriftIdl) resolve() error {
+	for _, t := range idl.types {
+		if err := idl.resolveType(t, 0); err != nil {
+			return err
+		}
+	}
+	for name, service := range idl.services {
+		visited := map[string]bool{name: true}
+		for s := service; len(s.Extends) > 0; s = idl.services[s.Extends] {
+			if idl.services[s.Extends] == nil {
+				return fmt.Errorf("unknown service: %s", s.Extends)
+			}
+			if visited[s.Extends] {
+				return fmt.Errorf("service extends loop: %s", name)
+			}
+			visited[s.Extends] = true
+		}
+	}
+	return nil
+}
+
+func (idl *ThriftIdl) resolveType(t *IdlType, depth int) error {
+	if len(t.ref) == 0 {
+		return nil
+	}
+	if depth > 32 {
+		return fmt.Errorf("typedef loop: %s", t.Name)
+	}
+
+	name := t.ref
+	if !strings.Contains(name, ".") {
+		name = t.scope + "." + name
+	}
+	if s, ok := idl.structs[name]; ok {
+		t.TType, t.Struct = thrift.STRUCT, s
+	} else if e, ok := idl.enums[name]; ok {
+		t.TType, t.Enum = thrift.I32, e
+	} else if def, ok := idl.typedefs[name]; ok {
+		if err := idl.resolveType(def, depth+1); err != nil {
+			return err
+		}
+		*t = IdlType{TType: def.TType, Name: t.Name, Binary: def.Binary, Key: def.Key, Elem: def.Elem,
+			Struct: def.Struct, Enum: def.Enum}
+	} else {
+		return fmt.Errorf("unknown type: %s", t.ref)
+	}
+	t.ref = ""
+	return nil
+}
+
+type idlParser struct {
+	idl    *ThriftIdl
+	scope  string
+	tokens []string
+	pos    int
+	err    error
+}
+
+func (p *idlParser) eof() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *idlParser) peek() string {
+	if p.eof() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *idlParser) next() string {
+	if p.eof() {
+		if p.err == nil {
+			p.err = fmt.Errorf("unexpected end of file")
+		}
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+func (p *idlParser) expect(token string) {
+	if t := p.next(); t != token && p.err == nil {
+		p.err = fmt.Errorf("expect %s, got %s", token, t)
+	}
+}
+
+func (p *idlParser) qualify(name string) string {
+	return p.scope + "." + name
+}
+
+// 跳过(key = "value", ...)形式的annotation
+func (p *idlParser) skipAnnotations() {
+	if p.peek() == "(" {
+		p.skipValue()
+	}
+}
+
+// 跳过const的值, 或者成对的括号
+func (p *idlParser) skipValue() {
+	depth := 0
+	for !p.eof() {
+		switch p.next() {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		if depth <= 0 {
+			return
+		}
+	}
+}
+
+func (p *idlParser) skipSeparator() {
+	if t := p.peek(); t == "," || t == ";" {
+		p.next()
+	}
+}
+
+func (p *idlParser) parseType() *IdlType {
+	name := p.next()
+	t := &IdlType{Name: name}
+	switch name {
+	case "bool":
+		t.TType = thrift.BOOL
+	case "byte", "i8":
+		t.TType = thrift.BYTE
+	case "i16":
+		t.TType = thrift.I16
+	case "i32":
+		t.TType = thrift.I32
+	case "i64":
+		t.TType = thrift.I64
+	case "double":
+		t.TType = thrift.DOUBLE
+	case "string", "slist":
+		t.TType = thrift.STRING
+	case "binary":
+		t.TType, t.Binary = thrift.STRING, true
+	case "list", "set":
+		t.TType = thrift.LIST
+		if name == "set" {
+			t.TType = thrift.SET
+		}
+		p.expect("<")
+		t.Elem = p.parseType()
+		p.expect(">")
+		t.Name = fmt.Sprintf("%s<%s>", name, t.Elem.Name)
+	case "map":
+		t.TType = thrift.MAP
+		p.expect("<")
+		t.Key = p.parseType()
+		p.expect(",")
+		t.Elem = p.parseType()
+		p.expect(">")
+		t.Name = fmt.Sprintf("map<%s,%s>", t.Key.Name, t.Elem.Name)
+	default:
+		t.ref, t.scope = name, p.scope
+		p.idl.types = append(p.idl.types, t)
+	}
+	if p.peek() == "cpp_type" {
+		p.next()
+		p.next()
+	}
+	p.skipAnnotations()
+	return t
+}
+
+func (p *idlParser) parseEnum() error {
+	e := &IdlEnum{Name: p.next(), Values: make(map[string]int32), Names: make(map[int32]string)}
+	p.expect("{")
+
+	var value int32 = 0
+	for p.err == nil && p.peek() != "}" {
+		name := p.next()
+		if p.peek() == "=" {
+			p.next()
+			v, err := strconv.ParseInt(p.next(), 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid enum value: %s.%s", e.Name, name)
+			}
+			value = int32(v)
+		}
+		e.Values[name], e.Names[value] = value, name
+		value++
+		p.skipAnnotations()
+		p.skipSeparator()
+	}
+	p.expect("}")
+	p.skipAnnotations()
+	p.idl.enums[p.qualify(e.Name)] = e
+	return nil
+}
+
+//
+// 解析"{ fields }"或者"( fields )"
+//
+func (p *idlParser) parseFields(end string) ([]*IdlField, error) {
+	var fields []*IdlField
+	var autoId int16 = 0
+	for p.err == nil && p.peek() != end {
+		field := &IdlField{}
+		if id, err := strconv.ParseInt(p.peek(), 0, 16); err == nil {
+			p.next()
+			p.expect(":")
+			field.Id = int16(id)
+		} else {
+			// 没有指定id时thrift自动分配负数的id
+			autoId--
+			field.Id = autoId
+		}
+
+		switch p.peek() {
+		case "required":
+			p.next()
+			field.Required = true
+		case "optional":
+			p.next()
+		}
+		field.Type = p.parseType()
+		field.Name = p.next()
+		if p.peek() == "=" {
+			p.next()
+			p.skipValue()
+		}
+		p.skipAnnotations()
+		p.skipSeparator()
+		fields = append(fields, field)
+	}
+	p.expect(end)
+	return fields, p.err
+}
+
+func (p *idlParser) parseStruct(isException bool) (*IdlStruct, error) {
+	s := &IdlStruct{Name: p.next(), IsException: isException}
+	p.expect("{")
+	fields, err := p.parseFields("}")
+	if err != nil {
+		return nil, err
+	}
+	s.Fields = fields
+	p.skipAnnotations()
+	return s, nil
+}
+
+func (p *idlParser) parseService() error {
+	service := &IdlService{Name: p.next(), Functions: make(map[string]*IdlFunction)}
+	if p.peek() == "extends" {
+		p.next()
+		service.Extends = p.next()
+		if !strings.Contains(service.Extends, ".") {
+			service.Extends = p.qualify(service.Extends)
+		}
+	}
+	p.expect("{")
+
+	for p.err == nil && p.peek() != "}" {
+		f := &IdlFunction{}
+		if p.peek() == "oneway" {
+			p.next()
+			f.Oneway = true
+		}
+		if p.peek() == "void" {
+			p.next()
+		} else {
+			f.Returns = p.parseType()
+		}
+		f.Name = p.next()
+
+		p.expect("(")
+		args, err := p.parseFields(")")
+		if err != nil {
+			return err
+		}
+		f.Args = &IdlStruct{Name: f.Name + "_args", Fields: args}
+
+		if p.peek() == "throws" {
+			p.next()
+			p.expect("(")
+			if f.Throws, err = p.parseFields(")"); err != nil {
+				return err
+			}
+		}
+		p.skipAnnotations()
+		p.skipSeparator()
+		service.Functions[f.Name] = f
+	}
+	p.expect("}")
+	p.skipAnnotations()
+	p.idl.services[p.qualify(service.Name)] = service
+	return nil
+}
+
+//
+// 将IDL拆分成为token: 名字(可以包含"."), 数字, 字符串, 符号; 注释被忽略
+//
+func tokenizeThriftIdl(content string) []string {
+	var tokens []string
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#' || strings.HasPrefix(content[i:], "//"):
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(content[i:], "/*"):
+			end := strings.Index(content[i+2:], "*/")
+			if end < 0 {
+				i = len(content)
+			} else {
+				i += end + 4
+			}
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(content) && content[j] != c {
+				if content[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(content) {
+				j++
+			}
+			tokens = append(tokens, content[i:j])
+			i = j
+		case isIdlNameChar(c) || c == '-' || c == '+':
+			j := i + 1
+			for j < len(content) && isIdlNameChar(content[j]) {
+				j++
+			}
+			tokens = append(tokens, content[i:j])
+			i = j
+		default:
+			tokens = append(tokens, content[i:i+1])
+			i++
+		}
+	}
+	return tokens
+}
+
+func isIdlNameChar(c byte) bool {
+	return c == '_' || c == '.' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
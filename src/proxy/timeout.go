@@ -0,0 +1,197 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+)
+
+const (
+	TIMEOUT_RULE_DEFAULT = "*" // 规则中用来覆盖全局默认超时的key
+)
+
+//
+// 请求的超时时间
+// 查找顺序: service.method --> service --> * --> rpc_timeout
+//
+// 规则有两个来源:
+// 1. 配置文件: rpc_timeouts=analytics:30s,typo.get_user_info:500ms
+// 2. zk(可选): /zk/product/ProductName/config/timeouts --> {"analytics": "30s", "typo.get_user_info": "500ms"}
+//    zk中的规则优先级更高, 修改之后实时生效
+//
+type RequestTimeouts struct {
+	defaultTimeout time.Duration
+	configRules    map[string]time.Duration
+
+	// 只用于保护: rules
+	lock  sync.RWMutex
+	rules map[string]time.Duration
+}
+
+func NewRequestTimeouts(defaultTimeout time.Duration, configRules map[string]time.Duration) *RequestTimeouts {
+	if defaultTimeout <= 0 {
+		defaultTimeout = time.Second * REQUEST_EXPIRED_TIME_SECONDS
+	}
+	t := &RequestTimeouts{
+		defaultTimeout: defaultTimeout,
+		configRules:    configRules,
+	}
+	t.Update(nil)
+	return t
+}
+
+//
+// 根据配置创建RequestTimeouts, 如果配置了rpc_timeouts_zk, 则同时监听zk中的超时配置
+//
+func NewRequestTimeoutsWithConf(conf *ProductConfig, topo Registry) *RequestTimeouts {
+	t := NewRequestTimeouts(conf.RpcTimeout, conf.RpcTimeouts)
+	if conf.RpcTimeoutsInZk {
+		if top, ok := topo.(*Topology); ok {
+			t.WatchZk(top)
+		} else {
+			log.Warnf("rpc_timeouts_zk ignored, registry: %s", conf.Registry)
+		}
+	}
+	return t
+}
+
+//
+// 获取service.method对应的超时时间
+//
+func (t *RequestTimeouts) Get(service string, method string) time.Duration {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if timeout, ok := t.rules[service+"."+method]; ok {
+		return timeout
+	}
+	if timeout, ok := t.rules[service]; ok {
+		return timeout
+	}
+	if timeout, ok := t.rules[TIMEOUT_RULE_DEFAULT]; ok {
+		return timeout
+	}
+	return t.defaultTimeout
+}
+
+//
+// 用新的动态规则(例如: 来自zk)覆盖配置文件中的规则
+//
+func (t *RequestTimeouts) Update(dynamicRules map[string]time.Duration) {
+	rules := make(map[string]time.Duration, len(t.configRules)+len(dynamicRules))
+	for key, timeout := range t.configRules {
+		rules[key] = timeout
+	}
+	for key, timeout := range dynamicRules {
+		rules[key] = timeout
+	}
+
+	t.lock.Lock()
+	t.rules = rules
+	t.lock.Unlock()
+}
+
+//
+// 监听zk中的超时配置, 节点不存在时只使用配置文件中的规则
+//
+func (t *RequestTimeouts) WatchZk(top *Topology) {
+	path := productTimeoutsPath(top.ProductName)
+	evtbus := make(chan interface{}, 2)
+
+	go func() {
+		for true {
+			data, err := top.WatchNodeIfExists(path, evtbus)
+			if err != nil {
+				log.WarnErrorf(err, "zk watch timeouts error: %s", path)
+				time.Sleep(time.Duration(5) * time.Second)
+				continue
+			}
+
+			rules, err := parseTimeoutRulesJson(data)
+			if err != nil {
+				// 格式错误时保留之前的规则
+				log.ErrorErrorf(err, "invalid timeouts in zk: %s", string(data))
+			} else {
+				log.Printf(Green("Load timeouts from zk: %s"), string(data))
+				t.Update(rules)
+			}
+
+			// 等待事件
+			<-evtbus
+		}
+	}()
+}
+
+func productTimeoutsPath(productName string) string {
+	return fmt.Sprintf("%s/config/timeouts", productBasePath(productName))
+}
+
+//
+// 解析超时时间: 不带单位时以秒为单位(和之前的rpc_timeout保持兼容)，也可以写作: 500ms, 1.5s等
+//
+func ParseTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	var timeout time.Duration
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		timeout = time.Duration(seconds * float64(time.Second))
+	} else if timeout, err = time.ParseDuration(value); err != nil {
+		return 0, err
+	}
+
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout: %s", value)
+	}
+	return timeout, nil
+}
+
+//
+// 解析配置文件中的规则: analytics:30s,typo.get_user_info:500ms
+//
+func ParseTimeoutRules(value string) (map[string]time.Duration, error) {
+	rules := make(map[string]time.Duration)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid timeout rule: %s", item)
+		}
+		timeout, err := ParseTimeout(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		rules[strings.TrimSpace(kv[0])] = timeout
+	}
+	return rules, nil
+}
+
+func parseTimeoutRulesJson(data []byte) (map[string]time.Duration, error) {
+	rules := make(map[string]time.Duration)
+	if len(data) == 0 {
+		return rules, nil
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	for key, value := range values {
+		timeout, err := ParseTimeout(value)
+		if err != nil {
+			return nil, err
+		}
+		rules[strings.TrimSpace(key)] = timeout
+	}
+	return rules, nil
+}
@@ -0,0 +1,55 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//
+// go test proxy -v -run "TestParseTimeout"
+//
+func TestParseTimeout(t *testing.T) {
+	timeout, err := ParseTimeout("15")
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Second, timeout)
+
+	timeout, _ = ParseTimeout(" 500ms")
+	assert.Equal(t, 500*time.Millisecond, timeout)
+
+	timeout, _ = ParseTimeout("0.5")
+	assert.Equal(t, 500*time.Millisecond, timeout)
+
+	_, err = ParseTimeout("0")
+	assert.True(t, err != nil)
+
+	rules, err := ParseTimeoutRules("analytics:30s, typo.get_user_info:500ms,")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(rules))
+	assert.Equal(t, 30*time.Second, rules["analytics"])
+
+	_, err = ParseTimeoutRules("analytics")
+	assert.True(t, err != nil)
+}
+
+//
+// go test proxy -v -run "TestRequestTimeouts"
+//
+func TestRequestTimeouts(t *testing.T) {
+	rules, _ := ParseTimeoutRules("analytics:30s,typo.get_user_info:500ms")
+	timeouts := NewRequestTimeouts(15*time.Second, rules)
+
+	assert.Equal(t, 30*time.Second, timeouts.Get("analytics", "report"))
+	assert.Equal(t, 500*time.Millisecond, timeouts.Get("typo", "get_user_info"))
+	assert.Equal(t, 15*time.Second, timeouts.Get("typo", "get_user_list"))
+
+	// zk中的规则优先
+	zkRules, err := parseTimeoutRulesJson([]byte(`{"*": "10s", "typo.get_user_info": "1s"}`))
+	assert.NoError(t, err)
+	timeouts.Update(zkRules)
+	assert.Equal(t, 30*time.Second, timeouts.Get("analytics", "report"))
+	assert.Equal(t, time.Second, timeouts.Get("typo", "get_user_info"))
+	assert.Equal(t, 10*time.Second, timeouts.Get("typo", "get_user_list"))
+}
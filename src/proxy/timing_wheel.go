@@ -0,0 +1,204 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	TIMING_WHEEL_TICK      = time.Millisecond
+	TIMING_WHEEL_SLOT_BITS = 6
+	TIMING_WHEEL_SLOTS     = 1 << TIMING_WHEEL_SLOT_BITS // 每一层64个slot
+	TIMING_WHEEL_SLOT_MASK = TIMING_WHEEL_SLOTS - 1
+	TIMING_WHEEL_LEVELS    = 4                                                   // 1ms精度时，最长可以覆盖: 64^4ms, 约4.6小时
+	TIMING_WHEEL_MAX_TICKS = 1<<(TIMING_WHEEL_SLOT_BITS*TIMING_WHEEL_LEVELS) - 1 // 超过范围的Timer放在最高层的最后
+)
+
+//
+// 分层的时间轮(参考: linux kernel的timer, 以及kafka的TimingWheel)
+//
+// 第0层每一个slot对应1个tick, 第1层每一个slot对应64个tick, 依次类推;
+// 当第0层转完一圈时，将上一层当前slot中的Timer重新分配到下面的各层中(cascade)
+//
+// 1. 添加Timer: O(1)
+// 2. 取消Timer: O(1)(直接从slot对应的双向链表中删除)
+// 3. 每个tick只处理到期的slot, 不需要扫描所有的Timer
+//
+type TimingWheel struct {
+	tick  time.Duration
+	start time.Time
+
+	// 保护: base, levels, 以及Timer的bucket/element
+	lock   sync.Mutex
+	base   int64 // 下一个需要处理的tick
+	levels [TIMING_WHEEL_LEVELS][TIMING_WHEEL_SLOTS]*list.List
+}
+
+type Timer struct {
+	wheel      *TimingWheel
+	expiration int64 // 到期的tick
+	f          func()
+
+	bucket  *list.List
+	element *list.Element
+}
+
+var (
+	requestTimingWheel     *TimingWheel
+	requestTimingWheelOnce sync.Once
+)
+
+//
+// 所有的BackendConn, BackendConnLB共用一个TimingWheel来处理请求的超时
+//
+func getRequestTimingWheel() *TimingWheel {
+	requestTimingWheelOnce.Do(func() {
+		requestTimingWheel = NewTimingWheel(TIMING_WHEEL_TICK)
+		go requestTimingWheel.Run()
+	})
+	return requestTimingWheel
+}
+
+func NewTimingWheel(tick time.Duration) *TimingWheel {
+	tw := &TimingWheel{
+		tick:  tick,
+		start: time.Now(),
+	}
+	for level := 0; level < TIMING_WHEEL_LEVELS; level++ {
+		for slot := 0; slot < TIMING_WHEEL_SLOTS; slot++ {
+			tw.levels[level][slot] = list.New()
+		}
+	}
+	return tw
+}
+
+//
+// d之后在TimingWheel的goroutine中执行f(f不能block太久，否则会影响其他的Timer)
+//
+func (tw *TimingWheel) AfterFunc(d time.Duration, f func()) *Timer {
+	// 向上取整，保证Timer不会提前触发
+	expiration := int64((time.Since(tw.start) + d + tw.tick - 1) / tw.tick)
+	timer := &Timer{
+		wheel:      tw,
+		expiration: expiration,
+		f:          f,
+	}
+
+	tw.lock.Lock()
+	tw.addTimer(timer)
+	tw.lock.Unlock()
+	return timer
+}
+
+//
+// 取消Timer, 如果Timer已经触发，或者已经取消则返回false
+//
+func (t *Timer) Stop() bool {
+	tw := t.wheel
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	if t.bucket == nil {
+		return false
+	}
+	t.bucket.Remove(t.element)
+	t.bucket, t.element = nil, nil
+	return true
+}
+
+//
+// 按照tick推进时间轮(阻塞)
+//
+func (tw *TimingWheel) Run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		tw.Advance(int64(time.Since(tw.start) / tw.tick))
+	}
+}
+
+//
+// 处理now(包括now)之前所有到期的Timer
+//
+func (tw *TimingWheel) Advance(now int64) {
+	var expired []*Timer
+
+	tw.lock.Lock()
+	for tw.base <= now {
+		index := int(tw.base & TIMING_WHEEL_SLOT_MASK)
+
+		// 第0层转完一圈，将上一层当前的slot拆分到下面的各层中
+		if index == 0 {
+			for level := 1; level < TIMING_WHEEL_LEVELS; level++ {
+				if tw.cascade(level, tw.levelIndex(level)) != 0 {
+					break
+				}
+			}
+		}
+		tw.base++
+
+		bucket := tw.levels[0][index]
+		for e := bucket.Front(); e != nil; e = e.Next() {
+			timer := e.Value.(*Timer)
+			timer.bucket, timer.element = nil, nil
+			expired = append(expired, timer)
+		}
+		bucket.Init()
+	}
+	tw.lock.Unlock()
+
+	// 在锁外执行回调, 回调中可以再添加或者取消Timer
+	for _, timer := range expired {
+		timer.f()
+	}
+}
+
+// 以下函数需要在 tw.lock 的保护下调用
+func (tw *TimingWheel) addTimer(timer *Timer) {
+	expiration := timer.expiration
+	ticks := expiration - tw.base
+
+	var bucket *list.List
+	if ticks < 0 {
+		// 已经过期, 下一个tick就触发
+		bucket = tw.levels[0][tw.base&TIMING_WHEEL_SLOT_MASK]
+	} else {
+		if ticks > TIMING_WHEEL_MAX_TICKS {
+			// 超出范围, 先放在最高层, cascade时重新计算
+			expiration = tw.base + TIMING_WHEEL_MAX_TICKS
+			ticks = TIMING_WHEEL_MAX_TICKS
+		}
+		level := 0
+		for ticks >= 1<<(uint(level+1)*TIMING_WHEEL_SLOT_BITS) {
+			level++
+		}
+		slot := (expiration >> (uint(level) * TIMING_WHEEL_SLOT_BITS)) & TIMING_WHEEL_SLOT_MASK
+		bucket = tw.levels[level][slot]
+	}
+
+	timer.bucket = bucket
+	timer.element = bucket.PushBack(timer)
+}
+
+func (tw *TimingWheel) levelIndex(level int) int {
+	return int((tw.base >> (uint(level) * TIMING_WHEEL_SLOT_BITS)) & TIMING_WHEEL_SLOT_MASK)
+}
+
+func (tw *TimingWheel) cascade(level int, index int) int {
+	// 先从slot中摘下来，再重新添加(超出范围的Timer可能会被重新放回当前的slot)
+	bucket := tw.levels[level][index]
+	timers := make([]*Timer, 0, bucket.Len())
+	for e := bucket.Front(); e != nil; e = e.Next() {
+		timers = append(timers, e.Value.(*Timer))
+	}
+	bucket.Init()
+
+	for _, timer := range timers {
+		tw.addTimer(timer)
+	}
+	return index
+}
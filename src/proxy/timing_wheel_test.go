@@ -0,0 +1,93 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+//
+// go test proxy -v -run "TestTimingWheel"
+//
+func TestTimingWheel(t *testing.T) {
+	// 通过Advance手动推进时间轮, tick足够大, 测试过程中时间轮的"当前时间"不会变化
+	tw := NewTimingWheel(time.Hour)
+
+	fired := make(map[int]int64)
+	var now int64
+	for _, ticks := range []int{0, 5, 64, 100, 5000, 300000} {
+		ticks := ticks
+		tw.AfterFunc(time.Duration(ticks)*time.Hour, func() {
+			fired[ticks] = now
+		})
+	}
+	stopped := tw.AfterFunc(200*time.Hour, func() {
+		fired[200] = now
+	})
+	assert.True(t, stopped.Stop())
+	assert.False(t, stopped.Stop())
+
+	// 逐个tick推进(AfterFunc向上取整, 因此Timer在ticks+1时触发)
+	for now = 0; now <= 300001; now++ {
+		tw.Advance(now)
+	}
+
+	assert.Equal(t, 6, len(fired))
+	for ticks, firedAt := range fired {
+		assert.Equal(t, int64(ticks+1), firedAt)
+	}
+}
+
+//
+// go test proxy -v -run "TestExpiringRequestMap"
+//
+func TestExpiringRequestMap(t *testing.T) {
+	requestMap, _ := NewExpiringRequestMap(20, getRequestTimingWheel())
+
+	// 1. 超时之后自动返回Timeout Exception
+	r1 := NewPingRequest()
+	r1.SetTimeout(20 * time.Millisecond)
+	r1.Wait.Add(1)
+	requestMap.Add(1, r1)
+
+	// 2. 请求返回之后, Timer被取消
+	r2 := NewPingRequest()
+	r2.SetTimeout(10 * time.Millisecond)
+	r2.Wait.Add(1)
+	requestMap.Add(2, r2)
+	assert.Equal(t, r2, requestMap.Pop(2))
+
+	r1.Wait.Wait()
+	elapsed := microseconds() - r1.Start
+	assert.True(t, elapsed >= 20*1000)
+	assert.True(t, elapsed < 200*1000)
+	assert.True(t, IsTimeoutError(r1.Response.Err))
+	assert.Equal(t, 0, requestMap.Len())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, r2.Response.Err)
+}
+
+//
+// go test proxy -v -run "TestExpiringRequestMapReAdd"
+//
+func TestExpiringRequestMapReAdd(t *testing.T) {
+	requestMap, _ := NewExpiringRequestMap(20, NewTimingWheel(time.Hour))
+
+	r1 := NewPingRequest()
+	r1.Wait.Add(1)
+	requestMap.Add(1, r1)
+	stale := requestMap.items[1].Value.(*Entry).timer.f
+
+	// 同一个SeqId被新的请求使用: 旧的Timer已经被时间轮取出(Stop失败)时, 也不能让新的请求超时
+	r2 := NewPingRequest()
+	r2.Wait.Add(1)
+	requestMap.Add(1, r2)
+	stale()
+
+	assert.Equal(t, 1, requestMap.Len())
+	assert.Nil(t, r2.Response.Err)
+	assert.Equal(t, r2, requestMap.Pop(1))
+}
@@ -15,6 +15,8 @@ import (
 
 var green = color.New(color.FgGreen).SprintFunc()
 
+//
+// Registry的zk实现
 //
 // 设计方案:
 // 1. zk中保存如下的数据
@@ -36,21 +38,17 @@ type Topology struct {
 	basePath    string
 }
 
-// 春雨产品服务列表对应的Path
-func (top *Topology) productBasePath(productName string) string {
-	return fmt.Sprintf("/zk/product/%s", productName)
-}
 func (top *Topology) ProductServicesPath() string {
-	return fmt.Sprintf("%s/services", top.basePath)
+	return productServicesPath(top.ProductName)
 }
 
 func (top *Topology) ProductServicePath(service string) string {
-	return fmt.Sprintf("%s/services/%s", top.basePath, service)
+	return productServicePath(top.ProductName, service)
 }
 
 // 获取具体的某个EndPoint的Path
 func (top *Topology) ProductServiceEndPointPath(service string, endpoint string) string {
-	return fmt.Sprintf("%s/services/%s/%s", top.basePath, service, endpoint)
+	return productServiceEndPointPath(top.ProductName, service, endpoint)
 }
 
 func (top *Topology) FullPath(path string) string {
@@ -69,7 +67,7 @@ func (top *Topology) Exist(path string) (bool, error) {
 func NewTopology(ProductName string, zkAddr string) *Topology {
 	// 创建Topology对象，并且初始化ZkConn
 	t := &Topology{zkAddr: zkAddr, ProductName: ProductName}
-	t.basePath = t.productBasePath(ProductName)
+	t.basePath = productBasePath(ProductName)
 	t.InitZkConn()
 	return t
 }
@@ -85,7 +83,8 @@ func (top *Topology) InitZkConn() {
 }
 
 func (top *Topology) IsChildrenChangedEvent(e interface{}) bool {
-	return e.(topo.Event).Type == topo.EventNodeChildrenChanged
+	event, ok := e.(*RegistryEvent)
+	return ok && event.Type == REGISTRY_EVENT_CHANGED
 }
 
 func (top *Topology) DeleteDir(path string) {
@@ -161,7 +160,7 @@ func (top *Topology) doWatch(evtch <-chan topo.Event, evtbus chan interface{}) {
 	// 如何处理? 照理说不会发生的
 	if e.State == topo.StateExpired || e.Type == topo.EventNotWatching {
 		log.Warnf("session expired: %+v", e)
-		evtbus <- e
+		evtbus <- newRegistryEvent(REGISTRY_EVENT_SESSION_EXPIRED, e.Path)
 		return
 	}
 
@@ -177,7 +176,7 @@ func (top *Topology) doWatch(evtch <-chan topo.Event, evtbus chan interface{}) {
 		// log.Warnf("%+v", e)
 	}
 
-	evtbus <- e
+	evtbus <- newRegistryEvent(REGISTRY_EVENT_CHANGED, e.Path)
 }
 
 func (top *Topology) WatchChildren(path string, evtbus chan interface{}) ([]string, error) {
@@ -206,6 +205,137 @@ func (top *Topology) WatchNode(path string, evtbus chan interface{}) ([]byte, er
 	return content, nil
 }
 
+//
+// 读取当前path对应的数据，监听之后的事件(包括创建, 修改和删除)
+// path不存在时返回的数据为nil, 不报错
+//
+func (top *Topology) WatchNodeIfExists(path string, evtbus chan interface{}) ([]byte, error) {
+	exist, _, evtch, err := top.ZkConn.ExistsW(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	go top.doWatch(evtch, evtbus)
+
+	if !exist {
+		return nil, nil
+	}
+	content, _, err := top.ZkConn.Get(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return content, nil
+}
+
+func (top *Topology) GetProductName() string {
+	return top.ProductName
+}
+
+//
+// 注册一个服务的Endpoints
+//
+func (top *Topology) AddServiceEndpoint(endpoint *ServiceEndpoint) error {
+	path := top.ProductServiceEndPointPath(endpoint.Service, endpoint.ServiceId)
+	data, err := json.Marshal(endpoint)
+	if err != nil {
+		return err
+	}
+
+	// 创建Service(XXX: Service本身不包含数据)
+	CreateRecursive(top.ZkConn, os_path.Dir(path), "", 0, zkhelper.DefaultDirACLs())
+
+	// 当前的Session挂了，服务就下线
+	// topo.FlagEphemeral
+
+	// 参考： https://www.box.com/blog/a-gotcha-when-using-zookeeper-ephemeral-nodes/
+	// 如果之前的Session信息还存在，则先删除；然后再添加
+	top.ZkConn.Delete(path, -1)
+	var pathCreated string
+	pathCreated, err = top.ZkConn.Create(path, []byte(data), int32(topo.FlagEphemeral), zkhelper.DefaultFileACLs())
+
+	log.Println(Green("AddServiceEndpoint"), "Path: ", pathCreated, ", Error: ", err)
+	return err
+}
+
+//
+// 删除Service Endpoint
+//
+func (top *Topology) DeleteServiceEndpoint(service string, serviceId string) error {
+	path := top.ProductServiceEndPointPath(service, serviceId)
+	if ok, _ := top.Exist(path); ok {
+		log.Println(Red("DeleteServiceEndpoint"), "Path: ", path)
+		return zkhelper.DeleteRecursive(top.ZkConn, path, -1)
+	}
+	return nil
+}
+
+func (top *Topology) ListServices() ([]string, error) {
+	services, _, err := top.ZkConn.Children(top.ProductServicesPath())
+	return services, err
+}
+
+func (top *Topology) ListServiceEndpoints(service string) ([]string, error) {
+	serviceIds, _, err := top.ZkConn.Children(top.ProductServicePath(service))
+	return serviceIds, err
+}
+
+func (top *Topology) GetServiceEndpoint(service string, serviceId string) (*ServiceEndpoint, error) {
+	path := top.ProductServiceEndPointPath(service, serviceId)
+	data, _, err := top.ZkConn.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &ServiceEndpoint{}
+	err = json.Unmarshal(data, endpoint)
+	if err != nil {
+		return nil, err
+	} else {
+		return endpoint, nil
+	}
+}
+
+func (top *Topology) WatchServices(evtbus chan interface{}) ([]string, error) {
+	// 保证Service目录存在，否则会报错
+	servicesPath := top.ProductServicesPath()
+	if _, err := top.CreateDir(servicesPath); err != nil {
+		return nil, err
+	}
+	return top.WatchChildren(servicesPath, evtbus)
+}
+
+func (top *Topology) WatchServiceEndpoints(service string, evtbus chan interface{}) ([]string, error) {
+	return top.WatchChildren(top.ProductServicePath(service), evtbus)
+}
+
+func (top *Topology) WatchServiceEndpoint(service string, serviceId string, evtbus chan interface{}) (*ServiceEndpoint, error) {
+	data, err := top.WatchNode(top.ProductServiceEndPointPath(service, serviceId), evtbus)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := &ServiceEndpoint{}
+	if err = json.Unmarshal(data, endpoint); err != nil {
+		return nil, err
+	}
+	return endpoint, nil
+}
+
+//
+// 监控: 当前的zk session的状态, 如果session出现异常，则evtbus会收到: REGISTRY_EVENT_SESSION_EXPIRED
+//
+func (top *Topology) WatchRegistration(service string, evtbus chan interface{}) error {
+	servicePath := top.ProductServicePath(service)
+
+	// 确保东西存在
+	if ok, _ := top.Exist(servicePath); !ok {
+		top.CreateDir(servicePath)
+	}
+	_, err := top.WatchNode(servicePath, evtbus)
+	return err
+}
+
+func (top *Topology) Close() {
+	top.ZkConn.Close()
+}
+
 // Create a path and any pieces required, think mkdir -p.
 // Intermediate znodes are always created empty.
 func CreateRecursive(zconn zkhelper.Conn, zkPath, value string, flags int, aclv []topo.ACL) (pathCreated string, err error) {
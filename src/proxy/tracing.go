@@ -0,0 +1,664 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wfxiang08/cyutils/utils/atomic2"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+//
+// 分布式追踪: Client --> rpc_proxy --> rpc_lb --> worker
+//
+// trace context通过参数struct中保留的第一个field(id: 32767, string)传递, 格式和W3C traceparent一致:
+//     00-<trace id, 32位hex>-<parent span id, 16位hex>-<flags, 01表示采样>
+// 不认识这个field的thrift代码会直接跳过它; 每一层转发之前将parent span id改写成为自己的span id(长度不变, 原地修改)
+//
+// 每一层记录的span:
+//     server: 请求从读取到返回的整个过程(service.method)
+//     queue: 在BackendConn(BackendConnLB).input中等待的时间
+//     wire/worker: 从写出请求到得到结果, rpc_proxy中为wire, rpc_lb中为worker
+//
+const (
+	TRACE_FIELD_ID   int16 = 32767
+	TRACE_PARENT_LEN       = 55
+	TRACE_FIELD_LEN        = 1 + 2 + 4 + TRACE_PARENT_LEN // type + id + len + value
+
+	TRACE_EXPORTER_ZIPKIN = "zipkin"
+	TRACE_EXPORTER_OTLP   = "otlp"
+
+	TRACE_QUEUE_SIZE        = 4096 // 等待导出的span, 超过时直接丢弃
+	TRACE_BATCH_SIZE        = 100
+	TRACE_FLUSH_INTERVAL    = time.Second
+	TRACE_COLLECTOR_TIMEOUT = 5 * time.Second
+
+	TRACE_SPAN_WIRE   = "wire"
+	TRACE_SPAN_WORKER = "worker"
+)
+
+type TraceConfig struct {
+	Collector  string  // http(s)://...: POST到collector; 否则为本地文件, 每行一个batch
+	Exporter   string  // zipkin, otlp
+	SampleRate float64 // 没有带trace context的请求按照这个比例开始新的trace
+}
+
+type TraceContext struct {
+	TraceIdHigh uint64
+	TraceIdLow  uint64
+	SpanId      uint64
+	Sampled     bool
+}
+
+func (c *TraceContext) TraceId() string {
+	return fmt.Sprintf("%016x%016x", c.TraceIdHigh, c.TraceIdLow)
+}
+
+//
+// 解析traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//
+func parseTraceParent(s []byte) (TraceContext, bool) {
+	var c TraceContext
+	if len(s) != TRACE_PARENT_LEN || s[0] != '0' || s[1] != '0' || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return c, false
+	}
+	var err1, err2, err3, err4 error
+	c.TraceIdHigh, err1 = strconv.ParseUint(string(s[3:19]), 16, 64)
+	c.TraceIdLow, err2 = strconv.ParseUint(string(s[19:35]), 16, 64)
+	c.SpanId, err3 = strconv.ParseUint(string(s[36:52]), 16, 64)
+	flags, err4 := strconv.ParseUint(string(s[53:55]), 16, 8)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return c, false
+	}
+	if (c.TraceIdHigh == 0 && c.TraceIdLow == 0) || c.SpanId == 0 {
+		return c, false
+	}
+	c.Sampled = flags&0x01 != 0
+	return c, true
+}
+
+// 写入到buf[0:TRACE_PARENT_LEN]中
+func formatTraceParent(buf []byte, c *TraceContext) {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	copy(buf, fmt.Sprintf("00-%016x%016x-%016x-%s", c.TraceIdHigh, c.TraceIdLow, c.SpanId, flags))
+}
+
+//
+// thrift message(TBinaryProtocol, strict)中参数struct的起始位置
+//
+func traceArgsOffset(data []byte) int {
+	if len(data) < 8 || data[0]&0x80 == 0 {
+		return -1
+	}
+	offset := 12 + int(binary.BigEndian.Uint32(data[4:8]))
+	if offset > len(data) {
+		return -1
+	}
+	return offset
+}
+
+//
+// trace field的value在data中的位置, -1表示没有
+//
+func traceFieldValueOffset(data []byte) int {
+	offset := traceArgsOffset(data)
+	if offset < 0 || offset+TRACE_FIELD_LEN > len(data) {
+		return -1
+	}
+	if thrift.TType(data[offset]) != thrift.STRING ||
+		int16(binary.BigEndian.Uint16(data[offset+1:offset+3])) != TRACE_FIELD_ID ||
+		binary.BigEndian.Uint32(data[offset+3:offset+7]) != TRACE_PARENT_LEN {
+		return -1
+	}
+	return offset + 7
+}
+
+func newTraceId() uint64 {
+	for {
+		if id := uint64(rand.Int63())<<1 ^ uint64(rand.Int63()); id != 0 {
+			return id
+		}
+	}
+}
+
+//
+// 一个请求在当前这一层的trace
+//
+type RequestTrace struct {
+	TraceContext        // SpanId为当前这一层的server span
+	ParentId     uint64 // 上一层(Client或者rpc_proxy)的span, 0表示trace从这里开始
+
+	// 每次分配给BackendConn(包括重试)
+	// attempts在PushBack, loopWriter和Session(finishRequestTrace)中访问, 由lock保护
+	lock     sync.Mutex
+	attempts []traceAttempt
+	finished bool // finishRequestTrace之后不再记录
+}
+
+type traceAttempt struct {
+	spanId uint64 // wire/worker span, 也是转发给下一层的parent span id
+	addr   string
+	queued int64
+	sent   int64 // 0表示没有写出
+}
+
+//
+// 在PushBack中调用: 请求进入BackendConn.input
+// 必须在请求交给loopWriter之前记录; 队列满了没有进入input时, 通过dequeue删除
+//
+func (t *RequestTrace) enqueue(addr string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.finished {
+		t.attempts = append(t.attempts, traceAttempt{spanId: newTraceId(), addr: addr, queued: microseconds()})
+	}
+}
+
+//
+// 请求没有进入BackendConn.input: 删除enqueue记录的attempt
+//
+func (t *RequestTrace) dequeue() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if n := len(t.attempts); n > 0 && !t.finished && t.attempts[n-1].sent == 0 {
+		t.attempts = t.attempts[:n-1]
+	}
+}
+
+//
+// 在loopWriter中, ReplaceSeqId之后, 写出之前调用: 将trace field中的parent span id改写成为当前的attempt
+// 请求已经结束(例如: 超时之后已经返回给Client)时不做任何处理, 此时data可能已经被回收
+//
+func (t *RequestTrace) sent(data []byte) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finished || len(t.attempts) == 0 {
+		return
+	}
+	attempt := &t.attempts[len(t.attempts)-1]
+	if attempt.sent != 0 {
+		return
+	}
+	attempt.sent = microseconds()
+
+	if offset := traceFieldValueOffset(data); offset >= 0 {
+		c := t.TraceContext
+		c.SpanId = attempt.spanId
+		formatTraceParent(data[offset:offset+TRACE_PARENT_LEN], &c)
+	}
+}
+
+//
+// Session读取请求之后调用(心跳除外):
+//     带有trace context: 如果采样, 则继续这个trace
+//     没有trace context: 按照比例开始新的trace, 并且在参数的最前面插入trace field
+//
+func startRequestTrace(r *Request) {
+	tracer := getTracer()
+	if tracer == nil {
+		return
+	}
+
+	data := r.Request.Data
+	if offset := traceFieldValueOffset(data); offset >= 0 {
+		c, ok := parseTraceParent(data[offset : offset+TRACE_PARENT_LEN])
+		if !ok || !c.Sampled {
+			return
+		}
+		r.Trace = &RequestTrace{TraceContext: c, ParentId: c.SpanId}
+		r.Trace.SpanId = newTraceId()
+		return
+	}
+
+	if tracer.sampleRate <= 0 || rand.Float64() >= tracer.sampleRate {
+		return
+	}
+	offset := traceArgsOffset(data)
+	if offset < 0 {
+		return
+	}
+
+	trace := &RequestTrace{TraceContext: TraceContext{
+		TraceIdHigh: newTraceId(),
+		TraceIdLow:  newTraceId(),
+		SpanId:      newTraceId(),
+		Sampled:     true,
+	}}
+
+	size := len(data) + TRACE_FIELD_LEN
+	newData := getSlice(size, size)
+	copy(newData, data[:offset])
+	newData[offset] = byte(thrift.STRING)
+	binary.BigEndian.PutUint16(newData[offset+1:], uint16(TRACE_FIELD_ID))
+	binary.BigEndian.PutUint32(newData[offset+3:], TRACE_PARENT_LEN)
+	formatTraceParent(newData[offset+7:offset+7+TRACE_PARENT_LEN], &trace.TraceContext)
+	copy(newData[offset+TRACE_FIELD_LEN:], data[offset:])
+
+	returnSlice(data)
+	r.Request.Data = newData
+	r.Trace = trace
+}
+
+//
+// Session返回结果之前调用: 生成当前这一层的span, 交给tracer导出
+// clientSpan: rpc_proxy中为wire, rpc_lb中为worker
+//
+func finishRequestTrace(r *Request, clientSpan string) {
+	t := r.Trace
+	if t == nil {
+		return
+	}
+	tracer := getTracer()
+	if tracer == nil {
+		return
+	}
+
+	t.lock.Lock()
+	t.finished = true
+	attempts := t.attempts
+	t.lock.Unlock()
+
+	now := microseconds()
+	outcome := r.Outcome()
+	name := r.Request.Name
+	if len(r.Service) > 0 {
+		name = r.Service + "." + r.Request.Name
+	}
+
+	server := &Span{
+		TraceContext: t.TraceContext,
+		ParentId:     t.ParentId,
+		Name:         name,
+		Kind:         SPAN_KIND_SERVER,
+		Start:        r.Start,
+		End:          now,
+		Error:        outcome != OUTCOME_SUCCESS,
+		Tags: map[string]string{
+			"rpc.service": r.Service,
+			"rpc.method":  r.Request.Name,
+			"rpc.outcome": outcome.String(),
+		},
+	}
+	tracer.export(server)
+
+	for i, attempt := range attempts {
+		// 重试之前的attempt结束于下一次进入队列
+		end := now
+		if i+1 < len(attempts) {
+			end = attempts[i+1].queued
+		}
+		queueEnd := attempt.sent
+		if queueEnd == 0 {
+			queueEnd = end
+		}
+		tags := map[string]string{
+			"peer.address": attempt.addr,
+			"attempt":      strconv.Itoa(i + 1),
+		}
+
+		queue := &Span{
+			TraceContext: t.TraceContext,
+			ParentId:     t.SpanId,
+			Name:         "queue",
+			Kind:         SPAN_KIND_INTERNAL,
+			Start:        attempt.queued,
+			End:          queueEnd,
+			Tags:         tags,
+		}
+		queue.SpanId = newTraceId()
+		tracer.export(queue)
+
+		if attempt.sent == 0 {
+			continue
+		}
+		wire := &Span{
+			TraceContext: t.TraceContext,
+			ParentId:     t.SpanId,
+			Name:         clientSpan,
+			Kind:         SPAN_KIND_CLIENT,
+			Start:        attempt.sent,
+			End:          end,
+			Error:        i+1 < len(attempts) || outcome != OUTCOME_SUCCESS,
+			Tags:         tags,
+		}
+		wire.SpanId = attempt.spanId
+		tracer.export(wire)
+	}
+}
+
+const (
+	SPAN_KIND_INTERNAL = "INTERNAL"
+	SPAN_KIND_SERVER   = "SERVER"
+	SPAN_KIND_CLIENT   = "CLIENT"
+)
+
+type Span struct {
+	TraceContext
+	ParentId uint64
+	Name     string
+	Kind     string
+	Start    int64 // 单位: microseconds
+	End      int64
+	Error    bool
+	Tags     map[string]string
+}
+
+//
+// 将span按批导出到collector(http或者本地文件)
+// export不阻塞: 队列满了, 或者collector出错时直接丢弃(计入dropped)
+//
+type tracer struct {
+	service    string // localEndpoint/service.name: rpc_proxy, 或者rpc_lb对应的服务
+	sampleRate float64
+	encode     func(spans []*Span, service string) ([]byte, error)
+	collector  traceCollector
+
+	spans    chan *Span
+	exported atomic2.Int64
+	dropped  atomic2.Int64
+}
+
+type traceCollector interface {
+	Write(payload []byte) error
+}
+
+var traceState struct {
+	lock   sync.RWMutex
+	tracer *tracer
+}
+
+func getTracer() *tracer {
+	traceState.lock.RLock()
+	defer traceState.lock.RUnlock()
+	return traceState.tracer
+}
+
+func setTracer(t *tracer) {
+	traceState.lock.Lock()
+	traceState.tracer = t
+	traceState.lock.Unlock()
+}
+
+func newTracer(config *TraceConfig, service string) (*tracer, error) {
+	t := &tracer{
+		service:    service,
+		sampleRate: config.SampleRate,
+		spans:      make(chan *Span, TRACE_QUEUE_SIZE),
+	}
+
+	switch config.Exporter {
+	case TRACE_EXPORTER_ZIPKIN, "":
+		t.encode = encodeZipkinSpans
+	case TRACE_EXPORTER_OTLP:
+		t.encode = encodeOTLPSpans
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", config.Exporter)
+	}
+
+	if strings.HasPrefix(config.Collector, "http://") || strings.HasPrefix(config.Collector, "https://") {
+		t.collector = &httpTraceCollector{
+			url:    config.Collector,
+			client: &http.Client{Timeout: TRACE_COLLECTOR_TIMEOUT},
+		}
+	} else {
+		collector, err := newFileTraceCollector(config.Collector)
+		if err != nil {
+			return nil, err
+		}
+		t.collector = collector
+	}
+	return t, nil
+}
+
+//
+// 配置了trace_collector时才打开追踪; 一个进程只启动一次
+//
+func StartTracer(config *TraceConfig, service string) {
+	if len(config.Collector) == 0 {
+		return
+	}
+	if getTracer() != nil {
+		log.Warnf("Tracer already started")
+		return
+	}
+
+	t, err := newTracer(config, service)
+	if err != nil {
+		log.ErrorErrorf(err, "Create tracer failed: %v", err)
+		return
+	}
+	setTracer(t)
+
+	log.Printf(Green("Export spans to: %s, sample rate: %.4f"), config.Collector, config.SampleRate)
+	go t.run()
+}
+
+func (t *tracer) export(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		t.dropped.Incr()
+	}
+}
+
+func (t *tracer) run() {
+	ticker := time.NewTicker(TRACE_FLUSH_INTERVAL)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, TRACE_BATCH_SIZE)
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < TRACE_BATCH_SIZE {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		t.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *tracer) flush(batch []*Span) {
+	payload, err := t.encode(batch, t.service)
+	if err == nil {
+		err = t.collector.Write(payload)
+	}
+	if err != nil {
+		t.dropped.Add(int64(len(batch)))
+		log.ErrorErrorf(err, "Export %d spans failed: %v", len(batch), err)
+		return
+	}
+	t.exported.Add(int64(len(batch)))
+}
+
+type httpTraceCollector struct {
+	url    string
+	client *http.Client
+}
+
+func (c *httpTraceCollector) Write(payload []byte) error {
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector %s returns %s", c.url, resp.Status)
+	}
+	return nil
+}
+
+// 本地文件: 每行一个batch(和POST到collector的内容一致)
+type fileTraceCollector struct {
+	file *os.File
+}
+
+func newFileTraceCollector(filename string) (*fileTraceCollector, error) {
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileTraceCollector{file: file}, nil
+}
+
+func (c *fileTraceCollector) Write(payload []byte) error {
+	_, err := c.file.Write(append(payload, '\n'))
+	return err
+}
+
+//
+// Zipkin v2 JSON: POST /api/v2/spans
+//
+type zipkinSpan struct {
+	TraceId       string            `json:"traceId"`
+	Id            string            `json:"id"`
+	ParentId      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+func encodeZipkinSpans(spans []*Span, service string) ([]byte, error) {
+	result := make([]*zipkinSpan, 0, len(spans))
+	for _, span := range spans {
+		s := &zipkinSpan{
+			TraceId:       span.TraceId(),
+			Id:            fmt.Sprintf("%016x", span.SpanId),
+			Name:          span.Name,
+			Timestamp:     span.Start,
+			Duration:      span.End - span.Start,
+			LocalEndpoint: zipkinEndpoint{ServiceName: service},
+			Tags:          span.Tags,
+		}
+		if span.ParentId != 0 {
+			s.ParentId = fmt.Sprintf("%016x", span.ParentId)
+		}
+		// zipkin中没有INTERNAL
+		if span.Kind != SPAN_KIND_INTERNAL {
+			s.Kind = span.Kind
+		}
+		if span.Error {
+			tags := make(map[string]string, len(span.Tags)+1)
+			for k, v := range span.Tags {
+				tags[k] = v
+			}
+			tags["error"] = "true"
+			s.Tags = tags
+		}
+		result = append(result, s)
+	}
+	return json.Marshal(result)
+}
+
+//
+// OTLP/HTTP JSON: POST /v1/traces (ExportTraceServiceRequest), id采用hex编码
+//
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+func newOTLPKeyValue(key string, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+var otlpSpanKinds = map[string]int{SPAN_KIND_INTERNAL: 1, SPAN_KIND_SERVER: 2, SPAN_KIND_CLIENT: 3}
+
+func encodeOTLPSpans(spans []*Span, service string) ([]byte, error) {
+	result := make([]*otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := &otlpSpan{
+			TraceId:           span.TraceId(),
+			SpanId:            fmt.Sprintf("%016x", span.SpanId),
+			Name:              span.Name,
+			Kind:              otlpSpanKinds[span.Kind],
+			StartTimeUnixNano: strconv.FormatInt(span.Start*1000, 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End*1000, 10),
+		}
+		if span.ParentId != 0 {
+			s.ParentSpanId = fmt.Sprintf("%016x", span.ParentId)
+		}
+		for k, v := range span.Tags {
+			s.Attributes = append(s.Attributes, newOTLPKeyValue(k, v))
+		}
+		if span.Error {
+			s.Status.Code = 2 // STATUS_CODE_ERROR
+		}
+		result = append(result, s)
+	}
+
+	request := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpKeyValue{newOTLPKeyValue("service.name", service)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "rpc_proxy"},
+						"spans": result,
+					},
+				},
+			},
+		},
+	}
+	return json.Marshal(request)
+}
@@ -0,0 +1,278 @@
+//// Copyright 2015 Spring Rain Software Compnay LTD. All Rights Reserved.
+//// Licensed under the MIT (MIT-LICENSE.txt) license.
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wfxiang08/go_thrift/thrift"
+)
+
+func traceTestArgs(traceParent string) []fakeField {
+	var fields []fakeField
+	if len(traceParent) > 0 {
+		fields = append(fields, fakeField{"trace", thrift.STRING, TRACE_FIELD_ID, traceParent})
+	}
+	return append(fields, fakeField{"user_name", thrift.STRING, 1, "u1"})
+}
+
+// 读取参数: field id --> string
+func readTraceTestArgs(t *testing.T, data []byte) (string, map[int16]string) {
+	transport := NewTMemoryBufferWithBuf(data)
+	protocol := thrift.NewTBinaryProtocolTransport(transport)
+	name, _, _, err := protocol.ReadMessageBegin()
+	assert.NoError(t, err)
+	protocol.ReadStructBegin()
+
+	args := make(map[int16]string)
+	for {
+		_, fieldType, fieldId, err := protocol.ReadFieldBegin()
+		assert.NoError(t, err)
+		if err != nil || fieldType == thrift.STOP {
+			break
+		}
+		args[fieldId], _ = protocol.ReadString()
+		protocol.ReadFieldEnd()
+	}
+	return name, args
+}
+
+func newTestTracer(t *testing.T, exporter string, sampleRate float64) (*tracer, string) {
+	dir, _ := ioutil.TempDir("", "tracing")
+	filename := path.Join(dir, "spans.log")
+	tr, err := newTracer(&TraceConfig{Collector: filename, Exporter: exporter, SampleRate: sampleRate}, "rpc_proxy")
+	assert.NoError(t, err)
+	setTracer(tr)
+	return tr, filename
+}
+
+func drainSpans(tr *tracer) []*Span {
+	var spans []*Span
+	for len(tr.spans) > 0 {
+		spans = append(spans, <-tr.spans)
+	}
+	return spans
+}
+
+//
+// go test proxy -v -run "TestTraceParent"
+//
+func TestTraceParent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c, ok := parseTraceParent([]byte(s))
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", c.TraceId())
+	assert.Equal(t, uint64(0x00f067aa0ba902b7), c.SpanId)
+	assert.True(t, c.Sampled)
+
+	buf := make([]byte, TRACE_PARENT_LEN)
+	formatTraceParent(buf, &c)
+	assert.Equal(t, s, string(buf))
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, ok := parseTraceParent([]byte(invalid))
+		assert.False(t, ok)
+	}
+}
+
+//
+// go test proxy -v -run "TestRequestTracePropagation"
+//
+func TestRequestTracePropagation(t *testing.T) {
+	tr, filename := newTestTracer(t, TRACE_EXPORTER_ZIPKIN, 1)
+	defer os.RemoveAll(path.Dir(filename))
+	defer setTracer(nil)
+
+	// 1. rpc_proxy: Client没有trace context, 开始新的trace, 在参数的最前面插入trace field
+	r, _ := NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, traceTestArgs("")...), true)
+	startRequestTrace(r)
+	assert.NotNil(t, r.Trace)
+	assert.Equal(t, uint64(0), r.Trace.ParentId)
+
+	name, args := readTraceTestArgs(t, r.Request.Data)
+	assert.Equal(t, "typo:get_user", name)
+	assert.Equal(t, "u1", args[1])
+	c, ok := parseTraceParent([]byte(args[TRACE_FIELD_ID]))
+	assert.True(t, ok)
+	assert.Equal(t, r.Trace.TraceId(), c.TraceId())
+
+	// trace field不作为Hash Key
+	key, _ := (&HashKeySource{}).Extract(r.Request.Data)
+	assert.Equal(t, "u1", string(key))
+
+	// 2. 第一次分配失败(没有写出), 重试之后写出: parent span id为最后一次attempt
+	r.Trace.enqueue("10.0.0.1:5555")
+	r.Trace.enqueue("10.0.0.2:5555")
+	r.ReplaceSeqId(1000)
+	r.Trace.sent(r.Request.Data)
+
+	name, args = readTraceTestArgs(t, r.Request.Data)
+	assert.Equal(t, "get_user", name)
+	forwarded, _ := parseTraceParent([]byte(args[TRACE_FIELD_ID]))
+	assert.Equal(t, r.Trace.TraceId(), forwarded.TraceId())
+	assert.Equal(t, r.Trace.attempts[1].spanId, forwarded.SpanId)
+	assert.True(t, forwarded.Sampled)
+
+	r.Response.TypeId = thrift.REPLY
+	finishRequestTrace(r, TRACE_SPAN_WIRE)
+	spans := drainSpans(tr)
+	assert.Equal(t, 4, len(spans)) // server, queue, queue, wire
+
+	server := spans[0]
+	assert.Equal(t, "typo.get_user", server.Name)
+	assert.Equal(t, SPAN_KIND_SERVER, server.Kind)
+	for _, span := range spans[1:] {
+		assert.Equal(t, server.SpanId, span.ParentId)
+		assert.Equal(t, server.TraceId(), span.TraceId())
+	}
+	assert.Equal(t, "queue", spans[1].Name)
+	assert.Equal(t, "10.0.0.1:5555", spans[1].Tags["peer.address"])
+	assert.Equal(t, TRACE_SPAN_WIRE, spans[3].Name)
+	assert.Equal(t, forwarded.SpanId, spans[3].SpanId)
+	assert.Equal(t, "10.0.0.2:5555", spans[3].Tags["peer.address"])
+
+	// 3. rpc_lb: 继续proxy转发过来的trace, server span的parent为proxy的wire span
+	lbRequest, _ := NewRequest(append([]byte(nil), r.Request.Data...), false)
+	startRequestTrace(lbRequest)
+	assert.Equal(t, r.Trace.TraceId(), lbRequest.Trace.TraceId())
+	assert.Equal(t, forwarded.SpanId, lbRequest.Trace.ParentId)
+	assert.NotEqual(t, forwarded.SpanId, lbRequest.Trace.SpanId)
+
+	// 4. 导出成为zipkin json
+	tr.flush(spans)
+	f, _ := os.Open(filename)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	assert.True(t, scanner.Scan())
+	var zipkin []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(scanner.Bytes(), &zipkin))
+	assert.Equal(t, 4, len(zipkin))
+	assert.Equal(t, r.Trace.TraceId(), zipkin[0]["traceId"])
+	assert.Equal(t, "SERVER", zipkin[0]["kind"])
+	assert.Nil(t, zipkin[0]["parentId"])
+	assert.Nil(t, zipkin[1]["kind"])
+	assert.Equal(t, zipkin[0]["id"], zipkin[3]["parentId"])
+	assert.Equal(t, "rpc_proxy", zipkin[0]["localEndpoint"].(map[string]interface{})["serviceName"])
+	assert.Equal(t, int64(4), tr.exported.Get())
+}
+
+//
+// go test proxy -v -run "TestRequestTraceAttempts"
+//
+func TestRequestTraceAttempts(t *testing.T) {
+	tr, filename := newTestTracer(t, TRACE_EXPORTER_ZIPKIN, 1)
+	defer os.RemoveAll(path.Dir(filename))
+	defer setTracer(nil)
+
+	r, _ := NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, traceTestArgs("")...), true)
+	startRequestTrace(r)
+
+	// 1. 队列满了, 请求没有进入input: 不记录attempt
+	r.Trace.enqueue("10.0.0.1:5555")
+	r.Trace.dequeue()
+	r.Trace.enqueue("10.0.0.2:5555")
+	r.ReplaceSeqId(1000)
+	r.Trace.sent(r.Request.Data)
+	assert.Equal(t, 1, len(r.Trace.attempts))
+	assert.Equal(t, "10.0.0.2:5555", r.Trace.attempts[0].addr)
+
+	// 已经写出的attempt不能删除
+	r.Trace.dequeue()
+	assert.Equal(t, 1, len(r.Trace.attempts))
+
+	r.Response.TypeId = thrift.REPLY
+	finishRequestTrace(r, TRACE_SPAN_WIRE)
+	assert.Equal(t, 3, len(drainSpans(tr))) // server, queue, wire
+
+	// 2. 请求结束之后, loopWriter中的记录被忽略, 也不再修改data
+	data := append([]byte(nil), r.Request.Data...)
+	r.Trace.enqueue("10.0.0.3:5555")
+	r.Trace.sent(r.Request.Data)
+	assert.Equal(t, 1, len(r.Trace.attempts))
+	assert.Equal(t, data, r.Request.Data)
+}
+
+//
+// go test proxy -v -run "TestRequestTraceSampling"
+//
+func TestRequestTraceSampling(t *testing.T) {
+	tr, filename := newTestTracer(t, TRACE_EXPORTER_ZIPKIN, 0)
+	defer os.RemoveAll(path.Dir(filename))
+	defer setTracer(nil)
+
+	sampled := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	notSampled := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+
+	// 1. 没有trace context, 并且不采样: 不修改数据
+	data := fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, traceTestArgs("")...)
+	r, _ := NewRequest(append([]byte(nil), data...), true)
+	startRequestTrace(r)
+	assert.Nil(t, r.Trace)
+	assert.Equal(t, data, r.Request.Data)
+
+	// 2. Client带有采样的trace context: 继续这个trace
+	r, _ = NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, traceTestArgs(sampled)...), true)
+	startRequestTrace(r)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", r.Trace.TraceId())
+	assert.Equal(t, uint64(0x00f067aa0ba902b7), r.Trace.ParentId)
+
+	// 3. Client没有采样: 不追踪
+	r, _ = NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, traceTestArgs(notSampled)...), true)
+	startRequestTrace(r)
+	assert.Nil(t, r.Trace)
+
+	// 4. 没有打开tracing时不处理
+	setTracer(nil)
+	r, _ = NewRequest(fakeArgsData(PROTOCOL_BINARY, "typo:get_user", thrift.CALL, 7, traceTestArgs(sampled)...), true)
+	startRequestTrace(r)
+	assert.Nil(t, r.Trace)
+	assert.Equal(t, 0, len(drainSpans(tr)))
+}
+
+//
+// go test proxy -v -run "TestOTLPSpans"
+//
+func TestOTLPSpans(t *testing.T) {
+	c := TraceContext{TraceIdHigh: 1, TraceIdLow: 2, SpanId: 3, Sampled: true}
+	spans := []*Span{
+		{TraceContext: c, Name: "typo.get_user", Kind: SPAN_KIND_SERVER, Start: 1000, End: 3000, Error: true,
+			Tags: map[string]string{"rpc.outcome": "timeout"}},
+	}
+	data, err := encodeOTLPSpans(spans, "rpc_proxy")
+	assert.NoError(t, err)
+
+	var request struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &request))
+	assert.Equal(t, "rpc_proxy", request.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "00000000000000010000000000000002", span.TraceId)
+	assert.Equal(t, "0000000000000003", span.SpanId)
+	assert.Equal(t, "", span.ParentSpanId)
+	assert.Equal(t, 2, span.Kind)
+	assert.Equal(t, "1000000", span.StartTimeUnixNano)
+	assert.Equal(t, "3000000", span.EndTimeUnixNano)
+	assert.Equal(t, 2, span.Status.Code)
+	assert.Equal(t, "rpc.outcome", span.Attributes[0].Key)
+}
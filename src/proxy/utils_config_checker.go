@@ -23,10 +23,11 @@ func ConfigCheckThriftService(conf *ServiceConfig) {
 	if conf.Service == "" {
 		log.Panic("Invalid ServiceName")
 	}
-
-	if conf.ZkAddr == "" {
-		log.Panic("Invalid zookeeper address")
+	if conf.Weight <= 0 {
+		log.Panic("Invalid weight")
 	}
+
+	checkRegistryConfig(&conf.ProductConfig)
 }
 
 //
@@ -36,9 +37,7 @@ func ConfigCheckRpcProxy(conf *ProxyConfig) {
 	if conf.ProductName == "" {
 		log.Panic("Invalid ProductName")
 	}
-	if conf.ZkAddr == "" {
-		log.Panic("Invalid zookeeper address")
-	}
+	checkRegistryConfig(&conf.ProductConfig)
 	if conf.ProxyAddr == "" {
 		log.Panic("Invalid Proxy address")
 	}
@@ -52,11 +51,9 @@ func ConfigCheckRpcLB(conf *ServiceConfig) {
 		log.Panic("Invalid ProductName")
 	}
 
-	if conf.ZkAddr == "" {
-		log.Panic("Invalid zookeeper address")
-	}
+	checkRegistryConfig(&conf.ProductConfig)
 
-	if conf.Service == "" {
+	if conf.Service == "" && len(conf.Services) == 0 {
 		log.Panic("Invalid ServiceName")
 	}
 
@@ -66,4 +63,24 @@ func ConfigCheckRpcLB(conf *ServiceConfig) {
 	if conf.FrontendAddr == "" {
 		log.Panic("Invalid frontend address")
 	}
+	if conf.Weight <= 0 {
+		log.Panic("Invalid weight")
+	}
+}
+
+func checkRegistryConfig(conf *ProductConfig) {
+	switch conf.Registry {
+	case "", REGISTRY_ZK:
+		if conf.ZkAddr == "" {
+			log.Panic("Invalid zookeeper address")
+		}
+	case REGISTRY_ETCD:
+		if conf.EtcdAddr == "" {
+			log.Panic("Invalid etcd address")
+		}
+	case REGISTRY_FILE:
+		if conf.ServicesFile == "" {
+			log.Panic("Invalid services file")
+		}
+	}
 }
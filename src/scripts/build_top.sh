@@ -0,0 +1,2 @@
+#!/usr/bin/env bash
+go build -ldflags "-X main.buildDate=`date +%Y%m%d%H%M%S` -X main.gitVersion=`git rev-parse HEAD`" cmds/rpc_top.go